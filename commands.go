@@ -1,18 +1,34 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
+	"os"
 	"runtime"
 	"strconv"
+	"text/tabwriter"
+	"time"
 
+	"github.com/rafaelespinoza/standardnotes/internal/check"
 	"github.com/rafaelespinoza/standardnotes/internal/config"
+	"github.com/rafaelespinoza/standardnotes/internal/db"
+	"github.com/rafaelespinoza/standardnotes/internal/errs"
+	userInteractors "github.com/rafaelespinoza/standardnotes/internal/interactors/user"
+	"github.com/rafaelespinoza/standardnotes/internal/keys"
+	"github.com/rafaelespinoza/standardnotes/internal/webhooks"
 )
 
 // Commands associates a CLI input argument to a Command.
 var Commands = map[string]*Command{
-	"api":     &_APICommand,
-	"version": &_VersionCommand,
+	"api":      &_APICommand,
+	"backup":   &_BackupCommand,
+	"check":    &_CheckCommand,
+	"keys":     &_KeysCommand,
+	"migrate":  &_MigrateCommand,
+	"users":    &_UsersCommand,
+	"version":  &_VersionCommand,
+	"webhooks": &_WebhooksCommand,
 }
 
 // A Command is the behavior to specify from this CLI.
@@ -43,11 +59,294 @@ var (
 			flags := flag.NewFlagSet(name, flag.ExitOnError)
 			flags.BoolVar(&a.daemon, "d", false, "run server in background")
 			flags.BoolVar(&a.stop, "stop", false, "shutdown server")
+			flags.BoolVar(&a.ephemeral, "ephemeral", false, "use an in-memory database, discarded on exit")
+			flags.StringVar(&a.seed, "seed", "", "with -ephemeral, load this database snapshot at startup")
 			flags.Usage = func() {
-				fmt.Printf(`Usage: %s %s [-d] [-stop]
+				fmt.Printf(`Usage: %s %s [-d] [-stop] [-ephemeral [-seed path]]
 
 	Run and manager the api server. By default it runs in the foreground. Pass
 	the -d flag to run it as a background daemon. Pass -stop to shut it down.
+
+	Pass -ephemeral to run with an in-memory SQLite database instead of the
+	configured one, for demos and client development. Nothing is written to the
+	database on disk, and scheduled backups are off. Pass -seed with a snapshot
+	from the backup command to start with its data.
+				`, _Bin, name)
+				printFlagDefaults(flags)
+			}
+			return flags
+		},
+	}
+
+	_BackupCommand = Command{
+		description: "write a verified snapshot of the database",
+		run: func(a *Args) (err error) {
+			if err = db.OpenDriver(config.Conf.DBDriver, config.Conf.DB, config.Conf.SQLite); err != nil {
+				return
+			}
+			path := a.output
+			if path == "" {
+				path = "standardnotes-" + time.Now().UTC().Format("20060102T150405Z") + ".db"
+				if a.gzip {
+					path += ".gz"
+				}
+			}
+			var out *os.File
+			if out, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600); err != nil {
+				return
+			}
+			if err = db.WriteSnapshot(context.Background(), out, a.gzip); err != nil {
+				out.Close()
+				os.Remove(path)
+				return
+			}
+			if err = out.Close(); err != nil {
+				return
+			}
+			fmt.Println(path)
+			return
+		},
+		setup: func(a *Args) *flag.FlagSet {
+			const name = "backup"
+			flags := flag.NewFlagSet(name, flag.ExitOnError)
+			flags.StringVar(&a.output, "o", "", "output file, must not exist yet (default \"standardnotes-<timestamp>.db\")")
+			flags.BoolVar(&a.gzip, "gzip", false, "compress the output with gzip")
+			flags.Usage = func() {
+				fmt.Printf(`Usage: %s %s [-o path] [-gzip]
+
+	Write a snapshot of the SQLite database to a file. It's safe to run while
+	the server is running. The copy is checked with PRAGMA integrity_check
+	before it's written out.
+				`, _Bin, name)
+				printFlagDefaults(flags)
+			}
+			return flags
+		},
+	}
+
+	_CheckCommand = Command{
+		description: "find, optionally fix, data consistency problems",
+		run: func(a *Args) error {
+			if err := openDB(); err != nil {
+				return err
+			}
+			problems, err := check.Run(context.Background(), a.fix, time.Now())
+			if err != nil {
+				return err
+			}
+			var unfixed int
+			w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+			fmt.Fprintln(w, "KIND\tTABLE\tKEY\tDETAIL\tFIX\tFIXED")
+			for _, p := range problems {
+				fix := p.Fix
+				if fix == "" {
+					fix = "-"
+				}
+				if !p.Fixed {
+					unfixed++
+				}
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%t\n", p.Kind, p.Table, p.Key, p.Detail, fix, p.Fixed)
+			}
+			if err = w.Flush(); err != nil {
+				return err
+			}
+			if unfixed > 0 {
+				return fmt.Errorf("%d of %d problems not fixed", unfixed, len(problems))
+			}
+			return nil
+		},
+		setup: func(a *Args) *flag.FlagSet {
+			const name = "check"
+			flags := flag.NewFlagSet(name, flag.ExitOnError)
+			flags.BoolVar(&a.fix, "fix", false, "repair or quarantine what can be fixed")
+			flags.Usage = func() {
+				fmt.Printf(`Usage: %s %s [-fix]
+
+	Scan the database for data consistency problems and list them. It exits
+	with an error if there are any problems left unfixed. The checks are:
+
+	orphaned_item       item belongs to a user that doesn't exist
+	duplicate_email     more than one user has the same email, ignoring case
+	empty_content_type  item has no content_type
+	empty_content       item is not deleted, but has no content
+	invalid_uuid        user or item uuid is not a valid UUID
+	future_timestamp    created_at or updated_at is in the future
+
+	With -fix, items with empty content are marked deleted, future timestamps
+	are set to now, and orphaned items, items without a content_type and items
+	with invalid UUIDs are moved to the quarantined_items table. Duplicate
+	emails and users with invalid UUIDs must be resolved by hand.
+				`, _Bin, name)
+				printFlagDefaults(flags)
+			}
+			return flags
+		},
+	}
+
+	_KeysCommand = Command{
+		description: "generate, rotate or list token signing keys",
+		run: func(a *Args) error {
+			path := a.keysFile
+			if path == "" {
+				path = config.Conf.Tokens.KeysFile
+			}
+			if path == "" {
+				return fmt.Errorf("no keys file; pass -f or set tokens.keys_file")
+			}
+			alg := a.alg
+			if alg == "" {
+				alg = config.Conf.Tokens.Alg
+			}
+			action := "list"
+			if len(a.positional) > 0 {
+				action = a.positional[0]
+			}
+			switch action {
+			case "list":
+				return printKeys(path)
+			case "generate":
+				key, err := keys.Create(path, alg, time.Now())
+				if err != nil {
+					return err
+				}
+				fmt.Println(key.ID)
+				return nil
+			case "rotate":
+				key, err := keys.Rotate(path, alg, a.keep, time.Now())
+				if err != nil {
+					return err
+				}
+				fmt.Println(key.ID)
+				return nil
+			default:
+				return fmt.Errorf("unknown keys action %q", action)
+			}
+		},
+		setup: func(a *Args) *flag.FlagSet {
+			const name = "keys"
+			flags := flag.NewFlagSet(name, flag.ExitOnError)
+			flags.StringVar(&a.keysFile, "f", "", "keys file (default tokens.keys_file from the config)")
+			flags.StringVar(&a.alg, "alg", "", "signing algorithm of a new key, HS256, EdDSA or RS256 (default tokens.alg from the config)")
+			flags.IntVar(&a.keep, "keep", 0, "with rotate, how many of the newest keys to keep, 0 for all")
+			flags.Usage = func() {
+				fmt.Printf(`Usage: %s %s [-f path] [-alg alg] [-keep num] [list | generate | rotate]
+
+	Manage the keys that sign tokens. The newest key in the file signs new
+	tokens, and every key in it verifies tokens. The actions are:
+
+	list      list keys, oldest first (default)
+	generate  write a new keys file with one key
+	rotate    add a new key, which signs tokens from now on
+
+	Switching algorithms is a rotation: with -alg EdDSA or RS256, the new key
+	signs tokens from then on, and its public key is served at
+	/.well-known/jwks.json.
+
+	The server reads the keys file when it starts, so restart it after
+	rotating. Tokens signed by a key that's removed with -keep stop working.
+				`, _Bin, name)
+				printFlagDefaults(flags)
+			}
+			return flags
+		},
+	}
+
+	_MigrateCommand = Command{
+		description: "apply, revert or show schema migrations",
+		run: func(a *Args) error {
+			if err := db.OpenDriver(config.Conf.DBDriver, config.Conf.DB, config.Conf.SQLite); err != nil {
+				return err
+			}
+			action := "status"
+			if len(a.positional) > 0 {
+				action = a.positional[0]
+			}
+			switch action {
+			case "status":
+				return printMigrations()
+			case "up":
+				return db.MigrateTo(db.LatestVersion())
+			case "down":
+				version, err := db.SchemaVersion()
+				if err != nil {
+					return err
+				} else if version < 1 {
+					return fmt.Errorf("no migrations to revert")
+				}
+				return db.MigrateTo(version - 1)
+			case "to":
+				if len(a.positional) < 2 {
+					return fmt.Errorf("missing target version")
+				}
+				version, err := strconv.Atoi(a.positional[1])
+				if err != nil {
+					return fmt.Errorf("invalid target version %q", a.positional[1])
+				}
+				return db.MigrateTo(version)
+			default:
+				return fmt.Errorf("unknown migrate action %q", action)
+			}
+		},
+		setup: func(a *Args) *flag.FlagSet {
+			const name = "migrate"
+			flags := flag.NewFlagSet(name, flag.ExitOnError)
+			flags.Usage = func() {
+				fmt.Printf(`Usage: %s %s [status | up | down | to version]
+
+	Manage the database schema. Each change to the schema is a numbered
+	migration. The actions are:
+
+	status      list migrations and whether or not they're applied (default)
+	up          apply all pending migrations
+	down        revert the most recently applied migration
+	to version  apply or revert migrations until the schema is at version
+				`, _Bin, name)
+				printFlagDefaults(flags)
+			}
+			return flags
+		},
+	}
+
+	_UsersCommand = Command{
+		description: "manage user accounts",
+		run: func(a *Args) error {
+			if err := openDB(); err != nil {
+				return err
+			}
+			if len(a.positional) < 1 {
+				return fmt.Errorf("missing users action")
+			}
+			switch action := a.positional[0]; action {
+			case "delete":
+				if len(a.positional) < 2 {
+					return fmt.Errorf("missing email")
+				}
+				email := a.positional[1]
+				err := userInteractors.DeleteUserByEmail(context.Background(), email, a.emailBackup)
+				if errs.NotFoundError(err) {
+					return fmt.Errorf("no user with email %q", email)
+				} else if err != nil {
+					return err
+				}
+				fmt.Println("deleted", email)
+				return nil
+			default:
+				return fmt.Errorf("unknown users action %q", action)
+			}
+		},
+		setup: func(a *Args) *flag.FlagSet {
+			const name = "users"
+			flags := flag.NewFlagSet(name, flag.ExitOnError)
+			flags.BoolVar(&a.emailBackup, "email-backup", false, "with delete, email a final backup to the user first")
+			flags.Usage = func() {
+				fmt.Printf(`Usage: %s %s [-email-backup] delete email
+
+	Manage user accounts. The actions are:
+
+	delete email  delete the account and all of its data for good
+
+	With -email-backup, the user is emailed a backup of their items first. If
+	that fails, then nothing is deleted.
 				`, _Bin, name)
 				printFlagDefaults(flags)
 			}
@@ -74,6 +373,7 @@ var (
         Run in Foreground: ` + strconv.FormatBool(a.daemon) + `
         Webserver Port:    ` + strconv.Itoa(conf.Port) + `
         Socket:            ` + socket + `
+        DB Driver:         ` + conf.DBDriver + `
         DB Path:           ` + conf.DB + `
         Debug:             ` + strconv.FormatBool(conf.Debug))
 
@@ -92,8 +392,86 @@ var (
 			return flags
 		},
 	}
+
+	_WebhooksCommand = Command{
+		description: "list recent webhook deliveries",
+		run: func(a *Args) error {
+			if err := openDB(); err != nil {
+				return err
+			}
+			deliveries, err := webhooks.LoadRecentDeliveries(context.Background(), a.limit)
+			if err != nil {
+				return err
+			}
+			w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+			fmt.Fprintln(w, "CREATED\tEVENT\tSTATUS\tATTEMPTS\tCODE\tURL\tERROR")
+			for _, d := range deliveries {
+				fmt.Fprintf(
+					w, "%s\t%s\t%s\t%d\t%d\t%s\t%s\n",
+					d.CreatedAt.UTC().Format(time.RFC3339), d.Event, d.Status,
+					d.Attempts, d.ResponseCode, d.URL, d.LastError,
+				)
+			}
+			return w.Flush()
+		},
+		setup: func(a *Args) *flag.FlagSet {
+			const name = "webhooks"
+			flags := flag.NewFlagSet(name, flag.ExitOnError)
+			flags.IntVar(&a.limit, "n", 20, "max number of deliveries to show")
+			flags.Usage = func() {
+				fmt.Printf(`Usage: %s %s [-n num]
+
+	List the most recent webhook deliveries, newest first, along with their
+	delivery status and the last error, if any.
+				`, _Bin, name)
+				printFlagDefaults(flags)
+			}
+			return flags
+		},
+	}
 )
 
+// openDB connects to the configured database for commands other than migrate.
+// Like the api command, they refuse an outdated schema unless auto_migrate is
+// set, rather than quietly migrating it.
+func openDB() error {
+	if err := db.OpenDriver(config.Conf.DBDriver, config.Conf.DB, config.Conf.SQLite); err != nil {
+		return err
+	}
+	return db.EnsureSchema(config.Conf.AutoMigrate)
+}
+
+func printMigrations() error {
+	migrations, err := db.Migrations()
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "VERSION\tNAME\tAPPLIED")
+	for _, m := range migrations {
+		applied := "pending"
+		if m.Applied {
+			applied = m.AppliedAt.UTC().Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\n", m.Version, m.Name, applied)
+	}
+	return w.Flush()
+}
+
+func printKeys(path string) error {
+	set, err := keys.Load(path)
+	if err != nil {
+		return err
+	}
+	current, _ := set.Current()
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "KID\tALG\tCREATED\tCURRENT")
+	for _, key := range set.Keys {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%t\n", key.ID, key.Alg, key.CreatedAt.UTC().Format(time.RFC3339), key.ID == current.ID)
+	}
+	return w.Flush()
+}
+
 func printFlagDefaults(f *flag.FlagSet) {
 	fmt.Printf("\nFlags:\n\n")
 	f.PrintDefaults()
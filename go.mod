@@ -8,9 +8,9 @@ require (
 	github.com/gorilla/handlers v1.4.2
 	github.com/gorilla/mux v1.7.3
 	github.com/kardianos/osext v0.0.0-20190222173326-2bc1f35cddc0 // indirect
-	github.com/kisielk/sqlstruct v0.0.0-20150923205031-648daed35d49
+	github.com/lib/pq v1.10.9
 	github.com/mattn/go-sqlite3 v2.0.1+incompatible
 	github.com/rs/cors v1.7.0
 	github.com/sevlyar/go-daemon v0.1.5
-	golang.org/x/sys v0.0.0-20191210023423-ac6580df4449 // indirect
+	golang.org/x/crypto v0.0.0-20210921155107-089bfa567519
 )
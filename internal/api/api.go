@@ -1,6 +1,8 @@
 package api
 
 import (
+	"context"
+	"crypto/rand"
 	"fmt"
 	"io"
 	"log"
@@ -8,12 +10,19 @@ import (
 	"net/http"
 	"os"
 	"strconv"
+	"time"
 
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
+	"github.com/rafaelespinoza/standardnotes/internal/backup"
 	"github.com/rafaelespinoza/standardnotes/internal/config"
 	"github.com/rafaelespinoza/standardnotes/internal/db"
+	userInteractors "github.com/rafaelespinoza/standardnotes/internal/interactors/user"
+	"github.com/rafaelespinoza/standardnotes/internal/jobs"
+	"github.com/rafaelespinoza/standardnotes/internal/keys"
 	"github.com/rafaelespinoza/standardnotes/internal/logger"
+	"github.com/rafaelespinoza/standardnotes/internal/models"
+	"github.com/rafaelespinoza/standardnotes/internal/webhooks"
 	"github.com/rs/cors"
 )
 
@@ -27,14 +36,22 @@ func Serve(cfg config.Config) (err error) {
 		return
 	}
 
-	db.Init(cfg.DB)
-	log.Printf("started StandardNotes Server\n\tconfig:\n\t%+v\n", cfg)
-
-	_Server, err := newServer(cfg)
+	_Server, err := setup(cfg)
 	if err != nil {
 		log.Println(err)
 		return
 	}
+	cfg = _Server.conf
+	log.Printf("started StandardNotes Server\n\tconfig:\n\t%+v\n", cfg)
+
+	background := make(chan struct{})
+	defer close(background)
+	go webhooks.Run(background)
+	go jobs.Run(background)
+	go userInteractors.RunSessionCleanup(background)
+	if !cfg.Ephemeral {
+		go backup.Run(background)
+	}
 
 	defer func(cfg config.Config) {
 		if len(cfg.Socket) != 0 {
@@ -50,6 +67,109 @@ func Serve(cfg config.Config) (err error) {
 	return
 }
 
+// setup loads the signing keys, opens the database and makes a server for cfg,
+// without listening yet.
+func setup(cfg config.Config) (serv *server, err error) {
+	if cfg.Ephemeral {
+		// Nothing on disk is touched, and there's no data yet, so it's
+		// always safe to migrate.
+		cfg.DBDriver, cfg.DB, cfg.AutoMigrate = db.DriverSQLite, ":memory:", true
+		log.Println("ephemeral mode, data is discarded when the server stops")
+	}
+	var set *keys.Set
+	if set, err = initSigningKeys(cfg); err != nil {
+		return
+	}
+	if err = initParamsSecret(cfg, set); err != nil {
+		return
+	}
+	if err = openDB(cfg); err != nil {
+		return
+	}
+	serv, err = newServer(cfg)
+	return
+}
+
+// initSigningKeys loads the keys that sign tokens. The built-in key is only
+// allowed in debug mode. In ephemeral mode, a random key is made up instead.
+// The output set is the one from the keys file, if any.
+func initSigningKeys(cfg config.Config) (set *keys.Set, err error) {
+	if cfg.Tokens.KeysFile != "" {
+		if set, err = keys.Load(cfg.Tokens.KeysFile); err != nil {
+			return
+		}
+		err = models.UseSigningKeys(set)
+		return
+	}
+	if !models.BuiltInSigningKey() {
+		return
+	}
+	if cfg.Ephemeral {
+		var key keys.Key
+		alg := cfg.Tokens.Alg
+		if alg == "" {
+			alg = keys.HS256
+		}
+		if key, err = keys.Generate(alg, time.Now()); err != nil {
+			return
+		}
+		err = models.UseSigningKeys(&keys.Set{Keys: []keys.Key{key}})
+		return
+	}
+	if !cfg.Debug {
+		err = fmt.Errorf("no key to sign tokens; set tokens.keys_file, or the SECRET_KEY_BASE environment variable")
+	}
+	return
+}
+
+// initParamsSecret sets the secret of the made-up auth params for unknown email
+// addresses. Without params_secret or SECRET_KEY_BASE, it's derived from the
+// oldest key of set, the keys file, if there is one. Like the built-in
+// signing key, the built-in secret is only allowed in debug mode, and a random
+// one is made up in ephemeral mode.
+func initParamsSecret(cfg config.Config, set *keys.Set) (err error) {
+	if cfg.ParamsSecret != "" {
+		models.UseParamsSecret([]byte(cfg.ParamsSecret))
+		return
+	}
+	if !models.BuiltInParamsSecret() {
+		return
+	}
+	if set != nil && len(set.Keys) > 0 {
+		models.UseParamsSecret(set.Keys[0].DeriveSecret("params_secret"))
+		return
+	}
+	if cfg.Ephemeral {
+		secret := make([]byte, 32)
+		if _, err = rand.Read(secret); err != nil {
+			return
+		}
+		models.UseParamsSecret(secret)
+		return
+	}
+	if !cfg.Debug {
+		err = fmt.Errorf("no secret for auth params; set params_secret, tokens.keys_file, or the SECRET_KEY_BASE environment variable")
+	}
+	return
+}
+
+// openDB connects to the database and makes sure that its schema is current,
+// applying pending migrations if configured to do so. In ephemeral mode, the
+// seed snapshot, if any, is loaded first.
+func openDB(cfg config.Config) (err error) {
+	if err = db.OpenDriver(cfg.DBDriver, cfg.DB, cfg.SQLite); err != nil {
+		return
+	}
+	if cfg.Ephemeral && cfg.Seed != "" {
+		if err = db.LoadSnapshot(context.Background(), cfg.Seed); err != nil {
+			return
+		}
+	}
+	db.SetQueryTimeout(time.Duration(cfg.DBTimeoutSeconds) * time.Second)
+	err = db.EnsureSchema(cfg.AutoMigrate)
+	return
+}
+
 // Shutdown closes the server's internal channel.
 func Shutdown() {
 	if _Server != nil {
@@ -76,15 +196,37 @@ func newServer(conf config.Config) (serv *server, err error) {
 
 	r.HandleFunc("/items/sync", itemsHandlers.syncItems).Methods(http.MethodPost)
 	r.HandleFunc("/items/backup", itemsHandlers.backupItems).Methods(http.MethodPost)
+	r.HandleFunc("/items/usage", itemsHandlers.usage).Methods(http.MethodGet)
+
+	r.HandleFunc("/sessions", sessionsHandlers.list).Methods(http.MethodGet)
+	r.HandleFunc("/sessions/others", sessionsHandlers.revokeOthers).Methods(http.MethodDelete)
+	r.HandleFunc("/sessions/{uuid}", sessionsHandlers.revoke).Methods(http.MethodDelete)
+
+	r.HandleFunc("/extensions/status", extensionsHandlers.status).Methods(http.MethodGet)
 
 	r.HandleFunc("/auth/params", authHandlers.getParams).Methods(http.MethodGet)
+	r.HandleFunc("/.well-known/jwks.json", authHandlers.publicKeys).Methods(http.MethodGet)
 	r.HandleFunc("/auth/update", authHandlers.updateUser).Methods(http.MethodPost)
 	r.HandleFunc("/auth/change_pw", authHandlers.changePassword).Methods(http.MethodPost)
+	r.HandleFunc("/auth/change_email", authHandlers.changeEmail).Methods(http.MethodPost)
 	r.HandleFunc("/auth/sign_in", authHandlers.loginUser).Methods(http.MethodPost)
 	r.HandleFunc("/auth/sign_in.json", authHandlers.loginUser).Methods(http.MethodPost)
+	r.HandleFunc("/auth/refresh", authHandlers.refresh).Methods(http.MethodPost)
+	r.HandleFunc("/auth/sign_out", authHandlers.signOut).Methods(http.MethodPost)
+	r.HandleFunc("/auth/delete", authHandlers.deleteUser).Methods(http.MethodPost)
+	r.HandleFunc("/auth/verify", authHandlers.verifyEmail).Methods(http.MethodGet)
+	r.HandleFunc("/auth/verify/resend", authHandlers.resendVerify).Methods(http.MethodPost)
+	r.HandleFunc("/auth/mfa", authHandlers.enrollMFA).Methods(http.MethodPost)
+	r.HandleFunc("/auth/mfa/activate", authHandlers.activateMFA).Methods(http.MethodPost)
+	r.HandleFunc("/auth/mfa/disable", authHandlers.disableMFA).Methods(http.MethodPost)
 	if !conf.NoReg {
 		r.HandleFunc("/auth", authHandlers.registerUser).Methods(http.MethodPost)
 	}
+	if conf.AdminToken != "" {
+		admin := r.PathPrefix("/admin/").Subrouter()
+		admin.Use(requireAdmin(conf.AdminToken))
+		admin.HandleFunc("/backup", adminHandlers.backupDB).Methods(http.MethodPost)
+	}
 
 	// middleware
 	r.Use(func(next http.Handler) http.Handler {
@@ -113,6 +255,7 @@ func newServer(conf config.Config) (serv *server, err error) {
 		handler = cors.New(
 			cors.Options{
 				AllowedHeaders: []string{"*"},
+				AllowedMethods: []string{http.MethodGet, http.MethodPost, http.MethodDelete},
 				ExposedHeaders: []string{"Access-Token", "Client", "UID"},
 				MaxAge:         86400,
 			},
@@ -1,28 +1,81 @@
 package api_test
 
 import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
 	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"strconv"
 	"sync"
 	"testing"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/rafaelespinoza/standardnotes/internal/api"
 	"github.com/rafaelespinoza/standardnotes/internal/config"
+	"github.com/rafaelespinoza/standardnotes/internal/keys"
 )
 
 // defaultDB tells the test server where the db is. If using sqlite3, use
 // ":memory:" if you don't want a file at all.
 const defaultDB = ":memory:"
 
+func TestServeSigningKeys(t *testing.T) {
+	cfg := config.Config{DB: defaultDB, Host: "localhost", Port: 7776, AutoMigrate: true}
+	if os.Getenv("SECRET_KEY_BASE") != "" {
+		t.Log("SECRET_KEY_BASE is set, so the built-in key isn't used")
+	} else if err := api.Serve(cfg); err == nil {
+		t.Fatal("expected server to refuse to start with the built-in key")
+	}
+
+	cfg.Tokens.KeysFile = filepath.Join(t.TempDir(), "missing.json")
+	if err := api.Serve(cfg); err == nil {
+		t.Fatal("expected server to refuse to start without its keys file")
+	}
+
+	// the params secret is derived from the keys.
+	cfg.Tokens.KeysFile = newKeysFile(t)
+	if _, err := api.Handler(cfg); err != nil {
+		t.Fatalf("expected server to start with only a keys file; got %v", err)
+	}
+}
+
+// newKeysFile writes a keys file for a test server.
+func newKeysFile(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "keys.json")
+	if _, err := keys.Create(path, keys.HS256, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// newTestServer serves cfg on a free port until the test ends, and outputs its
+// base URL.
+func newTestServer(t *testing.T, cfg config.Config) string {
+	t.Helper()
+	handler, err := api.Handler(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	return server.URL
+}
+
 func TestServe(t *testing.T) {
 	t.Run("cors", func(t *testing.T) {
 		cfg := config.Config{
-			Debug:   true,
-			DB:      defaultDB,
-			Host:    "localhost",
-			Port:    7777,
-			UseCORS: true,
+			Debug:       true,
+			DB:          defaultDB,
+			Host:        "localhost",
+			Port:        7777,
+			UseCORS:     true,
+			AutoMigrate: true,
 		}
 
 		type TestCase struct {
@@ -38,6 +91,10 @@ func TestServe(t *testing.T) {
 				method: http.MethodPost,
 				path:   "/auth/change_pw",
 			},
+			{
+				method: http.MethodPost,
+				path:   "/auth/change_email",
+			},
 			{
 				method: http.MethodPost,
 				path:   "/auth/sign_in",
@@ -50,6 +107,38 @@ func TestServe(t *testing.T) {
 				method: http.MethodGet,
 				path:   "/auth/params",
 			},
+			{
+				method: http.MethodGet,
+				path:   "/auth/verify",
+			},
+			{
+				method: http.MethodPost,
+				path:   "/auth/verify/resend",
+			},
+			{
+				method: http.MethodPost,
+				path:   "/auth/mfa",
+			},
+			{
+				method: http.MethodPost,
+				path:   "/auth/mfa/activate",
+			},
+			{
+				method: http.MethodPost,
+				path:   "/auth/mfa/disable",
+			},
+			{
+				method: http.MethodPost,
+				path:   "/auth/refresh",
+			},
+			{
+				method: http.MethodPost,
+				path:   "/auth/sign_out",
+			},
+			{
+				method: http.MethodPost,
+				path:   "/auth/delete",
+			},
 			{
 				method: http.MethodPost,
 				path:   "/items/backup",
@@ -58,6 +147,22 @@ func TestServe(t *testing.T) {
 				method: http.MethodPost,
 				path:   "/items/sync",
 			},
+			{
+				method: http.MethodGet,
+				path:   "/sessions",
+			},
+			{
+				method: http.MethodDelete,
+				path:   "/sessions/others",
+			},
+			{
+				method: http.MethodGet,
+				path:   "/extensions/status",
+			},
+			{
+				method: http.MethodGet,
+				path:   "/.well-known/jwks.json",
+			},
 		}
 
 		testClient := Client{http: &http.Client{}}
@@ -107,6 +212,159 @@ func TestServe(t *testing.T) {
 	})
 }
 
+// TestConcurrentSync syncs from many clients at once against a SQLite file,
+// which is where "database is locked" errors would show up.
+func TestConcurrentSync(t *testing.T) {
+	cfg := config.Config{
+		DB: filepath.Join(t.TempDir(), "concurrent.db"),
+		SQLite: config.SQLite{
+			JournalMode:   "WAL",
+			BusyTimeoutMS: 5000,
+			Synchronous:   "NORMAL",
+			MaxIdleConns:  4,
+			SingleWriter:  true,
+		},
+		AutoMigrate:  true,
+		ParamsSecret: "test-params-secret",
+		Tokens:       config.Tokens{KeysFile: newKeysFile(t)},
+	}
+	baseURL := newTestServer(t, cfg)
+	testClient := Client{http: &http.Client{Timeout: 30 * time.Second}}
+
+	const numUsers, clientsPerUser, syncsPerClient, itemsPerSync = 4, 6, 5, 3
+	tokens := make([]string, numUsers)
+	for i := range tokens {
+		var out struct {
+			Token string `json:"token"`
+		}
+		body := map[string]string{
+			"email":    fmt.Sprintf("%s-%d@example.com", t.Name(), i),
+			"password": "testpassword123",
+		}
+		if err := testClient.postJSON(baseURL+"/auth", "", body, &out); err != nil {
+			t.Fatalf("could not register user %d; %v", i, err)
+		}
+		tokens[i] = out.Token
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, numUsers*clientsPerUser*syncsPerClient)
+	for u := 0; u < numUsers; u++ {
+		for c := 0; c < clientsPerUser; c++ {
+			wg.Add(1)
+			go func(token string) {
+				defer wg.Done()
+				for s := 0; s < syncsPerClient; s++ {
+					items := make([]map[string]interface{}, itemsPerSync)
+					for i := range items {
+						items[i] = map[string]interface{}{
+							"uuid":         uuid.New().String(),
+							"content":      "alpha",
+							"content_type": "Note",
+							"enc_item_key": "alpha",
+						}
+					}
+					var out struct {
+						Saved []interface{} `json:"saved_items"`
+					}
+					if err := testClient.postJSON(baseURL+"/items/sync", token, map[string]interface{}{"items": items}, &out); err != nil {
+						errs <- err
+						continue
+					}
+					if len(out.Saved) != itemsPerSync {
+						errs <- fmt.Errorf("wrong number of saved items; got %d, expected %d", len(out.Saved), itemsPerSync)
+					}
+				}
+			}(tokens[u])
+		}
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestAdminBackup(t *testing.T) {
+	cfg := config.Config{
+		DB:           defaultDB,
+		AutoMigrate:  true,
+		AdminToken:   "test-admin-token",
+		ParamsSecret: "test-params-secret",
+		Tokens:       config.Tokens{KeysFile: newKeysFile(t)},
+	}
+	baseURL := newTestServer(t, cfg)
+	testClient := Client{http: &http.Client{Timeout: 30 * time.Second}}
+
+	backup := func(t *testing.T, token string) (*http.Response, []byte) {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodPost, baseURL+"/admin/backup", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		res, err := testClient.http.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		body, err := io.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res, body
+	}
+
+	t.Run("ok", func(t *testing.T) {
+		res, body := backup(t, cfg.AdminToken)
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("wrong status code; got %d, expected %d; %s", res.StatusCode, http.StatusOK, body)
+		}
+		if !bytes.HasPrefix(body, []byte("SQLite format 3")) {
+			t.Error("response is not a SQLite database")
+		}
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		for _, token := range []string{"", "wrong"} {
+			if res, _ := backup(t, token); res.StatusCode != http.StatusUnauthorized {
+				t.Errorf("token %q; wrong status code; got %d, expected %d", token, res.StatusCode, http.StatusUnauthorized)
+			}
+		}
+	})
+}
+
 type Client struct {
 	http *http.Client
 }
+
+// postJSON sends body to url and decodes a successful response into out.
+func (c Client) postJSON(url, token string, body, out interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	res, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	resBody, err := io.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("%s; status %d; %s", url, res.StatusCode, resBody)
+	}
+	return json.Unmarshal(resBody, out)
+}
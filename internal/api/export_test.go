@@ -0,0 +1,17 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/rafaelespinoza/standardnotes/internal/config"
+)
+
+// Handler sets up a server for cfg like Serve does, but outputs its handler
+// instead of listening, so that tests can serve it with httptest.
+func Handler(cfg config.Config) (http.Handler, error) {
+	serv, err := setup(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return serv.http.Handler, nil
+}
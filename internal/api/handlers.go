@@ -1,12 +1,20 @@
 package api
 
 import (
+	"crypto/subtle"
 	"encoding/json"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/gorilla/mux"
+	"github.com/rafaelespinoza/standardnotes/internal/db"
 	"github.com/rafaelespinoza/standardnotes/internal/errs"
+	"github.com/rafaelespinoza/standardnotes/internal/interactors/extensions"
 	"github.com/rafaelespinoza/standardnotes/internal/interactors/itemsync"
 	userInteractors "github.com/rafaelespinoza/standardnotes/internal/interactors/user"
 	"github.com/rafaelespinoza/standardnotes/internal/logger"
@@ -59,28 +67,69 @@ func readJSONRequest(r *http.Request, dst interface{}) error {
 }
 
 func authenticateUser(r *http.Request) (*models.User, error) {
-	return userInteractors.AuthenticateUser(r.Header.Get("Authorization"))
+	return userInteractors.AuthenticateUser(r.Context(), r.Header.Get("Authorization"))
+}
+
+func authenticateSession(r *http.Request) (*models.User, *models.Session, error) {
+	return userInteractors.AuthenticateSession(r.Context(), r.Header.Get("Authorization"))
+}
+
+// requestDevice describes the client making the request. The IP address is
+// from the X-Forwarded-For header when the request comes through a proxy on the
+// same host, as in the sample nginx config.
+func requestDevice(r *http.Request) userInteractors.Device {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	if addr := net.ParseIP(ip); addr != nil && addr.IsLoopback() {
+		if hops := strings.Split(r.Header.Get("X-Forwarded-For"), ","); hops[len(hops)-1] != "" {
+			ip = strings.TrimSpace(hops[len(hops)-1])
+		}
+	}
+	return userInteractors.Device{UserAgent: r.UserAgent(), IPAddress: ip}
 }
 
 // authHandlers groups http handlers for "/auth/" routes.
 var authHandlers = struct {
 	changePassword http.HandlerFunc
+	changeEmail    http.HandlerFunc
 	updateUser     http.HandlerFunc
 	registerUser   http.HandlerFunc
 	loginUser      http.HandlerFunc
+	refresh        http.HandlerFunc
+	signOut        http.HandlerFunc
+	publicKeys     http.HandlerFunc
+	deleteUser     http.HandlerFunc
 	getParams      http.HandlerFunc
+	verifyEmail    http.HandlerFunc
+	resendVerify   http.HandlerFunc
+	enrollMFA      http.HandlerFunc
+	activateMFA    http.HandlerFunc
+	disableMFA     http.HandlerFunc
 }{
 	changePassword: changePassword,
+	changeEmail:    changeEmail,
 	updateUser:     updateUser,
 	registerUser:   registerUser,
 	loginUser:      loginUser,
+	refresh:        refreshSession,
+	signOut:        signOut,
+	publicKeys:     publicKeys,
+	deleteUser:     deleteUser,
 	getParams:      getParams,
+	verifyEmail:    verifyEmail,
+	resendVerify:   resendVerification,
+	enrollMFA:      enrollTwoFactor,
+	activateMFA:    activateTwoFactor,
+	disableMFA:     disableTwoFactor,
 }
 
-// changePassword is the change password handler.
+// changePassword is the change password handler. The user's other sessions are
+// signed out.
 // POST /auth/change_pw
 func changePassword(w http.ResponseWriter, r *http.Request) {
-	user, err := authenticateUser(r)
+	user, sess, err := authenticateSession(r)
 	if err != nil {
 		mustShowError(w, err, http.StatusUnauthorized)
 		return
@@ -90,7 +139,7 @@ func changePassword(w http.ResponseWriter, r *http.Request) {
 		mustShowError(w, err, http.StatusUnprocessableEntity)
 		return
 	}
-	token, err := userInteractors.ChangeUserPassword(user, password)
+	tokens, err := userInteractors.ChangeUserPassword(r.Context(), user, sess.UUID, password)
 	if errs.ValidationError(err) {
 		mustShowError(w, err, http.StatusUnauthorized)
 		return
@@ -99,11 +148,53 @@ func changePassword(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	writeJSONResponse(
-		w,
-		http.StatusAccepted,
-		map[string]interface{}{"token": token, "user": user.MakeSaferCopy()},
+	writeJSONResponse(w, http.StatusAccepted, signedInResponse(user, tokens))
+}
+
+// changeEmail is the change email handler. Like changePassword, the user's
+// other sessions are signed out. The response has the auth params for the new
+// address.
+// POST /auth/change_email
+func changeEmail(w http.ResponseWriter, r *http.Request) {
+	user, sess, err := authenticateSession(r)
+	if err != nil {
+		mustShowError(w, err, http.StatusUnauthorized)
+		return
+	}
+	var params struct {
+		CurrentPassword string `json:"current_password"`
+		NewEmail        string `json:"new_email"`
+		NewPassword     string `json:"new_password"`
+		PwCost          int    `json:"pw_cost"`
+		PwNonce         string `json:"pw_nonce"`
+	}
+	if err := readJSONRequest(r, &params); err != nil {
+		mustShowError(w, err, http.StatusUnprocessableEntity)
+		return
+	}
+	tokens, err := userInteractors.ChangeUserEmail(
+		r.Context(),
+		user,
+		sess.UUID,
+		userInteractors.EmailChangeParams{
+			CurrentPassword: models.PwHash{Value: params.CurrentPassword},
+			NewEmail:        params.NewEmail,
+			NewPassword:     models.PwHash{Value: params.NewPassword},
+			PwCost:          params.PwCost,
+			PwNonce:         params.PwNonce,
+		},
 	)
+	if errs.ValidationError(err) {
+		mustShowError(w, err, http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		mustShowError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	out := signedInResponse(user, tokens)
+	out["params"] = models.MakePwGenParams(*user)
+	writeJSONResponse(w, http.StatusAccepted, out)
 }
 
 // updateUser updates user info.
@@ -121,7 +212,10 @@ func updateUser(w http.ResponseWriter, r *http.Request) {
 	}
 	logger.LogIfDebug("Request: ", p)
 
-	if err := user.Update(p); err != nil {
+	if err := userInteractors.UpdateUser(r.Context(), user, p); errs.ValidationError(err) {
+		mustShowError(w, err, http.StatusUnprocessableEntity)
+		return
+	} else if err != nil {
 		mustShowError(w, err, http.StatusInternalServerError)
 		return
 	}
@@ -138,18 +232,31 @@ func registerUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	logger.LogIfDebug("Request:", params)
-	user, token, err := userInteractors.RegisterUser(params)
+	params.Device = requestDevice(r)
+	user, tokens, err := userInteractors.RegisterUser(r.Context(), params)
 	if err != nil {
 		mustShowError(w, err, http.StatusUnprocessableEntity)
 		return
 	}
-	writeJSONResponse(
-		w,
-		http.StatusOK,
-		map[string]interface{}{"token": token, "user": user.MakeSaferCopy()},
-	)
+	if tokens.AccessToken == "" {
+		// the user must verify their email address before signing in.
+		writeJSONResponse(
+			w,
+			http.StatusAccepted,
+			map[string]interface{}{
+				"user":    user.MakeSaferCopy(),
+				"message": "please check your email to verify your account",
+			},
+		)
+		return
+	}
+	writeJSONResponse(w, http.StatusOK, signedInResponse(user, tokens))
 }
 
+// _TwoFactorCodeParam is the sign in parameter for a two-factor code. Clients
+// of the legacy API are told its name in the payload of an "mfa-required" error.
+const _TwoFactorCodeParam = "mfa_code"
+
 // loginUser handles sign in.
 // POST /auth/sign_in
 func loginUser(w http.ResponseWriter, r *http.Request) {
@@ -157,25 +264,90 @@ func loginUser(w http.ResponseWriter, r *http.Request) {
 		API      string `json:"api"`
 		Email    string `json:"email"`
 		Password string `json:"password"`
+		MFACode  string `json:"mfa_code"`
 	}
 	if err := readJSONRequest(r, &params); err != nil {
 		mustShowError(w, err, http.StatusUnprocessableEntity)
 		return
 	}
 	logger.LogIfDebug("Request:", params)
-	user, token, err := userInteractors.LoginUser(
+	user, tokens, err := userInteractors.LoginUser(
+		r.Context(),
 		params.Email,
 		&models.PwHash{Value: params.Password},
+		params.MFACode,
+		requestDevice(r),
 	)
+	if tag := userInteractors.TwoFactorTag(err); tag != "" {
+		writeJSONResponse(
+			w,
+			http.StatusUnauthorized,
+			map[string]interface{}{"error": map[string]interface{}{
+				"tag":     tag,
+				"message": err.Error(),
+				"payload": map[string]string{"mfa_key": _TwoFactorCodeParam},
+			}},
+		)
+		return
+	} else if err != nil {
+		mustShowError(w, err, http.StatusUnauthorized)
+		return
+	}
+	writeJSONResponse(w, http.StatusAccepted, signedInResponse(user, tokens))
+}
+
+// signedInResponse is the response body for a new or changed session. The
+// "token" is only there if legacy tokens are configured.
+func signedInResponse(user *models.User, tokens userInteractors.SessionTokens) map[string]interface{} {
+	out := map[string]interface{}{"session": tokens, "user": user.MakeSaferCopy()}
+	if tokens.Token != "" {
+		out["token"] = tokens.Token
+	}
+	return out
+}
+
+// refreshSession exchanges a refresh token for new tokens. Each refresh token
+// can only be used once.
+// POST /auth/refresh
+func refreshSession(w http.ResponseWriter, r *http.Request) {
+	var params struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := readJSONRequest(r, &params); err != nil {
+		mustShowError(w, err, http.StatusUnprocessableEntity)
+		return
+	}
+	tokens, err := userInteractors.RefreshSession(r.Context(), params.RefreshToken)
+	if sanitizeAuthError(err) {
+		mustShowError(w, err, http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		mustShowError(w, err, http.StatusInternalServerError)
+		return
+	}
+	writeJSONResponse(w, http.StatusOK, map[string]interface{}{"session": tokens})
+}
+
+// signOut ends the session making the request, so that its tokens stop working.
+// POST /auth/sign_out
+func signOut(w http.ResponseWriter, r *http.Request) {
+	user, sess, err := authenticateSession(r)
 	if err != nil {
 		mustShowError(w, err, http.StatusUnauthorized)
 		return
 	}
-	writeJSONResponse(
-		w,
-		http.StatusAccepted,
-		map[string]interface{}{"token": token, "user": user.MakeSaferCopy()},
-	)
+	if err = userInteractors.SignOut(r.Context(), *user, *sess); err != nil && !errs.NotFoundError(err) {
+		mustShowError(w, err, http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// publicKeys shows the public keys that verify tokens, so that other services
+// can verify them too.
+// GET /.well-known/jwks.json
+func publicKeys(w http.ResponseWriter, r *http.Request) {
+	writeJSONResponse(w, http.StatusOK, models.PublicSigningKeys())
 }
 
 // getParams is the get auth parameters handler.
@@ -185,7 +357,7 @@ func getParams(w http.ResponseWriter, r *http.Request) {
 	logger.LogIfDebug("Request:", string(email))
 	var params models.PwGenParams
 	var err error
-	if params, err = userInteractors.MakeAuthParams(email); sanitizeAuthError(err) {
+	if params, err = userInteractors.MakeAuthParams(r.Context(), email); sanitizeAuthError(err) {
 		mustShowError(w, err, http.StatusUnauthorized)
 		return
 	} else if err != nil {
@@ -201,13 +373,215 @@ func getParams(w http.ResponseWriter, r *http.Request) {
 	writeJSONResponse(w, http.StatusOK, params)
 }
 
+// verifyEmail marks the user's email address as verified.
+// GET /auth/verify
+func verifyEmail(w http.ResponseWriter, r *http.Request) {
+	err := userInteractors.VerifyEmail(r.Context(), r.FormValue("token"))
+	if sanitizeAuthError(err) {
+		mustShowError(w, err, http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		mustShowError(w, err, http.StatusInternalServerError)
+		return
+	}
+	writeJSONResponse(w, http.StatusOK, map[string]interface{}{"message": "email address verified"})
+}
+
+// resendVerification sends another email address verification link. The
+// response is the same whether or not the email address is registered.
+// POST /auth/verify/resend
+func resendVerification(w http.ResponseWriter, r *http.Request) {
+	var params struct {
+		Email string `json:"email"`
+	}
+	if err := readJSONRequest(r, &params); err != nil {
+		mustShowError(w, err, http.StatusUnprocessableEntity)
+		return
+	}
+	logger.LogIfDebug("Request:", params)
+	if err := userInteractors.ResendVerification(r.Context(), params.Email); errs.ValidationError(err) {
+		mustShowError(w, err, http.StatusUnprocessableEntity)
+		return
+	} else if err != nil {
+		mustShowError(w, err, http.StatusInternalServerError)
+		return
+	}
+	writeJSONResponse(w, http.StatusAccepted, nil)
+}
+
+// enrollTwoFactor starts setting up two-factor authentication. The response
+// has the secret for an authenticator app.
+// POST /auth/mfa
+func enrollTwoFactor(w http.ResponseWriter, r *http.Request) {
+	user, err := authenticateUser(r)
+	if err != nil {
+		mustShowError(w, err, http.StatusUnauthorized)
+		return
+	}
+	enrollment, err := userInteractors.EnrollTwoFactor(r.Context(), *user)
+	if errs.ValidationError(err) {
+		mustShowError(w, err, http.StatusUnprocessableEntity)
+		return
+	} else if err != nil {
+		mustShowError(w, err, http.StatusInternalServerError)
+		return
+	}
+	writeJSONResponse(w, http.StatusOK, enrollment)
+}
+
+// activateTwoFactor turns on two-factor authentication with a code from the
+// authenticator app. The response has recovery codes.
+// POST /auth/mfa/activate
+func activateTwoFactor(w http.ResponseWriter, r *http.Request) {
+	user, err := authenticateUser(r)
+	if err != nil {
+		mustShowError(w, err, http.StatusUnauthorized)
+		return
+	}
+	var params struct {
+		Code string `json:"code"`
+	}
+	if err = readJSONRequest(r, &params); err != nil {
+		mustShowError(w, err, http.StatusUnprocessableEntity)
+		return
+	}
+	recoveryCodes, err := userInteractors.ActivateTwoFactor(r.Context(), *user, params.Code)
+	if errs.ValidationError(err) {
+		mustShowError(w, err, http.StatusUnprocessableEntity)
+		return
+	} else if err != nil {
+		mustShowError(w, err, http.StatusInternalServerError)
+		return
+	}
+	writeJSONResponse(w, http.StatusOK, map[string]interface{}{"recovery_codes": recoveryCodes})
+}
+
+// disableTwoFactor turns off two-factor authentication. The request must have
+// the current password.
+// POST /auth/mfa/disable
+func disableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	user, err := authenticateUser(r)
+	if err != nil {
+		mustShowError(w, err, http.StatusUnauthorized)
+		return
+	}
+	var params struct {
+		Password string `json:"password"`
+	}
+	if err = readJSONRequest(r, &params); err != nil {
+		mustShowError(w, err, http.StatusUnprocessableEntity)
+		return
+	}
+	err = userInteractors.DisableTwoFactor(r.Context(), *user, &models.PwHash{Value: params.Password})
+	if errs.ValidationError(err) {
+		mustShowError(w, err, http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		mustShowError(w, err, http.StatusInternalServerError)
+		return
+	}
+	writeJSONResponse(w, http.StatusAccepted, nil)
+}
+
+// deleteUser deletes the user's account and all of its data, once the password
+// is confirmed. Pass email_backup to get a final backup by email first.
+// POST /auth/delete
+func deleteUser(w http.ResponseWriter, r *http.Request) {
+	user, err := authenticateUser(r)
+	if err != nil {
+		mustShowError(w, err, http.StatusUnauthorized)
+		return
+	}
+	var params struct {
+		Password    string `json:"password"`
+		EmailBackup bool   `json:"email_backup"`
+	}
+	if err = readJSONRequest(r, &params); err != nil {
+		mustShowError(w, err, http.StatusUnprocessableEntity)
+		return
+	}
+	err = userInteractors.DeleteUser(r.Context(), *user, &models.PwHash{Value: params.Password}, params.EmailBackup)
+	if errs.ValidationError(err) {
+		mustShowError(w, err, http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		mustShowError(w, err, http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// sessionsHandlers groups http handlers for "/sessions" routes.
+var sessionsHandlers = struct {
+	list         http.HandlerFunc
+	revoke       http.HandlerFunc
+	revokeOthers http.HandlerFunc
+}{
+	list:         listSessions,
+	revoke:       revokeSession,
+	revokeOthers: revokeOtherSessions,
+}
+
+// listSessions shows the user's signed in devices.
+// GET /sessions
+func listSessions(w http.ResponseWriter, r *http.Request) {
+	user, sess, err := authenticateSession(r)
+	if err != nil {
+		mustShowError(w, err, http.StatusUnauthorized)
+		return
+	}
+	sessions, err := userInteractors.ListSessions(r.Context(), *user, *sess)
+	if err != nil {
+		mustShowError(w, err, http.StatusInternalServerError)
+		return
+	}
+	writeJSONResponse(w, http.StatusOK, map[string]interface{}{"sessions": sessions})
+}
+
+// revokeSession signs out one of the user's sessions.
+// DELETE /sessions/{uuid}
+func revokeSession(w http.ResponseWriter, r *http.Request) {
+	user, err := authenticateUser(r)
+	if err != nil {
+		mustShowError(w, err, http.StatusUnauthorized)
+		return
+	}
+	err = userInteractors.RevokeSession(r.Context(), *user, mux.Vars(r)["uuid"])
+	if errs.NotFoundError(err) {
+		mustShowError(w, err, http.StatusNotFound)
+		return
+	} else if err != nil {
+		mustShowError(w, err, http.StatusInternalServerError)
+		return
+	}
+	writeJSONResponse(w, http.StatusAccepted, nil)
+}
+
+// revokeOtherSessions signs out all of the user's sessions except for the one
+// making the request.
+// DELETE /sessions/others
+func revokeOtherSessions(w http.ResponseWriter, r *http.Request) {
+	user, sess, err := authenticateSession(r)
+	if err != nil {
+		mustShowError(w, err, http.StatusUnauthorized)
+		return
+	}
+	if err = userInteractors.RevokeOtherSessions(r.Context(), *user, *sess); err != nil {
+		mustShowError(w, err, http.StatusInternalServerError)
+		return
+	}
+	writeJSONResponse(w, http.StatusAccepted, nil)
+}
+
 // itemsHandlers groups http handlers for "/items/" routes.
 var itemsHandlers = struct {
 	syncItems   http.HandlerFunc
 	backupItems http.HandlerFunc
+	usage       http.HandlerFunc
 }{
 	syncItems:   syncItems,
 	backupItems: backupItems,
+	usage:       itemsUsage,
 }
 
 // syncItems is the items sync handler.
@@ -224,7 +598,7 @@ func syncItems(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	logger.LogIfDebug("Request:", request)
-	response, err := itemsync.SyncUserItems(*user, request)
+	response, err := itemsync.SyncUserItems(r.Context(), *user, request)
 	if err != nil {
 		mustShowError(w, err, http.StatusInternalServerError)
 		return
@@ -244,3 +618,103 @@ func backupItems(w http.ResponseWriter, r *http.Request) {
 	}
 	fmt.Printf("%+v\n", r.Form)
 }
+
+// itemsUsage reports how much the user stores and their quota.
+// GET /items/usage
+func itemsUsage(w http.ResponseWriter, r *http.Request) {
+	user, err := authenticateUser(r)
+	if err != nil {
+		mustShowError(w, err, http.StatusUnauthorized)
+		return
+	}
+	report, err := itemsync.LoadUsage(r.Context(), *user)
+	if err != nil {
+		mustShowError(w, err, http.StatusInternalServerError)
+		return
+	}
+	writeJSONResponse(w, http.StatusOK, report)
+}
+
+// extensionsHandlers groups http handlers for "/extensions/" routes.
+var extensionsHandlers = struct {
+	status http.HandlerFunc
+}{
+	status: extensionStatus,
+}
+
+// extensionStatus reports the delivery health of the user's extensions.
+// GET /extensions/status
+func extensionStatus(w http.ResponseWriter, r *http.Request) {
+	user, err := authenticateUser(r)
+	if err != nil {
+		mustShowError(w, err, http.StatusUnauthorized)
+		return
+	}
+	statuses, err := extensions.LoadStatuses(r.Context(), *user)
+	if err != nil {
+		mustShowError(w, err, http.StatusInternalServerError)
+		return
+	}
+	writeJSONResponse(w, http.StatusOK, map[string]interface{}{"extensions": statuses})
+}
+
+// requireAdmin makes middleware that rejects requests without the admin token.
+func requireAdmin(token string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			got := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+				mustShowError(w, fmt.Errorf("invalid admin token"), http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// adminHandlers groups http handlers for "/admin/" routes.
+var adminHandlers = struct {
+	backupDB http.HandlerFunc
+}{
+	backupDB: backupDB,
+}
+
+// backupDB responds with a verified snapshot of the database. Pass gzip=true
+// to compress it.
+// POST /admin/backup
+func backupDB(w http.ResponseWriter, r *http.Request) {
+	compress, _ := strconv.ParseBool(r.FormValue("gzip"))
+	name := "standardnotes-" + time.Now().UTC().Format("20060102T150405Z") + ".db"
+	contentType := "application/vnd.sqlite3"
+	if compress {
+		name += ".gz"
+		contentType = "application/gzip"
+	}
+	// The snapshot is checked before anything is written, so a failure there
+	// can still be reported as an error response.
+	hw := &headerWriter{ResponseWriter: w, header: func(h http.Header) {
+		h.Set("Content-Type", contentType)
+		h.Set("Content-Disposition", `attachment; filename="`+name+`"`)
+	}}
+	if err := db.WriteSnapshot(r.Context(), hw, compress); err != nil && !hw.wrote {
+		mustShowError(w, err, http.StatusInternalServerError)
+	} else if err != nil {
+		log.Printf("backup response interrupted; %v\n", err)
+	}
+}
+
+// headerWriter sets headers right before the first write to the body.
+type headerWriter struct {
+	http.ResponseWriter
+	header func(http.Header)
+	wrote  bool
+}
+
+func (w *headerWriter) Write(p []byte) (int, error) {
+	if !w.wrote {
+		w.header(w.Header())
+		w.WriteHeader(http.StatusOK)
+		w.wrote = true
+	}
+	return w.ResponseWriter.Write(p)
+}
@@ -0,0 +1,152 @@
+// Package backup writes scheduled, operator-level backups of every user's
+// account to a Destination. Each backup is one file per user, in the same
+// format as the backups that clients make themselves.
+package backup
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rafaelespinoza/standardnotes/internal/config"
+	"github.com/rafaelespinoza/standardnotes/internal/models"
+)
+
+// A Destination stores backup files.
+type Destination interface {
+	// Put writes the contents of r to a file called name. It should be
+	// atomic: if it fails, then there's no partial file left behind, and
+	// nobody can see the file until it's complete.
+	Put(name string, r io.Reader) error
+	// List returns the names of all files starting with prefix.
+	List(prefix string) ([]string, error)
+	// Remove deletes a file.
+	Remove(name string) error
+}
+
+// NewDestination makes the Destination described by the configuration.
+func NewDestination(conf config.BackupDestination) (Destination, error) {
+	switch conf.Type {
+	case "", "local":
+		if conf.Path == "" {
+			return nil, fmt.Errorf("backup destination path is empty")
+		}
+		return &LocalDir{Path: conf.Path}, nil
+	case "webdav":
+		if conf.URL == "" {
+			return nil, fmt.Errorf("backup destination url is empty")
+		}
+		return NewWebDAV(conf.URL, conf.Username, conf.Password), nil
+	default:
+		return nil, fmt.Errorf("unknown backup destination type %q", conf.Type)
+	}
+}
+
+const (
+	_FilePrefix    = "sn-backup-"
+	_FileExtension = ".json"
+	// _TimeFormat is for the timestamp in a backup filename. It sorts
+	// lexically in chronological order.
+	_TimeFormat = "20060102T150405Z"
+)
+
+// Filename is the name of the backup file for a user at time t.
+func Filename(userUUID string, t time.Time) string {
+	return filePrefix(userUUID) + t.UTC().Format(_TimeFormat) + _FileExtension
+}
+
+func filePrefix(userUUID string) string { return _FilePrefix + userUUID + "-" }
+
+// Run makes a backup of every user at the configured interval until the done
+// channel is closed. It returns right away if backups are not configured.
+func Run(done <-chan struct{}) {
+	conf := config.Conf.Backups
+	if conf.IntervalHours < 1 {
+		return
+	}
+	dest, err := NewDestination(conf.Destination)
+	if err != nil {
+		log.Printf("backups disabled; %v\n", err)
+		return
+	}
+	ticker := time.NewTicker(time.Duration(conf.IntervalHours) * time.Hour)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if err = BackupAll(context.Background(), dest, conf.Retain, time.Now()); err != nil {
+				log.Printf("backup failed; %v\n", err)
+			}
+		}
+	}
+}
+
+// BackupAll writes a backup of each user to dest, then removes all but the
+// newest retain backups for each user. A failure for one user does not stop the
+// others; the output error summarizes all failures.
+func BackupAll(ctx context.Context, dest Destination, retain int, t time.Time) error {
+	userUUIDs, err := models.LoadUserUUIDs(ctx)
+	if err != nil {
+		return err
+	}
+	var failures []string
+	for _, userUUID := range userUUIDs {
+		if err = BackupUser(ctx, dest, userUUID, t); err != nil {
+			failures = append(failures, fmt.Sprintf("user %s: %v", userUUID, err))
+			continue
+		}
+		if err = Rotate(dest, userUUID, retain); err != nil {
+			failures = append(failures, fmt.Sprintf("user %s: rotate: %v", userUUID, err))
+		}
+	}
+	log.Printf("backed up %d of %d users\n", len(userUUIDs)-len(failures), len(userUUIDs))
+	if len(failures) > 0 {
+		return fmt.Errorf("%d backups failed; %s", len(failures), strings.Join(failures, "; "))
+	}
+	return nil
+}
+
+// BackupUser writes a backup of one user to dest.
+func BackupUser(ctx context.Context, dest Destination, userUUID string, t time.Time) (err error) {
+	var user *models.User
+	if user, err = models.LoadUserByUUID(ctx, userUUID); err != nil {
+		return
+	}
+	var contents models.Backup
+	if contents, err = user.MakeBackup(ctx); err != nil {
+		return
+	}
+	var data []byte
+	if data, err = json.Marshal(contents); err != nil {
+		return
+	}
+	err = dest.Put(Filename(user.UUID, t), bytes.NewReader(data))
+	return
+}
+
+// Rotate removes all but the newest retain backups of a user. If retain is
+// less than 1, then nothing is removed.
+func Rotate(dest Destination, userUUID string, retain int) (err error) {
+	if retain < 1 {
+		return
+	}
+	var names []string
+	if names, err = dest.List(filePrefix(userUUID)); err != nil {
+		return
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(names)))
+	for i := retain; i < len(names); i++ {
+		if err = dest.Remove(names[i]); err != nil {
+			return
+		}
+	}
+	return
+}
@@ -0,0 +1,103 @@
+package backup_test
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rafaelespinoza/standardnotes/internal/backup"
+	"github.com/rafaelespinoza/standardnotes/internal/db/dbtest"
+	"github.com/rafaelespinoza/standardnotes/internal/models"
+)
+
+func init() {
+	dbtest.Init()
+}
+
+func TestBackupAll(t *testing.T) {
+	dir := t.TempDir()
+	dest := &backup.LocalDir{Path: dir}
+
+	user := models.NewUser()
+	user.Email = t.Name() + "@example.com"
+	user.Password = "testpassword123"
+	user.PwNonce = "stub_password_nonce"
+	if err := user.Create(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	item := models.Item{UserUUID: user.UUID, ContentType: "Note", Content: "003:encrypted"}
+	if err := item.Create(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	const retain = 2
+	start := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 4; i++ {
+		if err := backup.BackupAll(context.Background(), dest, retain, start.Add(time.Duration(i)*time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	names, err := dest.List("sn-backup-" + user.UUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != retain {
+		t.Fatalf("wrong number of backups; got %d, expected %d", len(names), retain)
+	}
+	newest := backup.Filename(user.UUID, start.Add(3*time.Hour))
+	var found bool
+	for _, name := range names {
+		found = found || name == newest
+	}
+	if !found {
+		t.Fatalf("expected to keep newest backup %q; got %v", newest, names)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, newest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var contents models.Backup
+	if err = json.Unmarshal(data, &contents); err != nil {
+		t.Fatal(err)
+	}
+	if len(contents.Items) != 1 || contents.Items[0].UUID != item.UUID {
+		t.Errorf("wrong items in backup; got %+v", contents.Items)
+	}
+	if contents.AuthParams.PwNonce != user.PwNonce {
+		t.Errorf("wrong auth params in backup; got %+v", contents.AuthParams)
+	}
+}
+
+func TestLocalDir(t *testing.T) {
+	dir := t.TempDir()
+	dest := &backup.LocalDir{Path: filepath.Join(dir, "nested")}
+
+	if err := dest.Put("alpha.json", strings.NewReader("alpha")); err != nil {
+		t.Fatal(err)
+	}
+	if err := dest.Put("../escape.json", strings.NewReader("nope")); err == nil {
+		t.Error("expected error for file name outside of destination")
+	}
+
+	names, err := dest.List("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 1 || names[0] != "alpha.json" {
+		t.Errorf("expected only the complete file; got %v", names)
+	}
+	if err = dest.Remove("alpha.json"); err != nil {
+		t.Fatal(err)
+	}
+	if names, err = dest.List(""); err != nil {
+		t.Fatal(err)
+	} else if len(names) != 0 {
+		t.Errorf("expected no files; got %v", names)
+	}
+}
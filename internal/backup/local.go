@@ -0,0 +1,80 @@
+package backup
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// LocalDir is a Destination on the local filesystem.
+type LocalDir struct {
+	Path string
+}
+
+var _ Destination = (*LocalDir)(nil)
+
+// Put writes to a temporary file in the same directory, syncs it, then renames
+// it into place. A rename within a directory is atomic.
+func (d *LocalDir) Put(name string, r io.Reader) (err error) {
+	if err = checkName(name); err != nil {
+		return
+	}
+	if err = os.MkdirAll(d.Path, 0700); err != nil {
+		return
+	}
+	var tmp *os.File
+	if tmp, err = ioutil.TempFile(d.Path, ".tmp-"+name+"-"); err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+	if _, err = io.Copy(tmp, r); err != nil {
+		return
+	}
+	if err = tmp.Sync(); err != nil {
+		return
+	}
+	if err = tmp.Close(); err != nil {
+		return
+	}
+	err = os.Rename(tmp.Name(), filepath.Join(d.Path, name))
+	return
+}
+
+func (d *LocalDir) List(prefix string) (out []string, err error) {
+	var entries []os.FileInfo
+	if entries, err = ioutil.ReadDir(d.Path); os.IsNotExist(err) {
+		err = nil
+		return
+	} else if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if entry.Mode().IsRegular() && strings.HasPrefix(entry.Name(), prefix) {
+			out = append(out, entry.Name())
+		}
+	}
+	return
+}
+
+func (d *LocalDir) Remove(name string) error {
+	if err := checkName(name); err != nil {
+		return err
+	}
+	return os.Remove(filepath.Join(d.Path, name))
+}
+
+// checkName makes sure a file name can't point outside of the destination.
+func checkName(name string) error {
+	if name == "" || name != filepath.Base(name) || strings.HasPrefix(name, ".") {
+		return fmt.Errorf("invalid backup file name %q", name)
+	}
+	return nil
+}
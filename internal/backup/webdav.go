@@ -0,0 +1,167 @@
+package backup
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+// WebDAV is a Destination on a WebDAV server. The collection at the URL must
+// already exist.
+type WebDAV struct {
+	base     *url.URL
+	username string
+	password string
+	client   *http.Client
+}
+
+var _ Destination = (*WebDAV)(nil)
+
+// NewWebDAV makes a WebDAV Destination for the collection at baseURL.
+func NewWebDAV(baseURL, username, password string) *WebDAV {
+	if !strings.HasSuffix(baseURL, "/") {
+		baseURL += "/"
+	}
+	base, err := url.Parse(baseURL)
+	if err != nil {
+		base = &url.URL{Path: baseURL}
+	}
+	return &WebDAV{
+		base:     base,
+		username: username,
+		password: password,
+		client:   &http.Client{Timeout: 5 * time.Minute},
+	}
+}
+
+// Put uploads to a temporary name, then asks the server to MOVE it into place,
+// so that the file only appears under its real name once it's complete.
+func (d *WebDAV) Put(name string, r io.Reader) (err error) {
+	if err = checkName(name); err != nil {
+		return
+	}
+	suffix := make([]byte, 8)
+	if _, err = rand.Read(suffix); err != nil {
+		return
+	}
+	tmpName := ".tmp-" + name + "-" + hex.EncodeToString(suffix)
+
+	if err = d.do(http.MethodPut, tmpName, r, nil, http.StatusOK, http.StatusCreated, http.StatusNoContent); err != nil {
+		return
+	}
+	headers := map[string]string{
+		"Destination": d.resolve(name),
+		"Overwrite":   "T",
+	}
+	if err = d.do("MOVE", tmpName, nil, headers, http.StatusCreated, http.StatusNoContent); err != nil {
+		d.do(http.MethodDelete, tmpName, nil, nil, http.StatusOK, http.StatusNoContent)
+	}
+	return
+}
+
+func (d *WebDAV) List(prefix string) (out []string, err error) {
+	body := strings.NewReader(`<?xml version="1.0" encoding="utf-8"?>
+<propfind xmlns="DAV:"><prop><resourcetype/></prop></propfind>`)
+	var req *http.Request
+	if req, err = d.newRequest("PROPFIND", "", body); err != nil {
+		return
+	}
+	req.Header.Set("Depth", "1")
+	req.Header.Set("Content-Type", "application/xml; charset=utf-8")
+
+	var res *http.Response
+	if res, err = d.client.Do(req); err != nil {
+		return
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusMultiStatus {
+		err = fmt.Errorf("PROPFIND %s; unexpected status %d", d.base, res.StatusCode)
+		return
+	}
+
+	var status struct {
+		Responses []struct {
+			Href     string `xml:"href"`
+			Propstat []struct {
+				Prop struct {
+					ResourceType struct {
+						Collection *struct{} `xml:"collection"`
+					} `xml:"resourcetype"`
+				} `xml:"prop"`
+			} `xml:"propstat"`
+		} `xml:"response"`
+	}
+	if err = xml.NewDecoder(res.Body).Decode(&status); err != nil {
+		return
+	}
+	for _, resp := range status.Responses {
+		var isCollection bool
+		for _, ps := range resp.Propstat {
+			isCollection = isCollection || ps.Prop.ResourceType.Collection != nil
+		}
+		if isCollection {
+			continue
+		}
+		href, perr := url.PathUnescape(resp.Href)
+		if perr != nil {
+			continue
+		}
+		if name := path.Base(href); strings.HasPrefix(name, prefix) {
+			out = append(out, name)
+		}
+	}
+	return
+}
+
+func (d *WebDAV) Remove(name string) error {
+	if err := checkName(name); err != nil {
+		return err
+	}
+	return d.do(http.MethodDelete, name, nil, nil, http.StatusOK, http.StatusNoContent)
+}
+
+func (d *WebDAV) resolve(name string) string {
+	return d.base.ResolveReference(&url.URL{Path: name}).String()
+}
+
+func (d *WebDAV) newRequest(method, name string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, d.resolve(name), body)
+	if err != nil {
+		return nil, err
+	}
+	if d.username != "" {
+		req.SetBasicAuth(d.username, d.password)
+	}
+	return req, nil
+}
+
+func (d *WebDAV) do(method, name string, body io.Reader, headers map[string]string, okStatuses ...int) (err error) {
+	var req *http.Request
+	if req, err = d.newRequest(method, name, body); err != nil {
+		return
+	}
+	for key, val := range headers {
+		req.Header.Set(key, val)
+	}
+	var res *http.Response
+	if res, err = d.client.Do(req); err != nil {
+		return
+	}
+	defer res.Body.Close()
+	io.Copy(ioutil.Discard, res.Body)
+	for _, code := range okStatuses {
+		if res.StatusCode == code {
+			return
+		}
+	}
+	err = fmt.Errorf("%s %s; unexpected status %d", method, name, res.StatusCode)
+	return
+}
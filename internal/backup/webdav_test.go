@@ -0,0 +1,111 @@
+package backup_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/rafaelespinoza/standardnotes/internal/backup"
+)
+
+// fakeDAV is just enough of a WebDAV server, with one collection, to test the
+// client.
+type fakeDAV struct {
+	mtx        sync.Mutex
+	collection string
+	files      map[string][]byte
+}
+
+func (f *fakeDAV) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	if user, pass, ok := r.BasicAuth(); !ok || user != "user" || pass != "pass" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	name := path.Base(r.URL.Path)
+	switch r.Method {
+	case http.MethodPut:
+		data, _ := ioutil.ReadAll(r.Body)
+		f.files[name] = data
+		w.WriteHeader(http.StatusCreated)
+	case "MOVE":
+		dest, err := url.Parse(r.Header.Get("Destination"))
+		if err != nil || r.Header.Get("Overwrite") != "T" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		f.files[path.Base(dest.Path)] = f.files[name]
+		delete(f.files, name)
+		w.WriteHeader(http.StatusCreated)
+	case http.MethodDelete:
+		if _, ok := f.files[name]; !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		delete(f.files, name)
+		w.WriteHeader(http.StatusNoContent)
+	case "PROPFIND":
+		var b strings.Builder
+		b.WriteString(`<?xml version="1.0" encoding="utf-8"?><D:multistatus xmlns:D="DAV:">`)
+		fmt.Fprintf(&b, `<D:response><D:href>%s</D:href><D:propstat><D:prop><D:resourcetype><D:collection/></D:resourcetype></D:prop></D:propstat></D:response>`, f.collection)
+		for name := range f.files {
+			fmt.Fprintf(&b, `<D:response><D:href>%s</D:href><D:propstat><D:prop><D:resourcetype/></D:prop></D:propstat></D:response>`, f.collection+url.PathEscape(name))
+		}
+		b.WriteString(`</D:multistatus>`)
+		w.WriteHeader(http.StatusMultiStatus)
+		w.Write([]byte(b.String()))
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func TestWebDAV(t *testing.T) {
+	dav := &fakeDAV{collection: "/dav/backups/", files: make(map[string][]byte)}
+	srv := httptest.NewServer(dav)
+	defer srv.Close()
+
+	dest := backup.NewWebDAV(srv.URL+dav.collection, "user", "pass")
+	for _, name := range []string{"sn-backup-a-1.json", "sn-backup-a-2.json", "sn-backup-b-1.json"} {
+		if err := dest.Put(name, strings.NewReader(name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if string(dav.files["sn-backup-a-2.json"]) != "sn-backup-a-2.json" {
+		t.Errorf("wrong file contents; got %q", dav.files["sn-backup-a-2.json"])
+	}
+	for name := range dav.files {
+		if strings.HasPrefix(name, ".tmp") {
+			t.Errorf("temporary file %q should have been moved", name)
+		}
+	}
+
+	names, err := dest.List("sn-backup-a-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(names)
+	if len(names) != 2 || names[0] != "sn-backup-a-1.json" || names[1] != "sn-backup-a-2.json" {
+		t.Errorf("wrong listing; got %v", names)
+	}
+
+	if err = backup.Rotate(dest, "a", 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := dav.files["sn-backup-a-1.json"]; ok {
+		t.Error("expected older backup to be rotated out")
+	}
+	if _, ok := dav.files["sn-backup-a-2.json"]; !ok {
+		t.Error("expected newest backup to be kept")
+	}
+	if err = dest.Remove("sn-backup-a-1.json"); err == nil {
+		t.Error("expected error removing a missing file")
+	}
+}
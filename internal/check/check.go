@@ -0,0 +1,268 @@
+// Package check scans the database for data that the rest of the program
+// assumes can't happen, and optionally repairs it. Items that can't be repaired
+// in place are moved to the quarantined_items table rather than deleted, so an
+// operator can look at them later.
+package check
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rafaelespinoza/standardnotes/internal/db"
+)
+
+// Kinds of problems.
+const (
+	KindOrphanedItem     = "orphaned_item"
+	KindDuplicateEmail   = "duplicate_email"
+	KindEmptyContentType = "empty_content_type"
+	KindEmptyContent     = "empty_content"
+	KindInvalidUUID      = "invalid_uuid"
+	KindFutureTimestamp  = "future_timestamp"
+)
+
+// _ClockSkew is how far in the future a timestamp can be before it's a
+// problem. Clients and servers don't always agree on the time.
+const _ClockSkew = 5 * time.Minute
+
+// A Problem is one inconsistency found in the DB.
+type Problem struct {
+	Kind string
+	// Table is where the problem was found.
+	Table string
+	// Key identifies the row, usually by uuid.
+	Key    string
+	Detail string
+	// Fix describes the repair. It's empty if there isn't one; those
+	// problems need a person to look at them.
+	Fix string
+	// Fixed says whether or not the repair was made.
+	Fixed bool
+
+	repair func(ctx context.Context, now time.Time) error
+}
+
+// Run looks for problems. If fix is true, then it also repairs what it can,
+// each repair in its own transaction. The now argument is the reference time
+// for finding timestamps in the future.
+func Run(ctx context.Context, fix bool, now time.Time) (out []Problem, err error) {
+	now = now.UTC()
+	checks := []func(context.Context, time.Time) ([]Problem, error){
+		findOrphanedItems,
+		findDuplicateEmails,
+		findEmptyContentTypes,
+		findEmptyContent,
+		findInvalidUUIDs,
+		findFutureTimestamps,
+	}
+	for _, check := range checks {
+		var found []Problem
+		if found, err = check(ctx, now); err != nil {
+			return
+		}
+		out = append(out, found...)
+	}
+	if !fix {
+		return
+	}
+	for i, problem := range out {
+		if problem.repair == nil {
+			continue
+		}
+		if err = db.WithTx(ctx, func(ctx context.Context) error {
+			return problem.repair(ctx, now)
+		}); err != nil {
+			err = fmt.Errorf("could not fix %s %s in %s; %v", problem.Kind, problem.Key, problem.Table, err)
+			return
+		}
+		out[i].Fixed = true
+	}
+	return
+}
+
+func findOrphanedItems(ctx context.Context, now time.Time) (out []Problem, err error) {
+	err = db.SelectMany(ctx, func(row db.Iterator) (e error) {
+		var itemUUID, userUUID string
+		if e = row.Scan(&itemUUID, &userUUID); e != nil {
+			return
+		}
+		out = append(out, quarantine(KindOrphanedItem, itemUUID, "user "+userUUID+" does not exist"))
+		return
+	}, `SELECT i.uuid, i.user_uuid FROM items i
+		LEFT JOIN users u ON u.uuid = i.user_uuid
+		WHERE u.uuid IS NULL AND i.uuid IS NOT NULL`)
+	return
+}
+
+func findDuplicateEmails(ctx context.Context, now time.Time) (out []Problem, err error) {
+	err = db.SelectMany(ctx, func(row db.Iterator) (e error) {
+		var email string
+		var count int
+		if e = row.Scan(&email, &count); e != nil {
+			return
+		}
+		out = append(out, Problem{
+			Kind:   KindDuplicateEmail,
+			Table:  "users",
+			Key:    email,
+			Detail: strconv.Itoa(count) + " accounts have this email address, ignoring case",
+		})
+		return
+	}, `SELECT LOWER(email), COUNT(*) FROM users GROUP BY LOWER(email) HAVING COUNT(*) > 1`)
+	return
+}
+
+func findEmptyContentTypes(ctx context.Context, now time.Time) (out []Problem, err error) {
+	err = db.SelectMany(ctx, func(row db.Iterator) (e error) {
+		var itemUUID string
+		if e = row.Scan(&itemUUID); e != nil {
+			return
+		}
+		out = append(out, quarantine(KindEmptyContentType, itemUUID, "content_type is empty"))
+		return
+	}, `SELECT uuid FROM items WHERE content_type = '' AND uuid IS NOT NULL`)
+	return
+}
+
+func findEmptyContent(ctx context.Context, now time.Time) (out []Problem, err error) {
+	err = db.SelectMany(ctx, func(row db.Iterator) (e error) {
+		var itemUUID string
+		if e = row.Scan(&itemUUID); e != nil {
+			return
+		}
+		out = append(out, Problem{
+			Kind:   KindEmptyContent,
+			Table:  "items",
+			Key:    itemUUID,
+			Detail: "item is not deleted, but its content is empty",
+			Fix:    "mark deleted",
+			repair: func(ctx context.Context, now time.Time) error {
+				return db.Exec(
+					ctx,
+					`UPDATE items SET enc_item_key='', auth_hash='', deleted=?, updated_at=? WHERE uuid=?`,
+					true, now, itemUUID,
+				)
+			},
+		})
+		return
+	}, `SELECT uuid FROM items WHERE deleted = ? AND content = '' AND content_type <> '' AND uuid IS NOT NULL`, false)
+	return
+}
+
+func findInvalidUUIDs(ctx context.Context, now time.Time) (out []Problem, err error) {
+	if err = db.SelectMany(ctx, func(row db.Iterator) (e error) {
+		var userUUID sql.NullString
+		if e = row.Scan(&userUUID); e != nil {
+			return
+		}
+		if !validUUID(userUUID.String) {
+			out = append(out, Problem{
+				Kind:   KindInvalidUUID,
+				Table:  "users",
+				Key:    userUUID.String,
+				Detail: "uuid is not a valid UUID",
+			})
+		}
+		return
+	}, `SELECT uuid FROM users`); err != nil {
+		return
+	}
+	err = db.SelectMany(ctx, func(row db.Iterator) (e error) {
+		var itemUUID sql.NullString
+		if e = row.Scan(&itemUUID); e != nil {
+			return
+		}
+		if validUUID(itemUUID.String) {
+			return
+		}
+		if !itemUUID.Valid {
+			// Without a uuid, nothing can refer to it, including a fix.
+			out = append(out, Problem{Kind: KindInvalidUUID, Table: "items", Detail: "uuid is NULL"})
+			return
+		}
+		out = append(out, quarantine(KindInvalidUUID, itemUUID.String, "uuid is not a valid UUID"))
+		return
+	}, `SELECT uuid FROM items`)
+	return
+}
+
+func validUUID(in string) bool {
+	_, err := uuid.Parse(in)
+	return err == nil && len(in) == 36
+}
+
+func findFutureTimestamps(ctx context.Context, now time.Time) (out []Problem, err error) {
+	limit := now.Add(_ClockSkew)
+	for _, table := range []string{"users", "items"} {
+		table := table
+		if err = db.SelectMany(ctx, func(row db.Iterator) (e error) {
+			var key string
+			var createdAt, updatedAt sql.NullTime
+			if e = row.Scan(&key, &createdAt, &updatedAt); e != nil {
+				return
+			}
+			out = append(out, Problem{
+				Kind:  KindFutureTimestamp,
+				Table: table,
+				Key:   key,
+				Detail: fmt.Sprintf(
+					"created_at %s, updated_at %s",
+					createdAt.Time.UTC().Format(time.RFC3339), updatedAt.Time.UTC().Format(time.RFC3339),
+				),
+				Fix: "set future timestamps to now",
+				repair: func(ctx context.Context, now time.Time) (err error) {
+					// The table name comes from the list above, not input.
+					if err = db.Exec(
+						ctx, `UPDATE `+table+` SET created_at=? WHERE uuid=? AND created_at > ?`, now, key, limit,
+					); err != nil {
+						return
+					}
+					err = db.Exec(
+						ctx, `UPDATE `+table+` SET updated_at=? WHERE uuid=? AND updated_at > ?`, now, key, limit,
+					)
+					return
+				},
+			})
+			return
+		}, `SELECT uuid, created_at, updated_at FROM `+table+`
+			WHERE (created_at > ? OR updated_at > ?) AND uuid IS NOT NULL`, limit, limit); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// quarantine makes a Problem with an item that is fixed by moving it to the
+// quarantined_items table.
+func quarantine(kind, itemUUID, detail string) Problem {
+	return Problem{
+		Kind:   kind,
+		Table:  "items",
+		Key:    itemUUID,
+		Detail: detail,
+		Fix:    "quarantine",
+		repair: func(ctx context.Context, now time.Time) (err error) {
+			if err = db.Exec(
+				ctx,
+				strings.TrimSpace(`
+				INSERT INTO quarantined_items (
+					uuid, user_uuid, content, content_type, enc_item_key, auth_hash, deleted,
+					created_at, updated_at, reason
+				)
+				SELECT uuid, user_uuid, content, content_type, enc_item_key, auth_hash, deleted,
+					created_at, updated_at, CAST(? AS TEXT)
+				FROM items WHERE uuid = ?`),
+				kind+": "+detail, itemUUID,
+			); err != nil {
+				return
+			}
+			err = db.Exec(ctx, `DELETE FROM items WHERE uuid = ?`, itemUUID)
+			return
+		},
+	}
+}
@@ -0,0 +1,153 @@
+package check_test
+
+import (
+	"context"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rafaelespinoza/standardnotes/internal/check"
+	"github.com/rafaelespinoza/standardnotes/internal/db"
+	"github.com/rafaelespinoza/standardnotes/internal/db/dbtest"
+)
+
+func TestMain(m *testing.M) {
+	dbtest.Init()
+	os.Exit(m.Run())
+}
+
+const (
+	goodUser     = "6f0c3b9e-8d55-4b8e-9b2e-1f1f5d0b8a01"
+	dupeUser     = "6f0c3b9e-8d55-4b8e-9b2e-1f1f5d0b8a02"
+	badUser      = "not-a-uuid-user"
+	missingUser  = "6f0c3b9e-8d55-4b8e-9b2e-1f1f5d0b8a03"
+	goodItem     = "0b5e7c1a-27d4-4c61-8a1e-7f3d9c2b4e01"
+	orphanItem   = "0b5e7c1a-27d4-4c61-8a1e-7f3d9c2b4e02"
+	noTypeItem   = "0b5e7c1a-27d4-4c61-8a1e-7f3d9c2b4e03"
+	emptyItem    = "0b5e7c1a-27d4-4c61-8a1e-7f3d9c2b4e04"
+	futureItem   = "0b5e7c1a-27d4-4c61-8a1e-7f3d9c2b4e05"
+	badUUIDItem  = "not-a-uuid-item"
+	futureOffset = 24 * time.Hour
+)
+
+func TestRun(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now().UTC().Truncate(time.Second)
+	insertUser := func(t *testing.T, id, email string) {
+		t.Helper()
+		if err := db.Exec(
+			ctx,
+			`INSERT INTO users (uuid, email, password, pw_func, pw_alg, pw_cost, pw_key_size, pw_nonce, pw_salt, created_at, updated_at)
+			VALUES (?,?,?,?,?,?,?,?,?,?,?)`,
+			id, email, "password", "pbkdf2", "sha512", 110000, 512, "nonce", "salt", now, now,
+		); err != nil {
+			t.Fatal(err)
+		}
+	}
+	insertItem := func(t *testing.T, id, userUUID, content, contentType string, updatedAt time.Time) {
+		t.Helper()
+		if err := db.Exec(
+			ctx,
+			`INSERT INTO items (uuid, user_uuid, content, content_type, enc_item_key, auth_hash, deleted, created_at, updated_at)
+			VALUES (?,?,?,?,?,?,?,?,?)`,
+			id, userUUID, content, contentType, "key", "hash", false, now, updatedAt,
+		); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// duplicate emails are only possible from before the unique index.
+	if err := db.MigrateTo(12); err != nil {
+		t.Fatal(err)
+	}
+	insertUser(t, goodUser, "check@example.com")
+	insertUser(t, dupeUser, "CHECK@example.com")
+	insertUser(t, badUser, "bad@example.com")
+	insertItem(t, goodItem, goodUser, "alpha", "Note", now)
+	insertItem(t, orphanItem, missingUser, "alpha", "Note", now)
+	insertItem(t, noTypeItem, goodUser, "alpha", "", now)
+	insertItem(t, emptyItem, goodUser, "", "Note", now)
+	insertItem(t, futureItem, goodUser, "alpha", "Note", now.Add(futureOffset))
+	insertItem(t, badUUIDItem, goodUser, "alpha", "Note", now)
+
+	t.Run("ok", func(t *testing.T) {
+		problems, err := check.Run(ctx, false, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := []string{
+			check.KindDuplicateEmail + " check@example.com",
+			check.KindEmptyContent + " " + emptyItem,
+			check.KindEmptyContentType + " " + noTypeItem,
+			check.KindFutureTimestamp + " " + futureItem,
+			check.KindInvalidUUID + " " + badUUIDItem,
+			check.KindInvalidUUID + " " + badUser,
+			check.KindOrphanedItem + " " + orphanItem,
+		}
+		checkProblems(t, problems, expected)
+		for _, problem := range problems {
+			if problem.Fixed {
+				t.Errorf("%s %s; should not be fixed without fix mode", problem.Kind, problem.Key)
+			}
+		}
+	})
+
+	t.Run("fix", func(t *testing.T) {
+		problems, err := check.Run(ctx, true, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, problem := range problems {
+			if problem.Fixed != (problem.Fix != "") {
+				t.Errorf("%s %s; wrong Fixed value %t", problem.Kind, problem.Key, problem.Fixed)
+			}
+		}
+
+		// only the problems that need a person are left.
+		if problems, err = check.Run(ctx, false, now); err != nil {
+			t.Fatal(err)
+		}
+		checkProblems(t, problems, []string{
+			check.KindDuplicateEmail + " check@example.com",
+			check.KindInvalidUUID + " " + badUser,
+		})
+
+		var quarantined []string
+		if err = db.SelectMany(ctx, func(row db.Iterator) error {
+			var id string
+			if err := row.Scan(&id); err != nil {
+				return err
+			}
+			quarantined = append(quarantined, id)
+			return nil
+		}, `SELECT uuid FROM quarantined_items ORDER BY uuid`); err != nil {
+			t.Fatal(err)
+		}
+		expected := []string{orphanItem, noTypeItem, badUUIDItem}
+		sort.Strings(expected)
+		if strings.Join(quarantined, ",") != strings.Join(expected, ",") {
+			t.Errorf("wrong quarantined items;\ngot %v\nexp %v", quarantined, expected)
+		}
+
+		var deleted bool
+		if _, err = db.SelectExists(ctx, &deleted, `SELECT deleted FROM items WHERE uuid = ?`, emptyItem); err != nil {
+			t.Fatal(err)
+		} else if !deleted {
+			t.Error("expected item with empty content to be marked deleted")
+		}
+	})
+}
+
+func checkProblems(t *testing.T, problems []check.Problem, expected []string) {
+	t.Helper()
+	got := make([]string, len(problems))
+	for i, problem := range problems {
+		got[i] = problem.Kind + " " + problem.Key
+	}
+	sort.Strings(got)
+	sort.Strings(expected)
+	if strings.Join(got, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("wrong problems;\ngot\n\t%s\nexpected\n\t%s", strings.Join(got, "\n\t"), strings.Join(expected, "\n\t"))
+	}
+}
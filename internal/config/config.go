@@ -1,21 +1,305 @@
 package config
 
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+)
+
 type Config struct {
-	DB      string `json:"db"`
-	Debug   bool   `json:"debug"`
-	Host    string `json:"host"`
-	NoReg   bool   `json:"noreg"`
-	Port    int    `json:"port"`
-	Socket  string `json:"socket"`
-	UseCORS bool   `json:"cors"`
+	// DB is the path to the database file for SQLite, or the connection
+	// string for Postgres.
+	DB       string `json:"db"`
+	DBDriver string `json:"db_driver"`
+	Debug    bool   `json:"debug"`
+	Host     string `json:"host"`
+	NoReg    bool   `json:"noreg"`
+	Port     int    `json:"port"`
+	Socket   string `json:"socket"`
+	UseCORS  bool   `json:"cors"`
+	// AutoMigrate says whether or not the api server should apply pending
+	// schema migrations when it starts. If false, then the server refuses to
+	// start until the schema is migrated with the migrate command.
+	AutoMigrate bool `json:"auto_migrate"`
+	// DBTimeoutSeconds limits how long any one database query may take while
+	// serving requests. Set to 0 for no limit.
+	DBTimeoutSeconds int    `json:"db_timeout_seconds"`
+	SQLite           SQLite `json:"sqlite"`
+	// AdminToken authorizes requests to the "/admin/" routes, which are only
+	// served if it's set. Pass it as a bearer token.
+	AdminToken string `json:"admin_token"`
+	// ParamsSecret keys the made-up auth params that "/auth/params" responds
+	// with for unregistered email addresses, so that they're the same every
+	// time and can't be told apart from real ones. If empty, then the
+	// SECRET_KEY_BASE environment variable is the secret.
+	ParamsSecret string `json:"params_secret"`
+	// PublicURL is the externally-facing base URL of this server. It's used
+	// for building links sent to users, such as email verification links. If
+	// empty, then it's derived from Host and Port.
+	PublicURL    string       `json:"public_url"`
+	Mail         Mail         `json:"mail"`
+	Verification Verification `json:"verification"`
+	Lockout      Lockout      `json:"lockout"`
+	Webhooks     []Webhook    `json:"webhooks"`
+	Outbound     Outbound     `json:"outbound"`
+	Extensions   Extensions   `json:"extensions"`
+	Backups      Backups      `json:"backups"`
+	Quotas       Quotas       `json:"quotas"`
+	Tokens       Tokens       `json:"tokens"`
+
+	// Ephemeral runs the api server with an in-memory SQLite database, which
+	// is discarded when the server stops. It's set by the -ephemeral flag of
+	// the api command, not by the config file.
+	Ephemeral bool `json:"-"`
+	// Seed is the path to a database snapshot, as written by the backup
+	// command, to load into the database in ephemeral mode.
+	Seed string `json:"-"`
+}
+
+// String formats the Config like "%+v" would, but with its secrets redacted,
+// so that it's safe to log.
+func (c Config) String() string {
+	c.DB = redactDSN(c.DB)
+	c.AdminToken = redact(c.AdminToken)
+	c.ParamsSecret = redact(c.ParamsSecret)
+	c.Mail.Password = redact(c.Mail.Password)
+	c.Backups.Destination.Password = redact(c.Backups.Destination.Password)
+	c.Backups.Destination.URL = redactDSN(c.Backups.Destination.URL)
+	webhooks := make([]Webhook, len(c.Webhooks))
+	for i, hook := range c.Webhooks {
+		hook.Secret = redact(hook.Secret)
+		webhooks[i] = hook
+	}
+	c.Webhooks = webhooks
+	type plain Config // without the String method, so that it's not recursive.
+	return fmt.Sprintf("%+v", plain(c))
+}
+
+const _Redacted = "REDACTED"
+
+func redact(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return _Redacted
+}
+
+// _DSNPassword matches the password of a key=value connection string.
+var _DSNPassword = regexp.MustCompile(`(?i)(password\s*=\s*)('[^']*'|\S+)`)
+
+// redactDSN hides the password of a URL, or of a key=value connection string.
+func redactDSN(dsn string) string {
+	if u, err := url.Parse(dsn); err == nil && u.User != nil {
+		if _, ok := u.User.Password(); ok {
+			u.User = url.UserPassword(u.User.Username(), _Redacted)
+		}
+		return u.String()
+	}
+	return _DSNPassword.ReplaceAllString(dsn, "${1}"+_Redacted)
+}
+
+// SQLite tunes SQLite connections. It's ignored by other drivers.
+type SQLite struct {
+	// JournalMode is the journal_mode pragma. In "WAL" mode, reads don't
+	// block writes and writes don't block reads.
+	JournalMode string `json:"journal_mode"`
+	// BusyTimeoutMS is how long a connection waits on a lock held by another
+	// connection before giving up with a "database is locked" error.
+	BusyTimeoutMS int `json:"busy_timeout_ms"`
+	// Synchronous is the synchronous pragma. "NORMAL" is safe in WAL mode.
+	Synchronous string `json:"synchronous"`
+	// MaxOpenConns limits the number of open connections used for reads. Set
+	// to 0 for no limit.
+	MaxOpenConns int `json:"max_open_conns"`
+	// MaxIdleConns is the number of connections to keep around for reuse.
+	MaxIdleConns int `json:"max_idle_conns"`
+	// SingleWriter sends all writes through one dedicated connection, so
+	// they wait their turn in the program rather than fighting over the
+	// database file lock.
+	SingleWriter bool `json:"single_writer"`
+}
+
+// Mail configures outgoing email. If Host is empty, then messages are not
+// delivered; they're only logged in debug mode.
+type Mail struct {
+	Host     string `json:"host"`
+	Port     int    `json:"port"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	From     string `json:"from"`
+}
+
+// Verification configures email address verification for new accounts.
+type Verification struct {
+	// Required says whether or not a new account must verify its email
+	// address before it can sign in.
+	Required bool `json:"required"`
+	// ExpiryHours is how long a verification link is valid.
+	ExpiryHours int `json:"expiry_hours"`
+}
+
+// Lockout configures how repeated sign in failures are handled.
+type Lockout struct {
+	// MaxAttempts is the number of consecutive failed sign in attempts for an
+	// email address before it's locked out. Set to 0 to disable lockouts,
+	// which is the default. Failures are counted per address, whoever makes
+	// them, so anybody who knows an address can keep its user locked out.
+	MaxAttempts int `json:"max_attempts"`
+	// Minutes is how long a lockout lasts.
+	Minutes int `json:"minutes"`
+}
+
+// Webhook is an outbound HTTP endpoint that is notified of server events.
+type Webhook struct {
+	URL string `json:"url"`
+	// Secret is the key for signing request bodies so the receiver can check
+	// that a delivery came from this server.
+	Secret string `json:"secret"`
+	// Events limits deliveries to these event names. If empty, then every
+	// event is delivered.
+	Events []string `json:"events"`
+}
+
+// Outbound restricts HTTP requests made to URLs that come from user content,
+// such as extension URLs. By default, loopback, link-local, private and cloud
+// metadata addresses are blocked.
+type Outbound struct {
+	// Allow lists hostnames or CIDR ranges that are permitted even if they
+	// would otherwise be blocked.
+	Allow []string `json:"allow"`
+	// Deny lists more hostnames or CIDR ranges to block.
+	Deny []string `json:"deny"`
+	// MaxResponseBytes caps the size of a response body.
+	MaxResponseBytes int64 `json:"max_response_bytes"`
+	// TimeoutSeconds limits the duration of a whole request.
+	TimeoutSeconds int `json:"timeout_seconds"`
+}
+
+// Extensions configures how deliveries to failing extensions are backed off.
+type Extensions struct {
+	// FailureThreshold is the number of consecutive failed deliveries to an
+	// extension before deliveries are suspended.
+	FailureThreshold int `json:"failure_threshold"`
+	// BackoffMinutes is how long the first suspension lasts. Each subsequent
+	// failure doubles it.
+	BackoffMinutes int `json:"backoff_minutes"`
+	// MaxBackoffHours caps the length of a suspension.
+	MaxBackoffHours int `json:"max_backoff_hours"`
+}
+
+// Backups configures scheduled, server-side backups of every user's account.
+type Backups struct {
+	// IntervalHours is the time between backups. Set to 0 to disable them.
+	IntervalHours int `json:"interval_hours"`
+	// Retain is the number of backups to keep per user. Older ones are
+	// removed after each backup.
+	Retain      int               `json:"retain"`
+	Destination BackupDestination `json:"destination"`
+}
+
+// Quotas limit how much each user can store. The embedded Quota is the
+// default for everyone.
+type Quotas struct {
+	Quota
+	// Users overrides the default Quota for some users, keyed by user UUID.
+	Users map[string]Quota `json:"users"`
+}
+
+// A Quota limits how much one user can store. Deleted items don't count. A
+// limit of 0 means no limit.
+type Quota struct {
+	MaxItems int `json:"max_items"`
+	// MaxBytes limits the total length of item contents.
+	MaxBytes int64 `json:"max_bytes"`
+}
+
+// For returns the Quota of a user.
+func (q Quotas) For(userUUID string) Quota {
+	if quota, ok := q.Users[userUUID]; ok {
+		return quota
+	}
+	return q.Quota
+}
+
+// Tokens configures the tokens issued to signed in sessions.
+type Tokens struct {
+	// AccessMinutes is how long an access token is valid.
+	AccessMinutes int `json:"access_minutes"`
+	// RefreshDays is how long a refresh token is valid. Each refresh token is
+	// used once, to get a new access token and a new refresh token.
+	RefreshDays int `json:"refresh_days"`
+	// Legacy also issues a token that doesn't expire, and accepts such tokens,
+	// for clients that don't know about refresh tokens.
+	Legacy bool `json:"legacy"`
+	// KeysFile is the path to the keys that sign tokens, as written by the
+	// keys command. If empty, then the SECRET_KEY_BASE environment variable
+	// is the key.
+	KeysFile string `json:"keys_file"`
+	// Alg is the signing algorithm of new keys: "HS256", "EdDSA" or "RS256".
+	// With EdDSA or RS256, other services can verify tokens with the public
+	// keys served at "/.well-known/jwks.json".
+	Alg string `json:"alg"`
+}
+
+// BackupDestination says where to write backups.
+type BackupDestination struct {
+	// Type is either "local" or "webdav".
+	Type string `json:"type"`
+	// Path is the directory for local backups.
+	Path string `json:"path"`
+	// URL is the collection for WebDAV backups.
+	URL      string `json:"url"`
+	Username string `json:"username"`
+	Password string `json:"password"`
 }
 
 var Conf = Config{
-	DB:      "sf.db",
-	Debug:   false,
-	NoReg:   false,
-	Port:    8888,
-	UseCORS: false,
+	DB:               "sf.db",
+	Debug:            false,
+	NoReg:            false,
+	Port:             8888,
+	UseCORS:          false,
+	DBTimeoutSeconds: 10,
+	SQLite: SQLite{
+		JournalMode:   "WAL",
+		BusyTimeoutMS: 5000,
+		Synchronous:   "NORMAL",
+		MaxOpenConns:  0,
+		MaxIdleConns:  4,
+		SingleWriter:  true,
+	},
+	Mail: Mail{
+		Port: 587,
+		From: "standardnotes@localhost",
+	},
+	Verification: Verification{
+		Required:    false,
+		ExpiryHours: 24,
+	},
+	Lockout: Lockout{
+		MaxAttempts: 0,
+		Minutes:     15,
+	},
+	Outbound: Outbound{
+		MaxResponseBytes: 1 << 20,
+		TimeoutSeconds:   15,
+	},
+	Extensions: Extensions{
+		FailureThreshold: 5,
+		BackoffMinutes:   5,
+		MaxBackoffHours:  24,
+	},
+	Backups: Backups{
+		IntervalHours: 0,
+		Retain:        7,
+		Destination:   BackupDestination{Type: "local", Path: "backups"},
+	},
+	Tokens: Tokens{
+		AccessMinutes: 60,
+		RefreshDays:   30,
+		Legacy:        true,
+		Alg:           "HS256",
+	},
 }
 
 var Metadata = struct {
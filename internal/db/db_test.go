@@ -0,0 +1,197 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rafaelespinoza/standardnotes/internal/config"
+)
+
+func TestRebind(t *testing.T) {
+	tests := []struct {
+		driver   string
+		input    string
+		expected string
+	}{
+		{
+			driver:   DriverSQLite,
+			input:    "SELECT * FROM items WHERE uuid=? AND user_uuid=?",
+			expected: "SELECT * FROM items WHERE uuid=? AND user_uuid=?",
+		},
+		{
+			driver:   DriverPostgres,
+			input:    "SELECT * FROM items WHERE uuid=? AND user_uuid=?",
+			expected: "SELECT * FROM items WHERE uuid=$1 AND user_uuid=$2",
+		},
+		{
+			driver:   DriverPostgres,
+			input:    "UPDATE items SET content='?', deleted=? WHERE uuid=?",
+			expected: "UPDATE items SET content='?', deleted=$1 WHERE uuid=$2",
+		},
+		{
+			driver:   DriverPostgres,
+			input:    "INSERT INTO users (uuid, email) VALUES (?,?)",
+			expected: "INSERT INTO users (uuid, email) VALUES ($1,$2)",
+		},
+	}
+	for i, test := range tests {
+		got := Database{driver: test.driver}.rebind(test.input)
+		if got != test.expected {
+			t.Errorf("test [%d]\ngot %q\nexp %q", i, got, test.expected)
+		}
+	}
+}
+
+func TestMigrationsMatch(t *testing.T) {
+	if len(sqliteMigrations) != len(postgresMigrations) {
+		t.Fatalf(
+			"drivers have different numbers of migrations; sqlite: %d, postgres: %d",
+			len(sqliteMigrations), len(postgresMigrations),
+		)
+	}
+	for i, lite := range sqliteMigrations {
+		pg := postgresMigrations[i]
+		if lite.Version != i+1 || pg.Version != i+1 {
+			t.Errorf("migration [%d]; versions should be %d; sqlite: %d, postgres: %d", i, i+1, lite.Version, pg.Version)
+		}
+		if lite.Name != pg.Name {
+			t.Errorf("migration [%d]; names differ; sqlite: %q, postgres: %q", i, lite.Name, pg.Name)
+		}
+		if pg.Up == "" || pg.Down == "" || lite.Up == "" || lite.Down == "" {
+			t.Errorf("migration [%d]; up and down should not be empty", i)
+		}
+	}
+}
+
+func TestWithTx(t *testing.T) {
+	if err := Open(":memory:"); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if err := Exec(ctx, "CREATE TABLE things (name VARCHAR(32) NOT NULL)"); err != nil {
+		t.Fatal(err)
+	}
+	countThings := func(t *testing.T) (n int) {
+		t.Helper()
+		if _, err := SelectExists(ctx, &n, "SELECT COUNT(*) FROM things"); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	t.Run("ok", func(t *testing.T) {
+		err := WithTx(ctx, func(ctx context.Context) error {
+			if err := Exec(ctx, "INSERT INTO things (name) VALUES (?)", "alpha"); err != nil {
+				return err
+			}
+			// a nested call joins the outer transaction.
+			return WithTx(ctx, func(ctx context.Context) error {
+				return Exec(ctx, "INSERT INTO things (name) VALUES (?)", "bravo")
+			})
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n := countThings(t); n != 2 {
+			t.Errorf("wrong number of rows; got %d, expected %d", n, 2)
+		}
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		before := countThings(t)
+		errTest := errors.New("test")
+		err := WithTx(ctx, func(ctx context.Context) error {
+			if err := Exec(ctx, "INSERT INTO things (name) VALUES (?)", "charlie"); err != nil {
+				return err
+			}
+			return errTest
+		})
+		if err != errTest {
+			t.Errorf("wrong error; got %v, expected %v", err, errTest)
+		}
+		if n := countThings(t); n != before {
+			t.Errorf("expected rollback; got %d rows, expected %d", n, before)
+		}
+
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Error("expected panic to be re-raised")
+				}
+			}()
+			WithTx(ctx, func(ctx context.Context) error {
+				if err := Exec(ctx, "INSERT INTO things (name) VALUES (?)", "delta"); err != nil {
+					return err
+				}
+				panic("test")
+			})
+		}()
+		if n := countThings(t); n != before {
+			t.Errorf("expected rollback after panic; got %d rows, expected %d", n, before)
+		}
+	})
+}
+
+func TestQueryCanceled(t *testing.T) {
+	if err := Open(":memory:"); err != nil {
+		t.Fatal(err)
+	}
+	const endless = `WITH RECURSIVE c(x) AS (SELECT 1 UNION ALL SELECT x+1 FROM c) SELECT COUNT(*) FROM c`
+
+	t.Run("canceled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		var n int
+		if _, err := SelectExists(ctx, &n, "SELECT 1"); !errors.Is(err, context.Canceled) {
+			t.Errorf("wrong error; got %v, expected %v", err, context.Canceled)
+		}
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		SetQueryTimeout(50 * time.Millisecond)
+		defer SetQueryTimeout(0)
+		var n int
+		done := make(chan error, 1)
+		go func() {
+			_, err := SelectExists(context.Background(), &n, endless)
+			done <- err
+		}()
+		select {
+		case err := <-done:
+			if err == nil {
+				t.Error("expected error")
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("query was not interrupted")
+		}
+	})
+}
+
+func TestOpenDriverSQLiteConf(t *testing.T) {
+	dir := t.TempDir()
+	journalMode := func(t *testing.T) (mode string) {
+		t.Helper()
+		if _, err := SelectExists(context.Background(), &mode, "PRAGMA journal_mode"); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	// the global config says WAL, but only conf should count.
+	if err := OpenDriver(DriverSQLite, filepath.Join(dir, "default.db"), config.SQLite{}); err != nil {
+		t.Fatal(err)
+	}
+	if mode := journalMode(t); mode != "delete" {
+		t.Errorf("wrong journal mode; got %q, expected %q", mode, "delete")
+	}
+
+	if err := OpenDriver(DriverSQLite, filepath.Join(dir, "wal.db"), config.SQLite{JournalMode: "WAL"}); err != nil {
+		t.Fatal(err)
+	}
+	if mode := journalMode(t); mode != "wal" {
+		t.Errorf("wrong journal mode; got %q, expected %q", mode, "wal")
+	}
+}
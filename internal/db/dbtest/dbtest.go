@@ -0,0 +1,37 @@
+// Package dbtest sets up a database for tests. By default, it's an in-memory
+// SQLite database. To run tests against another database, set these
+// environment variables:
+//
+//	DB_DRIVER_TEST  a driver name, such as "postgres"
+//	DB_DSN_TEST     the connection string or path for that driver
+//
+// The schema of that database is dropped and recreated, so don't point it at
+// anything you want to keep.
+package dbtest
+
+import (
+	"os"
+
+	"github.com/rafaelespinoza/standardnotes/internal/config"
+	"github.com/rafaelespinoza/standardnotes/internal/db"
+)
+
+// Init opens the test database and resets its schema to the latest version.
+func Init() {
+	driver, dsn := os.Getenv("DB_DRIVER_TEST"), os.Getenv("DB_DSN_TEST")
+	if driver == "" || driver == db.DriverSQLite {
+		driver = db.DriverSQLite
+		if dsn == "" {
+			dsn = ":memory:"
+		}
+	}
+	if err := db.OpenDriver(driver, dsn, config.Conf.SQLite); err != nil {
+		panic(err)
+	}
+	if err := db.MigrateTo(0); err != nil {
+		panic(err)
+	}
+	if err := db.MigrateTo(db.LatestVersion()); err != nil {
+		panic(err)
+	}
+}
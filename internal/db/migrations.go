@@ -0,0 +1,179 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+)
+
+// A Migration is one numbered change to the schema. Versions start at 1 and
+// increase by 1. The Up and Down statements of a migration run in the same
+// transaction as the bookkeeping in the schema_migrations table, so a failed
+// migration leaves the schema as it was.
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// MigrationStatus says whether or not a Migration has been applied.
+type MigrationStatus struct {
+	Migration
+	Applied   bool
+	AppliedAt time.Time
+}
+
+const migrationsTable = `
+CREATE TABLE IF NOT EXISTS "schema_migrations" (
+    "version" integer primary key NOT NULL,
+    "name" varchar(255) NOT NULL,
+    "applied_at" timestamp DEFAULT CURRENT_TIMESTAMP NOT NULL);
+`
+
+// migrations is the whole history of the schema for the open DB connection.
+// Each driver has its own list, but they must have the same versions and names.
+// Append new migrations to the end of each list; never edit one that has been
+// released.
+func migrations() []Migration {
+	if database.driver == DriverPostgres {
+		return postgresMigrations
+	}
+	return sqliteMigrations
+}
+
+// LatestVersion is the version of the newest known migration.
+func LatestVersion() int {
+	known := migrations()
+	return known[len(known)-1].Version
+}
+
+// SchemaVersion is the version of the newest applied migration. It's 0 when no
+// migrations have been applied.
+func SchemaVersion() (version int, err error) {
+	if err = ensureMigrationsTable(); err != nil {
+		return
+	}
+	err = database.db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&version)
+	return
+}
+
+// EnsureSchema makes sure that the schema is at the latest version. An
+// outdated schema is migrated only if autoMigrate is set; otherwise it's an
+// error, as is a schema newer than this program supports.
+func EnsureSchema(autoMigrate bool) (err error) {
+	var version int
+	if version, err = SchemaVersion(); err != nil {
+		return
+	}
+	latest := LatestVersion()
+	if version > latest {
+		err = fmt.Errorf("schema version %d is newer than this program supports (%d)", version, latest)
+		return
+	} else if version == latest {
+		return
+	}
+	if !autoMigrate {
+		err = fmt.Errorf(
+			"schema version %d is outdated, latest is %d; run the migrate command or enable auto_migrate",
+			version, latest,
+		)
+		return
+	}
+	err = MigrateTo(latest)
+	return
+}
+
+// Migrations lists every known migration along with whether or not it has been
+// applied, in order of version.
+func Migrations() (out []MigrationStatus, err error) {
+	if err = ensureMigrationsTable(); err != nil {
+		return
+	}
+	applied := make(map[int]time.Time)
+	err = SelectMany(
+		context.Background(),
+		func(row Iterator) (err error) {
+			var version int
+			var appliedAt time.Time
+			if err = row.Scan(&version, &appliedAt); err != nil {
+				return
+			}
+			applied[version] = appliedAt
+			return
+		},
+		`SELECT version, applied_at FROM schema_migrations`,
+	)
+	if err != nil {
+		return
+	}
+	known := migrations()
+	out = make([]MigrationStatus, len(known))
+	for i, m := range known {
+		appliedAt, ok := applied[m.Version]
+		out[i] = MigrationStatus{Migration: m, Applied: ok, AppliedAt: appliedAt}
+	}
+	return
+}
+
+// MigrateTo applies or reverts migrations, one at a time, until the schema is
+// at the target version. Use 0 to revert everything, or LatestVersion to apply
+// everything.
+func MigrateTo(target int) (err error) {
+	if target < 0 || target > LatestVersion() {
+		err = fmt.Errorf("unknown schema version %d; latest is %d", target, LatestVersion())
+		return
+	}
+	var current int
+	if current, err = SchemaVersion(); err != nil {
+		return
+	}
+	if current > LatestVersion() {
+		err = fmt.Errorf("schema version %d is newer than this program knows about (%d)", current, LatestVersion())
+		return
+	}
+	known := migrations()
+	for current < target {
+		m := known[current]
+		if err = runMigration(m.Up, `INSERT INTO schema_migrations (version, name, applied_at) VALUES(?, ?, ?)`, m.Version, m.Name, time.Now().UTC()); err != nil {
+			err = fmt.Errorf("migration %d (%s) up: %v", m.Version, m.Name, err)
+			return
+		}
+		log.Printf("applied migration %d: %s\n", m.Version, m.Name)
+		current++
+	}
+	for current > target {
+		m := known[current-1]
+		if err = runMigration(m.Down, `DELETE FROM schema_migrations WHERE version = ?`, m.Version); err != nil {
+			err = fmt.Errorf("migration %d (%s) down: %v", m.Version, m.Name, err)
+			return
+		}
+		log.Printf("reverted migration %d: %s\n", m.Version, m.Name)
+		current--
+	}
+	return
+}
+
+func runMigration(statements, bookkeeping string, args ...interface{}) (err error) {
+	var tx *sql.Tx
+	if tx, err = database.writer.Begin(); err != nil {
+		return
+	}
+	if _, err = tx.Exec(statements); err != nil {
+		tx.Rollback()
+		return
+	}
+	if _, err = tx.Exec(database.rebind(bookkeeping), args...); err != nil {
+		tx.Rollback()
+		return
+	}
+	err = tx.Commit()
+	return
+}
+
+func ensureMigrationsTable() (err error) {
+	_, err = database.writer.Exec(migrationsTable)
+	return
+}
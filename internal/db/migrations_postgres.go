@@ -0,0 +1,218 @@
+package db
+
+// postgresMigrations are the migrations for Postgres. Postgres enforces column
+// lengths, so identifiers and free-form text get more room than in SQLite.
+var postgresMigrations = []Migration{
+	{
+		Version: 1,
+		Name:    "create users and items",
+		Up: `
+CREATE TABLE IF NOT EXISTS items (
+    uuid varchar(255) primary key NOT NULL,
+    user_uuid varchar(255) NOT NULL,
+    content text NOT NULL,
+    content_type varchar(255) NOT NULL,
+    enc_item_key text NOT NULL,
+    auth_hash text NOT NULL,
+    deleted boolean NOT NULL DEFAULT false,
+    created_at timestamptz DEFAULT CURRENT_TIMESTAMP NOT NULL,
+    updated_at timestamptz DEFAULT CURRENT_TIMESTAMP);
+CREATE TABLE IF NOT EXISTS users (
+    uuid varchar(255) primary key NOT NULL,
+    email varchar(255) NOT NULL,
+    password varchar(255) NOT NULL,
+    pw_func varchar(255) NOT NULL DEFAULT 'pbkdf2',
+    pw_alg varchar(255) NOT NULL DEFAULT 'sha512',
+    pw_cost integer NOT NULL DEFAULT 5000,
+    pw_key_size integer NOT NULL DEFAULT 512,
+    pw_nonce varchar(255) NOT NULL,
+    pw_salt varchar(255) NOT NULL,
+    created_at timestamptz DEFAULT CURRENT_TIMESTAMP NOT NULL,
+    updated_at timestamptz DEFAULT CURRENT_TIMESTAMP);
+CREATE INDEX IF NOT EXISTS user_uuid ON items (user_uuid);
+CREATE INDEX IF NOT EXISTS user_content ON items (user_uuid, content_type);
+CREATE INDEX IF NOT EXISTS updated_at ON items (updated_at);
+CREATE INDEX IF NOT EXISTS email ON users (email);
+`,
+		Down: `
+DROP TABLE IF EXISTS items;
+DROP TABLE IF EXISTS users;
+`,
+	},
+	{
+		Version: 2,
+		Name:    "create email_verifications",
+		Up: `
+CREATE TABLE IF NOT EXISTS email_verifications (
+    user_uuid varchar(255) primary key NOT NULL,
+    verified boolean NOT NULL DEFAULT false,
+    created_at timestamptz DEFAULT CURRENT_TIMESTAMP NOT NULL,
+    updated_at timestamptz DEFAULT CURRENT_TIMESTAMP);
+`,
+		Down: `DROP TABLE IF EXISTS email_verifications;`,
+	},
+	{
+		Version: 3,
+		Name:    "create auth_failures",
+		Up: `
+CREATE TABLE IF NOT EXISTS auth_failures (
+    email varchar(255) primary key NOT NULL,
+    failures integer NOT NULL DEFAULT 0,
+    locked_until timestamptz NOT NULL,
+    updated_at timestamptz DEFAULT CURRENT_TIMESTAMP);
+`,
+		Down: `DROP TABLE IF EXISTS auth_failures;`,
+	},
+	{
+		Version: 4,
+		Name:    "create webhook_deliveries",
+		Up: `
+CREATE TABLE IF NOT EXISTS webhook_deliveries (
+    uuid varchar(255) primary key NOT NULL,
+    event varchar(255) NOT NULL,
+    url varchar(2048) NOT NULL,
+    payload bytea NOT NULL,
+    status varchar(16) NOT NULL,
+    attempts integer NOT NULL DEFAULT 0,
+    response_code integer NOT NULL DEFAULT 0,
+    last_error text NOT NULL DEFAULT '',
+    next_attempt_at timestamptz NOT NULL,
+    created_at timestamptz DEFAULT CURRENT_TIMESTAMP NOT NULL,
+    updated_at timestamptz DEFAULT CURRENT_TIMESTAMP);
+CREATE INDEX IF NOT EXISTS webhook_pending ON webhook_deliveries (status, next_attempt_at);
+`,
+		Down: `DROP TABLE IF EXISTS webhook_deliveries;`,
+	},
+	{
+		Version: 5,
+		Name:    "create outbound_rejections",
+		Up: `
+CREATE TABLE IF NOT EXISTS outbound_rejections (
+    id bigserial primary key,
+    user_uuid varchar(255) NOT NULL,
+    url varchar(2048) NOT NULL,
+    reason text NOT NULL,
+    created_at timestamptz DEFAULT CURRENT_TIMESTAMP NOT NULL);
+`,
+		Down: `DROP TABLE IF EXISTS outbound_rejections;`,
+	},
+	{
+		Version: 6,
+		Name:    "create extension_health",
+		Up: `
+CREATE TABLE IF NOT EXISTS extension_health (
+    extension_uuid varchar(255) primary key NOT NULL,
+    user_uuid varchar(255) NOT NULL,
+    consecutive_failures integer NOT NULL DEFAULT 0,
+    last_error text NOT NULL DEFAULT '',
+    last_failure_at timestamptz NOT NULL,
+    last_success_at timestamptz NOT NULL,
+    suspended_until timestamptz NOT NULL,
+    updated_at timestamptz DEFAULT CURRENT_TIMESTAMP);
+CREATE INDEX IF NOT EXISTS extension_health_user ON extension_health (user_uuid);
+`,
+		Down: `DROP TABLE IF EXISTS extension_health;`,
+	},
+	{
+		Version: 7,
+		Name:    "create quarantined_items",
+		Up: `
+CREATE TABLE IF NOT EXISTS quarantined_items (
+    id bigserial primary key,
+    uuid varchar(255) NULL,
+    user_uuid varchar(255) NOT NULL,
+    content text NOT NULL,
+    content_type varchar(255) NOT NULL,
+    enc_item_key text NOT NULL,
+    auth_hash text NOT NULL,
+    deleted boolean NOT NULL DEFAULT false,
+    created_at timestamptz NOT NULL,
+    updated_at timestamptz NULL,
+    reason text NOT NULL,
+    quarantined_at timestamptz DEFAULT CURRENT_TIMESTAMP NOT NULL);
+`,
+		Down: `DROP TABLE IF EXISTS quarantined_items;`,
+	},
+	{
+		Version: 8,
+		Name:    "create two_factor",
+		Up: `
+CREATE TABLE IF NOT EXISTS two_factor (
+    user_uuid varchar(255) primary key NOT NULL,
+    secret varchar(255) NOT NULL,
+    enabled boolean NOT NULL DEFAULT false,
+    last_counter bigint NOT NULL DEFAULT 0,
+    created_at timestamptz DEFAULT CURRENT_TIMESTAMP NOT NULL,
+    updated_at timestamptz DEFAULT CURRENT_TIMESTAMP);
+CREATE TABLE IF NOT EXISTS recovery_codes (
+    user_uuid varchar(255) NOT NULL,
+    code_hash varchar(64) NOT NULL,
+    created_at timestamptz DEFAULT CURRENT_TIMESTAMP NOT NULL,
+    PRIMARY KEY (user_uuid, code_hash));
+`,
+		Down: `DROP TABLE IF EXISTS recovery_codes; DROP TABLE IF EXISTS two_factor;`,
+	},
+	{
+		Version: 9,
+		Name:    "create sessions",
+		Up: `
+CREATE TABLE IF NOT EXISTS sessions (
+    uuid varchar(255) primary key NOT NULL,
+    user_uuid varchar(255) NOT NULL,
+    user_agent text NOT NULL DEFAULT '',
+    ip_address varchar(45) NOT NULL DEFAULT '',
+    created_at timestamptz NOT NULL,
+    last_used_at timestamptz NOT NULL);
+CREATE INDEX IF NOT EXISTS sessions_user ON sessions (user_uuid);
+`,
+		Down: `DROP TABLE IF EXISTS sessions;`,
+	},
+	{
+		Version: 10,
+		Name:    "create refresh_tokens",
+		Up: `
+CREATE TABLE IF NOT EXISTS refresh_tokens (
+    token_hash varchar(64) primary key NOT NULL,
+    session_uuid varchar(255) NOT NULL,
+    used boolean NOT NULL DEFAULT false,
+    expires_at timestamptz NOT NULL,
+    created_at timestamptz DEFAULT CURRENT_TIMESTAMP NOT NULL);
+CREATE INDEX IF NOT EXISTS refresh_tokens_session ON refresh_tokens (session_uuid);
+`,
+		Down: `DROP TABLE IF EXISTS refresh_tokens;`,
+	},
+	{
+		Version: 11,
+		Name:    "add user_uuid to webhook_deliveries",
+		Up: `
+ALTER TABLE webhook_deliveries ADD COLUMN IF NOT EXISTS user_uuid varchar(255) NOT NULL DEFAULT '';
+UPDATE webhook_deliveries SET user_uuid = COALESCE((
+    SELECT uuid FROM users
+    WHERE convert_from(webhook_deliveries.payload, 'UTF8') LIKE '%"user_uuid":"' || users.uuid || '"%'
+    LIMIT 1), '');
+CREATE INDEX IF NOT EXISTS webhook_deliveries_user ON webhook_deliveries (user_uuid);
+`,
+		Down: `
+DROP INDEX IF EXISTS webhook_deliveries_user;
+ALTER TABLE webhook_deliveries DROP COLUMN IF EXISTS user_uuid;
+`,
+	},
+	{
+		Version: 12,
+		Name:    "create revoked_sessions",
+		Up: `
+CREATE TABLE IF NOT EXISTS revoked_sessions (
+    uuid varchar(255) primary key NOT NULL,
+    user_uuid varchar(255) NOT NULL,
+    revoked_at timestamptz NOT NULL);
+CREATE INDEX IF NOT EXISTS revoked_sessions_user ON revoked_sessions (user_uuid);
+`,
+		Down: `DROP TABLE IF EXISTS revoked_sessions;`,
+	},
+	{
+		Version: 13,
+		Name:    "add unique index on lowercase users email",
+		Up:      `CREATE UNIQUE INDEX IF NOT EXISTS users_email_lower ON users (LOWER(email));`,
+		Down:    `DROP INDEX IF EXISTS users_email_lower;`,
+	},
+}
@@ -0,0 +1,242 @@
+package db
+
+// sqliteMigrations are the migrations for SQLite.
+//
+// The tables in the first few migrations existed before migrations were
+// tracked, so they are created only if they don't already exist. That way, a
+// database made by an older version of this program can be brought under
+// version control by running them.
+var sqliteMigrations = []Migration{
+	{
+		Version: 1,
+		Name:    "create users and items",
+		Up: `
+CREATE TABLE IF NOT EXISTS "items" (
+    "uuid" varchar(36) primary key NULL,
+    "user_uuid" varchar(36) NOT NULL,
+    "content" blob NOT NULL,
+    "content_type" varchar(255) NOT NULL,
+    "enc_item_key" varchar(255) NOT NULL,
+    "auth_hash" varchar(255) NOT NULL,
+    "deleted" integer(1) NOT NULL DEFAULT 0,
+    "created_at" timestamp DEFAULT CURRENT_TIMESTAMP NOT NULL,
+    "updated_at" timestamp DEFAULT CURRENT_TIMESTAMP);
+CREATE TABLE IF NOT EXISTS "users" (
+    "uuid" varchar(36) primary key NULL,
+    "email" varchar(255) NOT NULL,
+    "password" varchar(255) NOT NULL,
+    "pw_func" varchar(255) NOT NULL DEFAULT "pbkdf2",
+    "pw_alg" varchar(255) NOT NULL DEFAULT "sha512",
+    "pw_cost" integer NOT NULL DEFAULT 5000,
+    "pw_key_size" integer NOT NULL DEFAULT 512,
+    "pw_nonce" varchar(255) NOT NULL,
+    "pw_salt" varchar(255) NOT NULL,
+    "created_at" timestamp DEFAULT CURRENT_TIMESTAMP NOT NULL,
+    "updated_at" timestamp DEFAULT CURRENT_TIMESTAMP);
+CREATE INDEX IF NOT EXISTS user_uuid ON items (user_uuid);
+CREATE INDEX IF NOT EXISTS user_content on items (user_uuid, content_type);
+CREATE INDEX IF NOT EXISTS updated_at on items (updated_at);
+CREATE INDEX IF NOT EXISTS email on users (email);
+`,
+		Down: `
+DROP TABLE IF EXISTS "items";
+DROP TABLE IF EXISTS "users";
+`,
+	},
+	{
+		Version: 2,
+		Name:    "create email_verifications",
+		Up: `
+CREATE TABLE IF NOT EXISTS "email_verifications" (
+    "user_uuid" varchar(36) primary key NOT NULL,
+    "verified" integer(1) NOT NULL DEFAULT 0,
+    "created_at" timestamp DEFAULT CURRENT_TIMESTAMP NOT NULL,
+    "updated_at" timestamp DEFAULT CURRENT_TIMESTAMP);
+`,
+		Down: `DROP TABLE IF EXISTS "email_verifications";`,
+	},
+	{
+		Version: 3,
+		Name:    "create auth_failures",
+		Up: `
+CREATE TABLE IF NOT EXISTS "auth_failures" (
+    "email" varchar(255) primary key NOT NULL,
+    "failures" integer NOT NULL DEFAULT 0,
+    "locked_until" timestamp NOT NULL,
+    "updated_at" timestamp DEFAULT CURRENT_TIMESTAMP);
+`,
+		Down: `DROP TABLE IF EXISTS "auth_failures";`,
+	},
+	{
+		Version: 4,
+		Name:    "create webhook_deliveries",
+		Up: `
+CREATE TABLE IF NOT EXISTS "webhook_deliveries" (
+    "uuid" varchar(36) primary key NOT NULL,
+    "event" varchar(255) NOT NULL,
+    "url" varchar(2048) NOT NULL,
+    "payload" blob NOT NULL,
+    "status" varchar(16) NOT NULL,
+    "attempts" integer NOT NULL DEFAULT 0,
+    "response_code" integer NOT NULL DEFAULT 0,
+    "last_error" text NOT NULL DEFAULT '',
+    "next_attempt_at" timestamp NOT NULL,
+    "created_at" timestamp DEFAULT CURRENT_TIMESTAMP NOT NULL,
+    "updated_at" timestamp DEFAULT CURRENT_TIMESTAMP);
+CREATE INDEX IF NOT EXISTS webhook_pending on webhook_deliveries (status, next_attempt_at);
+`,
+		Down: `DROP TABLE IF EXISTS "webhook_deliveries";`,
+	},
+	{
+		Version: 5,
+		Name:    "create outbound_rejections",
+		Up: `
+CREATE TABLE IF NOT EXISTS "outbound_rejections" (
+    "id" integer primary key autoincrement,
+    "user_uuid" varchar(36) NOT NULL,
+    "url" varchar(2048) NOT NULL,
+    "reason" text NOT NULL,
+    "created_at" timestamp DEFAULT CURRENT_TIMESTAMP NOT NULL);
+`,
+		Down: `DROP TABLE IF EXISTS "outbound_rejections";`,
+	},
+	{
+		Version: 6,
+		Name:    "create extension_health",
+		Up: `
+CREATE TABLE IF NOT EXISTS "extension_health" (
+    "extension_uuid" varchar(36) primary key NOT NULL,
+    "user_uuid" varchar(36) NOT NULL,
+    "consecutive_failures" integer NOT NULL DEFAULT 0,
+    "last_error" text NOT NULL DEFAULT '',
+    "last_failure_at" timestamp NOT NULL,
+    "last_success_at" timestamp NOT NULL,
+    "suspended_until" timestamp NOT NULL,
+    "updated_at" timestamp DEFAULT CURRENT_TIMESTAMP);
+CREATE INDEX IF NOT EXISTS extension_health_user on extension_health (user_uuid);
+`,
+		Down: `DROP TABLE IF EXISTS "extension_health";`,
+	},
+	{
+		Version: 7,
+		Name:    "create quarantined_items",
+		Up: `
+CREATE TABLE IF NOT EXISTS "quarantined_items" (
+    "id" integer primary key autoincrement,
+    "uuid" varchar(36) NULL,
+    "user_uuid" varchar(36) NOT NULL,
+    "content" blob NOT NULL,
+    "content_type" varchar(255) NOT NULL,
+    "enc_item_key" varchar(255) NOT NULL,
+    "auth_hash" varchar(255) NOT NULL,
+    "deleted" integer(1) NOT NULL DEFAULT 0,
+    "created_at" timestamp NOT NULL,
+    "updated_at" timestamp NULL,
+    "reason" text NOT NULL,
+    "quarantined_at" timestamp DEFAULT CURRENT_TIMESTAMP NOT NULL);
+`,
+		Down: `DROP TABLE IF EXISTS "quarantined_items";`,
+	},
+	{
+		Version: 8,
+		Name:    "create two_factor",
+		Up: `
+CREATE TABLE IF NOT EXISTS "two_factor" (
+    "user_uuid" varchar(36) primary key NOT NULL,
+    "secret" varchar(255) NOT NULL,
+    "enabled" integer(1) NOT NULL DEFAULT 0,
+    "last_counter" integer NOT NULL DEFAULT 0,
+    "created_at" timestamp DEFAULT CURRENT_TIMESTAMP NOT NULL,
+    "updated_at" timestamp DEFAULT CURRENT_TIMESTAMP);
+CREATE TABLE IF NOT EXISTS "recovery_codes" (
+    "user_uuid" varchar(36) NOT NULL,
+    "code_hash" varchar(64) NOT NULL,
+    "created_at" timestamp DEFAULT CURRENT_TIMESTAMP NOT NULL,
+    PRIMARY KEY ("user_uuid", "code_hash"));
+`,
+		Down: `DROP TABLE IF EXISTS "recovery_codes"; DROP TABLE IF EXISTS "two_factor";`,
+	},
+	{
+		Version: 9,
+		Name:    "create sessions",
+		Up: `
+CREATE TABLE IF NOT EXISTS "sessions" (
+    "uuid" varchar(36) primary key NOT NULL,
+    "user_uuid" varchar(36) NOT NULL,
+    "user_agent" text NOT NULL DEFAULT '',
+    "ip_address" varchar(45) NOT NULL DEFAULT '',
+    "created_at" timestamp NOT NULL,
+    "last_used_at" timestamp NOT NULL);
+CREATE INDEX IF NOT EXISTS sessions_user on sessions (user_uuid);
+`,
+		Down: `DROP TABLE IF EXISTS "sessions";`,
+	},
+	{
+		Version: 10,
+		Name:    "create refresh_tokens",
+		Up: `
+CREATE TABLE IF NOT EXISTS "refresh_tokens" (
+    "token_hash" varchar(64) primary key NOT NULL,
+    "session_uuid" varchar(36) NOT NULL,
+    "used" integer(1) NOT NULL DEFAULT 0,
+    "expires_at" timestamp NOT NULL,
+    "created_at" timestamp DEFAULT CURRENT_TIMESTAMP NOT NULL);
+CREATE INDEX IF NOT EXISTS refresh_tokens_session on refresh_tokens (session_uuid);
+`,
+		Down: `DROP TABLE IF EXISTS "refresh_tokens";`,
+	},
+	{
+		Version: 11,
+		Name:    "add user_uuid to webhook_deliveries",
+		Up: `
+ALTER TABLE "webhook_deliveries" ADD COLUMN "user_uuid" varchar(36) NOT NULL DEFAULT '';
+UPDATE "webhook_deliveries" SET "user_uuid" = COALESCE((
+    SELECT uuid FROM users
+    WHERE CAST(webhook_deliveries.payload AS text) LIKE '%"user_uuid":"' || users.uuid || '"%'
+    LIMIT 1), '');
+CREATE INDEX IF NOT EXISTS webhook_deliveries_user on webhook_deliveries (user_uuid);
+`,
+		// this version of SQLite can't drop a column, so the table is rebuilt.
+		Down: `
+DROP INDEX IF EXISTS webhook_deliveries_user;
+DROP INDEX IF EXISTS webhook_pending;
+ALTER TABLE "webhook_deliveries" RENAME TO "webhook_deliveries_old";
+CREATE TABLE "webhook_deliveries" (
+    "uuid" varchar(36) primary key NOT NULL,
+    "event" varchar(255) NOT NULL,
+    "url" varchar(2048) NOT NULL,
+    "payload" blob NOT NULL,
+    "status" varchar(16) NOT NULL,
+    "attempts" integer NOT NULL DEFAULT 0,
+    "response_code" integer NOT NULL DEFAULT 0,
+    "last_error" text NOT NULL DEFAULT '',
+    "next_attempt_at" timestamp NOT NULL,
+    "created_at" timestamp DEFAULT CURRENT_TIMESTAMP NOT NULL,
+    "updated_at" timestamp DEFAULT CURRENT_TIMESTAMP);
+INSERT INTO "webhook_deliveries" SELECT
+    uuid, event, url, payload, status, attempts, response_code, last_error,
+    next_attempt_at, created_at, updated_at
+    FROM "webhook_deliveries_old";
+DROP TABLE "webhook_deliveries_old";
+CREATE INDEX IF NOT EXISTS webhook_pending on webhook_deliveries (status, next_attempt_at);
+`,
+	},
+	{
+		Version: 12,
+		Name:    "create revoked_sessions",
+		Up: `
+CREATE TABLE IF NOT EXISTS "revoked_sessions" (
+    "uuid" varchar(36) primary key NOT NULL,
+    "user_uuid" varchar(36) NOT NULL,
+    "revoked_at" timestamp NOT NULL);
+CREATE INDEX IF NOT EXISTS revoked_sessions_user on revoked_sessions (user_uuid);
+`,
+		Down: `DROP TABLE IF EXISTS "revoked_sessions";`,
+	},
+	{
+		Version: 13,
+		Name:    "add unique index on lowercase users email",
+		Up:      `CREATE UNIQUE INDEX IF NOT EXISTS users_email_lower on users (LOWER(email));`,
+		Down:    `DROP INDEX IF EXISTS users_email_lower;`,
+	},
+}
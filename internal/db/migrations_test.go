@@ -0,0 +1,169 @@
+package db_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/rafaelespinoza/standardnotes/internal/db"
+)
+
+func TestMigrateTo(t *testing.T) {
+	if err := db.Open(":memory:"); err != nil {
+		t.Fatal(err)
+	}
+
+	tableExists := func(t *testing.T, name string) bool {
+		t.Helper()
+		var found string
+		exists, err := db.SelectExists(context.Background(), &found, `SELECT name FROM sqlite_master WHERE type = 'table' AND name = ?`, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return exists
+	}
+	checkVersion := func(t *testing.T, expected int) {
+		t.Helper()
+		version, err := db.SchemaVersion()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if version != expected {
+			t.Errorf("wrong schema version; got %d, expected %d", version, expected)
+		}
+	}
+
+	t.Run("ok", func(t *testing.T) {
+		checkVersion(t, 0)
+		if err := db.MigrateTo(2); err != nil {
+			t.Fatal(err)
+		}
+		checkVersion(t, 2)
+		if !tableExists(t, "email_verifications") {
+			t.Error("expected email_verifications table")
+		}
+		if tableExists(t, "auth_failures") {
+			t.Error("did not expect auth_failures table")
+		}
+
+		statuses, err := db.Migrations()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(statuses) != db.LatestVersion() {
+			t.Fatalf("wrong number of migrations; got %d, expected %d", len(statuses), db.LatestVersion())
+		}
+		for i, status := range statuses {
+			if status.Version != i+1 {
+				t.Errorf("migration %d has wrong version %d", i, status.Version)
+			}
+			if applied := status.Version <= 2; status.Applied != applied {
+				t.Errorf("migration %d; wrong applied; got %t, expected %t", status.Version, status.Applied, applied)
+			}
+		}
+
+		if err = db.MigrateTo(db.LatestVersion()); err != nil {
+			t.Fatal(err)
+		}
+		checkVersion(t, db.LatestVersion())
+		if !tableExists(t, "extension_health") {
+			t.Error("expected extension_health table")
+		}
+
+		if err = db.MigrateTo(0); err != nil {
+			t.Fatal(err)
+		}
+		checkVersion(t, 0)
+		if tableExists(t, "users") {
+			t.Error("did not expect users table")
+		}
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		for _, target := range []int{-1, db.LatestVersion() + 1} {
+			if err := db.MigrateTo(target); err == nil {
+				t.Errorf("expected error for target %d", target)
+			}
+		}
+	})
+}
+
+func TestEnsureSchema(t *testing.T) {
+	if err := db.Open(":memory:"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.MigrateTo(3); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.EnsureSchema(false); err == nil {
+		t.Error("expected error for outdated schema")
+	}
+	if version, err := db.SchemaVersion(); err != nil {
+		t.Fatal(err)
+	} else if version != 3 {
+		t.Errorf("expected schema to be left alone; got version %d", version)
+	}
+
+	if err := db.EnsureSchema(true); err != nil {
+		t.Fatal(err)
+	}
+	if version, err := db.SchemaVersion(); err != nil {
+		t.Fatal(err)
+	} else if version != db.LatestVersion() {
+		t.Errorf("expected schema to be migrated; got version %d", version)
+	}
+	if err := db.EnsureSchema(false); err != nil {
+		t.Errorf("did not expect error for current schema; got %v", err)
+	}
+}
+
+func TestMigrateWebhookDeliveriesUser(t *testing.T) {
+	if err := db.Open(":memory:"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.MigrateTo(10); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	const userUUID = "4c7e5e0e-6a0a-4b8e-9d43-1f0b6c1b2a10"
+	if err := db.Exec(ctx, "INSERT INTO users (uuid, email, password, pw_nonce, pw_salt) VALUES (?,?,?,?,?)", userUUID, "user@example.com", "", "", ""); err != nil {
+		t.Fatal(err)
+	}
+	for id, payload := range map[string]string{
+		"about-user": `{"event":"user.registered","data":{"user_uuid":"` + userUUID + `"}}`,
+		"about-none": `{"event":"user.sign_in_lockout","data":{"email":"nobody@example.com"}}`,
+	} {
+		if err := db.Exec(
+			ctx,
+			"INSERT INTO webhook_deliveries (uuid, event, url, payload, status, next_attempt_at) VALUES (?,?,?,?,?,?)",
+			id, "test", "http://127.0.0.1", []byte(payload), "pending", time.Now().UTC(),
+		); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := db.MigrateTo(11); err != nil {
+		t.Fatal(err)
+	}
+	for id, expected := range map[string]string{"about-user": userUUID, "about-none": ""} {
+		var actual string
+		if err := db.SelectOne(ctx, func(row db.Iterator) error { return row.Scan(&actual) },
+			"SELECT user_uuid FROM webhook_deliveries WHERE uuid=?", id,
+		); err != nil {
+			t.Fatal(err)
+		} else if actual != expected {
+			t.Errorf("delivery %q; wrong user_uuid; got %q, expected %q", id, actual, expected)
+		}
+	}
+
+	if err := db.MigrateTo(10); err != nil {
+		t.Fatal(err)
+	}
+	var n int
+	if err := db.SelectOne(ctx, func(row db.Iterator) error { return row.Scan(&n) },
+		"SELECT COUNT(*) FROM webhook_deliveries",
+	); err != nil || n != 2 {
+		t.Errorf("expected deliveries to be kept after migrating down; got %d, err %v", n, err)
+	}
+}
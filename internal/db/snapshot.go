@@ -0,0 +1,195 @@
+package db
+
+import (
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	sqlite3 "github.com/mattn/go-sqlite3"
+)
+
+// WriteSnapshot copies the open database to w. The copy is a consistent
+// snapshot, even while other connections are writing, and it's checked with
+// PRAGMA integrity_check before anything is written to w. If compress is true,
+// then the output is gzipped. Only SQLite is supported; use pg_dump for
+// Postgres.
+func WriteSnapshot(ctx context.Context, w io.Writer, compress bool) (err error) {
+	if database.driver != DriverSQLite {
+		err = fmt.Errorf("snapshots are only supported for %s; got %s", DriverSQLite, database.driver)
+		return
+	}
+	var dir string
+	if dir, err = os.MkdirTemp("", "standardnotes-snapshot-"); err != nil {
+		return
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "snapshot.db")
+
+	// VACUUM INTO reads from a single transaction, so the copy doesn't see
+	// writes that happen while it's being made.
+	if _, err = database.db.ExecContext(ctx, `VACUUM INTO ?`, path); err != nil {
+		err = fmt.Errorf("could not copy database; %v", err)
+		return
+	}
+	if err = CheckIntegrity(ctx, path); err != nil {
+		return
+	}
+
+	var src *os.File
+	if src, err = os.Open(path); err != nil {
+		return
+	}
+	defer src.Close()
+	if !compress {
+		_, err = io.Copy(w, src)
+		return
+	}
+	zw := gzip.NewWriter(w)
+	if _, err = io.Copy(zw, src); err != nil {
+		return
+	}
+	err = zw.Close()
+	return
+}
+
+// CheckIntegrity runs PRAGMA integrity_check on the SQLite database file at
+// path. The output error lists any problems found.
+func CheckIntegrity(ctx context.Context, path string) (err error) {
+	var conn *sql.DB
+	if conn, err = sql.Open(DriverSQLite, "file:"+path+"?mode=ro"); err != nil {
+		return
+	}
+	defer conn.Close()
+	var rows *sql.Rows
+	if rows, err = conn.QueryContext(ctx, `PRAGMA integrity_check`); err != nil {
+		return
+	}
+	defer rows.Close()
+	var problems []string
+	for rows.Next() {
+		var result string
+		if err = rows.Scan(&result); err != nil {
+			return
+		}
+		if result != "ok" {
+			problems = append(problems, result)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return
+	}
+	if len(problems) > 0 {
+		err = fmt.Errorf("integrity check failed; %s", strings.Join(problems, "; "))
+	}
+	return
+}
+
+// LoadSnapshot replaces the contents of the open database with the snapshot in
+// the file at path, as written by WriteSnapshot. The file may be gzipped. The
+// snapshot is checked with PRAGMA integrity_check before it's loaded. Only
+// SQLite is supported.
+func LoadSnapshot(ctx context.Context, path string) (err error) {
+	if database.driver != DriverSQLite {
+		err = fmt.Errorf("snapshots are only supported for %s; got %s", DriverSQLite, database.driver)
+		return
+	}
+	var dir string
+	if dir, err = os.MkdirTemp("", "standardnotes-snapshot-"); err != nil {
+		return
+	}
+	defer os.RemoveAll(dir)
+	if path, err = gunzipSnapshot(path, filepath.Join(dir, "snapshot.db")); err != nil {
+		return
+	}
+	if err = CheckIntegrity(ctx, path); err != nil {
+		return
+	}
+
+	var src *sql.DB
+	if src, err = sql.Open(DriverSQLite, "file:"+path+"?mode=ro"); err != nil {
+		return
+	}
+	defer src.Close()
+	var srcConn, destConn *sql.Conn
+	if srcConn, err = src.Conn(ctx); err != nil {
+		return
+	}
+	defer srcConn.Close()
+	if destConn, err = database.writer.Conn(ctx); err != nil {
+		return
+	}
+	defer destConn.Close()
+
+	// The online backup API copies every page, schema included, so the
+	// result is the same as the snapshot no matter what was there before.
+	err = destConn.Raw(func(destDriverConn interface{}) error {
+		return srcConn.Raw(func(srcDriverConn interface{}) (err error) {
+			dest, ok := destDriverConn.(*sqlite3.SQLiteConn)
+			if !ok {
+				return fmt.Errorf("unexpected connection type %T", destDriverConn)
+			}
+			src, ok := srcDriverConn.(*sqlite3.SQLiteConn)
+			if !ok {
+				return fmt.Errorf("unexpected connection type %T", srcDriverConn)
+			}
+			var backup *sqlite3.SQLiteBackup
+			if backup, err = dest.Backup("main", src, "main"); err != nil {
+				return
+			}
+			if _, err = backup.Step(-1); err != nil {
+				backup.Finish()
+				return
+			}
+			return backup.Finish()
+		})
+	})
+	if err != nil {
+		err = fmt.Errorf("could not load snapshot; %v", err)
+	}
+	return
+}
+
+// gunzipSnapshot decompresses the file at path to tmp if it's gzipped. The
+// output is the path to the uncompressed snapshot, which is path itself if it
+// wasn't compressed.
+func gunzipSnapshot(path, tmp string) (out string, err error) {
+	var in *os.File
+	if in, err = os.Open(path); err != nil {
+		return
+	}
+	defer in.Close()
+	magic := make([]byte, 2)
+	if _, err = io.ReadFull(in, magic); err != nil {
+		err = fmt.Errorf("could not read snapshot %s; %v", path, err)
+		return
+	}
+	if magic[0] != 0x1f || magic[1] != 0x8b {
+		out = path
+		return
+	}
+	if _, err = in.Seek(0, io.SeekStart); err != nil {
+		return
+	}
+	var zr *gzip.Reader
+	if zr, err = gzip.NewReader(in); err != nil {
+		return
+	}
+	var dest *os.File
+	if dest, err = os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600); err != nil {
+		return
+	}
+	if _, err = io.Copy(dest, zr); err != nil {
+		dest.Close()
+		return
+	}
+	if err = dest.Close(); err != nil {
+		return
+	}
+	out = tmp
+	return
+}
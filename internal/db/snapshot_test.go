@@ -0,0 +1,171 @@
+package db_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rafaelespinoza/standardnotes/internal/db"
+)
+
+func TestWriteSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	if err := db.Init(filepath.Join(dir, "source.db")); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if err := db.Exec(
+		ctx,
+		`INSERT INTO users (uuid, email, password, pw_func, pw_alg, pw_cost, pw_key_size, pw_nonce, pw_salt, created_at, updated_at)
+		VALUES (?,?,?,?,?,?,?,?,?,CURRENT_TIMESTAMP,CURRENT_TIMESTAMP)`,
+		"snapshot-user", "snapshot@example.com", "password", "pbkdf2", "sha512", 110000, 512, "nonce", "salt",
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	checkCopy := func(t *testing.T, data []byte) {
+		t.Helper()
+		path := filepath.Join(dir, t.Name()+".db")
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.CheckIntegrity(ctx, path); err != nil {
+			t.Fatal(err)
+		}
+		conn, err := sql.Open(db.DriverSQLite, path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		var email string
+		if err = conn.QueryRow(`SELECT email FROM users WHERE uuid = ?`, "snapshot-user").Scan(&email); err != nil {
+			t.Fatal(err)
+		}
+		if email != "snapshot@example.com" {
+			t.Errorf("wrong email; got %q, expected %q", email, "snapshot@example.com")
+		}
+	}
+
+	t.Run("ok", func(t *testing.T) {
+		var buf bytes.Buffer
+		if err := db.WriteSnapshot(ctx, &buf, false); err != nil {
+			t.Fatal(err)
+		}
+		checkCopy(t, buf.Bytes())
+	})
+
+	t.Run("compressed", func(t *testing.T) {
+		var buf bytes.Buffer
+		if err := db.WriteSnapshot(ctx, &buf, true); err != nil {
+			t.Fatal(err)
+		}
+		zr, err := gzip.NewReader(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(zr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkCopy(t, data)
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		path := filepath.Join(dir, "corrupt.db")
+		if err := os.WriteFile(path, bytes.Repeat([]byte("not a database"), 512), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.CheckIntegrity(ctx, path); err == nil {
+			t.Error("expected error")
+		}
+	})
+}
+
+func TestLoadSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+	insertUser := func(t *testing.T, id string) {
+		t.Helper()
+		if err := db.Exec(
+			ctx,
+			`INSERT INTO users (uuid, email, password, pw_func, pw_alg, pw_cost, pw_key_size, pw_nonce, pw_salt, created_at, updated_at)
+			VALUES (?,?,?,?,?,?,?,?,?,CURRENT_TIMESTAMP,CURRENT_TIMESTAMP)`,
+			id, id+"@example.com", "password", "pbkdf2", "sha512", 110000, 512, "nonce", "salt",
+		); err != nil {
+			t.Fatal(err)
+		}
+	}
+	userExists := func(t *testing.T, id string) bool {
+		t.Helper()
+		var found string
+		exists, err := db.SelectExists(ctx, &found, `SELECT uuid FROM users WHERE uuid = ?`, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return exists
+	}
+
+	if err := db.Init(filepath.Join(dir, "source.db")); err != nil {
+		t.Fatal(err)
+	}
+	insertUser(t, "seed-user")
+	for _, compress := range []bool{false, true} {
+		var buf bytes.Buffer
+		if err := db.WriteSnapshot(ctx, &buf, compress); err != nil {
+			t.Fatal(err)
+		}
+		name := "snapshot.db"
+		if compress {
+			name += ".gz"
+		}
+		if err := os.WriteFile(filepath.Join(dir, name), buf.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, name := range []string{"snapshot.db", "snapshot.db.gz"} {
+		t.Run(name, func(t *testing.T) {
+			if err := db.Init(":memory:"); err != nil {
+				t.Fatal(err)
+			}
+			insertUser(t, "replaced-user")
+			if err := db.LoadSnapshot(ctx, filepath.Join(dir, name)); err != nil {
+				t.Fatal(err)
+			}
+			if !userExists(t, "seed-user") {
+				t.Error("expected user from snapshot to exist")
+			}
+			if userExists(t, "replaced-user") {
+				t.Error("expected user from before the snapshot to be gone")
+			}
+			if version, err := db.SchemaVersion(); err != nil {
+				t.Fatal(err)
+			} else if version != db.LatestVersion() {
+				t.Errorf("wrong schema version; got %d, expected %d", version, db.LatestVersion())
+			}
+		})
+	}
+
+	t.Run("errors", func(t *testing.T) {
+		if err := db.Init(":memory:"); err != nil {
+			t.Fatal(err)
+		}
+		path := filepath.Join(dir, "corrupt.db")
+		if err := os.WriteFile(path, bytes.Repeat([]byte("not a database"), 512), 0644); err != nil {
+			t.Fatal(err)
+		}
+		for _, path := range []string{path, filepath.Join(dir, "missing.db")} {
+			if err := db.LoadSnapshot(ctx, path); err == nil {
+				t.Errorf("expected error for %s", path)
+			}
+		}
+	})
+}
@@ -0,0 +1,59 @@
+// Package extensions reports on the extensions that users have configured.
+package extensions
+
+import (
+	"context"
+	"time"
+
+	"github.com/rafaelespinoza/standardnotes/internal/models"
+)
+
+// States of extension delivery health.
+const (
+	StateOK        = "ok"
+	StateFailing   = "failing"
+	StateSuspended = "suspended"
+)
+
+// Status is the delivery health of one extension, summarized by State.
+type Status struct {
+	models.ExtensionHealth
+	State string `json:"state"`
+}
+
+// LoadStatuses reports the delivery health of each of the user's active
+// extensions so the user can tell when one is broken.
+func LoadStatuses(ctx context.Context, user models.User) (out []Status, err error) {
+	var extensions models.Items
+	if extensions, err = user.LoadActiveExtensionItems(ctx); err != nil {
+		return
+	}
+	var recorded []models.ExtensionHealth
+	if recorded, err = models.LoadUserExtensionHealth(ctx, user.UUID); err != nil {
+		return
+	}
+	byExtension := make(map[string]models.ExtensionHealth, len(recorded))
+	for _, health := range recorded {
+		byExtension[health.ExtensionUUID] = health
+	}
+
+	now := time.Now().UTC()
+	out = make([]Status, len(extensions))
+	for i, ext := range extensions {
+		health, ok := byExtension[ext.UUID]
+		if !ok {
+			health = models.ExtensionHealth{ExtensionUUID: ext.UUID, UserUUID: user.UUID}
+		}
+		out[i] = Status{ExtensionHealth: health, State: stateOf(health, now)}
+	}
+	return
+}
+
+func stateOf(health models.ExtensionHealth, now time.Time) string {
+	if health.Suspended(now) {
+		return StateSuspended
+	} else if health.ConsecutiveFailures > 0 {
+		return StateFailing
+	}
+	return StateOK
+}
@@ -0,0 +1,71 @@
+package extensions_test
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/rafaelespinoza/standardnotes/internal/db/dbtest"
+	"github.com/rafaelespinoza/standardnotes/internal/interactors/extensions"
+	"github.com/rafaelespinoza/standardnotes/internal/models"
+)
+
+func init() {
+	dbtest.Init()
+}
+
+func TestLoadStatuses(t *testing.T) {
+	user := models.NewUser()
+	user.Email = t.Name() + "@example.com"
+	user.Password = "testpassword123"
+	if err := user.Create(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	content := "000" + base64.StdEncoding.EncodeToString([]byte(`{"url":"https://ext.example.com","frequency":"daily"}`))
+	healthy := models.Item{UserUUID: user.UUID, ContentType: "SF|Extension", Content: content}
+	failing := models.Item{UserUUID: user.UUID, ContentType: "SF|Extension", Content: content}
+	suspended := models.Item{UserUUID: user.UUID, ContentType: "SF|Extension", Content: content}
+	for _, item := range []*models.Item{&healthy, &failing, &suspended} {
+		if err := item.Create(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	now := time.Now().UTC()
+	for item, failures := range map[string]int{failing.UUID: 1, suspended.UUID: 3} {
+		health, err := models.LoadExtensionHealth(context.Background(), item, user.UUID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < failures; i++ {
+			health.RecordFailure(now, errors.New("boom"), 3, time.Hour, time.Hour)
+		}
+		if err = health.Save(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	statuses, err := extensions.LoadStatuses(context.Background(), *user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{
+		healthy.UUID:   extensions.StateOK,
+		failing.UUID:   extensions.StateFailing,
+		suspended.UUID: extensions.StateSuspended,
+	}
+	if len(statuses) != len(expected) {
+		t.Fatalf("wrong number of statuses; got %d, expected %d", len(statuses), len(expected))
+	}
+	for _, status := range statuses {
+		if status.State != expected[status.ExtensionUUID] {
+			t.Errorf(
+				"extension %s; wrong state; got %q, expected %q",
+				status.ExtensionUUID, status.State, expected[status.ExtensionUUID],
+			)
+		}
+	}
+}
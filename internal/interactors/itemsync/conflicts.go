@@ -17,6 +17,9 @@ var (
 	// errUUIDConflict signals a UUID conflict, this might happen if a user
 	// is importing data from another account.
 	errUUIDConflict = errors.New("uuid_conflict")
+	// errQuotaExceeded signals that saving an item would put the user over
+	// their storage quota.
+	errQuotaExceeded = errors.New("quota_exceeded")
 )
 
 // ItemConflict describes an item sync conflict. It's comprised of the Item and
@@ -57,3 +60,18 @@ func (c *syncConflict) MarshalJSON() ([]byte, error) {
 		"type":        c.Conflict().Error(),
 	})
 }
+
+type quotaConflict struct {
+	item models.Item
+}
+
+var _ ItemConflict = (*quotaConflict)(nil)
+
+func (c *quotaConflict) Item() models.Item { return c.item }
+func (c *quotaConflict) Conflict() error   { return errQuotaExceeded }
+func (c *quotaConflict) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]interface{}{
+		"unsaved_item": c.Item(),
+		"type":         c.Conflict().Error(),
+	})
+}
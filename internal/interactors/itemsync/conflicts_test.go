@@ -34,6 +34,15 @@ func TestItemConflict(t *testing.T) {
 			expectedKeys: []string{"type", "server_item"},
 			expectedType: "sync_conflict",
 		},
+		errQuotaExceeded: {
+			inputItem: models.Item{
+				UUID:      "foo",
+				CreatedAt: time.Now().UTC().Add(-time.Hour),
+				UpdatedAt: time.Now().UTC().Add(-time.Minute),
+			},
+			expectedKeys: []string{"type", "unsaved_item"},
+			expectedType: "quota_exceeded",
+		},
 	}
 	// test the JSON shape, which entails testing the other interface methods.
 	testItemConflict := func(t *testing.T, conflict ItemConflict, test TestCase) (ok bool) {
@@ -98,6 +107,12 @@ func TestItemConflict(t *testing.T) {
 			t.Error("item conflict incorrect")
 		}
 	})
+	t.Run("quota_exceeded", func(t *testing.T) {
+		test := tests[errQuotaExceeded]
+		if ok := testItemConflict(t, &quotaConflict{item: test.inputItem}, test); !ok {
+			t.Error("item conflict incorrect")
+		}
+	})
 }
 
 func itemFromJSON(in map[string]interface{}) (out models.Item, err error) {
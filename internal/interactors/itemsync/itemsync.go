@@ -1,6 +1,7 @@
 package itemsync
 
 import (
+	"context"
 	"encoding/base64"
 	"fmt"
 	"math"
@@ -8,8 +9,11 @@ import (
 	"strings"
 	"time"
 
+	"github.com/rafaelespinoza/standardnotes/internal/config"
+	"github.com/rafaelespinoza/standardnotes/internal/db"
 	"github.com/rafaelespinoza/standardnotes/internal/logger"
 	"github.com/rafaelespinoza/standardnotes/internal/models"
+	"github.com/rafaelespinoza/standardnotes/internal/webhooks"
 )
 
 // Request is a collection of named parameters for an incoming sync request.
@@ -33,7 +37,7 @@ type Response struct {
 }
 
 // SyncUserItems manages user item syncs.
-func SyncUserItems(user models.User, req Request) (res *Response, err error) {
+func SyncUserItems(ctx context.Context, user models.User, req Request) (res *Response, err error) {
 	res = &Response{
 		Retrieved: make([]models.Item, 0),
 		Saved:     make([]models.Item, 0),
@@ -48,22 +52,30 @@ func SyncUserItems(user models.User, req Request) (res *Response, err error) {
 		return
 	}
 
-	if err = res.doItemSync(user, req); err != nil {
+	if err = res.doItemSync(ctx, user, req); err != nil {
 		return
 	}
+	if len(res.Saved) > 0 || len(res.Conflicts) > 0 {
+		webhooks.Publish(ctx, webhooks.EventItemsSynced, user.UUID, map[string]interface{}{
+			"user_uuid": user.UUID,
+			"saved":     len(res.Saved),
+			"retrieved": len(res.Retrieved),
+			"conflicts": len(res.Conflicts),
+		})
+	}
 
-	err = enqueueRealtimeExtensionJobs(user, req.Items)
+	err = enqueueRealtimeExtensionJobs(ctx, user, req.Items)
 	if err != nil {
 		return
 	}
-	if err = enqueueDailyBackupExtensionJobs(res.Saved); err != nil {
+	if err = enqueueDailyBackupExtensionJobs(ctx, res.Saved); err != nil {
 		return
 	}
 
 	if !req.ComputeIntegrity {
 		return
 	}
-	userItems, err := user.LoadActiveItems()
+	userItems, err := user.LoadActiveItems(ctx)
 	if err != nil {
 		return
 	}
@@ -76,7 +88,7 @@ func SyncUserItems(user models.User, req Request) (res *Response, err error) {
 // request, then either creates new items or updates the existing items to the
 // DB. Conflicting items cannot be saved to the DB, so they're collected in a
 // separate list and sent back to the client.
-func (r *Response) doItemSync(user models.User, req Request) (err error) {
+func (r *Response) doItemSync(ctx context.Context, user models.User, req Request) (err error) {
 	var retrieved models.Items
 	var saved models.Items
 	var conflicts []ItemConflict
@@ -92,18 +104,28 @@ func (r *Response) doItemSync(user models.User, req Request) (err error) {
 	var moreUserItems bool
 	if req.CursorToken != "" {
 		date := decodePaginationToken(req.CursorToken)
-		retrieved, moreUserItems, err = user.LoadItemsAfter(date, true, req.ContentType, limit)
+		retrieved, moreUserItems, err = user.LoadItemsAfter(ctx, date, true, req.ContentType, limit)
 	} else if req.SyncToken != "" {
 		date := decodePaginationToken(req.SyncToken)
-		retrieved, moreUserItems, err = user.LoadItemsAfter(date, false, req.ContentType, limit)
+		retrieved, moreUserItems, err = user.LoadItemsAfter(ctx, date, false, req.ContentType, limit)
 	} else {
-		retrieved, moreUserItems, err = user.LoadAllItems(req.ContentType, limit)
+		retrieved, moreUserItems, err = user.LoadAllItems(ctx, req.ContentType, limit)
 	}
 
 	if err != nil {
 		return
 	}
 
+	// Concurrent syncs by the same user each check against the usage from
+	// their own start, so a quota can be overshot by a little. That's fine.
+	quota := config.Conf.Quotas.For(user.UUID)
+	var usage models.Usage
+	if quota.MaxItems > 0 || quota.MaxBytes > 0 {
+		if usage, err = models.LoadUsage(ctx, user.UUID); err != nil {
+			return
+		}
+	}
+
 	// sync user items, identify conflicts.
 	for _, incomingItem := range req.Items {
 		var item *models.Item
@@ -114,7 +136,8 @@ func (r *Response) doItemSync(user models.User, req Request) (err error) {
 		// conflicts since the items ought to be retrieved by this point.
 		// However, this may not be true if there's pagination. For now, just go
 		// back to the DB until there's more knowledge.
-		item, ierr = findCheckItem(incomingItem)
+		var alreadyExists bool
+		item, alreadyExists, ierr = findCheckItem(ctx, incomingItem)
 		if ierr == errUUIDConflict {
 			conflicts = append(conflicts, &uuidConflict{item: incomingItem})
 			continue
@@ -132,21 +155,33 @@ func (r *Response) doItemSync(user models.User, req Request) (err error) {
 		// the known user.
 		item.UserUUID = user.UUID
 		incomingItem.UserUUID = user.UUID
+		var before models.Usage
+		if alreadyExists {
+			before = item.Usage()
+		}
 		if err = item.MergeProtected(&incomingItem); err != nil {
 			return
 		}
+		after := item.Usage()
+		if overQuota(quota, usage, before, after) {
+			conflicts = append(conflicts, &quotaConflict{item: incomingItem})
+			retrieved.Delete(item.UUID)
+			continue
+		}
 
 		// Can *probably* do Save or Delete instead of potentially doing both.
 		// But before doing that, consider if there are other things that need
-		// to be saved before it's marked as "deleted".
-		if err = item.Save(); err != nil {
-			return
-		}
-		if item.Deleted {
-			if err = item.Delete(); err != nil {
-				return
+		// to be saved before it's marked as "deleted". Either way, do both in
+		// one transaction so a failure doesn't leave the item half-deleted.
+		if err = db.WithTx(ctx, func(ctx context.Context) error {
+			if err := item.Save(ctx); err != nil || !item.Deleted {
+				return err
 			}
+			return item.Delete(ctx)
+		}); err != nil {
+			return
 		}
+		usage = usage.Add(after).Add(before.Negate())
 		saved = append(saved, *item)
 	}
 	if saved == nil {
@@ -186,10 +221,10 @@ func (r *Response) doItemSync(user models.User, req Request) (err error) {
 // database, then it returns a pointer to the incoming Item. If it is, then it
 // compares timestamps on the item found in the DB and the incomingItem. If
 // they're the same, then assume both items are identical. If different (outside
-// of a certain threshold), then consider it a sync conflict.
-func findCheckItem(incomingItem models.Item) (item *models.Item, err error) {
-	var alreadyExists bool
-	if alreadyExists, err = incomingItem.Exists(); err != nil {
+// of a certain threshold), then consider it a sync conflict. The alreadyExists
+// output says whether or not the item was found in the DB.
+func findCheckItem(ctx context.Context, incomingItem models.Item) (item *models.Item, alreadyExists bool, err error) {
+	if alreadyExists, err = incomingItem.Exists(ctx); err != nil {
 		// probably importing notes from another account? This is translated
 		// from the ruby implementation, and I don't know how they decided that
 		// any error here would be considered a conflicting UUID...
@@ -201,7 +236,7 @@ func findCheckItem(incomingItem models.Item) (item *models.Item, err error) {
 		return
 	} else {
 		// hydrate item fields with DB values
-		if item, err = models.LoadItemByUUID(incomingItem.UUID); err != nil {
+		if item, err = models.LoadItemByUUID(ctx, incomingItem.UUID); err != nil {
 			return
 		}
 	}
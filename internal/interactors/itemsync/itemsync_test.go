@@ -1,29 +1,23 @@
 package itemsync
 
 import (
+	"context"
 	"os"
 	"strconv"
 	"testing"
 	"time"
 
-	"github.com/rafaelespinoza/standardnotes/internal/db"
+	"github.com/rafaelespinoza/standardnotes/internal/config"
+	"github.com/rafaelespinoza/standardnotes/internal/db/dbtest"
 	"github.com/rafaelespinoza/standardnotes/internal/models"
 )
 
-const (
-	testDBName        = "standardnotes_test"
-	baseTestOutputDir = "/tmp/standardnotes_test"
-)
-
 func TestMain(m *testing.M) {
-	os.MkdirAll(baseTestOutputDir, 0755)
-	m.Run()
-	os.RemoveAll(baseTestOutputDir)
+	dbtest.Init()
+	os.Exit(m.Run())
 }
 
 func TestSyncUserItems(t *testing.T) {
-	db.Init(":memory:")
-
 	user := models.User{UUID: t.Name() + time.Now().Format(time.RFC3339Nano)}
 
 	existingItems := []models.Item{
@@ -33,11 +27,11 @@ func TestSyncUserItems(t *testing.T) {
 		makeItem(t.Name()+"/delta", user.UUID),
 	}
 	for i, item := range existingItems {
-		if err := item.Save(); err != nil {
+		if err := item.Save(context.Background()); err != nil {
 			t.Fatalf("could not save existingItems[%d] during setup; %v", i, err)
 		}
 	}
-	res, err := SyncUserItems(user, Request{ComputeIntegrity: true})
+	res, err := SyncUserItems(context.Background(), user, Request{ComputeIntegrity: true})
 	if err != nil {
 		t.Error(err)
 		return
@@ -59,14 +53,6 @@ func TestDoItemSync(t *testing.T) {
 	// token is there. The queries are not fully-developed anyways (ignores
 	// content type and limit inputs), so just test with all user items for now.
 
-	pathToTestDir := baseTestOutputDir + "/" + t.Name()
-	if err := os.MkdirAll(pathToTestDir, 0755); err != nil {
-		t.Fatalf("error creating test directory %s", pathToTestDir)
-	}
-	defer os.RemoveAll(pathToTestDir)
-	// debugging is easier when the DB is not in-memory.
-	db.Init(pathToTestDir + "/" + testDBName)
-
 	user := models.User{UUID: t.Name() + time.Now().Format(time.RFC3339Nano)}
 	unchangedItem := makeItem(t.Name()+"/unchanged", user.UUID)
 	itemToChange := makeItem(t.Name()+"/change", user.UUID)
@@ -79,7 +65,7 @@ func TestDoItemSync(t *testing.T) {
 		&itemToMarkDeleted,
 	}
 	for i, item := range existingItems {
-		if err := item.Save(); err != nil {
+		if err := item.Save(context.Background()); err != nil {
 			t.Fatalf("could not save existingItems[%d] during setup; %v", i, err)
 		}
 	}
@@ -97,7 +83,7 @@ func TestDoItemSync(t *testing.T) {
 		newItem,
 	}
 	res := &Response{}
-	if err := res.doItemSync(user, Request{Items: incomingItems}); err != nil {
+	if err := res.doItemSync(context.Background(), user, Request{Items: incomingItems}); err != nil {
 		t.Errorf("did not expect error; got %v", err)
 	}
 
@@ -147,7 +133,7 @@ func TestDoItemSync(t *testing.T) {
 
 	// test Update behavior
 	var updatedItemToChange *models.Item
-	if updatedItemToChange, err = models.LoadItemByUUID(itemToChange.UUID); err != nil {
+	if updatedItemToChange, err = models.LoadItemByUUID(context.Background(), itemToChange.UUID); err != nil {
 		t.Fatalf("did not expect error fetching 'changed' item; got %v", err)
 	}
 	if updatedItemToChange.Content != "bravo" {
@@ -159,7 +145,7 @@ func TestDoItemSync(t *testing.T) {
 
 	// test Delete behavior
 	var updatedDeletedItem *models.Item
-	if updatedDeletedItem, err = models.LoadItemByUUID(itemToMarkDeleted.UUID); err != nil {
+	if updatedDeletedItem, err = models.LoadItemByUUID(context.Background(), itemToMarkDeleted.UUID); err != nil {
 		t.Fatalf("did not expect error fetching 'deleted' item; got %v", err)
 	}
 	if !updatedDeletedItem.Deleted {
@@ -176,19 +162,90 @@ func TestDoItemSync(t *testing.T) {
 	}
 }
 
-func TestFindCheckItem(t *testing.T) {
-	pathToTestDir := baseTestOutputDir + "/" + t.Name()
-	if err := os.MkdirAll(pathToTestDir, 0755); err != nil {
-		t.Fatalf("error creating test directory %s", pathToTestDir)
+func TestDoItemSyncQuota(t *testing.T) {
+	ctx := context.Background()
+	user := models.User{UUID: t.Name() + time.Now().Format(time.RFC3339Nano)}
+	quotas := config.Conf.Quotas
+	defer func() { config.Conf.Quotas = quotas }()
+	config.Conf.Quotas = config.Quotas{
+		Users: map[string]config.Quota{user.UUID: {MaxItems: 2, MaxBytes: 12}},
+	}
+
+	existingItem := makeItem(t.Name()+"/existing", user.UUID)
+	if err := existingItem.Save(ctx); err != nil {
+		t.Fatal(err)
+	}
+	checkSync := func(t *testing.T, incoming []models.Item, expectedSaved, expectedConflicts []string) {
+		t.Helper()
+		res := &Response{}
+		if err := res.doItemSync(ctx, user, Request{Items: incoming}); err != nil {
+			t.Fatal(err)
+		}
+		if len(res.Saved) != len(expectedSaved) {
+			t.Errorf("wrong number of saved items; got %d, expected %d", len(res.Saved), len(expectedSaved))
+		}
+		for _, item := range res.Saved {
+			if !member(expectedSaved, item.UUID) {
+				t.Errorf("did not expect item %q to be saved", item.UUID)
+			}
+		}
+		if len(res.Conflicts) != len(expectedConflicts) {
+			t.Errorf("wrong number of conflicts; got %d, expected %d", len(res.Conflicts), len(expectedConflicts))
+		}
+		for _, conflict := range res.Conflicts {
+			if !member(expectedConflicts, conflict.Item().UUID) {
+				t.Errorf("did not expect item %q to conflict", conflict.Item().UUID)
+			} else if conflict.Conflict() != errQuotaExceeded {
+				t.Errorf("wrong conflict; got %v, expected %v", conflict.Conflict(), errQuotaExceeded)
+			}
+		}
 	}
-	defer os.RemoveAll(pathToTestDir)
-	// debugging is easier when the DB is not in-memory.
-	db.Init(pathToTestDir + "/" + testDBName)
+	checkUsage := func(t *testing.T, expected models.Usage, maxItems int, maxBytes int64) {
+		t.Helper()
+		report, err := LoadUsage(ctx, user)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if report.Usage != expected {
+			t.Errorf("wrong usage; got %+v, expected %+v", report.Usage, expected)
+		}
+		if report.MaxItems != maxItems || report.MaxBytes != maxBytes {
+			t.Errorf("wrong limits; got %d items, %d bytes", report.MaxItems, report.MaxBytes)
+		}
+	}
+
+	t.Run("ok", func(t *testing.T) {
+		added := makeItem(t.Name()+"/added", user.UUID)
+		tooMany := makeItem(t.Name()+"/too_many", user.UUID)
+		tooBig := existingItem
+		tooBig.Content = "alphabravo"
+		checkSync(
+			t,
+			[]models.Item{added, tooMany, tooBig},
+			[]string{added.UUID},
+			[]string{tooMany.UUID, tooBig.UUID},
+		)
+		checkUsage(t, models.Usage{Items: 2, Bytes: 10}, 2, 12)
+	})
 
+	t.Run("over quota", func(t *testing.T) {
+		// Lower the quota below the usage. Deleting must still work.
+		config.Conf.Quotas.Users[user.UUID] = config.Quota{MaxItems: 1, MaxBytes: 2}
+		defer func() { config.Conf.Quotas.Users[user.UUID] = config.Quota{MaxItems: 2, MaxBytes: 12} }()
+		deleted := existingItem
+		deleted.Deleted = true
+		checkSync(t, []models.Item{deleted}, []string{deleted.UUID}, nil)
+		checkUsage(t, models.Usage{Items: 1, Bytes: 5}, 1, 2)
+	})
+}
+
+func TestFindCheckItem(t *testing.T) {
 	t.Run("item does not exist in DB", func(t *testing.T) {
 		incomingItem := makeItem("alpha", "alpha")
-		if item, err := findCheckItem(incomingItem); err != nil {
+		if item, exists, err := findCheckItem(context.Background(), incomingItem); err != nil {
 			t.Errorf("did not expect error, got %v", err)
+		} else if exists {
+			t.Errorf("did not expect item to exist")
 		} else if *item != incomingItem {
 			t.Errorf("output item did not equal expected item")
 		}
@@ -224,13 +281,16 @@ func TestFindCheckItem(t *testing.T) {
 		for i, test := range tests {
 			name := t.Name() + strconv.Itoa(i)
 			existingItem := makeItem(name, name+"user")
-			if err := existingItem.Save(); err != nil {
+			if err := existingItem.Save(context.Background()); err != nil {
 				t.Fatal(err)
 			}
 			incomingItem := makeItem(name, name+"user")
 			incomingItem.UpdatedAt = existingItem.UpdatedAt.UTC().Add(test.updatedOffset)
 
-			item, err := findCheckItem(incomingItem)
+			item, exists, err := findCheckItem(context.Background(), incomingItem)
+			if !exists {
+				t.Errorf("test [%d]; expected item to exist", i)
+			}
 			if err != test.err {
 				t.Errorf("test [%d]; unexpected error; got %v, expected %v", i, err, test.err)
 			}
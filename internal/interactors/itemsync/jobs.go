@@ -1,21 +1,21 @@
 package itemsync
 
 import (
-	"log"
+	"context"
 
 	"github.com/rafaelespinoza/standardnotes/internal/jobs"
 	"github.com/rafaelespinoza/standardnotes/internal/models"
 )
 
-func enqueueRealtimeExtensionJobs(user models.User, items models.Items) (err error) {
+func enqueueRealtimeExtensionJobs(ctx context.Context, user models.User, items models.Items) (err error) {
 	if len(items) < 1 {
 		return
 	}
-	extensions, err := user.LoadActiveExtensionItems()
+	extensions, err := user.LoadActiveExtensionItems(ctx)
 	if err != nil {
 		return
 	}
-	for i, ext := range extensions {
+	for _, ext := range extensions {
 		content := ext.DecodedContentMetadata()
 		if content == nil || content.Frequency != models.FrequencyRealtime || len(content.URL) < 1 {
 			continue
@@ -25,26 +25,21 @@ func enqueueRealtimeExtensionJobs(user models.User, items models.Items) (err err
 		for i, item := range items {
 			itemIDs[i] = item.UUID
 		}
-		if err = jobs.PerformExtensionJob(
-			jobs.ExtensionJobParams{
-				URL:         content.URL,
-				ItemIDs:     itemIDs,
-				UserID:      user.UUID,
-				ExtensionID: ext.UUID,
-			},
-		); err != nil {
-			log.Printf(
-				"could not perform job on extensions[%d]; %v",
-				i, err,
-			)
-			return
-		}
+		// Delivery happens in the background, so that a slow or broken
+		// extension doesn't hold up or fail the sync. Its health is tracked
+		// by the job.
+		jobs.EnqueueExtensionJob(jobs.ExtensionJobParams{
+			URL:         content.URL,
+			ItemIDs:     itemIDs,
+			UserID:      user.UUID,
+			ExtensionID: ext.UUID,
+		})
 	}
 	return
 }
 
-func enqueueDailyBackupExtensionJobs(items models.Items) (err error) {
-	for i, item := range items {
+func enqueueDailyBackupExtensionJobs(ctx context.Context, items models.Items) (err error) {
+	for _, item := range items {
 		if !item.IsDailyBackupExtension() || item.Deleted {
 			continue
 		}
@@ -54,24 +49,13 @@ func enqueueDailyBackupExtensionJobs(items models.Items) (err error) {
 		}
 
 		if content.SubType == "backup.email_archive" {
-			err = jobs.PerformMailerJob(
-				jobs.MailerJobParams{UserID: item.UserUUID},
-			)
+			jobs.EnqueueMailerJob(jobs.MailerJobParams{UserID: item.UserUUID})
 		} else if content.Frequency == models.FrequencyDaily && content.URL != "" {
-			err = jobs.PerformExtensionJob(
-				jobs.ExtensionJobParams{
-					URL:         content.URL,
-					UserID:      item.UserUUID,
-					ExtensionID: item.UUID,
-				},
-			)
-
-		}
-		if err != nil {
-			log.Printf(
-				"could not perform job on items[%d]; %v",
-				i, err,
-			)
+			jobs.EnqueueExtensionJob(jobs.ExtensionJobParams{
+				URL:         content.URL,
+				UserID:      item.UserUUID,
+				ExtensionID: item.UUID,
+			})
 		}
 	}
 	return
@@ -0,0 +1,38 @@
+package itemsync
+
+import (
+	"context"
+
+	"github.com/rafaelespinoza/standardnotes/internal/config"
+	"github.com/rafaelespinoza/standardnotes/internal/models"
+)
+
+// A UsageReport is how much a user stores and how much they may store. A
+// limit of 0 means no limit.
+type UsageReport struct {
+	models.Usage
+	MaxItems int   `json:"max_items"`
+	MaxBytes int64 `json:"max_bytes"`
+}
+
+// LoadUsage reports on the storage of a user.
+func LoadUsage(ctx context.Context, user models.User) (out UsageReport, err error) {
+	quota := config.Conf.Quotas.For(user.UUID)
+	out.MaxItems, out.MaxBytes = quota.MaxItems, quota.MaxBytes
+	out.Usage, err = models.LoadUsage(ctx, user.UUID)
+	return
+}
+
+// overQuota says whether or not changing the usage of one item from before to
+// after puts the total over the quota. Changes that don't add to the usage are
+// always allowed, so a user over their quota can still delete and shrink items.
+func overQuota(quota config.Quota, total, before, after models.Usage) bool {
+	next := total.Add(after).Add(before.Negate())
+	if quota.MaxItems > 0 && after.Items > before.Items && next.Items > quota.MaxItems {
+		return true
+	}
+	if quota.MaxBytes > 0 && after.Bytes > before.Bytes && next.Bytes > quota.MaxBytes {
+		return true
+	}
+	return false
+}
@@ -0,0 +1,185 @@
+package interactors
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/rafaelespinoza/standardnotes/internal/config"
+	"github.com/rafaelespinoza/standardnotes/internal/errs"
+	"github.com/rafaelespinoza/standardnotes/internal/logger"
+	"github.com/rafaelespinoza/standardnotes/internal/models"
+)
+
+// Device describes where a sign in request came from. It's saved with the
+// session, so that users can tell their sessions apart.
+type Device struct {
+	UserAgent string
+	IPAddress string
+}
+
+// SessionInfo is a session as shown to its user.
+type SessionInfo struct {
+	models.Session
+	// Current is true for the session making the request.
+	Current bool `json:"current"`
+}
+
+// ListSessions outputs the user's sessions, most recently used first.
+func ListSessions(ctx context.Context, user models.User, current models.Session) (out []SessionInfo, err error) {
+	var sessions []models.Session
+	if sessions, err = models.LoadSessions(ctx, user.UUID); err != nil {
+		return
+	}
+	out = make([]SessionInfo, len(sessions))
+	for i, sess := range sessions {
+		out[i] = SessionInfo{Session: sess, Current: sess.UUID == current.UUID}
+	}
+	return
+}
+
+// RevokeSession signs out one of the user's sessions, which may be the current
+// one. Its tokens stop working right away. If the user has no such session,
+// then the error is a NotFound error.
+func RevokeSession(ctx context.Context, user models.User, sessionUUID string) error {
+	return models.RevokeSession(ctx, user.UUID, sessionUUID)
+}
+
+// SignOut ends the current session. Its tokens, including the one making the
+// request, stop working right away.
+func SignOut(ctx context.Context, user models.User, current models.Session) error {
+	return models.RevokeSession(ctx, user.UUID, current.UUID)
+}
+
+// RevokeOtherSessions signs out all of the user's sessions except for the
+// current one.
+func RevokeOtherSessions(ctx context.Context, user models.User, current models.Session) error {
+	return models.RevokeOtherSessions(ctx, user.UUID, current.UUID)
+}
+
+// _SessionCleanupInterval is how often expired sessions are cleaned up.
+const _SessionCleanupInterval = time.Hour
+
+// RunSessionCleanup cleans up expired sessions right away, and then
+// periodically until the done channel is closed.
+func RunSessionCleanup(done <-chan struct{}) {
+	ticker := time.NewTicker(_SessionCleanupInterval)
+	defer ticker.Stop()
+	for {
+		if err := CleanUpSessions(context.Background(), time.Now()); err != nil {
+			log.Printf("sessions: %v\n", err)
+		}
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// CleanUpSessions deletes refresh tokens that expired before t, and sessions
+// that can't be used anymore. While legacy tokens are on, a legacy token
+// restores its session when it's next used, so revoked sessions are remembered
+// until legacy tokens are turned off.
+func CleanUpSessions(ctx context.Context, t time.Time) (err error) {
+	conf := config.Conf.Tokens
+	// Access tokens are issued at sign in and on refresh, which both count as
+	// using the session. So once a session is idle for longer than an access
+	// token lasts, none of its access tokens work. The extra minute covers uses
+	// that weren't saved.
+	idleBefore := t.Add(-accessTTL() - time.Minute)
+	var tokens, sessions int64
+	if tokens, sessions, err = models.DeleteExpiredSessions(ctx, t, idleBefore, conf.Legacy); err != nil {
+		return
+	}
+	logger.LogIfDebug("deleted", tokens, "expired refresh tokens and", sessions, "sessions")
+	return
+}
+
+func accessTTL() time.Duration {
+	if ttl := time.Duration(config.Conf.Tokens.AccessMinutes) * time.Minute; ttl > 0 {
+		return ttl
+	}
+	return time.Hour
+}
+
+// SessionTokens are issued when a session starts and each time it's refreshed.
+// Expirations are in milliseconds since the Unix epoch.
+type SessionTokens struct {
+	AccessToken       string `json:"access_token"`
+	AccessExpiration  int64  `json:"access_expiration"`
+	RefreshToken      string `json:"refresh_token"`
+	RefreshExpiration int64  `json:"refresh_expiration"`
+	// Token doesn't expire. It's for legacy clients, and is only issued if
+	// legacy tokens are configured.
+	Token string `json:"-"`
+}
+
+// issueTokens makes a new access token and refresh token for the session.
+func issueTokens(ctx context.Context, user models.User, sessionUUID string) (out SessionTokens, err error) {
+	conf := config.Conf.Tokens
+	refreshTTL := time.Duration(conf.RefreshDays) * 24 * time.Hour
+	if refreshTTL <= 0 {
+		refreshTTL = 30 * 24 * time.Hour
+	}
+
+	// JWT expirations are in whole seconds.
+	accessExpiration := time.Now().Add(accessTTL()).Truncate(time.Second)
+	if out.AccessToken, err = models.EncodeToken(user, sessionUUID, accessExpiration); err != nil {
+		return
+	}
+	var refresh models.RefreshToken
+	if refresh, err = models.IssueRefreshToken(ctx, sessionUUID, refreshTTL); err != nil {
+		return
+	}
+	out.AccessExpiration = accessExpiration.UnixNano() / int64(time.Millisecond)
+	out.RefreshToken = refresh.Token
+	out.RefreshExpiration = refresh.ExpiresAt.UnixNano() / int64(time.Millisecond)
+	if conf.Legacy {
+		out.Token, err = models.EncodeToken(user, sessionUUID, time.Time{})
+	}
+	return
+}
+
+// sessionFor outputs sessionUUID, or, if it's empty because the user signed in
+// with a token from before sessions were tracked, the UUID of a new session.
+// That way, new tokens issued to the user belong to a session.
+func sessionFor(ctx context.Context, user models.User, sessionUUID string) (string, error) {
+	if sessionUUID != "" {
+		return sessionUUID, nil
+	}
+	sess, err := models.CreateSession(ctx, user.UUID, "", "")
+	if err != nil {
+		return "", err
+	}
+	return sess.UUID, nil
+}
+
+// RefreshSession exchanges a refresh token for new tokens of the same session.
+// A refresh token can only be used once. Using one again revokes its session.
+func RefreshSession(ctx context.Context, refreshToken string) (tokens SessionTokens, err error) {
+	var sessionUUID string
+	if sessionUUID, err = models.UseRefreshToken(ctx, refreshToken, time.Now()); errs.ValidationError(err) {
+		err = authenticationError{error: err, validation: true}
+		return
+	} else if err != nil {
+		return
+	}
+	var sess *models.Session
+	if sess, err = models.LoadSession(ctx, sessionUUID); errs.NotFoundError(err) {
+		err = authenticationError{error: errSessionRevoked, validation: true}
+		return
+	} else if err != nil {
+		return
+	}
+	var user *models.User
+	if user, err = models.LoadUserByUUID(ctx, sess.UserUUID); err != nil {
+		err = maybeMutateError(err)
+		return
+	}
+	if err = sess.Touch(ctx, time.Now()); err != nil {
+		return
+	}
+	tokens, err = issueTokens(ctx, *user, sess.UUID)
+	return
+}
@@ -0,0 +1,320 @@
+package interactors_test
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/rafaelespinoza/standardnotes/internal/config"
+	userInteractors "github.com/rafaelespinoza/standardnotes/internal/interactors/user"
+	"github.com/rafaelespinoza/standardnotes/internal/models"
+)
+
+func TestSessions(t *testing.T) {
+	const plaintextPassword = "testpassword123"
+	ctx := context.Background()
+	user, _, err := userInteractors.RegisterUser(ctx, userInteractors.RegisterUserParams{
+		Email:    t.Name() + "@example.com",
+		Password: plaintextPassword,
+		PwNonce:  "stub_password_nonce",
+		Device:   userInteractors.Device{UserAgent: "laptop", IPAddress: "192.0.2.1"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, phoneToken, err := userInteractors.LoginUser(
+		ctx, user.Email, &models.PwHash{Value: plaintextPassword}, "",
+		userInteractors.Device{UserAgent: "phone", IPAddress: "192.0.2.2"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, phone, err := userInteractors.AuthenticateSession(ctx, "Bearer "+phoneToken.AccessToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sessions, err := userInteractors.ListSessions(ctx, *user, *phone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 2 {
+		t.Fatalf("wrong number of sessions; got %d, expected %d", len(sessions), 2)
+	}
+	for _, sess := range sessions {
+		if sess.Current != (sess.UUID == phone.UUID) {
+			t.Errorf("wrong value for Current of %q; got %t", sess.UserAgent, sess.Current)
+		}
+		if sess.UserAgent == "laptop" && sess.IPAddress != "192.0.2.1" {
+			t.Errorf("wrong IPAddress; got %q, expected %q", sess.IPAddress, "192.0.2.1")
+		}
+	}
+
+	if err = userInteractors.RevokeOtherSessions(ctx, *user, *phone); err != nil {
+		t.Fatal(err)
+	}
+	if sessions, err = userInteractors.ListSessions(ctx, *user, *phone); err != nil {
+		t.Fatal(err)
+	} else if len(sessions) != 1 || !sessions[0].Current {
+		t.Errorf("expected only the current session; got %+v", sessions)
+	}
+
+	if err = userInteractors.RevokeSession(ctx, *user, phone.UUID); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = userInteractors.AuthenticateSession(ctx, "Bearer "+phoneToken.AccessToken); !testError(t, err, errExpectations{
+		messageFragment: "session",
+		validation:      true,
+	}) {
+		t.Error("expected token of revoked session to be rejected")
+	}
+}
+
+func TestRefreshSession(t *testing.T) {
+	ctx := context.Background()
+	_, tokens, err := userInteractors.RegisterUser(ctx, userInteractors.RegisterUserParams{
+		Email:    t.Name() + "@example.com",
+		Password: "testpassword123",
+		PwNonce:  "stub_password_nonce",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tokens.RefreshToken == "" || tokens.AccessExpiration <= time.Now().UnixNano()/int64(time.Millisecond) {
+		t.Fatalf("unexpected tokens %+v", tokens)
+	}
+
+	refreshed, err := userInteractors.RefreshSession(ctx, tokens.RefreshToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if refreshed.RefreshToken == tokens.RefreshToken {
+		t.Error("expected refresh token to be rotated")
+	}
+	_, first, err := userInteractors.AuthenticateSession(ctx, "Bearer "+tokens.AccessToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, second, err := userInteractors.AuthenticateSession(ctx, "Bearer "+refreshed.AccessToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.UUID != second.UUID {
+		t.Errorf("expected the same session; got %q, expected %q", second.UUID, first.UUID)
+	}
+
+	// using the first refresh token again revokes the whole session.
+	if _, err = userInteractors.RefreshSession(ctx, tokens.RefreshToken); !testError(t, err, errExpectations{
+		messageFragment: "already used",
+		validation:      true,
+	}) {
+		t.Error("expected reused refresh token to be rejected")
+	}
+	if _, err = userInteractors.RefreshSession(ctx, refreshed.RefreshToken); !testError(t, err, errExpectations{
+		validation: true,
+	}) {
+		t.Error("expected newest refresh token to be revoked too")
+	}
+	if _, _, err = userInteractors.AuthenticateSession(ctx, "Bearer "+refreshed.AccessToken); !testError(t, err, errExpectations{
+		messageFragment: "session",
+		validation:      true,
+	}) {
+		t.Error("expected access token of revoked session to be rejected")
+	}
+}
+
+func TestLegacyTokens(t *testing.T) {
+	defer func(legacy bool) { config.Conf.Tokens.Legacy = legacy }(config.Conf.Tokens.Legacy)
+	ctx := context.Background()
+
+	config.Conf.Tokens.Legacy = true
+	_, tokens, err := userInteractors.RegisterUser(ctx, userInteractors.RegisterUserParams{
+		Email:    t.Name() + "@example.com",
+		Password: "testpassword123",
+		PwNonce:  "stub_password_nonce",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tokens.Token == "" {
+		t.Fatal("expected a legacy token")
+	}
+	if _, _, err = userInteractors.AuthenticateSession(ctx, "Bearer "+tokens.Token); err != nil {
+		t.Errorf("expected legacy token to be accepted; got %v", err)
+	}
+
+	config.Conf.Tokens.Legacy = false
+	if _, _, err = userInteractors.AuthenticateSession(ctx, "Bearer "+tokens.Token); !testError(t, err, errExpectations{
+		messageFragment: "don't expire",
+		validation:      true,
+	}) {
+		t.Error("expected legacy token to be rejected")
+	}
+	if _, _, err = userInteractors.AuthenticateSession(ctx, "Bearer "+tokens.AccessToken); err != nil {
+		t.Errorf("expected access token to be accepted; got %v", err)
+	}
+	if refreshed, err := userInteractors.RefreshSession(ctx, tokens.RefreshToken); err != nil {
+		t.Fatal(err)
+	} else if refreshed.Token != "" {
+		t.Error("did not expect a legacy token")
+	}
+}
+
+func TestCleanUpSessions(t *testing.T) {
+	defer func(legacy bool) { config.Conf.Tokens.Legacy = legacy }(config.Conf.Tokens.Legacy)
+	const plaintextPassword = "testpassword123"
+	ctx := context.Background()
+
+	config.Conf.Tokens.Legacy = true
+	user, kept, err := userInteractors.RegisterUser(ctx, userInteractors.RegisterUserParams{
+		Email:    t.Name() + "@example.com",
+		Password: plaintextPassword,
+		PwNonce:  "stub_password_nonce",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, signedOut, err := userInteractors.LoginUser(ctx, user.Email, &models.PwHash{Value: plaintextPassword}, "", userInteractors.Device{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, sess, err := userInteractors.AuthenticateSession(ctx, "Bearer "+signedOut.Token); err != nil {
+		t.Fatal(err)
+	} else if err = userInteractors.SignOut(ctx, *user, *sess); err != nil {
+		t.Fatal(err)
+	}
+	// long after every refresh token has expired.
+	later := time.Now().AddDate(1, 0, 0)
+
+	if err = userInteractors.CleanUpSessions(ctx, later); err != nil {
+		t.Fatal(err)
+	}
+	if sessions, err := models.LoadSessions(ctx, user.UUID); err != nil || len(sessions) != 0 {
+		t.Errorf("expected idle sessions to be deleted in legacy mode; got %d, err %v", len(sessions), err)
+	}
+	if _, _, err = userInteractors.AuthenticateSession(ctx, "Bearer "+kept.Token); err != nil {
+		t.Errorf("expected legacy token to restore its session; got %v", err)
+	}
+	if _, _, err = userInteractors.AuthenticateSession(ctx, "Bearer "+signedOut.Token); !testError(t, err, errExpectations{
+		messageFragment: "session",
+		validation:      true,
+	}) {
+		t.Error("expected legacy token of signed out session to stay revoked")
+	}
+
+	config.Conf.Tokens.Legacy = false
+	if err = userInteractors.CleanUpSessions(ctx, later); err != nil {
+		t.Fatal(err)
+	}
+	if sessions, err := models.LoadSessions(ctx, user.UUID); err != nil || len(sessions) != 0 {
+		t.Errorf("expected idle sessions to be deleted; got %d, err %v", len(sessions), err)
+	}
+}
+
+func TestSessionlessLegacyTokens(t *testing.T) {
+	defer func(legacy bool) { config.Conf.Tokens.Legacy = legacy }(config.Conf.Tokens.Legacy)
+	const plaintextPassword = "testpassword123"
+	ctx := context.Background()
+
+	config.Conf.Tokens.Legacy = true
+	user, _, err := userInteractors.RegisterUser(ctx, userInteractors.RegisterUserParams{
+		Email:    t.Name() + "@example.com",
+		Password: plaintextPassword,
+		PwNonce:  "stub_password_nonce",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Before sessions were tracked, the stored password was a plain hash and
+	// tokens carried it, with no session, expiry or key ID.
+	updates := user.MakeSaferCopy()
+	updates.Password = models.Hash(plaintextPassword)
+	if err = user.Update(ctx, updates); err != nil {
+		t.Fatal(err)
+	}
+	key := os.Getenv("SECRET_KEY_BASE")
+	if key == "" {
+		key = "qA6irmDikU6RkCM4V0cJiUJEROuCsqTa1esexI4aWedSv405v8lw4g1KB1nQVsSdCrcyRlKFdws4XPlsArWwv9y5Xr5Jtkb11w1NxKZabOUa7mxjeENuCs31Y1Ce49XH9kGMPe0ms7iV7e9F6WgnsPFGOlIA3CwfGyr12okas2EsDd71SbSnA0zJYjyxeCVCZJWISmLB"
+	}
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, struct {
+		PwHash string
+		UserID string
+		jwt.StandardClaims
+	}{PwHash: user.Password, UserID: user.UUID}).SignedString([]byte(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config.Conf.Tokens.Legacy = false
+	if _, _, err = userInteractors.AuthenticateSession(ctx, "Bearer "+token); !testError(t, err, errExpectations{
+		messageFragment: "don't expire",
+		validation:      true,
+	}) {
+		t.Error("expected token without a session to be rejected")
+	}
+
+	config.Conf.Tokens.Legacy = true
+	authenticated, sess, err := userInteractors.AuthenticateSession(ctx, "Bearer "+token)
+	if err != nil {
+		t.Fatalf("expected token without a session to be accepted; got %v", err)
+	}
+	if authenticated.UUID != user.UUID || sess.UserUUID != user.UUID {
+		t.Errorf("wrong user; got %q, session of %q, expected %q", authenticated.UUID, sess.UserUUID, user.UUID)
+	}
+
+	// Tokens issued from here on belong to a session.
+	tokens, err := userInteractors.ChangeUserPassword(ctx, authenticated, sess.UUID, models.PwChangeParams{
+		API:             "20190520",
+		Identifier:      authenticated.Email,
+		PwCost:          authenticated.PwCost,
+		PwNonce:         "new_password_nonce",
+		CurrentPassword: models.PwHash{Value: plaintextPassword},
+		NewPassword:     models.PwHash{Value: "newpassword123"},
+		Version:         "20190520",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, sess, err = userInteractors.AuthenticateSession(ctx, "Bearer "+tokens.AccessToken); err != nil {
+		t.Fatal(err)
+	} else if sess.UUID == "" {
+		t.Error("expected new tokens to belong to a session")
+	}
+	if _, err = userInteractors.RefreshSession(ctx, tokens.RefreshToken); err != nil {
+		t.Errorf("expected refresh token to be accepted; got %v", err)
+	}
+}
+
+func TestSignOut(t *testing.T) {
+	ctx := context.Background()
+	_, tokens, err := userInteractors.RegisterUser(ctx, userInteractors.RegisterUserParams{
+		Email:    t.Name() + "@example.com",
+		Password: "testpassword123",
+		PwNonce:  "stub_password_nonce",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, sess, err := userInteractors.AuthenticateSession(ctx, "Bearer "+tokens.AccessToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = userInteractors.SignOut(ctx, *user, *sess); err != nil {
+		t.Fatal(err)
+	}
+	for _, token := range []string{tokens.AccessToken, tokens.Token} {
+		if _, _, err = userInteractors.AuthenticateSession(ctx, "Bearer "+token); !testError(t, err, errExpectations{
+			messageFragment: "session",
+			validation:      true,
+		}) {
+			t.Error("expected token to be rejected after signing out")
+		}
+	}
+	if _, err = userInteractors.RefreshSession(ctx, tokens.RefreshToken); !testError(t, err, errExpectations{
+		validation: true,
+	}) {
+		t.Error("expected refresh token to be rejected after signing out")
+	}
+}
@@ -0,0 +1,153 @@
+package interactors
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/rafaelespinoza/standardnotes/internal/errs"
+	"github.com/rafaelespinoza/standardnotes/internal/models"
+)
+
+// _TwoFactorIssuer names this service in authenticator apps.
+const _TwoFactorIssuer = "Standard Notes"
+
+// TwoFactorEnrollment is what a user needs to add their second factor to an
+// authenticator app.
+type TwoFactorEnrollment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+// EnrollTwoFactor starts setting up TOTP two-factor authentication for the
+// user. It isn't required to sign in until it's activated with a code from the
+// authenticator app. Enrolling again before then starts over with a new secret.
+func EnrollTwoFactor(ctx context.Context, user models.User) (out TwoFactorEnrollment, err error) {
+	var tf models.TwoFactor
+	if tf, err = models.LoadTwoFactor(ctx, user.UUID); err == nil && tf.Enabled {
+		err = authenticationError{error: errTwoFactorAlreadyEnabled, validation: true}
+		return
+	} else if err != nil && !errs.NotFoundError(err) {
+		return
+	}
+	if tf, err = models.NewTwoFactor(user.UUID); err != nil {
+		return
+	}
+	if err = tf.SavePending(ctx); err != nil {
+		return
+	}
+	out = TwoFactorEnrollment{Secret: tf.Secret, URI: tf.URI(_TwoFactorIssuer, user.Email)}
+	return
+}
+
+// ActivateTwoFactor turns on two-factor authentication for the user if the
+// code is from their pending second factor. It outputs recovery codes, which
+// can be used once each in place of a code from the authenticator app.
+func ActivateTwoFactor(ctx context.Context, user models.User, code string) (recoveryCodes []string, err error) {
+	var tf models.TwoFactor
+	if tf, err = models.LoadTwoFactor(ctx, user.UUID); errs.NotFoundError(err) {
+		err = authenticationError{error: errTwoFactorNotEnrolled, validation: true}
+		return
+	} else if err != nil {
+		return
+	} else if tf.Enabled {
+		err = authenticationError{error: errTwoFactorAlreadyEnabled, validation: true}
+		return
+	}
+	var ok bool
+	if ok, err = tf.Check(ctx, code, time.Now()); err != nil {
+		return
+	} else if !ok {
+		err = authenticationError{error: errTwoFactorCodeInvalid, validation: true}
+		return
+	}
+	recoveryCodes, err = tf.Enable(ctx)
+	return
+}
+
+// DisableTwoFactor turns off two-factor authentication for the user, once the
+// current password is confirmed.
+func DisableTwoFactor(ctx context.Context, user models.User, password *models.PwHash) (err error) {
+	if len(password.Value) == 0 {
+		err = authenticationError{error: errNoPasswordProvidedDuringChange, validation: true}
+		return
+	}
+	if _, err = checkPassword(ctx, user.Email, password); err != nil {
+		err = authenticationError{error: errPasswordIncorrect, validation: true}
+		return
+	}
+	err = models.DeleteTwoFactor(ctx, user.UUID)
+	return
+}
+
+// checkTwoFactor is the second step of signing in, for users with two-factor
+// authentication turned on. The code is either from the authenticator app or
+// is one of the user's recovery codes. A wrong code counts as a failed sign in
+// attempt.
+func checkTwoFactor(ctx context.Context, user models.User, code string) (err error) {
+	var tf models.TwoFactor
+	if tf, err = models.LoadTwoFactor(ctx, user.UUID); errs.NotFoundError(err) {
+		err = nil
+		return
+	} else if err != nil || !tf.Enabled {
+		return
+	}
+	if code == "" {
+		err = twoFactorError{error: errTwoFactorRequired, tag: _TwoFactorRequiredTag}
+		return
+	}
+	var ok bool
+	if ok, err = tf.Check(ctx, code, time.Now()); err != nil || ok {
+		return
+	}
+	if ok, err = models.UseRecoveryCode(ctx, user.UUID, code); err != nil || ok {
+		return
+	}
+	if ierr := handleFailedAuthAttempt(ctx, user.Email, user.UUID); ierr != nil {
+		log.Printf("could not record failed sign in attempt; %v\n", ierr)
+	}
+	err = twoFactorError{error: errTwoFactorCodeInvalid, tag: _TwoFactorInvalidTag}
+	return
+}
+
+// Tags of two-factor sign in errors, as expected by clients of the legacy API.
+const (
+	_TwoFactorRequiredTag = "mfa-required"
+	_TwoFactorInvalidTag  = "mfa-invalid"
+)
+
+// twoFactorError means that the password was correct, but the second factor is
+// missing or wrong.
+type twoFactorError struct {
+	error
+	tag string
+}
+
+func (e twoFactorError) Validation() bool { return true }
+
+var _ errs.Validation = (*twoFactorError)(nil)
+
+// TwoFactorTag outputs "mfa-required" or "mfa-invalid" if err is about the
+// second factor of a sign in. Otherwise, it outputs an empty string.
+func TwoFactorTag(err error) string {
+	if e, ok := err.(twoFactorError); ok {
+		return e.tag
+	}
+	return ""
+}
+
+var (
+	errTwoFactorRequired = errors.New(
+		"please enter your two-factor authentication code",
+	)
+	errTwoFactorCodeInvalid = errors.New(
+		"the two-factor authentication code you entered is incorrect, please try again",
+	)
+	errTwoFactorAlreadyEnabled = errors.New(
+		"two-factor authentication is already enabled",
+	)
+	errTwoFactorNotEnrolled = errors.New(
+		"two-factor authentication has not been set up yet",
+	)
+)
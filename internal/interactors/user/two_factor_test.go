@@ -0,0 +1,118 @@
+package interactors_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	userInteractors "github.com/rafaelespinoza/standardnotes/internal/interactors/user"
+	"github.com/rafaelespinoza/standardnotes/internal/models"
+)
+
+func TestTwoFactor(t *testing.T) {
+	const plaintextPassword = "testpassword123"
+	ctx := context.Background()
+	user, _, err := userInteractors.RegisterUser(ctx, userInteractors.RegisterUserParams{
+		Email:    t.Name() + "@example.com",
+		Password: plaintextPassword,
+		PwNonce:  "stub_password_nonce",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	password := &models.PwHash{Value: plaintextPassword}
+
+	if _, err = userInteractors.ActivateTwoFactor(ctx, *user, "123456"); !testError(t, err, errExpectations{
+		messageFragment: "not been set up",
+		validation:      true,
+	}) {
+		t.Error("expected activation before enrolling to fail")
+	}
+	enrollment, err := userInteractors.EnrollTwoFactor(ctx, *user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if enrollment.Secret == "" || enrollment.URI == "" {
+		t.Fatalf("incomplete enrollment %+v", enrollment)
+	}
+	// not active yet, so a code isn't needed.
+	if _, _, err = userInteractors.LoginUser(ctx, user.Email, password, "", userInteractors.Device{}); err != nil {
+		t.Fatalf("did not expect error before activation; got %v", err)
+	}
+
+	now := time.Now()
+	codeAt := func(t *testing.T, when time.Time) string {
+		t.Helper()
+		code, err := models.TOTPCode(enrollment.Secret, when)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return code
+	}
+	if _, err = userInteractors.ActivateTwoFactor(ctx, *user, "000000"+codeAt(t, now)); !testError(t, err, errExpectations{
+		messageFragment: "incorrect",
+		validation:      true,
+	}) {
+		t.Error("expected activation with a wrong code to fail")
+	}
+	recoveryCodes, err := userInteractors.ActivateTwoFactor(ctx, *user, codeAt(t, now))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recoveryCodes) == 0 {
+		t.Fatal("expected recovery codes")
+	}
+	if _, err = userInteractors.EnrollTwoFactor(ctx, *user); !testError(t, err, errExpectations{
+		messageFragment: "already enabled",
+		validation:      true,
+	}) {
+		t.Error("expected enrolling again to fail")
+	}
+
+	t.Run("sign in", func(t *testing.T) {
+		tests := []struct {
+			name   string
+			code   string
+			expTag string
+		}{
+			{"no code", "", "mfa-required"},
+			{"wrong code", "not-a-code", "mfa-invalid"},
+			{"used code", codeAt(t, now), "mfa-invalid"},
+			{"next code", codeAt(t, now.Add(30*time.Second)), ""},
+			{"recovery code", recoveryCodes[0], ""},
+			{"used recovery code", recoveryCodes[0], "mfa-invalid"},
+		}
+		for _, test := range tests {
+			signedIn, token, err := userInteractors.LoginUser(ctx, user.Email, password, test.code, userInteractors.Device{})
+			if tag := userInteractors.TwoFactorTag(err); tag != test.expTag {
+				t.Errorf("%s; wrong tag; got %q, expected %q", test.name, tag, test.expTag)
+			}
+			if test.expTag == "" && (err != nil || token.AccessToken == "" || signedIn == nil) {
+				t.Errorf("%s; expected to sign in; got err %v", test.name, err)
+			} else if test.expTag != "" && (token.AccessToken != "" || signedIn != nil) {
+				t.Errorf("%s; expected no token or user", test.name)
+			}
+		}
+
+		// the second factor doesn't make up for a wrong password.
+		_, _, err := userInteractors.LoginUser(ctx, user.Email, &models.PwHash{Value: plaintextPassword[1:]}, recoveryCodes[1], userInteractors.Device{})
+		if tag := userInteractors.TwoFactorTag(err); err == nil || tag != "" {
+			t.Errorf("expected password error; got %v", err)
+		}
+	})
+
+	t.Run("disable", func(t *testing.T) {
+		if err := userInteractors.DisableTwoFactor(ctx, *user, &models.PwHash{Value: plaintextPassword[1:]}); !testError(t, err, errExpectations{
+			messageFragment: "password",
+			validation:      true,
+		}) {
+			t.Error("expected wrong password to be rejected")
+		}
+		if err := userInteractors.DisableTwoFactor(ctx, *user, password); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := userInteractors.LoginUser(ctx, user.Email, password, "", userInteractors.Device{}); err != nil {
+			t.Errorf("did not expect error after disabling; got %v", err)
+		}
+	})
+}
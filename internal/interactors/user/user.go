@@ -1,23 +1,34 @@
 package interactors
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"log"
 	"strings"
+	"time"
 
+	"github.com/rafaelespinoza/standardnotes/internal/config"
+	"github.com/rafaelespinoza/standardnotes/internal/db"
 	"github.com/rafaelespinoza/standardnotes/internal/errs"
 	"github.com/rafaelespinoza/standardnotes/internal/jobs"
 	"github.com/rafaelespinoza/standardnotes/internal/logger"
 	"github.com/rafaelespinoza/standardnotes/internal/models"
+	"github.com/rafaelespinoza/standardnotes/internal/webhooks"
 )
 
-func MakeAuthParams(email string) (params models.PwGenParams, err error) {
+// MakeAuthParams outputs the parameters that the client needs to derive the
+// user's password. To avoid revealing which addresses are registered, made-up
+// parameters are output for an unknown address.
+func MakeAuthParams(ctx context.Context, email string) (params models.PwGenParams, err error) {
 	if err = models.ValidateEmail(email); err != nil {
 		return
 	}
 	var user *models.User
-	if user, err = models.LoadUserByEmail(email); err != nil {
+	if user, err = models.LoadUserByEmail(ctx, email); errs.NotFoundError(err) {
+		params, err = models.FakePwGenParams(email), nil
+		return
+	} else if err != nil {
 		err = maybeMutateError(err)
 		return
 	}
@@ -33,24 +44,42 @@ type RegisterUserParams struct {
 	PwCost     int    `json:"pw_cost"`
 	PwNonce    string `json:"pw_nonce"`
 	Version    string
+	// Device is where the request came from, for the new session.
+	Device Device `json:"-"`
 }
 
-// Register creates a new user and returns a token.
-func RegisterUser(params RegisterUserParams) (user *models.User, token string, err error) {
+// Register creates a new user and returns tokens for a new session. If email
+// verification is required, then there's no session yet and the tokens are
+// empty.
+func RegisterUser(ctx context.Context, params RegisterUserParams) (user *models.User, tokens SessionTokens, err error) {
 	user = models.NewUser()
 	user.Email = params.Email
 	user.Password = params.Password
 	user.PwCost = params.PwCost
 	user.PwNonce = params.PwNonce
-	err = user.Create()
-	if err != nil {
+
+	// If verification is required, then the user can't sign in until they
+	// follow the link in the welcome message. So don't hand out a token yet.
+	// The account and its verification record are saved together, so that
+	// there's never an account that skipped verification.
+	verify := config.Conf.Verification.Required
+	if err = db.WithTx(ctx, func(ctx context.Context) (err error) {
+		if err = user.Create(ctx); err != nil || !verify {
+			return
+		}
+		return models.RequireEmailVerification(ctx, user.UUID)
+	}); err != nil {
 		user = nil
 		return
 	}
 
-	password := user.PwHashState()
-	user, token, err = LoginUser(user.Email, &password)
-	if err != nil {
+	var link string
+	if verify {
+		if link, err = makeVerificationLink(*user); err != nil {
+			user = nil
+			return
+		}
+	} else if tokens, err = signIn(ctx, user, params.Device); err != nil {
 		user = nil
 		err = fmt.Errorf("registration failed; %v", err)
 		return
@@ -58,27 +87,76 @@ func RegisterUser(params RegisterUserParams) (user *models.User, token string, e
 
 	if err = jobs.PerformRegistrationJob(
 		jobs.RegistrationJobParams{
-			Email:     user.Email,
-			CreatedAt: user.CreatedAt.UTC(),
+			Email:            user.Email,
+			CreatedAt:        user.CreatedAt.UTC(),
+			VerificationLink: link,
 		},
 	); err != nil {
 		// log it, but keep going
 		log.Printf("error performing job; %v\n", err)
 		err = nil
 	}
+	webhooks.Publish(ctx, webhooks.EventUserRegistered, user.UUID, map[string]interface{}{
+		"user_uuid":  user.UUID,
+		"email":      user.Email,
+		"created_at": user.CreatedAt.UTC(),
+	})
 	return
 }
 
-// LoginUser signs in the user. It returns a token on success, otherwise an error.
-func LoginUser(email string, password *models.PwHash) (user *models.User, token string, err error) {
-	password.Hash()
-	if user, err = models.LoadUserByEmailAndPassword(email, password.Value); err != nil {
-		err = maybeMutateError(err)
+// LoginUser signs in the user. It returns tokens, for a new session on the
+// device, on success, otherwise an error. If the user has two-factor
+// authentication turned on, then code is the TOTP code or a recovery code.
+// Without one, the error has a TwoFactorTag.
+func LoginUser(ctx context.Context, email string, password *models.PwHash, code string, device Device) (user *models.User, tokens SessionTokens, err error) {
+	if user, err = checkPassword(ctx, email, password); err != nil {
+		return
+	}
+	if err = checkTwoFactor(ctx, *user, code); err != nil {
+		user = nil
 		return
 	}
+	if tokens, err = signIn(ctx, user, device); err != nil {
+		user = nil
+	}
+	return
+}
 
-	if user.UUID == "" {
+// checkPassword loads the user with the email address if the password is
+// correct. A wrong password counts as a failed sign in attempt. An unknown
+// address takes as long, and fails the same way, as a wrong password.
+func checkPassword(ctx context.Context, email string, password *models.PwHash) (user *models.User, err error) {
+	if err = checkLockout(ctx, email); err != nil {
+		return
+	}
+	if user, err = models.LoadUserByEmail(ctx, email); err == nil {
+		var ok bool
+		if ok, err = user.VerifyPassword(ctx, password.Value); err == nil && !ok {
+			err = authenticationError{error: errInvalidEmailOrPassword, notFound: true}
+		}
+	} else if errs.NotFoundError(err) {
+		models.SimulatePasswordCheck(password.Value)
+	}
+	if err != nil {
+		var userUUID string
+		if user != nil {
+			userUUID = user.UUID
+		}
 		user = nil
+		if errs.NotFoundError(err) {
+			if ierr := handleFailedAuthAttempt(ctx, email, userUUID); ierr != nil {
+				log.Printf("could not record failed sign in attempt; %v\n", ierr)
+			}
+		}
+		err = maybeMutateError(err)
+	}
+	return
+}
+
+// signIn starts a session and issues its tokens for a user whose password is
+// already checked.
+func signIn(ctx context.Context, user *models.User, device Device) (tokens SessionTokens, err error) {
+	if user.UUID == "" {
 		err = authenticationError{
 			error:      errInvalidEmailOrPassword,
 			validation: true,
@@ -86,27 +164,94 @@ func LoginUser(email string, password *models.PwHash) (user *models.User, token
 		return
 	}
 
-	token, err = models.EncodeToken(*user)
-	if err != nil {
-		user = nil
+	var verified bool
+	if verified, err = models.EmailVerified(ctx, user.UUID); err != nil {
+		return
+	} else if !verified {
+		err = authenticationError{error: errEmailNotVerified, validation: true}
 		return
 	}
 
+	if err = handleSuccessfulAuthAttempt(ctx, user.Email); err != nil {
+		return
+	}
+
+	var sess *models.Session
+	if sess, err = models.CreateSession(ctx, user.UUID, device.UserAgent, device.IPAddress); err != nil {
+		return
+	}
+	tokens, err = issueTokens(ctx, *user, sess.UUID)
 	return
 }
 
-func handleFailedAuthAttempt(u models.User) error {
-	// TODO increment number of failed login attempts for user (also store in
-	// the db). If it 's past a limit, return an error and lockout user.
+// checkLockout returns an error if the email address has had too many failed
+// sign in attempts recently.
+func checkLockout(ctx context.Context, email string) error {
+	if config.Conf.Lockout.MaxAttempts < 1 {
+		return nil
+	}
+	failures, err := models.LoadAuthFailures(ctx, email)
+	if err != nil {
+		return err
+	}
+	if failures.Locked(time.Now().UTC()) {
+		return authenticationError{error: errTooManyFailedAttempts, validation: true}
+	}
 	return nil
 }
 
-func handleSuccessfulAuthAttempt(u models.User) error {
-	// TODO reset number of failed attempts to 0.
+// handleFailedAuthAttempt increments the number of failed sign in attempts for
+// the email address. Once it's past the configured limit, the address is locked
+// out for a while. The userUUID is of the user with the address, if there is
+// one.
+func handleFailedAuthAttempt(ctx context.Context, email, userUUID string) error {
+	conf := config.Conf.Lockout
+	if conf.MaxAttempts < 1 {
+		return nil
+	}
+	lockFor := time.Duration(conf.Minutes) * time.Minute
+	locked, err := models.RecordAuthFailure(ctx, email, conf.MaxAttempts, lockFor)
+	if err != nil {
+		return err
+	}
+	if locked {
+		log.Printf("locked out %q after %d failed sign in attempts\n", email, conf.MaxAttempts)
+		webhooks.Publish(ctx, webhooks.EventSignInLockout, userUUID, map[string]interface{}{
+			"email":        email,
+			"attempts":     conf.MaxAttempts,
+			"locked_until": time.Now().UTC().Add(lockFor),
+		})
+	}
 	return nil
 }
 
-func ChangeUserPassword(user *models.User, password models.PwChangeParams) (token string, err error) {
+// handleSuccessfulAuthAttempt resets the number of failed attempts to 0.
+func handleSuccessfulAuthAttempt(ctx context.Context, email string) error {
+	if config.Conf.Lockout.MaxAttempts < 1 {
+		return nil
+	}
+	return models.ResetAuthFailures(ctx, email)
+}
+
+// UpdateUser saves new auth params for the user. The password in the updates
+// is hashed the same way as it is at registration, and it can't be empty.
+func UpdateUser(ctx context.Context, user *models.User, updates models.User) (err error) {
+	if updates.Password == "" {
+		err = authenticationError{error: errNoPasswordProvidedDuringUpdate, validation: true}
+		return
+	}
+	if updates.Password, err = models.HashPassword(updates.Password); err != nil {
+		return
+	}
+	err = user.Update(ctx, updates)
+	return
+}
+
+// ChangeUserPassword sets a new password for the user, who is signed in with
+// the session sessionUUID. The user's other sessions are revoked, and the
+// output is new tokens for the same session. The password and revocations are
+// saved in one transaction.
+func ChangeUserPassword(ctx context.Context, user *models.User, sessionUUID string, password models.PwChangeParams) (tokens SessionTokens, err error) {
 	if len(password.CurrentPassword.Value) == 0 {
 		err = authenticationError{error: errNoPasswordProvidedDuringChange, validation: true}
 		return
@@ -115,40 +260,193 @@ func ChangeUserPassword(user *models.User, password models.PwChangeParams) (toke
 		return
 	}
 
-	if _, _, err = LoginUser(user.Email, &password.CurrentPassword); err != nil {
-		if ierr := handleFailedAuthAttempt(*user); ierr != nil {
-			err = ierr
-		}
+	if _, err = checkPassword(ctx, user.Email, &password.CurrentPassword); err != nil {
 		err = authenticationError{error: errPasswordIncorrect, validation: true}
 		return
 	}
-	if err = handleSuccessfulAuthAttempt(*user); err != nil {
+
+	updates := user.MakeSaferCopy()
+	if updates.Password, err = models.HashPassword(password.NewPassword.Value); err != nil {
+		return
+	}
+	updates.PwNonce = password.PwNonce
+
+	saved := *user // in case of db error, rollback in-memory.
+	if err = db.WithTx(ctx, func(ctx context.Context) (err error) {
+		if sessionUUID, err = sessionFor(ctx, *user, sessionUUID); err != nil {
+			return
+		}
+		if err = user.Update(ctx, updates); err != nil {
+			return
+		}
+		if err = models.RevokeOtherSessions(ctx, user.UUID, sessionUUID); err != nil {
+			return
+		}
+		// the new password already revokes every legacy token from before.
+		if err = models.ForgetRevokedSessions(ctx, user.UUID); err != nil {
+			return
+		}
+		return models.RevokeRefreshTokens(ctx, sessionUUID)
+	}); err != nil {
+		*user = saved
+		err = maybeMutateError(err)
+		return
+	}
+	if tokens, err = issueTokens(ctx, *user, sessionUUID); err != nil {
+		return
+	}
+	webhooks.Publish(ctx, webhooks.EventPasswordChanged, user.UUID, map[string]interface{}{
+		"user_uuid":  user.UUID,
+		"updated_at": user.UpdatedAt.UTC(),
+	})
+	return
+}
+
+// EmailChangeParams are the inputs for changing a user's email address. The
+// client derives a new password, with a new nonce, from the new address.
+type EmailChangeParams struct {
+	CurrentPassword models.PwHash
+	NewEmail        string
+	NewPassword     models.PwHash
+	PwCost          int
+	PwNonce         string
+}
+
+// ChangeUserEmail moves the user, who is signed in with the session
+// sessionUUID, to a new email address. Like ChangeUserPassword, the user's
+// other sessions are revoked, and the output is new tokens for the same
+// session. If email verification is required, then the new address has to be
+// verified before the user can sign in again.
+func ChangeUserEmail(ctx context.Context, user *models.User, sessionUUID string, params EmailChangeParams) (tokens SessionTokens, err error) {
+	if len(params.CurrentPassword.Value) == 0 {
+		err = authenticationError{error: errNoPasswordProvidedDuringEmailChange, validation: true}
+		return
+	} else if len(params.NewPassword.Value) == 0 || len(params.PwNonce) == 0 {
+		err = authenticationError{error: errMissingNewEmailAuthParams, validation: true}
+		return
+	} else if strings.EqualFold(params.NewEmail, user.Email) {
+		err = authenticationError{error: errSameEmail, validation: true}
+		return
+	}
+
+	if _, err = checkPassword(ctx, user.Email, &params.CurrentPassword); err != nil {
+		err = authenticationError{error: errPasswordIncorrect, validation: true}
 		return
 	}
 
+	previousEmail := user.Email
 	updates := user.MakeSaferCopy()
-	password.NewPassword.Hash()
-	updates.Password = password.NewPassword.Value
-	updates.PwNonce = password.PwNonce
-	if err = user.Update(updates); err != nil {
+	updates.Email = params.NewEmail
+	if updates.Password, err = models.HashPassword(params.NewPassword.Value); err != nil {
 		return
 	}
+	updates.PwCost = params.PwCost
+	updates.PwNonce = params.PwNonce
 
-	// now login again with new password
-	newPassword := models.PwHash{
-		Value: user.Password,
-		// Don't rehash, login would fail. It was already hashed before updating
-		// user in DB.
-		Hashed: true,
+	verify := config.Conf.Verification.Required
+	saved := *user // in case of db error, rollback in-memory.
+	if err = db.WithTx(ctx, func(ctx context.Context) (err error) {
+		if sessionUUID, err = sessionFor(ctx, *user, sessionUUID); err != nil {
+			return
+		}
+		if err = user.ChangeEmail(ctx, updates); err != nil {
+			return
+		}
+		if verify {
+			if err = models.RequireEmailVerification(ctx, user.UUID); err != nil {
+				return
+			}
+		}
+		if err = models.RevokeOtherSessions(ctx, user.UUID, sessionUUID); err != nil {
+			return
+		}
+		// the new password already revokes every legacy token from before.
+		if err = models.ForgetRevokedSessions(ctx, user.UUID); err != nil {
+			return
+		}
+		return models.RevokeRefreshTokens(ctx, sessionUUID)
+	}); err != nil {
+		*user = saved
+		err = maybeMutateError(err)
+		return
 	}
-	if user, token, err = LoginUser(user.Email, &newPassword); err != nil {
+	if tokens, err = issueTokens(ctx, *user, sessionUUID); err != nil {
+		return
+	}
+
+	if verify {
+		var link string
+		if link, err = makeVerificationLink(*user); err != nil {
+			return
+		}
+		if err = jobs.PerformVerificationJob(
+			jobs.VerificationJobParams{Email: user.Email, VerificationLink: link},
+		); err != nil {
+			// log it, but keep going; the user can ask for another link.
+			log.Printf("error performing job; %v\n", err)
+			err = nil
+		}
+	}
+	webhooks.Publish(ctx, webhooks.EventEmailChanged, user.UUID, map[string]interface{}{
+		"user_uuid":      user.UUID,
+		"email":          user.Email,
+		"previous_email": previousEmail,
+		"updated_at":     user.UpdatedAt.UTC(),
+	})
+	return
+}
+
+// DeleteUser deletes the user's account and all of its data for good, once the
+// password is confirmed. With emailBackup, a backup of the user's items is
+// emailed first; if that fails, then nothing is deleted.
+func DeleteUser(ctx context.Context, user models.User, password *models.PwHash, emailBackup bool) (err error) {
+	if len(password.Value) == 0 {
+		err = authenticationError{error: errNoPasswordProvidedDuringDelete, validation: true}
+		return
+	}
+	if _, err = checkPassword(ctx, user.Email, password); err != nil {
 		err = authenticationError{error: errPasswordIncorrect, validation: true}
 		return
 	}
+	err = deleteUser(ctx, user, emailBackup)
+	return
+}
+
+// DeleteUserByEmail is DeleteUser for administrators, without a password. If
+// there's no such user, then the error is a NotFound error.
+func DeleteUserByEmail(ctx context.Context, email string, emailBackup bool) (err error) {
+	var user *models.User
+	if user, err = models.LoadUserByEmail(ctx, email); err != nil {
+		return
+	}
+	err = deleteUser(ctx, *user, emailBackup)
+	return
+}
+
+func deleteUser(ctx context.Context, user models.User, emailBackup bool) (err error) {
+	if emailBackup {
+		if err = jobs.PerformMailerJob(ctx, jobs.MailerJobParams{
+			UserID:  user.UUID,
+			Subject: "Your Standard Notes account was deleted",
+			Body:    "Your Standard Notes account was deleted. Attached is a final backup of your data. It's encrypted, and can be imported into a new account.\n",
+		}); err != nil {
+			return
+		}
+	}
+	if err = user.Delete(ctx); err != nil {
+		return
+	}
+	webhooks.Publish(ctx, webhooks.EventUserDeleted, user.UUID, map[string]interface{}{
+		"user_uuid":  user.UUID,
+		"deleted_at": time.Now().UTC(),
+	})
 	return
 }
 
 var (
+	errNoPasswordProvidedDuringUpdate = errors.New(
+		"the update request is missing a password, please try again",
+	)
 	errMissingNewAuthParams = errors.New(
 		"the change password request is missing new auth parameters, please try again",
 	)
@@ -156,9 +454,33 @@ var (
 		your current password is required to change your password,
 		please update your application if you do not see this option.`,
 	))
+	errNoPasswordProvidedDuringEmailChange = errors.New(
+		"your current password is required to change your email address",
+	)
+	errMissingNewEmailAuthParams = errors.New(
+		"the change email request is missing a new password or auth parameters, please try again",
+	)
+	errSameEmail = errors.New(
+		"the new email address is the same as the current one",
+	)
+	errNoPasswordProvidedDuringDelete = errors.New(
+		"your current password is required to delete your account",
+	)
 	errPasswordIncorrect = errors.New(
 		"the current password you entered is incorrect, please try again",
 	)
+	errTooManyFailedAttempts = errors.New(
+		"too many failed sign in attempts, please try again later",
+	)
+	errEmailNotVerified = errors.New(
+		"your email address has not been verified yet, please check your email for a verification link",
+	)
+	errSessionRevoked = errors.New(
+		"your session has ended, please sign in again",
+	)
+	errLegacyToken = errors.New(
+		"tokens that don't expire are not accepted, please sign in again",
+	)
 	// errInvalidEmailOrPassword is a fallback error.
 	errInvalidEmailOrPassword = errors.New("invalid email or password")
 )
@@ -191,7 +513,16 @@ func maybeMutateError(in error) (out error) {
 	return
 }
 
-func AuthenticateUser(header string) (user *models.User, err error) {
+// AuthenticateUser checks the token in an Authorization header and outputs the
+// user that it belongs to.
+func AuthenticateUser(ctx context.Context, header string) (user *models.User, err error) {
+	user, _, err = AuthenticateSession(ctx, header)
+	return
+}
+
+// AuthenticateSession is like AuthenticateUser, but also outputs the session
+// that the token belongs to. Tokens for revoked sessions are rejected.
+func AuthenticateSession(ctx context.Context, header string) (user *models.User, sess *models.Session, err error) {
 	authHeaderParts := strings.Split(header, " ")
 
 	if len(authHeaderParts) != 2 || strings.ToLower(authHeaderParts[0]) != "bearer" {
@@ -216,9 +547,13 @@ func AuthenticateUser(header string) (user *models.User, err error) {
 		return
 	}
 	claims := token.Claims()
+	if claims.Expiry().IsZero() && !config.Conf.Tokens.Legacy {
+		err = authenticationError{error: errLegacyToken, validation: true}
+		return
+	}
 	logger.LogIfDebug("token is valid, claims: ", claims)
 
-	if user, err = models.LoadUserByUUID(claims.UUID()); err != nil {
+	if user, err = models.LoadUserByUUID(ctx, claims.UUID()); err != nil {
 		logger.LogIfDebug("LoadUserByUUID error: ", err)
 		err = maybeMutateError(err)
 		return
@@ -230,6 +565,37 @@ func AuthenticateUser(header string) (user *models.User, err error) {
 			error:      errors.New("password does not match"),
 			validation: true,
 		}
+		return
+	}
+
+	if claims.Session() == "" {
+		// a token from before sessions were tracked. It doesn't expire, so
+		// it's only accepted in legacy mode, on the strength of the password
+		// fingerprint that's checked above. There's no session to load, so
+		// the output is an unsaved one.
+		if !config.Conf.Tokens.Legacy {
+			user = nil
+			err = authenticationError{error: errLegacyToken, validation: true}
+			return
+		}
+		sess = &models.Session{UserUUID: user.UUID}
+		return
+	}
+	sess, err = models.LoadSession(ctx, claims.Session())
+	if errs.NotFoundError(err) && claims.Expiry().IsZero() {
+		// a legacy token, whose session was cleaned up while it was idle.
+		sess, err = models.RestoreSession(ctx, claims.Session(), user.UUID)
+	}
+	if errs.NotFoundError(err) || (err == nil && sess.UserUUID != user.UUID) {
+		user, sess = nil, nil
+		err = authenticationError{error: errSessionRevoked, validation: true}
+		return
+	} else if err != nil {
+		user = nil
+		return
+	}
+	if terr := sess.Touch(ctx, time.Now()); terr != nil {
+		log.Printf("could not update session last used time; %v\n", terr)
 	}
 	return
 }
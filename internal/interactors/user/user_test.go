@@ -1,17 +1,22 @@
 package interactors_test
 
 import (
+	"context"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/rafaelespinoza/standardnotes/internal/config"
 	"github.com/rafaelespinoza/standardnotes/internal/db"
+	"github.com/rafaelespinoza/standardnotes/internal/db/dbtest"
 	"github.com/rafaelespinoza/standardnotes/internal/errs"
 	userInteractors "github.com/rafaelespinoza/standardnotes/internal/interactors/user"
+	"github.com/rafaelespinoza/standardnotes/internal/mail"
 	"github.com/rafaelespinoza/standardnotes/internal/models"
 )
 
 func init() {
-	db.Init(":memory:")
+	dbtest.Init()
 }
 
 func TestMakeAuthParams(t *testing.T) {
@@ -21,11 +26,11 @@ func TestMakeAuthParams(t *testing.T) {
 		user.Password = "testpassword123"
 		user.PwNonce = "stub_password_nonce"
 		var err error
-		if err = user.Create(); err != nil {
+		if err = user.Create(context.Background()); err != nil {
 			t.Fatal(err)
 		}
 		var params models.PwGenParams
-		if params, err = userInteractors.MakeAuthParams(user.Email); err != nil {
+		if params, err = userInteractors.MakeAuthParams(context.Background(), user.Email); err != nil {
 			t.Error(err)
 		}
 		if params.PwFunc != "pbkdf2" {
@@ -43,6 +48,44 @@ func TestMakeAuthParams(t *testing.T) {
 				params.PwNonce, "stub_password_nonce",
 			)
 		}
+		// otherwise, whether an address is registered shows in whether its
+		// params depend on case.
+		if params, err = userInteractors.MakeAuthParams(context.Background(), strings.ToUpper(user.Email)); err != nil {
+			t.Error(err)
+		} else if params.PwNonce != "stub_password_nonce" {
+			t.Errorf("expected the user's params for another case; got nonce %q", params.PwNonce)
+		}
+	})
+
+	t.Run("unknown email", func(t *testing.T) {
+		email := t.Name() + "@example.com"
+		params, err := userInteractors.MakeAuthParams(context.Background(), email)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if params.Identifier != email || params.Version != "003" {
+			t.Errorf("wrong params; got %+v", params)
+		}
+		if params.PwFunc != "pbkdf2" || params.PwCost < 100000 {
+			t.Errorf("expected params like those of a new user; got %+v", params)
+		}
+		if len(params.PwNonce) != 64 || params.PwSalt == "" {
+			t.Errorf("expected a nonce and salt; got %+v", params)
+		}
+		again, err := userInteractors.MakeAuthParams(context.Background(), email)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if again != params {
+			t.Errorf("expected the same params every time;\nfirst:  %+v\nsecond: %+v", params, again)
+		}
+		other, err := userInteractors.MakeAuthParams(context.Background(), "other-"+email)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if other.PwNonce == params.PwNonce {
+			t.Error("expected different addresses to have different nonces")
+		}
 	})
 
 	t.Run("errors", func(t *testing.T) {
@@ -50,17 +93,17 @@ func TestMakeAuthParams(t *testing.T) {
 		user.Email = t.Name() + "@example.com"
 		user.Password = "testpassword123"
 		var err error
-		if err = user.Create(); err != nil {
+		if err = user.Create(context.Background()); err != nil {
 			t.Fatal(err)
 		}
-		if _, err = userInteractors.MakeAuthParams(""); !errs.ValidationError(err) {
+		if _, err = userInteractors.MakeAuthParams(context.Background(), ""); !errs.ValidationError(err) {
 			t.Errorf("expected validation error but got %#v", err)
 		}
 		longEmail := strings.Repeat("foobar", 42) + "@example.com"
-		if _, err = userInteractors.MakeAuthParams(longEmail); !errs.ValidationError(err) {
+		if _, err = userInteractors.MakeAuthParams(context.Background(), longEmail); !errs.ValidationError(err) {
 			t.Errorf("expected validation error but got %#v", err)
 		}
-		if _, err = userInteractors.MakeAuthParams("foobar"); !errs.ValidationError(err) {
+		if _, err = userInteractors.MakeAuthParams(context.Background(), "foobar"); !errs.ValidationError(err) {
 			t.Errorf("expected validation error but got %#v", err)
 		}
 	})
@@ -68,6 +111,7 @@ func TestMakeAuthParams(t *testing.T) {
 
 func TestRegisterUser(t *testing.T) {
 	user, tokenAfterRegistration, err := userInteractors.RegisterUser(
+		context.Background(),
 		userInteractors.RegisterUserParams{
 			Email:    "user2@local",
 			Password: "3cb5561daa49bd5b4438ad214a6f9a6d9b056a2c0b9a91991420ad9d658b8fac",
@@ -76,31 +120,29 @@ func TestRegisterUser(t *testing.T) {
 	if err != nil {
 		t.Error(err)
 	}
-	if tokenAfterRegistration == "" {
+	if tokenAfterRegistration.AccessToken == "" {
 		t.Error("token should not be empty")
 	}
 	if user == nil {
 		t.Error("user should not be nil")
 	}
 
-	password := user.PwHashState()
 	user, tokenAfterLogin, err := userInteractors.LoginUser(
+		context.Background(),
 		user.Email,
-		&password,
+		&models.PwHash{Value: "3cb5561daa49bd5b4438ad214a6f9a6d9b056a2c0b9a91991420ad9d658b8fac"},
+		"",
+		userInteractors.Device{},
 	)
 	if err != nil {
 		t.Error(err)
 	}
-	if tokenAfterLogin == "" {
+	if tokenAfterLogin.AccessToken == "" {
 		t.Error("token should not be empty")
 	}
-	if tokenAfterLogin != tokenAfterRegistration {
-		if tokenAfterLogin != tokenAfterRegistration {
-			t.Errorf(
-				"tokens should be the same\nafter registration: %q\nafter logging in:   %q",
-				tokenAfterRegistration, tokenAfterLogin,
-			)
-		}
+	// each sign in is a separate session.
+	if tokenAfterLogin.AccessToken == tokenAfterRegistration.AccessToken {
+		t.Errorf("tokens should be different; got %q", tokenAfterLogin.AccessToken)
 	}
 }
 
@@ -113,16 +155,15 @@ func TestLoginUser(t *testing.T) {
 		user.Email = email
 		user.Password = plaintextPassword
 		user.PwNonce = "stub_password_nonce"
-		if err := user.Create(); err != nil {
+		if err := user.Create(context.Background()); err != nil {
 			t.Fatal(err)
 		}
 
-		password := user.PwHashState()
-		user, token, err := userInteractors.LoginUser(email, &password)
+		user, token, err := userInteractors.LoginUser(context.Background(), email, &models.PwHash{Value: plaintextPassword}, "", userInteractors.Device{})
 		if err != nil {
 			t.Error(err)
 		}
-		if token == "" {
+		if token.AccessToken == "" {
 			t.Error("token empty")
 		}
 		if user == nil {
@@ -137,15 +178,15 @@ func TestLoginUser(t *testing.T) {
 			user.Email = email
 			user.Password = plaintextPassword
 			user.PwNonce = "stub_password_nonce"
-			if err := user.Create(); err != nil {
+			if err := user.Create(context.Background()); err != nil {
 				t.Fatal(err)
 			}
 
-			user, token, err := userInteractors.LoginUser(email, &models.PwHash{Value: plaintextPassword[1:]})
+			user, token, err := userInteractors.LoginUser(context.Background(), email, &models.PwHash{Value: plaintextPassword[1:]}, "", userInteractors.Device{})
 			if err == nil {
 				t.Errorf("expected error; got %v", err)
 			}
-			if token != "" {
+			if token.AccessToken != "" {
 				t.Error("token should be empty")
 			}
 			if user != nil {
@@ -161,11 +202,11 @@ func TestLoginUser(t *testing.T) {
 			user.PwNonce = "stub_password_nonce"
 
 			password := user.PwHashState()
-			user, token, err := userInteractors.LoginUser(email, &password)
+			user, token, err := userInteractors.LoginUser(context.Background(), email, &password, "", userInteractors.Device{})
 			if err == nil {
 				t.Errorf("expected error; got %v", err)
 			}
-			if token != "" {
+			if token.AccessToken != "" {
 				t.Error("token should be empty")
 			}
 			if user != nil {
@@ -180,6 +221,7 @@ func TestChangeUserPassword(t *testing.T) {
 		var err error
 
 		user, oldToken, err := userInteractors.RegisterUser(
+			context.Background(),
 			userInteractors.RegisterUserParams{
 				Email:    t.Name() + "@example.com",
 				Password: "testpassword123",
@@ -189,18 +231,22 @@ func TestChangeUserPassword(t *testing.T) {
 		if err != nil {
 			t.Fatalf("did not expect error; got %v", err)
 		}
+		_, sess, err := userInteractors.AuthenticateSession(context.Background(), "Bearer "+oldToken.AccessToken)
+		if err != nil {
+			t.Fatal(err)
+		}
 		oldNonce := user.PwNonce
 		newPassword := models.PwChangeParams{
 			API:             "20190520",
 			Identifier:      user.Email,
 			PwCost:          user.PwCost,
 			PwNonce:         user.PwNonce[1:],
-			CurrentPassword: user.PwHashState(),
-			NewPassword:     models.PwHash{Value: user.Password[1:]},
+			CurrentPassword: models.PwHash{Value: "testpassword123"},
+			NewPassword:     models.PwHash{Value: "newpassword123"},
 			Version:         "20190520",
 		}
 
-		newToken, err := userInteractors.ChangeUserPassword(user, newPassword)
+		newToken, err := userInteractors.ChangeUserPassword(context.Background(), user, sess.UUID, newPassword)
 		if err != nil {
 			t.Errorf("did not expect error; got %v", err)
 		}
@@ -208,8 +254,8 @@ func TestChangeUserPassword(t *testing.T) {
 			t.Error("pw nonce must be different from previous")
 		}
 
-		oldParts := strings.Split(oldToken, ".")
-		newParts := strings.Split(newToken, ".")
+		oldParts := strings.Split(oldToken.AccessToken, ".")
+		newParts := strings.Split(newToken.AccessToken, ".")
 		// Testing parts of the old token is not crucial, but it's low-hanging
 		// fruit. What's important is that some parts have changed correctly.
 		for i, parts := range [][]string{oldParts, newParts} {
@@ -240,20 +286,20 @@ func TestChangeUserPassword(t *testing.T) {
 			user.Email = t.Name() + "@example.com"
 			user.Password = "testpassword123"
 			user.PwNonce = "stub_password_nonce"
-			if err := user.Create(); err != nil {
+			if err := user.Create(context.Background()); err != nil {
 				t.Fatalf("could not set up user; got %v", err)
 			}
 
 			newPassword := models.PwChangeParams{}
-			token, err := userInteractors.ChangeUserPassword(user, newPassword)
+			token, err := userInteractors.ChangeUserPassword(context.Background(), user, "", newPassword)
 			if !testError(t, err, errExpectations{
 				messageFragment: "password",
 				validation:      true,
 			}) {
 				t.Errorf("expected validation error, got %v", err)
 			}
-			if token != "" {
-				t.Errorf("expected empty token, got %q", token)
+			if token.AccessToken != "" {
+				t.Errorf("expected empty token, got %q", token.AccessToken)
 			}
 		})
 
@@ -261,7 +307,7 @@ func TestChangeUserPassword(t *testing.T) {
 			user := models.NewUser()
 			user.Email = t.Name() + "@example.com"
 			user.Password = "testpassword123"
-			if err := user.Create(); err != nil {
+			if err := user.Create(context.Background()); err != nil {
 				t.Fatalf("could not set up user; got %v", err)
 			}
 
@@ -269,15 +315,15 @@ func TestChangeUserPassword(t *testing.T) {
 				// User:            *user,
 				CurrentPassword: user.PwHashState(),
 			}
-			token, err := userInteractors.ChangeUserPassword(user, newPassword)
+			token, err := userInteractors.ChangeUserPassword(context.Background(), user, "", newPassword)
 			if !testError(t, err, errExpectations{
 				messageFragment: "param",
 				validation:      true,
 			}) {
 				t.Errorf("expected validation error, got %v", err)
 			}
-			if token != "" {
-				t.Errorf("expected empty token, got %q", token)
+			if token.AccessToken != "" {
+				t.Errorf("expected empty token, got %q", token.AccessToken)
 			}
 		})
 
@@ -286,7 +332,7 @@ func TestChangeUserPassword(t *testing.T) {
 			user.Email = t.Name() + "@example.com"
 			user.Password = "testpassword123"
 			user.PwNonce = "stub_password_nonce"
-			if err := user.Create(); err != nil {
+			if err := user.Create(context.Background()); err != nil {
 				t.Fatalf("could not set up user; got %v", err)
 			}
 
@@ -296,17 +342,261 @@ func TestChangeUserPassword(t *testing.T) {
 				// User:            *user,
 				CurrentPassword: currPW,
 			}
-			token, err := userInteractors.ChangeUserPassword(user, newPassword)
+			token, err := userInteractors.ChangeUserPassword(context.Background(), user, "", newPassword)
 			if !testError(t, err, errExpectations{
 				messageFragment: "password",
 				validation:      true,
 			}) {
 				t.Errorf("expected validation error, got %v", err)
 			}
-			if token != "" {
-				t.Errorf("expected empty token, got %q", token)
+			if token.AccessToken != "" {
+				t.Errorf("expected empty token, got %q", token.AccessToken)
 			}
 		})
+
+		t.Run("rolled back", func(t *testing.T) {
+			ctx := context.Background()
+			user, tokens, err := userInteractors.RegisterUser(ctx, userInteractors.RegisterUserParams{
+				Email:    t.Name() + "@example.com",
+				Password: "testpassword123",
+				PwNonce:  "stub_password_nonce",
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, sess, err := userInteractors.AuthenticateSession(ctx, "Bearer "+tokens.AccessToken)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// revoking the other sessions fails, after the password is saved.
+			if err = db.Exec(ctx, "ALTER TABLE revoked_sessions RENAME TO revoked_sessions_hidden"); err != nil {
+				t.Fatal(err)
+			}
+			defer func() {
+				if err := db.Exec(ctx, "ALTER TABLE revoked_sessions_hidden RENAME TO revoked_sessions"); err != nil {
+					t.Fatal(err)
+				}
+			}()
+
+			saved := *user
+			_, err = userInteractors.ChangeUserPassword(ctx, user, sess.UUID, models.PwChangeParams{
+				API:             "20190520",
+				Identifier:      user.Email,
+				PwCost:          user.PwCost,
+				PwNonce:         "new_password_nonce",
+				CurrentPassword: models.PwHash{Value: "testpassword123"},
+				NewPassword:     models.PwHash{Value: "newpassword123"},
+				Version:         "20190520",
+			})
+			if err == nil {
+				t.Fatal("expected error")
+			}
+			if user.Password != saved.Password || user.PwNonce != saved.PwNonce {
+				t.Error("expected in-memory user to be restored")
+			}
+			loaded, err := models.LoadUserByUUID(ctx, user.UUID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if loaded.PwNonce != saved.PwNonce {
+				t.Errorf("expected password change to be rolled back; got nonce %q", loaded.PwNonce)
+			}
+			if ok, err := loaded.VerifyPassword(ctx, "testpassword123"); err != nil || !ok {
+				t.Errorf("expected old password to still work; got ok=%t, err=%v", ok, err)
+			}
+		})
+	})
+}
+
+func TestUpdateUser(t *testing.T) {
+	t.Run("ok", func(t *testing.T) {
+		user, _, err := userInteractors.RegisterUser(
+			context.Background(),
+			userInteractors.RegisterUserParams{
+				Email:    t.Name() + "@example.com",
+				Password: "testpassword123",
+				PwNonce:  "stub_password_nonce",
+			},
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		updates := user.MakeSaferCopy()
+		updates.Password = "newpassword123"
+		updates.PwNonce = "new_password_nonce"
+		if err = userInteractors.UpdateUser(context.Background(), user, updates); err != nil {
+			t.Fatalf("did not expect error; got %v", err)
+		}
+
+		loaded, err := models.LoadUserByUUID(context.Background(), user.UUID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if loaded.Password == "newpassword123" {
+			t.Fatal("password should be hashed")
+		}
+		if ok, err := loaded.VerifyPassword(context.Background(), "newpassword123"); err != nil || !ok {
+			t.Errorf("expected new password to match; got ok=%t, err=%v", ok, err)
+		}
+		if loaded.PwNonce != "new_password_nonce" {
+			t.Errorf("wrong pw nonce; got %q", loaded.PwNonce)
+		}
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		user, _, err := userInteractors.RegisterUser(
+			context.Background(),
+			userInteractors.RegisterUserParams{
+				Email:    t.Name() + "@example.com",
+				Password: "testpassword123",
+				PwNonce:  "stub_password_nonce",
+			},
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		updates := user.MakeSaferCopy()
+		err = userInteractors.UpdateUser(context.Background(), user, updates)
+		if !testError(t, err, errExpectations{
+			messageFragment: "missing a password",
+			validation:      true,
+		}) {
+			t.Errorf("expected validation error, got %v", err)
+		}
+		if ok, err := user.VerifyPassword(context.Background(), "testpassword123"); err != nil || !ok {
+			t.Errorf("password should not change; got ok=%t, err=%v", ok, err)
+		}
+	})
+}
+
+func TestChangeUserEmail(t *testing.T) {
+	const plaintextPassword = "testpassword123"
+	ctx := context.Background()
+	box := &mailbox{}
+	mail.Use(box)
+	defer func() {
+		mail.Use(nil)
+		config.Conf.Verification.Required = false
+	}()
+
+	user, tokens, err := userInteractors.RegisterUser(ctx, userInteractors.RegisterUserParams{
+		Email:    t.Name() + "@example.com",
+		Password: plaintextPassword,
+		PwNonce:  "stub_password_nonce",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, sess, err := userInteractors.AuthenticateSession(ctx, "Bearer "+tokens.AccessToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, otherTokens, err := userInteractors.LoginUser(ctx, user.Email, &models.PwHash{Value: plaintextPassword}, "", userInteractors.Device{UserAgent: "phone"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, _, err := userInteractors.RegisterUser(ctx, userInteractors.RegisterUserParams{
+		Email:    "other-" + t.Name() + "@example.com",
+		Password: plaintextPassword,
+		PwNonce:  "stub_password_nonce",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldEmail := user.Email
+	newEmail := "new-" + t.Name() + "@example.com"
+	params := func(current, email string) userInteractors.EmailChangeParams {
+		return userInteractors.EmailChangeParams{
+			CurrentPassword: models.PwHash{Value: current},
+			NewEmail:        email,
+			NewPassword:     models.PwHash{Value: "newpassword123"},
+			PwNonce:         "new_password_nonce",
+		}
+	}
+
+	t.Run("errors", func(t *testing.T) {
+		tests := []struct {
+			name            string
+			params          userInteractors.EmailChangeParams
+			messageFragment string
+		}{
+			{name: "no current password", params: params("", newEmail), messageFragment: "current password"},
+			{
+				name:            "no nonce",
+				params:          userInteractors.EmailChangeParams{CurrentPassword: models.PwHash{Value: plaintextPassword}, NewEmail: newEmail},
+				messageFragment: "param",
+			},
+			{name: "same email", params: params(plaintextPassword, oldEmail), messageFragment: "same"},
+			{name: "wrong password", params: params(plaintextPassword[1:], newEmail), messageFragment: "incorrect"},
+			{name: "same email, in another case", params: params(plaintextPassword, strings.ToUpper(oldEmail)), messageFragment: "same"},
+			{name: "taken", params: params(plaintextPassword, other.Email), messageFragment: "already registered"},
+			{name: "taken, in another case", params: params(plaintextPassword, strings.ToUpper(other.Email)), messageFragment: "already registered"},
+			{name: "invalid", params: params(plaintextPassword, "not an email address"), messageFragment: "email"},
+		}
+		for _, test := range tests {
+			tokens, err := userInteractors.ChangeUserEmail(ctx, user, sess.UUID, test.params)
+			if !testError(t, err, errExpectations{messageFragment: test.messageFragment, validation: true}) {
+				t.Errorf("test %q; wrong error", test.name)
+			}
+			if tokens.AccessToken != "" {
+				t.Errorf("test %q; expected empty token, got %q", test.name, tokens.AccessToken)
+			}
+		}
+		if user.Email != oldEmail {
+			t.Errorf("expected email to be left alone; got %q", user.Email)
+		}
+	})
+
+	t.Run("ok", func(t *testing.T) {
+		config.Conf.Verification.Required = true
+		box.messages = nil
+
+		newTokens, err := userInteractors.ChangeUserEmail(ctx, user, sess.UUID, params(plaintextPassword, newEmail))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if user.Email != newEmail {
+			t.Errorf("wrong email; got %q, expected %q", user.Email, newEmail)
+		}
+		if _, _, err = userInteractors.AuthenticateSession(ctx, "Bearer "+newTokens.AccessToken); err != nil {
+			t.Errorf("expected new token to be accepted; got %v", err)
+		}
+		for name, tok := range map[string]string{"old": tokens.AccessToken, "other session": otherTokens.AccessToken} {
+			if _, _, err = userInteractors.AuthenticateSession(ctx, "Bearer "+tok); err == nil {
+				t.Errorf("expected %s token to be rejected", name)
+			}
+		}
+
+		authParams, err := userInteractors.MakeAuthParams(ctx, newEmail)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if authParams.Identifier != newEmail || authParams.PwNonce != "new_password_nonce" {
+			t.Errorf("wrong auth params; got %+v", authParams)
+		}
+		if authParams, err = userInteractors.MakeAuthParams(ctx, oldEmail); err != nil {
+			t.Fatal(err)
+		} else if authParams.PwNonce == "stub_password_nonce" || authParams.PwNonce == "new_password_nonce" {
+			t.Errorf("expected made-up params for the old address; got %+v", authParams)
+		}
+
+		// the new address has to be verified before signing in again.
+		if len(box.messages) != 1 || box.messages[0].To != newEmail {
+			t.Fatalf("expected a verification message to %q; got %+v", newEmail, box.messages)
+		}
+		newPassword := &models.PwHash{Value: "newpassword123"}
+		if _, _, err = userInteractors.LoginUser(ctx, newEmail, newPassword, "", userInteractors.Device{}); !testError(t, err, errExpectations{
+			messageFragment: "verified",
+			validation:      true,
+		}) {
+			t.Error("expected sign in to fail before verification")
+		}
+		if err = userInteractors.VerifyEmail(ctx, verificationToken(t, box.messages[0])); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err = userInteractors.LoginUser(ctx, newEmail, newPassword, "", userInteractors.Device{}); err != nil {
+			t.Errorf("did not expect error; got %v", err)
+		}
 	})
 }
 
@@ -366,13 +656,17 @@ func TestAuthenticateUser(t *testing.T) {
 		knownUser.Email = t.Name() + "@example.com"
 		knownUser.Password = "testpassword123"
 		knownUser.PwNonce = "stub_password_nonce"
-		if err = knownUser.Create(); err != nil {
+		if err = knownUser.Create(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		sess, err := models.CreateSession(context.Background(), knownUser.UUID, "test", "127.0.0.1")
+		if err != nil {
 			t.Fatal(err)
 		}
-		if tok, err = models.EncodeToken(*knownUser); err != nil {
+		if tok, err = models.EncodeToken(*knownUser, sess.UUID, time.Now().Add(time.Hour)); err != nil {
 			t.Fatal(err)
 		}
-		if authenticatedUser, err = userInteractors.AuthenticateUser("Bearer " + tok); err != nil {
+		if authenticatedUser, err = userInteractors.AuthenticateUser(context.Background(), "Bearer "+tok); err != nil {
 			t.Errorf("did not expect error; got %v", err)
 		} else if authenticatedUser.UUID != knownUser.UUID {
 			t.Errorf("users not equal\n%#v\n%#v\n", *authenticatedUser, *knownUser)
@@ -385,19 +679,19 @@ func TestAuthenticateUser(t *testing.T) {
 			var err error
 			expError := errExpectations{messageFragment: "header", notFound: false, validation: true}
 
-			user, err = userInteractors.AuthenticateUser("")
+			user, err = userInteractors.AuthenticateUser(context.Background(), "")
 			testError(t, err, expError)
 			if user != nil {
 				t.Error("user should be nil")
 			}
 
-			user, err = userInteractors.AuthenticateUser("foobar")
+			user, err = userInteractors.AuthenticateUser(context.Background(), "foobar")
 			testError(t, err, expError)
 			if user != nil {
 				t.Error("user should be nil")
 			}
 
-			user, err = userInteractors.AuthenticateUser("foo bar")
+			user, err = userInteractors.AuthenticateUser(context.Background(), "foo bar")
 			testError(t, err, expError)
 			if user != nil {
 				t.Error("user should be nil")
@@ -406,7 +700,7 @@ func TestAuthenticateUser(t *testing.T) {
 
 		t.Run("token validation", func(t *testing.T) {
 			expError := errExpectations{messageFragment: "token", notFound: false, validation: true}
-			user, err := userInteractors.AuthenticateUser("Bearer foobar")
+			user, err := userInteractors.AuthenticateUser(context.Background(), "Bearer foobar")
 
 			testError(t, err, expError)
 			if user != nil {
@@ -424,11 +718,11 @@ func TestAuthenticateUser(t *testing.T) {
 				PwNonce:  "stub_password_nonce",
 			}
 
-			if tok, err = models.EncodeToken(unknownUser); err != nil {
+			if tok, err = models.EncodeToken(unknownUser, "", time.Now().Add(time.Hour)); err != nil {
 				t.Fatal(err)
 			}
 
-			user, err := userInteractors.AuthenticateUser("Bearer " + tok)
+			user, err := userInteractors.AuthenticateUser(context.Background(), "Bearer "+tok)
 			testError(t, err, errExpectations{"email", true, false})
 			if user != nil {
 				t.Error("user should be nil")
@@ -444,23 +738,29 @@ func TestAuthenticateUser(t *testing.T) {
 				PwNonce:  "stub_password_nonce",
 			}
 
-			if err = knownUser.Create(); err != nil {
+			if err = knownUser.Create(context.Background()); err != nil {
 				t.Fatal(err)
 			}
-			if tok, err = models.EncodeToken(knownUser); err != nil {
+			sess, err := models.CreateSession(context.Background(), knownUser.UUID, "test", "127.0.0.1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tok, err = models.EncodeToken(knownUser, sess.UUID, time.Now().Add(time.Hour)); err != nil {
 				t.Fatal(err)
 			}
 
 			// make a legit token stale by updating password
 			if _, err = userInteractors.ChangeUserPassword(
+				context.Background(),
 				&knownUser,
+				sess.UUID,
 				models.PwChangeParams{
 					API:             "20190520",
 					Identifier:      knownUser.Email,
 					PwCost:          knownUser.PwCost,
 					PwNonce:         knownUser.PwNonce,
-					CurrentPassword: knownUser.PwHashState(),
-					NewPassword:     models.PwHash{Value: knownUser.Password[1:]},
+					CurrentPassword: models.PwHash{Value: "testpassword123"},
+					NewPassword:     models.PwHash{Value: "newpassword123"},
 					Version:         "20190520",
 				},
 			); err != nil {
@@ -471,11 +771,120 @@ func TestAuthenticateUser(t *testing.T) {
 				notFound:        false,
 				validation:      true,
 			}
-			user, err := userInteractors.AuthenticateUser("Bearer " + tok)
+			user, err := userInteractors.AuthenticateUser(context.Background(), "Bearer "+tok)
 			testError(t, err, expError)
 			if user != nil {
 				t.Error("user should be nil")
 			}
 		})
+
+		t.Run("revoked session", func(t *testing.T) {
+			knownUser := models.User{
+				Email:    t.Name() + "@example.com",
+				Password: "testpassword123",
+				PwNonce:  "stub_password_nonce",
+			}
+			if err := knownUser.Create(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			sess, err := models.CreateSession(context.Background(), knownUser.UUID, "test", "127.0.0.1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			tok, err := models.EncodeToken(knownUser, sess.UUID, time.Now().Add(time.Hour))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = userInteractors.RevokeSession(context.Background(), knownUser, sess.UUID); err != nil {
+				t.Fatal(err)
+			}
+			user, err := userInteractors.AuthenticateUser(context.Background(), "Bearer "+tok)
+			testError(t, err, errExpectations{messageFragment: "session", validation: true})
+			if user != nil {
+				t.Error("user should be nil")
+			}
+		})
+	})
+}
+
+func TestLoginUserLockout(t *testing.T) {
+	defer func(conf config.Lockout) { config.Conf.Lockout = conf }(config.Conf.Lockout)
+	config.Conf.Lockout = config.Lockout{MaxAttempts: 3, Minutes: 15}
+
+	const plaintextPassword = "testpassword123"
+	user := models.NewUser()
+	user.Email = t.Name() + "@example.com"
+	user.Password = plaintextPassword
+	user.PwNonce = "stub_password_nonce"
+	if err := user.Create(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < config.Conf.Lockout.MaxAttempts; i++ {
+		_, _, err := userInteractors.LoginUser(context.Background(), user.Email, &models.PwHash{Value: plaintextPassword[1:]}, "", userInteractors.Device{})
+		testError(t, err, errExpectations{messageFragment: "invalid", notFound: true})
+	}
+
+	// correct password, but locked out.
+	_, token, err := userInteractors.LoginUser(context.Background(), user.Email, &models.PwHash{Value: plaintextPassword}, "", userInteractors.Device{})
+	testError(t, err, errExpectations{messageFragment: "too many", validation: true})
+	if token.AccessToken != "" {
+		t.Error("token should be empty")
+	}
+}
+
+func TestDeleteUser(t *testing.T) {
+	const plaintextPassword = "testpassword123"
+	ctx := context.Background()
+	box := &mailbox{}
+	mail.Use(box)
+	defer mail.Use(nil)
+
+	user, tokens, err := userInteractors.RegisterUser(ctx, userInteractors.RegisterUserParams{
+		Email:    t.Name() + "@example.com",
+		Password: plaintextPassword,
+		PwNonce:  "stub_password_nonce",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	box.messages = nil
+
+	t.Run("errors", func(t *testing.T) {
+		if err := userInteractors.DeleteUser(ctx, *user, &models.PwHash{}, false); !testError(t, err, errExpectations{
+			messageFragment: "password",
+			validation:      true,
+		}) {
+			t.Error("expected missing password to be rejected")
+		}
+		if err := userInteractors.DeleteUser(ctx, *user, &models.PwHash{Value: plaintextPassword[1:]}, false); !testError(t, err, errExpectations{
+			messageFragment: "incorrect",
+			validation:      true,
+		}) {
+			t.Error("expected wrong password to be rejected")
+		}
+		if err := userInteractors.DeleteUserByEmail(ctx, "nobody-"+user.Email, false); !errs.NotFoundError(err) {
+			t.Errorf("expected not found error; got %v", err)
+		}
+		if _, err := models.LoadUserByUUID(ctx, user.UUID); err != nil {
+			t.Errorf("did not expect user to be deleted; got %v", err)
+		}
+	})
+
+	t.Run("ok", func(t *testing.T) {
+		if err := userInteractors.DeleteUser(ctx, *user, &models.PwHash{Value: plaintextPassword}, true); err != nil {
+			t.Fatal(err)
+		}
+		if len(box.messages) != 1 || len(box.messages[0].Attachments) != 1 {
+			t.Fatalf("expected a message with a backup attached; got %+v", box.messages)
+		} else if box.messages[0].To != user.Email {
+			t.Errorf("wrong recipient; got %q, expected %q", box.messages[0].To, user.Email)
+		}
+		if _, err := models.LoadUserByUUID(ctx, user.UUID); !errs.NotFoundError(err) {
+			t.Errorf("expected user to be deleted; got %v", err)
+		}
+		if _, _, err := userInteractors.AuthenticateSession(ctx, "Bearer "+tokens.AccessToken); err == nil {
+			t.Error("expected token of deleted user to be rejected")
+		}
 	})
 }
@@ -0,0 +1,87 @@
+package interactors
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/rafaelespinoza/standardnotes/internal/config"
+	"github.com/rafaelespinoza/standardnotes/internal/errs"
+	"github.com/rafaelespinoza/standardnotes/internal/jobs"
+	"github.com/rafaelespinoza/standardnotes/internal/models"
+)
+
+// VerifyEmail marks a user's email address as verified if the token, from a
+// verification link, is valid.
+func VerifyEmail(ctx context.Context, token string) (err error) {
+	var userUUID, email string
+	if userUUID, email, err = models.DecodeVerificationToken(token); err != nil {
+		err = authenticationError{error: errInvalidVerificationLink, validation: true}
+		return
+	}
+	var user *models.User
+	if user, err = models.LoadUserByUUID(ctx, userUUID); err != nil {
+		err = maybeMutateError(err)
+		return
+	}
+	if user.Email != email {
+		// the account's email address has changed since the link was sent.
+		err = authenticationError{error: errInvalidVerificationLink, validation: true}
+		return
+	}
+	err = models.MarkEmailVerified(ctx, user.UUID)
+	return
+}
+
+// ResendVerification sends another verification link to the email address.
+// To avoid revealing which addresses are registered, it does not return an
+// error when the address is unknown or already verified.
+func ResendVerification(ctx context.Context, email string) (err error) {
+	if err = models.ValidateEmail(email); err != nil {
+		return
+	}
+	var user *models.User
+	if user, err = models.LoadUserByEmail(ctx, email); errs.NotFoundError(err) {
+		err = nil
+		return
+	} else if err != nil {
+		return
+	}
+	var verified bool
+	if verified, err = models.EmailVerified(ctx, user.UUID); err != nil || verified {
+		return
+	}
+	var link string
+	if link, err = makeVerificationLink(*user); err != nil {
+		return
+	}
+	err = jobs.PerformVerificationJob(
+		jobs.VerificationJobParams{Email: user.Email, VerificationLink: link},
+	)
+	return
+}
+
+func makeVerificationLink(user models.User) (link string, err error) {
+	ttl := time.Duration(config.Conf.Verification.ExpiryHours) * time.Hour
+	if ttl <= 0 {
+		ttl = 24 * time.Hour
+	}
+	var token string
+	if token, err = models.EncodeVerificationToken(user, ttl); err != nil {
+		return
+	}
+	base := config.Conf.PublicURL
+	if base == "" {
+		host := config.Conf.Host
+		if host == "" {
+			host = "localhost"
+		}
+		base = "http://" + host + ":" + strconv.Itoa(config.Conf.Port)
+	}
+	link = base + "/auth/verify?token=" + url.QueryEscape(token)
+	return
+}
+
+var errInvalidVerificationLink = errors.New("the verification link is invalid or has expired")
@@ -0,0 +1,145 @@
+package interactors_test
+
+import (
+	"context"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/rafaelespinoza/standardnotes/internal/config"
+	userInteractors "github.com/rafaelespinoza/standardnotes/internal/interactors/user"
+	"github.com/rafaelespinoza/standardnotes/internal/mail"
+	"github.com/rafaelespinoza/standardnotes/internal/models"
+)
+
+type mailbox struct{ messages []mail.Message }
+
+func (m *mailbox) Send(msg mail.Message) error {
+	m.messages = append(m.messages, msg)
+	return nil
+}
+
+// verificationToken extracts the token from the verification link in a
+// message body.
+func verificationToken(t *testing.T, msg mail.Message) string {
+	t.Helper()
+	for _, line := range strings.Split(msg.Body, "\n") {
+		if !strings.Contains(line, "/auth/verify?") {
+			continue
+		}
+		link, err := url.Parse(strings.TrimSpace(line))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return link.Query().Get("token")
+	}
+	t.Fatalf("no verification link in message %q", msg.Body)
+	return ""
+}
+
+func TestVerifyEmail(t *testing.T) {
+	box := &mailbox{}
+	mail.Use(box)
+	config.Conf.Verification.Required = true
+	defer func() {
+		mail.Use(nil)
+		config.Conf.Verification.Required = false
+	}()
+
+	const plaintextPassword = "testpassword123"
+	user, token, err := userInteractors.RegisterUser(
+		context.Background(),
+		userInteractors.RegisterUserParams{
+			Email:    t.Name() + "@example.com",
+			Password: plaintextPassword,
+			PwNonce:  "stub_password_nonce",
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.AccessToken != "" {
+		t.Error("token should be empty until email is verified")
+	}
+	if len(box.messages) != 1 {
+		t.Fatalf("wrong number of messages; got %d, expected %d", len(box.messages), 1)
+	}
+
+	if _, _, err = userInteractors.LoginUser(context.Background(), user.Email, &models.PwHash{Value: plaintextPassword}, "", userInteractors.Device{}); !testError(t, err, errExpectations{
+		messageFragment: "verified",
+		validation:      true,
+	}) {
+		t.Error("expected sign in to fail before verification")
+	}
+
+	if err = userInteractors.ResendVerification(context.Background(), user.Email); err != nil {
+		t.Fatal(err)
+	}
+	if len(box.messages) != 2 {
+		t.Fatalf("wrong number of messages; got %d, expected %d", len(box.messages), 2)
+	}
+
+	if err = userInteractors.VerifyEmail(context.Background(), "not-a-token"); !testError(t, err, errExpectations{
+		messageFragment: "verification",
+		validation:      true,
+	}) {
+		t.Error("expected invalid token to be rejected")
+	}
+	if err = userInteractors.VerifyEmail(context.Background(), verificationToken(t, box.messages[1])); err != nil {
+		t.Fatalf("did not expect error; got %v", err)
+	}
+	if _, token, err = userInteractors.LoginUser(context.Background(), user.Email, &models.PwHash{Value: plaintextPassword}, "", userInteractors.Device{}); err != nil {
+		t.Errorf("did not expect error; got %v", err)
+	} else if token.AccessToken == "" {
+		t.Error("token should not be empty")
+	}
+
+	// already verified, so nothing to send.
+	if err = userInteractors.ResendVerification(context.Background(), user.Email); err != nil {
+		t.Error(err)
+	}
+	// unknown address, nothing to send.
+	if err = userInteractors.ResendVerification(context.Background(), "nobody-"+t.Name()+"@example.com"); err != nil {
+		t.Error(err)
+	}
+	if len(box.messages) != 2 {
+		t.Errorf("wrong number of messages; got %d, expected %d", len(box.messages), 2)
+	}
+}
+
+func TestVerifyEmailExistingAccount(t *testing.T) {
+	box := &mailbox{}
+	mail.Use(box)
+	defer func() {
+		mail.Use(nil)
+		config.Conf.Verification.Required = false
+	}()
+
+	// the account is made before verification is required.
+	config.Conf.Verification.Required = false
+	const plaintextPassword = "testpassword123"
+	user, _, err := userInteractors.RegisterUser(
+		context.Background(),
+		userInteractors.RegisterUserParams{
+			Email:    t.Name() + "@example.com",
+			Password: plaintextPassword,
+			PwNonce:  "stub_password_nonce",
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sent := len(box.messages)
+
+	config.Conf.Verification.Required = true
+	if _, _, err = userInteractors.LoginUser(context.Background(), user.Email, &models.PwHash{Value: plaintextPassword}, "", userInteractors.Device{}); err != nil {
+		t.Errorf("did not expect error for existing account; got %v", err)
+	}
+	// it's considered verified, so there's nothing to send.
+	if err = userInteractors.ResendVerification(context.Background(), user.Email); err != nil {
+		t.Error(err)
+	}
+	if len(box.messages) != sent {
+		t.Errorf("wrong number of messages; got %d, expected %d", len(box.messages), sent)
+	}
+}
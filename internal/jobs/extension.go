@@ -1,5 +1,21 @@
 package jobs
 
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/rafaelespinoza/standardnotes/internal/config"
+	"github.com/rafaelespinoza/standardnotes/internal/logger"
+	"github.com/rafaelespinoza/standardnotes/internal/models"
+)
+
 type ExtensionJobParams struct {
 	URL         string
 	ItemIDs     []string
@@ -7,6 +23,126 @@ type ExtensionJobParams struct {
 	ExtensionID string
 }
 
-func PerformExtensionJob(params ExtensionJobParams) error {
-	return nil
+// PerformExtensionJob sends user items to an extension URL. If ItemIDs is
+// empty, then all of the user's active items are sent, which is what a backup
+// extension expects. Since the URL comes from user content, the request is made
+// with a client that refuses to reach internal addresses.
+//
+// The outcome of each delivery is tracked per extension. After too many
+// consecutive failures, deliveries to the extension are suspended for a while
+// and this function skips it without an error. Only failures to deliver count;
+// failing to load what's delivered isn't the extension's fault.
+func PerformExtensionJob(ctx context.Context, params ExtensionJobParams) (err error) {
+	var target *url.URL
+	if target, err = url.Parse(params.URL); err != nil {
+		return
+	} else if target.Scheme != "http" && target.Scheme != "https" {
+		err = fmt.Errorf("extension url scheme must be http or https; got %q", target.Scheme)
+		return
+	}
+
+	var health models.ExtensionHealth
+	if params.ExtensionID != "" {
+		if health, err = models.LoadExtensionHealth(ctx, params.ExtensionID, params.UserID); err != nil {
+			return
+		}
+		if health.Suspended(time.Now().UTC()) {
+			logger.LogIfDebug("skipping suspended extension", params.ExtensionID, "until", health.SuspendedUntil)
+			return
+		}
+	}
+
+	var body []byte
+	if body, err = extensionPayload(ctx, params); err != nil {
+		return
+	}
+	err = postToExtension(ctx, params, body)
+	if params.ExtensionID == "" {
+		return
+	}
+
+	conf := config.Conf.Extensions
+	if now := time.Now().UTC(); err == nil {
+		health.RecordSuccess(now)
+	} else {
+		health.RecordFailure(
+			now, err, conf.FailureThreshold,
+			time.Duration(conf.BackoffMinutes)*time.Minute,
+			time.Duration(conf.MaxBackoffHours)*time.Hour,
+		)
+		if health.Suspended(now) {
+			log.Printf(
+				"suspended extension %s after %d consecutive failures; %v\n",
+				params.ExtensionID, health.ConsecutiveFailures, err,
+			)
+		}
+	}
+	if serr := health.Save(ctx); serr != nil {
+		log.Printf("could not save health of extension %s; %v\n", params.ExtensionID, serr)
+	}
+	return
+}
+
+// extensionPayload loads the user's items, and encodes them along with the
+// user's auth params.
+func extensionPayload(ctx context.Context, params ExtensionJobParams) (body []byte, err error) {
+	var user *models.User
+	if user, err = models.LoadUserByUUID(ctx, params.UserID); err != nil {
+		return
+	}
+	var items models.Items
+	if items, err = user.LoadActiveItems(ctx); err != nil {
+		return
+	}
+	if len(params.ItemIDs) > 0 {
+		items = filterItems(items, params.ItemIDs)
+	}
+
+	body, err = json.Marshal(map[string]interface{}{
+		"items":       items,
+		"auth_params": models.MakePwGenParams(*user),
+	})
+	return
+}
+
+func postToExtension(ctx context.Context, params ExtensionJobParams, body []byte) (err error) {
+	conf := config.Conf.Outbound
+	client := newOutboundClient(conf)
+	defer client.CloseIdleConnections()
+
+	var req *http.Request
+	if req, err = http.NewRequestWithContext(ctx, http.MethodPost, params.URL, bytes.NewReader(body)); err != nil {
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	var res *http.Response
+	if res, err = client.Do(req); err != nil {
+		var rejected *errOutboundRejected
+		if errors.As(err, &rejected) {
+			recordRejection(ctx, params.UserID, params.URL, rejected)
+		}
+		return
+	}
+	defer res.Body.Close()
+	if _, err = readLimited(res.Body, conf.MaxResponseBytes); err != nil {
+		return
+	}
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		err = fmt.Errorf("extension responded with status %d", res.StatusCode)
+	}
+	return
+}
+
+func filterItems(items models.Items, ids []string) (out models.Items) {
+	wanted := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		wanted[id] = true
+	}
+	out = make(models.Items, 0, len(ids))
+	for _, item := range items {
+		if wanted[item.UUID] {
+			out = append(out, item)
+		}
+	}
+	return
 }
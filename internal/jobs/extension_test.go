@@ -0,0 +1,126 @@
+package jobs
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/rafaelespinoza/standardnotes/internal/config"
+	"github.com/rafaelespinoza/standardnotes/internal/models"
+)
+
+func TestPerformExtensionJob(t *testing.T) {
+	var requests int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer srv.Close()
+
+	defer func(outbound config.Outbound, extensions config.Extensions) {
+		config.Conf.Outbound = outbound
+		config.Conf.Extensions = extensions
+	}(config.Conf.Outbound, config.Conf.Extensions)
+	config.Conf.Outbound.Allow = []string{"127.0.0.1"}
+	config.Conf.Extensions = config.Extensions{FailureThreshold: 2, BackoffMinutes: 5, MaxBackoffHours: 1}
+
+	user := models.NewUser()
+	user.Email = t.Name() + "@example.com"
+	user.Password = "testpassword123"
+	if err := user.Create(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	params := ExtensionJobParams{
+		URL:         srv.URL,
+		UserID:      user.UUID,
+		ExtensionID: "0f5b0a4e-3c55-4d44-9f49-7c3b2a0c6f11",
+	}
+
+	for i := 0; i < config.Conf.Extensions.FailureThreshold; i++ {
+		if err := PerformExtensionJob(context.Background(), params); err == nil {
+			t.Errorf("attempt %d; expected error", i)
+		}
+	}
+	health, err := models.LoadExtensionHealth(context.Background(), params.ExtensionID, params.UserID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !health.Suspended(time.Now().UTC()) {
+		t.Fatalf("expected extension to be suspended; got %+v", health)
+	}
+
+	// suspended, so it's skipped.
+	if err = PerformExtensionJob(context.Background(), params); err != nil {
+		t.Errorf("did not expect error; got %v", err)
+	}
+	if requests != config.Conf.Extensions.FailureThreshold {
+		t.Errorf("wrong number of requests; got %d, expected %d", requests, config.Conf.Extensions.FailureThreshold)
+	}
+
+	// failing to load the user's items isn't the extension's fault.
+	params.UserID = "00000000-0000-0000-0000-000000000000"
+	params.ExtensionID = "0f5b0a4e-3c55-4d44-9f49-7c3b2a0c6f12"
+	if err = PerformExtensionJob(context.Background(), params); err == nil {
+		t.Error("expected error for unknown user")
+	}
+	if health, err = models.LoadExtensionHealth(context.Background(), params.ExtensionID, params.UserID); err != nil {
+		t.Fatal(err)
+	} else if health.ConsecutiveFailures != 0 {
+		t.Errorf("did not expect a failure to be recorded; got %+v", health)
+	}
+}
+
+func TestEnqueueExtensionJob(t *testing.T) {
+	received := make(chan struct{}, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- struct{}{}
+	}))
+	defer srv.Close()
+
+	defer func(outbound config.Outbound) {
+		config.Conf.Outbound = outbound
+	}(config.Conf.Outbound)
+	config.Conf.Outbound.Allow = []string{"127.0.0.1"}
+
+	user := models.NewUser()
+	user.Email = t.Name() + "@example.com"
+	user.Password = "testpassword123"
+	if err := user.Create(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	done, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		Run(done)
+	}()
+	defer func() {
+		close(done)
+		<-stopped
+	}()
+
+	EnqueueExtensionJob(ExtensionJobParams{URL: srv.URL, UserID: user.UUID})
+	select {
+	case <-received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("extension did not receive the queued delivery")
+	}
+}
+
+func TestEnqueueFull(t *testing.T) {
+	before := DroppedJobs()
+	noop := queuedJob{name: "noop", perform: func(ctx context.Context) error { return nil }}
+	for i := 0; i < _QueueSize+1; i++ {
+		enqueue(noop)
+	}
+	defer func() {
+		for len(queue) > 0 {
+			<-queue
+		}
+	}()
+	if dropped := DroppedJobs() - before; dropped != 1 {
+		t.Errorf("wrong number of dropped jobs; got %d, expected %d", dropped, 1)
+	}
+}
@@ -1,48 +1,57 @@
 package jobs
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"time"
 
+	"github.com/rafaelespinoza/standardnotes/internal/mail"
 	"github.com/rafaelespinoza/standardnotes/internal/models"
 )
 
 type MailerJobParams struct {
 	UserID string
+	// Subject and Body, if not empty, replace the default message that goes
+	// with the backup.
+	Subject string
+	Body    string
 }
 
-func PerformMailerJob(params MailerJobParams) (err error) {
+// PerformMailerJob emails a backup of the user's items to the user, as an
+// attachment.
+func PerformMailerJob(ctx context.Context, params MailerJobParams) (err error) {
 	var user *models.User
-	var contents struct {
-		Items      models.Items
-		AuthParams models.PwGenParams
-	}
-	var attachment struct {
-		Filename string
-		MimeType string
-		Content  []byte
-	}
+	var attachment mail.Attachment
 
-	if user, err = models.LoadUserByUUID(params.UserID); err != nil {
+	if user, err = models.LoadUserByUUID(ctx, params.UserID); err != nil {
 		return
 	}
-	if items, ierr := user.LoadActiveItems(); ierr != nil {
-		err = ierr
+	if contents, berr := user.MakeBackup(ctx); berr != nil {
+		err = berr
 		return
-	} else {
-		contents.Items = items
-	}
-	if data, perr := json.Marshal(contents); perr != nil {
+	} else if data, perr := json.Marshal(contents); perr != nil {
 		err = perr
 		return
 	} else {
 		attachment.Content = data
 	}
 
-	contents.AuthParams = models.MakePwGenParams(*user)
-	attachment.Filename = fmt.Sprintf("SN-Data-%s.txt", time.Now().Format("20060102015405"))
-	attachment.MimeType = "application/json"
-	// TODO: send email to user with attached JSON file.
+	attachment.Filename = fmt.Sprintf("SN-Data-%s.txt", time.Now().Format("20060102150405"))
+	attachment.ContentType = "application/json"
+
+	msg := mail.Message{
+		To:          user.Email,
+		Subject:     "Your Standard Notes backup",
+		Body:        "Attached is a backup of your Standard Notes data. It's encrypted, and can be imported into any Standard Notes app.\n",
+		Attachments: []mail.Attachment{attachment},
+	}
+	if params.Subject != "" {
+		msg.Subject = params.Subject
+	}
+	if params.Body != "" {
+		msg.Body = params.Body
+	}
+	err = mail.Send(msg)
 	return
 }
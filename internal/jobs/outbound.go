@@ -0,0 +1,247 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/rafaelespinoza/standardnotes/internal/config"
+	"github.com/rafaelespinoza/standardnotes/internal/db"
+)
+
+// _BlockedNetworks are address ranges that user-supplied URLs may not reach
+// unless they're explicitly allowed in the configuration.
+var _BlockedNetworks = mustParseCIDRs(
+	"0.0.0.0/8",      // "this" network
+	"10.0.0.0/8",     // private
+	"100.64.0.0/10",  // carrier-grade NAT
+	"127.0.0.0/8",    // loopback
+	"169.254.0.0/16", // link-local, includes cloud metadata services
+	"172.16.0.0/12",  // private
+	"192.0.0.0/24",   // IETF protocol assignments
+	"192.168.0.0/16", // private
+	"198.18.0.0/15",  // benchmarking
+	"224.0.0.0/4",    // multicast
+	"240.0.0.0/4",    // reserved, broadcast
+	"::/128",         // unspecified
+	"::1/128",        // loopback
+	"64:ff9b::/96",   // IPv4/IPv6 translation
+	"fc00::/7",       // unique local, includes fd00:ec2::254 metadata
+	"fe80::/10",      // link-local
+	"ff00::/8",       // multicast
+)
+
+func mustParseCIDRs(in ...string) []*net.IPNet {
+	out := make([]*net.IPNet, len(in))
+	for i, cidr := range in {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		out[i] = network
+	}
+	return out
+}
+
+// errOutboundRejected means an outbound request was not made because its
+// destination is not permitted.
+type errOutboundRejected struct {
+	host   string
+	reason string
+}
+
+func (e *errOutboundRejected) Error() string {
+	return fmt.Sprintf("outbound request to %q rejected; %s", e.host, e.reason)
+}
+
+// hostRules is a parsed set of hostnames and networks from the configuration.
+type hostRules struct {
+	hosts    map[string]bool
+	networks []*net.IPNet
+}
+
+func parseHostRules(entries []string) (out hostRules) {
+	out.hosts = make(map[string]bool)
+	for _, entry := range entries {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entry == "" {
+			continue
+		}
+		if _, network, err := net.ParseCIDR(entry); err == nil {
+			out.networks = append(out.networks, network)
+		} else if ip := net.ParseIP(entry); ip != nil {
+			out.networks = append(out.networks, singleIP(ip))
+		} else {
+			out.hosts[strings.TrimSuffix(entry, ".")] = true
+		}
+	}
+	return
+}
+
+func singleIP(ip net.IP) *net.IPNet {
+	if v4 := ip.To4(); v4 != nil {
+		return &net.IPNet{IP: v4, Mask: net.CIDRMask(32, 32)}
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
+}
+
+func (r hostRules) matchHost(host string) bool {
+	return r.hosts[strings.TrimSuffix(strings.ToLower(host), ".")]
+}
+
+func (r hostRules) matchIP(ip net.IP) bool { return containsIP(r.networks, ip) }
+
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	if v4 := ip.To4(); v4 != nil {
+		ip = v4
+	}
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// outboundGuard decides whether or not a destination may be dialed.
+type outboundGuard struct {
+	allow    hostRules
+	deny     hostRules
+	resolver *net.Resolver
+	dialer   *net.Dialer
+}
+
+func newOutboundGuard(conf config.Outbound) *outboundGuard {
+	return &outboundGuard{
+		allow:    parseHostRules(conf.Allow),
+		deny:     parseHostRules(conf.Deny),
+		resolver: net.DefaultResolver,
+		dialer:   &net.Dialer{Timeout: 10 * time.Second},
+	}
+}
+
+// checkIP returns an error if the host, which resolved to ip, is not allowed.
+// The deny list wins over the allow list; the allow list wins over the
+// default blocked ranges.
+func (g *outboundGuard) checkIP(host string, ip net.IP) error {
+	if g.deny.matchHost(host) || g.deny.matchIP(ip) {
+		return &errOutboundRejected{host: host, reason: "destination is denied"}
+	}
+	if g.allow.matchHost(host) || g.allow.matchIP(ip) {
+		return nil
+	}
+	if containsIP(_BlockedNetworks, ip) {
+		return &errOutboundRejected{host: host, reason: fmt.Sprintf("address %s is not public", ip)}
+	}
+	return nil
+}
+
+// dialContext resolves the host itself and connects to a checked address. It
+// never lets the underlying dialer do its own lookup, so the address that was
+// checked is the address that's connected to, even if DNS changes in between.
+func (g *outboundGuard) dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if g.deny.matchHost(host) {
+		return nil, &errOutboundRejected{host: host, reason: "destination is denied"}
+	}
+
+	var ips []net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		ips = []net.IP{ip}
+	} else {
+		addrs, lerr := g.resolver.LookupIPAddr(ctx, host)
+		if lerr != nil {
+			return nil, lerr
+		}
+		for _, a := range addrs {
+			ips = append(ips, a.IP)
+		}
+	}
+	if len(ips) < 1 {
+		return nil, fmt.Errorf("no addresses found for %q", host)
+	}
+	// Every address must pass, otherwise a host could list one public and one
+	// private address and hope for the best.
+	for _, ip := range ips {
+		if err = g.checkIP(host, ip); err != nil {
+			return nil, err
+		}
+	}
+
+	var conn net.Conn
+	for _, ip := range ips {
+		if conn, err = g.dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port)); err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+// newOutboundClient makes an HTTP client for requests to URLs from user content.
+// It should be used for all such requests made by jobs.
+func newOutboundClient(conf config.Outbound) *http.Client {
+	guard := newOutboundGuard(conf)
+	timeout := time.Duration(conf.TimeoutSeconds) * time.Second
+	if timeout <= 0 {
+		timeout = 15 * time.Second
+	}
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			// A proxy would do its own DNS lookups, which skips the guard.
+			Proxy:                 nil,
+			DialContext:           guard.dialContext,
+			MaxIdleConns:          10,
+			IdleConnTimeout:       30 * time.Second,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ResponseHeaderTimeout: timeout,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			// Redirect targets are dialed through the guard too.
+			if len(via) >= 3 {
+				return errors.New("stopped after 3 redirects")
+			}
+			return nil
+		},
+	}
+}
+
+// errResponseTooLarge means a response body exceeded the configured limit.
+var errResponseTooLarge = errors.New("response body too large")
+
+// readLimited reads r in full unless it's more than max bytes.
+func readLimited(r io.Reader, max int64) ([]byte, error) {
+	if max <= 0 {
+		max = 1 << 20
+	}
+	out, err := io.ReadAll(io.LimitReader(r, max+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(out)) > max {
+		return nil, errResponseTooLarge
+	}
+	return out, nil
+}
+
+// recordRejection saves a rejected outbound request so operators can see when
+// users point extensions at places they shouldn't.
+func recordRejection(ctx context.Context, userID, rawURL string, rejected *errOutboundRejected) {
+	log.Printf("outbound: user %s; %v\n", userID, rejected)
+	if err := db.Exec(
+		ctx,
+		"INSERT INTO outbound_rejections (user_uuid, url, reason, created_at) VALUES (?,?,?,?)",
+		userID, rawURL, rejected.Error(), time.Now().UTC(),
+	); err != nil {
+		log.Printf("outbound: could not record rejection; %v\n", err)
+	}
+}
@@ -0,0 +1,107 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/rafaelespinoza/standardnotes/internal/config"
+	"github.com/rafaelespinoza/standardnotes/internal/db/dbtest"
+)
+
+func init() {
+	dbtest.Init()
+}
+
+func TestOutboundGuardCheckIP(t *testing.T) {
+	guard := newOutboundGuard(config.Outbound{
+		Allow: []string{"10.1.2.0/24", "intranet.example.com"},
+		Deny:  []string{"203.0.113.7", "evil.example.com"},
+	})
+
+	tests := []struct {
+		host    string
+		ip      string
+		allowed bool
+	}{
+		{host: "example.com", ip: "93.184.216.34", allowed: true},
+		{host: "example.com", ip: "2606:2800:220:1:248:1893:25c8:1946", allowed: true},
+		{host: "localhost", ip: "127.0.0.1", allowed: false},
+		{host: "localhost", ip: "::1", allowed: false},
+		{host: "metadata", ip: "169.254.169.254", allowed: false},
+		{host: "metadata", ip: "fd00:ec2::254", allowed: false},
+		{host: "private", ip: "192.168.1.1", allowed: false},
+		{host: "private", ip: "172.16.0.1", allowed: false},
+		{host: "mapped", ip: "::ffff:127.0.0.1", allowed: false},
+		{host: "zero", ip: "0.0.0.0", allowed: false},
+		{host: "allowed-cidr", ip: "10.1.2.3", allowed: true},
+		{host: "blocked-cidr", ip: "10.1.3.3", allowed: false},
+		{host: "intranet.example.com", ip: "10.9.9.9", allowed: true},
+		{host: "denied-ip", ip: "203.0.113.7", allowed: false},
+		{host: "evil.example.com", ip: "93.184.216.34", allowed: false},
+	}
+
+	for i, test := range tests {
+		err := guard.checkIP(test.host, net.ParseIP(test.ip))
+		if test.allowed && err != nil {
+			t.Errorf("test [%d]; expected %s (%s) to be allowed; got %v", i, test.host, test.ip, err)
+		} else if !test.allowed && err == nil {
+			t.Errorf("test [%d]; expected %s (%s) to be rejected", i, test.host, test.ip)
+		}
+	}
+}
+
+func TestOutboundClient(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(strings.Repeat("a", 64)))
+	}))
+	defer srv.Close()
+
+	t.Run("loopback rejected", func(t *testing.T) {
+		client := newOutboundClient(config.Outbound{})
+		_, err := client.Get(srv.URL)
+		var rejected *errOutboundRejected
+		if !errors.As(err, &rejected) {
+			t.Errorf("expected request to be rejected; got %v", err)
+		}
+	})
+
+	t.Run("loopback allowed", func(t *testing.T) {
+		client := newOutboundClient(config.Outbound{Allow: []string{"127.0.0.1"}})
+		res, err := client.Get(srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		if _, err = readLimited(res.Body, 32); err != errResponseTooLarge {
+			t.Errorf("expected %v; got %v", errResponseTooLarge, err)
+		}
+	})
+
+	t.Run("extension job", func(t *testing.T) {
+		err := postToExtension(
+			context.Background(),
+			ExtensionJobParams{URL: srv.URL, UserID: t.Name()},
+			[]byte(`{}`),
+		)
+		var rejected *errOutboundRejected
+		if !errors.As(err, &rejected) {
+			t.Errorf("expected request to be rejected; got %v", err)
+		}
+	})
+
+	t.Run("extension job canceled", func(t *testing.T) {
+		defer func(outbound config.Outbound) { config.Conf.Outbound = outbound }(config.Conf.Outbound)
+		config.Conf.Outbound.Allow = []string{"127.0.0.1"}
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		err := postToExtension(ctx, ExtensionJobParams{URL: srv.URL, UserID: t.Name()}, []byte(`{}`))
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("expected %v; got %v", context.Canceled, err)
+		}
+	})
+}
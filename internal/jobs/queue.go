@@ -0,0 +1,104 @@
+package jobs
+
+import (
+	"context"
+	"log"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// _QueueSize is how many jobs can wait for a worker. Jobs enqueued while
+	// the queue is full are dropped.
+	_QueueSize = 256
+	// _Workers is how many jobs run at the same time.
+	_Workers = 4
+)
+
+type queuedJob struct {
+	name    string
+	perform func(ctx context.Context) error
+}
+
+// queue holds jobs in memory only. It isn't durable: jobs that are waiting when
+// the server stops are lost, and so are jobs enqueued while it's full. Those are
+// logged and counted by DroppedJobs. Unlike webhooks, a lost extension delivery
+// is made up for by the next sync or daily backup.
+var (
+	queue      = make(chan queuedJob, _QueueSize)
+	dropped    uint64
+	queueMtx   sync.Mutex
+	queueAlive bool
+)
+
+// EnqueueExtensionJob schedules PerformExtensionJob to run in the background,
+// so that a slow extension doesn't hold up the request that triggered it. It
+// doesn't block; the job is dropped if the queue is full.
+func EnqueueExtensionJob(params ExtensionJobParams) {
+	enqueue(queuedJob{
+		name: "extension " + params.ExtensionID,
+		perform: func(ctx context.Context) error {
+			return PerformExtensionJob(ctx, params)
+		},
+	})
+}
+
+// EnqueueMailerJob schedules PerformMailerJob to run in the background. It
+// doesn't block; the job is dropped if the queue is full.
+func EnqueueMailerJob(params MailerJobParams) {
+	enqueue(queuedJob{
+		name: "mailer",
+		perform: func(ctx context.Context) error {
+			return PerformMailerJob(ctx, params)
+		},
+	})
+}
+
+// DroppedJobs is the number of jobs that were dropped because the queue was
+// full, since the server started.
+func DroppedJobs() uint64 { return atomic.LoadUint64(&dropped) }
+
+func enqueue(job queuedJob) {
+	select {
+	case queue <- job:
+	default:
+		n := atomic.AddUint64(&dropped, 1)
+		log.Printf("jobs: queue is full, dropped %s job; %d dropped so far\n", job.name, n)
+	}
+}
+
+// Run performs enqueued jobs until the done channel is closed. Only one set of
+// workers runs at a time; calling it again while it's running is a no-op.
+func Run(done <-chan struct{}) {
+	queueMtx.Lock()
+	if queueAlive {
+		queueMtx.Unlock()
+		return
+	}
+	queueAlive = true
+	queueMtx.Unlock()
+	defer func() {
+		queueMtx.Lock()
+		queueAlive = false
+		queueMtx.Unlock()
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < _Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				case job := <-queue:
+					if err := job.perform(context.Background()); err != nil {
+						log.Printf("jobs: could not perform %s job; %v\n", job.name, err)
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
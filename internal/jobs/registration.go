@@ -1,12 +1,63 @@
 package jobs
 
-import "time"
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/rafaelespinoza/standardnotes/internal/mail"
+)
 
 type RegistrationJobParams struct {
 	Email     string
 	CreatedAt time.Time
+	// VerificationLink, if not empty, is included in the welcome message so
+	// the user can verify their email address.
+	VerificationLink string
 }
 
+// PerformRegistrationJob sends a welcome message to a newly-registered user.
 func PerformRegistrationJob(params RegistrationJobParams) (err error) {
+	body := strings.TrimSpace(fmt.Sprintf(`
+Welcome to Standard Notes!
+
+Your account, %s, was created on %s.
+`, params.Email, params.CreatedAt.UTC().Format(time.RFC1123)))
+
+	if params.VerificationLink != "" {
+		body += "\n\n" + verificationInstructions(params.VerificationLink)
+	}
+
+	err = mail.Send(mail.Message{
+		To:      params.Email,
+		Subject: "Welcome to Standard Notes",
+		Body:    body + "\n",
+	})
 	return
 }
+
+type VerificationJobParams struct {
+	Email            string
+	VerificationLink string
+}
+
+// PerformVerificationJob sends another email address verification link to a
+// user who has not verified yet.
+func PerformVerificationJob(params VerificationJobParams) (err error) {
+	err = mail.Send(mail.Message{
+		To:      params.Email,
+		Subject: "Verify your Standard Notes email address",
+		Body:    verificationInstructions(params.VerificationLink) + "\n",
+	})
+	return
+}
+
+func verificationInstructions(link string) string {
+	return strings.TrimSpace(fmt.Sprintf(`
+Please verify your email address by visiting this link:
+
+%s
+
+If you did not create this account, then you can ignore this message.
+`, link))
+}
@@ -0,0 +1,330 @@
+// Package keys manages the keys that sign and verify tokens. Keys are kept in
+// a JSON file, oldest first. The newest key signs new tokens, and every key in
+// the file verifies tokens, so that rotating in a new key doesn't sign anybody
+// out. Each key has an ID, which goes in the "kid" header of the tokens it
+// signs.
+package keys
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Algorithms, named as in the "alg" header of a JWT.
+const (
+	// HS256 is HMAC with SHA-256. The same secret signs and verifies, so
+	// only this server can verify its tokens.
+	HS256 = "HS256"
+	// EdDSA is Ed25519. Anybody with the public key can verify tokens.
+	EdDSA = "EdDSA"
+	// RS256 is RSA PKCS #1 v1.5 with SHA-256. Anybody with the public key can
+	// verify tokens.
+	RS256 = "RS256"
+)
+
+const (
+	// _MinSecretLength is the shortest secret accepted for HS256, in bytes.
+	// It's the size of the hash output.
+	_MinSecretLength = 32
+	// _RSABits is the size of new RSA keys, which is also the smallest size
+	// accepted.
+	_RSABits = 2048
+)
+
+// A Key signs and verifies tokens. HS256 keys have a Secret. Other keys have a
+// PrivateKey, in PKCS #8 form, which includes the public key.
+type Key struct {
+	ID         string    `json:"kid"`
+	Alg        string    `json:"alg"`
+	Secret     []byte    `json:"secret,omitempty"`
+	PrivateKey []byte    `json:"private_key,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+
+	// private is PrivateKey, parsed.
+	private crypto.Signer
+}
+
+// Generate makes a new random key for the algorithm alg.
+func Generate(alg string, t time.Time) (key Key, err error) {
+	id := make([]byte, 8)
+	if _, err = rand.Read(id); err != nil {
+		return
+	}
+	key = Key{
+		ID:        hex.EncodeToString(id),
+		Alg:       alg,
+		CreatedAt: t.UTC().Truncate(time.Second),
+	}
+	switch alg {
+	case HS256:
+		key.Secret = make([]byte, 64)
+		_, err = rand.Read(key.Secret)
+		return
+	case EdDSA:
+		_, key.private, err = ed25519.GenerateKey(rand.Reader)
+	case RS256:
+		key.private, err = rsa.GenerateKey(rand.Reader, _RSABits)
+	default:
+		err = fmt.Errorf("unsupported key algorithm %q", alg)
+	}
+	if err != nil {
+		return
+	}
+	key.PrivateKey, err = x509.MarshalPKCS8PrivateKey(key.private)
+	return
+}
+
+// parse checks that the key is usable, and parses its private key.
+func (k *Key) parse() (err error) {
+	if k.ID == "" {
+		return fmt.Errorf("key is missing a kid")
+	}
+	if k.Alg == HS256 {
+		if len(k.Secret) < _MinSecretLength {
+			return fmt.Errorf("key %q secret too short; got %d bytes, expected >= %d", k.ID, len(k.Secret), _MinSecretLength)
+		}
+		return nil
+	}
+	var parsed interface{}
+	if parsed, err = x509.ParsePKCS8PrivateKey(k.PrivateKey); err != nil {
+		return fmt.Errorf("key %q private_key invalid; %v", k.ID, err)
+	}
+	switch private := parsed.(type) {
+	case ed25519.PrivateKey:
+		if k.Alg != EdDSA {
+			break
+		}
+		k.private = private
+		return nil
+	case *rsa.PrivateKey:
+		if k.Alg != RS256 {
+			break
+		}
+		if private.N.BitLen() < _RSABits {
+			return fmt.Errorf("key %q too small; got %d bits, expected >= %d", k.ID, private.N.BitLen(), _RSABits)
+		}
+		k.private = private
+		return nil
+	}
+	return fmt.Errorf("key %q has unsupported algorithm %q for its private_key", k.ID, k.Alg)
+}
+
+// SigningKey outputs what the jwt library signs tokens with for the key's
+// algorithm.
+func (k Key) SigningKey() interface{} {
+	if k.Alg == HS256 {
+		return k.Secret
+	}
+	return k.private
+}
+
+// VerificationKey outputs what the jwt library verifies tokens with for the
+// key's algorithm.
+func (k Key) VerificationKey() interface{} {
+	if k.Alg == HS256 {
+		return k.Secret
+	} else if k.private == nil {
+		return nil
+	}
+	return k.private.Public()
+}
+
+// DeriveSecret makes a secret for purpose out of the key's private material, so
+// that the secret doesn't have to be configured separately. The same key and
+// purpose always make the same secret.
+func (k Key) DeriveSecret(purpose string) []byte {
+	material := k.Secret
+	if k.Alg != HS256 {
+		material = k.PrivateKey
+	}
+	mac := hmac.New(sha256.New, material)
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
+
+// A JWK is the public part of a key, in JSON Web Key form.
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	// Crv and X are set for Ed25519 keys.
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	// N and E are set for RSA keys.
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+}
+
+// JWK outputs the public part of the key. HS256 keys have no public part.
+func (k Key) JWK() (out JWK, ok bool) {
+	out = JWK{Kid: k.ID, Alg: k.Alg, Use: "sig"}
+	enc := base64.RawURLEncoding
+	switch public := k.VerificationKey().(type) {
+	case ed25519.PublicKey:
+		out.Kty, out.Crv, out.X = "OKP", "Ed25519", enc.EncodeToString(public)
+		ok = true
+	case *rsa.PublicKey:
+		out.Kty = "RSA"
+		out.N = enc.EncodeToString(public.N.Bytes())
+		out.E = enc.EncodeToString(big.NewInt(int64(public.E)).Bytes())
+		ok = true
+	}
+	return
+}
+
+// A Set is the contents of a keys file.
+type Set struct {
+	// Keys is ordered oldest first.
+	Keys []Key `json:"keys"`
+}
+
+// Current outputs the newest key, which is the one that signs new tokens.
+func (s *Set) Current() (key Key, ok bool) {
+	if ok = len(s.Keys) > 0; ok {
+		key = s.Keys[len(s.Keys)-1]
+	}
+	return
+}
+
+// Find looks up a key by its ID.
+func (s *Set) Find(kid string) (key Key, ok bool) {
+	for _, key = range s.Keys {
+		if key.ID == kid {
+			return key, true
+		}
+	}
+	return Key{}, false
+}
+
+// Validate makes sure that the set has at least one key, that every key is
+// usable and that no two keys have the same ID. It has to be called before
+// the keys sign or verify anything, because it also parses private keys.
+func (s *Set) Validate() error {
+	if len(s.Keys) == 0 {
+		return fmt.Errorf("no keys")
+	}
+	seen := make(map[string]bool, len(s.Keys))
+	for i := range s.Keys {
+		if err := s.Keys[i].parse(); err != nil {
+			return err
+		}
+		if seen[s.Keys[i].ID] {
+			return fmt.Errorf("duplicate kid %q", s.Keys[i].ID)
+		}
+		seen[s.Keys[i].ID] = true
+	}
+	return nil
+}
+
+// JWKS outputs the public keys of the set, in JSON Web Key Set form. Keys
+// without a public part are left out.
+func (s *Set) JWKS() map[string][]JWK {
+	out := make([]JWK, 0, len(s.Keys))
+	for _, key := range s.Keys {
+		if jwk, ok := key.JWK(); ok {
+			out = append(out, jwk)
+		}
+	}
+	return map[string][]JWK{"keys": out}
+}
+
+// Load reads and validates a keys file.
+func Load(path string) (set *Set, err error) {
+	var data []byte
+	if data, err = ioutil.ReadFile(path); err != nil {
+		return
+	}
+	set = new(Set)
+	if err = json.Unmarshal(data, set); err != nil {
+		set = nil
+		err = fmt.Errorf("keys file %s: %v", path, err)
+		return
+	}
+	if err = set.Validate(); err != nil {
+		set = nil
+		err = fmt.Errorf("keys file %s: %v", path, err)
+	}
+	return
+}
+
+// Save writes the set to a temporary file in the same directory, readable only
+// by its owner, then renames it into place.
+func Save(path string, set *Set) (err error) {
+	if err = set.Validate(); err != nil {
+		return
+	}
+	var data []byte
+	if data, err = json.MarshalIndent(set, "", "    "); err != nil {
+		return
+	}
+	var tmp *os.File
+	if tmp, err = ioutil.TempFile(filepath.Dir(path), ".tmp-"+filepath.Base(path)+"-"); err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+	if _, err = tmp.Write(append(data, '\n')); err != nil {
+		return
+	}
+	if err = tmp.Sync(); err != nil {
+		return
+	}
+	if err = tmp.Close(); err != nil {
+		return
+	}
+	err = os.Rename(tmp.Name(), path)
+	return
+}
+
+// Create writes a new keys file with one key. It fails if the file exists.
+func Create(path, alg string, t time.Time) (key Key, err error) {
+	if _, err = os.Stat(path); err == nil {
+		err = fmt.Errorf("keys file %s already exists", path)
+		return
+	} else if !os.IsNotExist(err) {
+		return
+	}
+	if key, err = Generate(alg, t); err != nil {
+		return
+	}
+	err = Save(path, &Set{Keys: []Key{key}})
+	return
+}
+
+// Rotate adds a new key to a keys file, which becomes the current key. If keep
+// is positive, then only the newest keep keys are kept; tokens signed by the
+// removed keys stop working.
+func Rotate(path, alg string, keep int, t time.Time) (key Key, err error) {
+	var set *Set
+	if set, err = Load(path); err != nil {
+		return
+	}
+	if key, err = Generate(alg, t); err != nil {
+		return
+	}
+	set.Keys = append(set.Keys, key)
+	if keep > 0 && len(set.Keys) > keep {
+		set.Keys = set.Keys[len(set.Keys)-keep:]
+	}
+	err = Save(path, set)
+	return
+}
@@ -0,0 +1,140 @@
+package keys_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rafaelespinoza/standardnotes/internal/keys"
+)
+
+func TestRotate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.json")
+	if _, err := keys.Rotate(path, keys.HS256, 0, time.Now()); err == nil {
+		t.Error("expected error rotating a keys file that doesn't exist")
+	}
+	first, err := keys.Create(path, keys.HS256, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = keys.Create(path, keys.HS256, time.Now()); err == nil {
+		t.Error("expected error creating over an existing keys file")
+	}
+	if info, err := os.Stat(path); err != nil {
+		t.Fatal(err)
+	} else if info.Mode().Perm() != 0600 {
+		t.Errorf("wrong file mode; got %v, expected %v", info.Mode().Perm(), os.FileMode(0600))
+	}
+
+	second, err := keys.Rotate(path, keys.HS256, 0, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	set, err := keys.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if current, ok := set.Current(); !ok || current.ID != second.ID {
+		t.Errorf("expected newest key to be current; got %q, expected %q", current.ID, second.ID)
+	}
+	if found, ok := set.Find(first.ID); !ok || string(found.Secret) != string(first.Secret) {
+		t.Error("expected old key to be kept")
+	}
+
+	third, err := keys.Rotate(path, keys.HS256, 2, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if set, err = keys.Load(path); err != nil {
+		t.Fatal(err)
+	}
+	if len(set.Keys) != 2 || set.Keys[0].ID != second.ID || set.Keys[1].ID != third.ID {
+		t.Errorf("expected only the newest 2 keys; got %+v", set.Keys)
+	}
+	if _, ok := set.Find(first.ID); ok {
+		t.Error("expected oldest key to be removed")
+	}
+}
+
+func TestLoad(t *testing.T) {
+	tests := []struct {
+		name     string
+		contents string
+	}{
+		{"not json", "keys"},
+		{"no keys", `{"keys": []}`},
+		{"no kid", `{"keys": [{"alg": "HS256", "secret": "c2VjcmV0c2VjcmV0c2VjcmV0c2VjcmV0c2VjcmV0c2VjcmV0"}]}`},
+		{"unknown alg", `{"keys": [{"kid": "a", "alg": "none", "secret": "c2VjcmV0c2VjcmV0c2VjcmV0c2VjcmV0c2VjcmV0c2VjcmV0"}]}`},
+		{"short secret", `{"keys": [{"kid": "a", "alg": "HS256", "secret": "c2VjcmV0"}]}`},
+		{"duplicate kid", `{"keys": [
+			{"kid": "a", "alg": "HS256", "secret": "c2VjcmV0c2VjcmV0c2VjcmV0c2VjcmV0c2VjcmV0c2VjcmV0"},
+			{"kid": "a", "alg": "HS256", "secret": "c2VjcmV0c2VjcmV0c2VjcmV0c2VjcmV0c2VjcmV0c2VjcmV0"}
+		]}`},
+	}
+	dir := t.TempDir()
+	for i, test := range tests {
+		path := filepath.Join(dir, "keys"+string(rune('a'+i))+".json")
+		if err := ioutil.WriteFile(path, []byte(test.contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := keys.Load(path); err == nil {
+			t.Errorf("%s; expected error", test.name)
+		}
+	}
+}
+
+func TestGenerate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.json")
+	set := new(keys.Set)
+	for _, alg := range []string{keys.HS256, keys.EdDSA, keys.RS256} {
+		key, err := keys.Generate(alg, time.Now())
+		if err != nil {
+			t.Fatalf("%s; %v", alg, err)
+		}
+		set.Keys = append(set.Keys, key)
+	}
+	if _, err := keys.Generate("none", time.Now()); err == nil {
+		t.Error("expected error for unknown algorithm")
+	}
+	if err := keys.Save(path, set); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := keys.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jwks := loaded.JWKS()["keys"]
+	if len(jwks) != 2 {
+		t.Fatalf("expected public keys of EdDSA and RS256 keys only; got %+v", jwks)
+	}
+	if jwk := jwks[0]; jwk.Kid != set.Keys[1].ID || jwk.Kty != "OKP" || jwk.Crv != "Ed25519" || jwk.X == "" {
+		t.Errorf("unexpected Ed25519 key %+v", jwk)
+	}
+	if jwk := jwks[1]; jwk.Kid != set.Keys[2].ID || jwk.Kty != "RSA" || jwk.N == "" || jwk.E != "AQAB" {
+		t.Errorf("unexpected RSA key %+v", jwk)
+	}
+
+	for i, key := range loaded.Keys {
+		secret := key.DeriveSecret("test")
+		if string(secret) != string(set.Keys[i].DeriveSecret("test")) {
+			t.Errorf("%s; expected the same secret after loading", key.Alg)
+		}
+		if string(secret) == string(key.DeriveSecret("other")) {
+			t.Errorf("%s; expected different secrets for different purposes", key.Alg)
+		}
+		if i > 0 && string(secret) == string(loaded.Keys[i-1].DeriveSecret("test")) {
+			t.Errorf("%s; expected different secrets for different keys", key.Alg)
+		}
+	}
+
+	// a private key has to match the algorithm.
+	mismatched := *set
+	mismatched.Keys = []keys.Key{set.Keys[1]}
+	mismatched.Keys[0].Alg = keys.RS256
+	if err = mismatched.Validate(); err == nil {
+		t.Error("expected error for an Ed25519 key labeled RS256")
+	}
+}
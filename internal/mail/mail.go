@@ -0,0 +1,123 @@
+// Package mail sends email to end users.
+package mail
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"net/smtp"
+	"net/textproto"
+	"strconv"
+	"time"
+
+	"github.com/rafaelespinoza/standardnotes/internal/config"
+	"github.com/rafaelespinoza/standardnotes/internal/logger"
+)
+
+// A Message is one plain text email, with optional attachments.
+type Message struct {
+	To          string
+	Subject     string
+	Body        string
+	Attachments []Attachment
+}
+
+// An Attachment is a file sent along with a Message.
+type Attachment struct {
+	Filename    string
+	ContentType string
+	Content     []byte
+}
+
+// A Sender delivers a Message.
+type Sender interface {
+	Send(msg Message) error
+}
+
+var _Sender Sender
+
+// Use sets the Sender for all subsequent messages. It's mostly useful for
+// tests. Pass nil to go back to using the configured Sender.
+func Use(s Sender) { _Sender = s }
+
+// Send delivers the message with the Sender set by Use. If there isn't one,
+// then it's delivered via SMTP when a mail host is configured. Otherwise, the
+// message is only logged in debug mode.
+func Send(msg Message) error {
+	if msg.To == "" {
+		return fmt.Errorf("message recipient is empty")
+	}
+	if _Sender != nil {
+		return _Sender.Send(msg)
+	}
+	conf := config.Conf.Mail
+	if conf.Host == "" {
+		return logSender{}.Send(msg)
+	}
+	return smtpSender{conf: conf}.Send(msg)
+}
+
+type logSender struct{}
+
+func (s logSender) Send(msg Message) error {
+	logger.LogIfDebug(fmt.Sprintf(
+		"mail not configured; to: %q, subject: %q, attachments: %d\n%s",
+		msg.To, msg.Subject, len(msg.Attachments), msg.Body,
+	))
+	return nil
+}
+
+type smtpSender struct {
+	conf config.Mail
+}
+
+func (s smtpSender) Send(msg Message) error {
+	var auth smtp.Auth
+	if s.conf.Username != "" {
+		auth = smtp.PlainAuth("", s.conf.Username, s.conf.Password, s.conf.Host)
+	}
+	addr := s.conf.Host + ":" + strconv.Itoa(s.conf.Port)
+	return smtp.SendMail(addr, auth, s.conf.From, []string{msg.To}, s.format(msg))
+}
+
+func (s smtpSender) format(msg Message) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", s.conf.From)
+	fmt.Fprintf(&buf, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&buf, "Subject: %s\r\n", msg.Subject)
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().UTC().Format(time.RFC1123Z))
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	if len(msg.Attachments) < 1 {
+		buf.WriteString("Content-Type: text/plain; charset=\"utf-8\"\r\n")
+		buf.WriteString("\r\n")
+		buf.WriteString(msg.Body)
+		return buf.Bytes()
+	}
+
+	// Writes to a bytes.Buffer don't fail, so errors are ignored.
+	parts := multipart.NewWriter(&buf)
+	fmt.Fprintf(&buf, "Content-Type: multipart/mixed; boundary=%q\r\n", parts.Boundary())
+	buf.WriteString("\r\n")
+	body, _ := parts.CreatePart(textproto.MIMEHeader{
+		"Content-Type": {"text/plain; charset=\"utf-8\""},
+	})
+	body.Write([]byte(msg.Body))
+	for _, att := range msg.Attachments {
+		part, _ := parts.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {att.ContentType},
+			"Content-Transfer-Encoding": {"base64"},
+			"Content-Disposition":       {mime.FormatMediaType("attachment", map[string]string{"filename": att.Filename})},
+		})
+		encoded := base64.StdEncoding.EncodeToString(att.Content)
+		// Lines of base64 are limited to 76 characters.
+		for len(encoded) > 76 {
+			part.Write([]byte(encoded[:76] + "\r\n"))
+			encoded = encoded[76:]
+		}
+		part.Write([]byte(encoded + "\r\n"))
+	}
+	parts.Close()
+	return buf.Bytes()
+}
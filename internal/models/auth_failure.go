@@ -0,0 +1,66 @@
+package models
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/rafaelespinoza/standardnotes/internal/db"
+)
+
+// AuthFailures tracks consecutive failed sign in attempts for an email address.
+type AuthFailures struct {
+	Email       string
+	Failures    int
+	LockedUntil time.Time
+}
+
+// Locked tells you if the email address is locked out at time t.
+func (f AuthFailures) Locked(t time.Time) bool { return t.Before(f.LockedUntil) }
+
+// LoadAuthFailures fetches failed sign in attempts for the email address. If
+// there are none, then the output has zero failures and is not locked.
+func LoadAuthFailures(ctx context.Context, email string) (out AuthFailures, err error) {
+	out.Email = email
+	err = db.SelectMany(ctx, func(iterator db.Iterator) error {
+		return iterator.Scan(&out.Failures, &out.LockedUntil)
+	}, "SELECT failures, locked_until FROM auth_failures WHERE email=?", email)
+	return
+}
+
+// RecordAuthFailure increments the count of failed sign in attempts for the
+// email address. Once the count reaches maxAttempts, the address is locked out
+// for the duration lockFor and the count starts over. The output locked is true
+// when this failure caused a lockout. The count is incremented in one
+// statement, so that concurrent failures are all counted.
+func RecordAuthFailure(ctx context.Context, email string, maxAttempts int, lockFor time.Duration) (locked bool, err error) {
+	now := time.Now().UTC()
+	err = db.WithTx(ctx, func(ctx context.Context) (err error) {
+		if err = db.Exec(ctx,
+			strings.TrimSpace(`
+			INSERT INTO auth_failures (email, failures, locked_until, updated_at)
+			VALUES (?,?,?,?)
+			ON CONFLICT (email) DO UPDATE
+			SET failures = auth_failures.failures + 1, updated_at = excluded.updated_at`),
+			email, 1, time.Time{}, now,
+		); err != nil || maxAttempts <= 0 {
+			return
+		}
+		var n int64
+		n, err = db.ExecAffected(ctx,
+			"UPDATE auth_failures SET failures=?, locked_until=? WHERE email=? AND failures >= ?",
+			0, now.Add(lockFor), email, maxAttempts,
+		)
+		locked = n > 0
+		return
+	})
+	if err != nil {
+		locked = false
+	}
+	return
+}
+
+// ResetAuthFailures forgets about failed sign in attempts for the email address.
+func ResetAuthFailures(ctx context.Context, email string) error {
+	return db.Exec(ctx, "DELETE FROM auth_failures WHERE email=?", email)
+}
@@ -0,0 +1,76 @@
+package models_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rafaelespinoza/standardnotes/internal/models"
+)
+
+func TestRecordAuthFailure(t *testing.T) {
+	const maxAttempts = 3
+	email := t.Name() + "@example.com"
+
+	for i := 1; i <= maxAttempts; i++ {
+		locked, err := models.RecordAuthFailure(context.Background(), email, maxAttempts, time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expLocked := i == maxAttempts; locked != expLocked {
+			t.Errorf("attempt %d; wrong locked value; got %t, expected %t", i, locked, expLocked)
+		}
+	}
+
+	failures, err := models.LoadAuthFailures(context.Background(), email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !failures.Locked(time.Now().UTC()) {
+		t.Error("expected email to be locked")
+	}
+	if failures.Locked(time.Now().UTC().Add(2 * time.Hour)) {
+		t.Error("expected lock to expire")
+	}
+
+	if err = models.ResetAuthFailures(context.Background(), email); err != nil {
+		t.Fatal(err)
+	}
+	if failures, err = models.LoadAuthFailures(context.Background(), email); err != nil {
+		t.Fatal(err)
+	} else if failures.Failures != 0 || failures.Locked(time.Now().UTC()) {
+		t.Errorf("expected failures to be reset; got %+v", failures)
+	}
+}
+
+func TestRecordAuthFailureConcurrently(t *testing.T) {
+	const attempts = 20
+	email := t.Name() + "@example.com"
+
+	var wg sync.WaitGroup
+	errs := make(chan error, attempts)
+	for i := 0; i < attempts; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := models.RecordAuthFailure(context.Background(), email, attempts*2, time.Hour)
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	failures, err := models.LoadAuthFailures(context.Background(), email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if failures.Failures != attempts {
+		t.Errorf("expected every failure to be counted; got %d, expected %d", failures.Failures, attempts)
+	}
+}
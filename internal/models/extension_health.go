@@ -0,0 +1,125 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/rafaelespinoza/standardnotes/internal/db"
+)
+
+// ExtensionHealth tracks how deliveries to one extension have been going.
+type ExtensionHealth struct {
+	ExtensionUUID       string    `json:"extension_uuid"`
+	UserUUID            string    `json:"user_uuid"`
+	ConsecutiveFailures int       `json:"consecutive_failures"`
+	LastError           string    `json:"last_error"`
+	LastFailureAt       time.Time `json:"last_failure_at"`
+	LastSuccessAt       time.Time `json:"last_success_at"`
+	SuspendedUntil      time.Time `json:"suspended_until"`
+}
+
+// Suspended tells you if deliveries to the extension are on hold at time t.
+func (h ExtensionHealth) Suspended(t time.Time) bool { return t.Before(h.SuspendedUntil) }
+
+// RecordSuccess resets the failure count and lifts any suspension.
+func (h *ExtensionHealth) RecordSuccess(t time.Time) {
+	h.ConsecutiveFailures = 0
+	h.LastError = ""
+	h.LastSuccessAt = t
+	h.SuspendedUntil = time.Time{}
+}
+
+// RecordFailure increments the failure count. Once it reaches threshold, the
+// extension is suspended for backoff. Each failure after that doubles the
+// suspension, up to maxBackoff.
+func (h *ExtensionHealth) RecordFailure(t time.Time, cause error, threshold int, backoff, maxBackoff time.Duration) {
+	h.ConsecutiveFailures++
+	h.LastFailureAt = t
+	if cause != nil {
+		h.LastError = cause.Error()
+	}
+	if threshold < 1 || h.ConsecutiveFailures < threshold {
+		return
+	}
+	wait := backoff
+	for i := threshold; i < h.ConsecutiveFailures && wait < maxBackoff; i++ {
+		wait *= 2
+	}
+	if wait > maxBackoff {
+		wait = maxBackoff
+	}
+	h.SuspendedUntil = t.Add(wait)
+}
+
+// LoadExtensionHealth fetches the delivery health of an extension. If nothing
+// has been recorded yet, then the output is healthy.
+func LoadExtensionHealth(ctx context.Context, extensionUUID, userUUID string) (out ExtensionHealth, err error) {
+	var found []ExtensionHealth
+	if found, err = queryExtensionHealth(
+		ctx,
+		"SELECT "+_ExtensionHealthColumns+" FROM extension_health WHERE extension_uuid=? AND user_uuid=?",
+		extensionUUID, userUUID,
+	); err != nil {
+		return
+	}
+	if len(found) > 0 {
+		out = found[0]
+		return
+	}
+	out = ExtensionHealth{ExtensionUUID: extensionUUID, UserUUID: userUUID}
+	return
+}
+
+// LoadUserExtensionHealth fetches the delivery health of all the user's
+// extensions that have had a delivery attempt.
+func LoadUserExtensionHealth(ctx context.Context, userUUID string) ([]ExtensionHealth, error) {
+	return queryExtensionHealth(
+		ctx,
+		"SELECT "+_ExtensionHealthColumns+" FROM extension_health WHERE user_uuid=?",
+		userUUID,
+	)
+}
+
+// Save writes the health record to the DB, in one statement whether or not
+// it's there already.
+func (h *ExtensionHealth) Save(ctx context.Context) (err error) {
+	if h.ExtensionUUID == "" || h.UserUUID == "" {
+		return validationError{fmt.Errorf("extension_uuid and user_uuid are required")}
+	}
+	err = db.Exec(ctx,
+		strings.TrimSpace(`
+		INSERT INTO extension_health (
+			extension_uuid, user_uuid, consecutive_failures, last_error,
+			last_failure_at, last_success_at, suspended_until, updated_at
+		) VALUES (?,?,?,?,?,?,?,?)
+		ON CONFLICT (extension_uuid) DO UPDATE
+		SET consecutive_failures = excluded.consecutive_failures, last_error = excluded.last_error,
+			last_failure_at = excluded.last_failure_at, last_success_at = excluded.last_success_at,
+			suspended_until = excluded.suspended_until, updated_at = excluded.updated_at
+		WHERE extension_health.user_uuid = excluded.user_uuid`),
+		h.ExtensionUUID, h.UserUUID, h.ConsecutiveFailures, h.LastError,
+		h.LastFailureAt, h.LastSuccessAt, h.SuspendedUntil, time.Now().UTC(),
+	)
+	return
+}
+
+const _ExtensionHealthColumns = `extension_uuid, user_uuid, consecutive_failures, last_error,
+	last_failure_at, last_success_at, suspended_until`
+
+func queryExtensionHealth(ctx context.Context, query string, args ...interface{}) (out []ExtensionHealth, err error) {
+	out = make([]ExtensionHealth, 0)
+	err = db.SelectMany(ctx, func(iterator db.Iterator) (e error) {
+		var h ExtensionHealth
+		if e = iterator.Scan(
+			&h.ExtensionUUID, &h.UserUUID, &h.ConsecutiveFailures, &h.LastError,
+			&h.LastFailureAt, &h.LastSuccessAt, &h.SuspendedUntil,
+		); e != nil {
+			return
+		}
+		out = append(out, h)
+		return
+	}, query, args...)
+	return
+}
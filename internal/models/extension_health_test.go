@@ -0,0 +1,114 @@
+package models_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/rafaelespinoza/standardnotes/internal/models"
+)
+
+func TestExtensionHealthRecordFailure(t *testing.T) {
+	const threshold = 3
+	const backoff = 5 * time.Minute
+	const maxBackoff = 30 * time.Minute
+	now := time.Now().UTC()
+
+	expectedWaits := []time.Duration{
+		0, 0, // below threshold
+		5 * time.Minute,
+		10 * time.Minute,
+		20 * time.Minute,
+		30 * time.Minute, // capped
+		30 * time.Minute,
+	}
+	health := models.ExtensionHealth{}
+	for i, expWait := range expectedWaits {
+		health.RecordFailure(now, errors.New("boom"), threshold, backoff, maxBackoff)
+		if health.ConsecutiveFailures != i+1 {
+			t.Errorf("failure %d; wrong count %d", i+1, health.ConsecutiveFailures)
+		}
+		if health.LastError != "boom" {
+			t.Errorf("failure %d; wrong last error %q", i+1, health.LastError)
+		}
+		if expWait == 0 {
+			if health.Suspended(now) {
+				t.Errorf("failure %d; should not be suspended", i+1)
+			}
+			continue
+		}
+		if wait := health.SuspendedUntil.Sub(now); wait != expWait {
+			t.Errorf("failure %d; wrong suspension; got %v, expected %v", i+1, wait, expWait)
+		}
+	}
+
+	health.RecordSuccess(now)
+	if health.ConsecutiveFailures != 0 || health.LastError != "" || health.Suspended(now) {
+		t.Errorf("expected success to reset health; got %+v", health)
+	}
+}
+
+func TestExtensionHealthSave(t *testing.T) {
+	const extensionUUID = "c3f1e1c0-8d0b-4a3e-9d0a-0d9f0e0b1a2c"
+	userUUID := stubbedUUID
+
+	health, err := models.LoadExtensionHealth(context.Background(), extensionUUID, userUUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if health.ConsecutiveFailures != 0 {
+		t.Fatalf("expected empty health; got %+v", health)
+	}
+
+	now := time.Now().UTC()
+	for i := 0; i < 2; i++ {
+		health.RecordFailure(now, errors.New("boom"), 2, time.Minute, time.Hour)
+		if err = health.Save(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	loaded, err := models.LoadExtensionHealth(context.Background(), extensionUUID, userUUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.ConsecutiveFailures != 2 {
+		t.Errorf("wrong failures; got %d, expected %d", loaded.ConsecutiveFailures, 2)
+	}
+	if !loaded.Suspended(now) {
+		t.Error("expected extension to be suspended")
+	}
+
+	all, err := models.LoadUserExtensionHealth(context.Background(), userUUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var found bool
+	for _, h := range all {
+		found = found || h.ExtensionUUID == extensionUUID
+	}
+	if !found {
+		t.Error("expected to find extension in user's extension health")
+	}
+
+	// two deliveries that both loaded the health before either saved it.
+	const otherUUID = "c3f1e1c0-8d0b-4a3e-9d0a-0d9f0e0b1a2d"
+	first, err := models.LoadExtensionHealth(context.Background(), otherUUID, userUUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second := first
+	first.RecordFailure(now, errors.New("boom"), 2, time.Minute, time.Hour)
+	second.RecordSuccess(now)
+	for _, h := range []models.ExtensionHealth{first, second} {
+		if err = h.Save(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if loaded, err = models.LoadExtensionHealth(context.Background(), otherUUID, userUUID); err != nil {
+		t.Fatal(err)
+	} else if loaded.ConsecutiveFailures != 0 || loaded.LastSuccessAt.IsZero() {
+		t.Errorf("expected the last save to win; got %+v", loaded)
+	}
+}
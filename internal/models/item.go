@@ -2,7 +2,9 @@ package models
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha256"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"sort"
@@ -11,7 +13,6 @@ import (
 	"time"
 
 	"github.com/google/uuid"
-	"github.com/rafaelespinoza/standardnotes/internal/db"
 	"github.com/rafaelespinoza/standardnotes/internal/logger"
 )
 
@@ -29,38 +30,30 @@ type Item struct {
 }
 
 // LoadItemByUUID fetches an Item from the DB.
-func LoadItemByUUID(uuid string) (item *Item, err error) {
+func LoadItemByUUID(ctx context.Context, uuid string) (item *Item, err error) {
 	if uuid == "" {
 		err = fmt.Errorf("uuid is empty")
 		return
 	}
-	item = &Item{} // can't be nil to start out
-	err = db.SelectStruct(
-		item,
-		`SELECT * FROM items WHERE uuid = ?`,
-		uuid,
-	)
-	if err != nil {
-		item = nil
-	}
+	item, err = _Repos.Items.FindByUUID(ctx, uuid)
 	return
 }
 
 // Save either adds a new Item to the DB or updates an existing Item in the DB.
-func (i *Item) Save() error {
+func (i *Item) Save(ctx context.Context) error {
 	if i.UUID == "" {
-		return i.Create()
+		return i.Create(ctx)
 	}
-	if exists, err := i.Exists(); err != nil {
+	if exists, err := i.Exists(ctx); err != nil {
 		return err
 	} else if !exists {
-		return i.Create()
+		return i.Create(ctx)
 	}
-	return i.Update()
+	return i.Update(ctx)
 }
 
 // Create adds the Item to the DB.
-func (i *Item) Create() error {
+func (i *Item) Create(ctx context.Context) error {
 	if len(i.UserUUID) < MinIDLength {
 		return validationError{fmt.Errorf("user_uuid too short")}
 	}
@@ -69,60 +62,39 @@ func (i *Item) Create() error {
 		id := uuid.New()
 		i.UUID = uuid.Must(id, nil).String()
 	}
-	i.CreatedAt = time.Now().UTC()
-	i.UpdatedAt = time.Now().UTC()
+	i.CreatedAt = now()
+	i.UpdatedAt = now()
 	logger.LogIfDebug("Create:", i.UUID)
-	return db.Query(
-		strings.TrimSpace(`
-		INSERT INTO items (
-			uuid, user_uuid, content, content_type, enc_item_key, auth_hash, deleted, created_at, updated_at
-		) VALUES(?,?,?,?,?,?,?,?,?)`),
-		i.UUID, i.UserUUID, i.Content, i.ContentType, i.EncItemKey, i.AuthHash, i.Deleted, i.CreatedAt, i.UpdatedAt,
-	)
+	return _Repos.Items.Create(ctx, i)
 }
 
 // Update updates the Item in the DB.
-func (i *Item) Update() error {
-	i.UpdatedAt = time.Now().UTC()
+func (i *Item) Update(ctx context.Context) error {
+	i.UpdatedAt = now()
 	logger.LogIfDebug("Update:", i.UUID)
-	return db.Query(
-		strings.TrimSpace(`
-		UPDATE items
-		SET content=?, content_type=?, enc_item_key=?, auth_hash=?, deleted=?, updated_at=?
-		WHERE uuid=? AND user_uuid=?`,
-		),
-		i.Content, i.ContentType, i.EncItemKey, i.AuthHash, i.Deleted, i.UpdatedAt,
-		i.UUID, i.UserUUID,
-	)
+	return _Repos.Items.Update(ctx, i)
 }
 
 // Delete performs a "soft delete" on the Item. It is not removed from the DB,
 // but its fields are set to empty and its Deleted field is set to true.
-func (i *Item) Delete() error {
+func (i *Item) Delete(ctx context.Context) error {
 	if i.UUID == "" {
 		return fmt.Errorf("attempted to delete non-existent item")
 	}
 	i.Content = ""
 	i.EncItemKey = ""
 	i.AuthHash = ""
-	i.UpdatedAt = time.Now().UTC()
+	i.UpdatedAt = now()
 	i.Deleted = true
 
-	return db.Query(
-		strings.TrimSpace(`
-			UPDATE items
-			SET content='', enc_item_key='', auth_hash='', deleted=1, updated_at=?
-			WHERE uuid=? AND user_uuid=?`,
-		),
-		i.UpdatedAt, i.UUID, i.UserUUID,
-	)
+	return _Repos.Items.Delete(ctx, i)
 }
 
 // Copy duplicates the Item, generates a new UUID and saves it to the DB.
-func (i Item) Copy() (Item, error) {
+func (i Item) Copy(ctx context.Context) (Item, error) {
 	i.UUID = "" // the Create method should make another one.
-	i.UpdatedAt = time.Now().UTC()
-	err := i.Create()
+	i.UpdatedAt = now()
+	err := i.Create(ctx)
 	if err != nil {
 		logger.LogIfDebug(err)
 		return Item{}, err
@@ -131,16 +103,11 @@ func (i Item) Copy() (Item, error) {
 }
 
 // Exists checks if an item exists in the DB.
-func (i *Item) Exists() (bool, error) {
+func (i *Item) Exists(ctx context.Context) (bool, error) {
 	if i.UUID == "" {
 		return false, nil
 	}
-	var id string
-	return db.SelectExists(
-		&id,
-		"SELECT uuid FROM items WHERE uuid=?",
-		i.UUID,
-	)
+	return _Repos.Items.Exists(ctx, i.UUID)
 }
 
 // MergeProtected reconciles Item fields in preparation for sync updates while
@@ -195,88 +162,6 @@ func (i *Item) MarshalJSON() ([]byte, error) {
 	})
 }
 
-// detuplize is used for converting a db query result into an Item. It's a
-// little inflexible because it assumes that the columns are always in the same
-// order. At the moment, this works with a `SELECT *`; but it'd probably get in
-// the way if you needed to project differently or the schema changed.
-func (i *Item) detuplize(iterator db.Iterator) (err error) {
-	var uuid, userUUID, content, contentType, encItemKey, authHash string
-	var deleted bool
-	var createdAt, updatedAt time.Time
-	attrs := []interface{}{ // the ordering must match columns of db query result.
-		&uuid, &userUUID, &content, &contentType, &encItemKey, &authHash,
-		&deleted,
-		&createdAt, &updatedAt,
-	}
-	if err = iterator.Scan(attrs...); err != nil {
-		return
-	}
-	switch val := attrs[0].(type) {
-	case *string:
-		i.UUID = *val
-	default:
-		err = validationError{fmt.Errorf("wrong type for UUID; got %T, exp *string", val)}
-		return
-	}
-	switch val := attrs[1].(type) {
-	case *string:
-		i.UserUUID = *val
-	default:
-		err = validationError{fmt.Errorf("wrong type for UserUUID; got %T, exp *string", val)}
-		return
-	}
-	switch val := attrs[2].(type) {
-	case *string:
-		i.Content = *val
-	default:
-		err = validationError{fmt.Errorf("wrong type for Content; got %T, exp *string", val)}
-		return
-	}
-	switch val := attrs[3].(type) {
-	case *string:
-		i.ContentType = *val
-	default:
-		err = validationError{fmt.Errorf("wrong type for ContentType; got %T, exp *string", val)}
-		return
-	}
-	switch val := attrs[4].(type) {
-	case *string:
-		i.EncItemKey = *val
-	default:
-		err = validationError{fmt.Errorf("wrong type for EncItemKey; got %T, exp *string", val)}
-		return
-	}
-	switch val := attrs[5].(type) {
-	case *string:
-		i.AuthHash = *val
-	default:
-		err = validationError{fmt.Errorf("wrong type for AuthHash; got %T, exp *string", val)}
-		return
-	}
-	switch val := attrs[6].(type) {
-	case *bool:
-		i.Deleted = *val
-	default:
-		err = validationError{fmt.Errorf("wrong type for Deleted; got %T, exp *bool", val)}
-		return
-	}
-	switch val := attrs[7].(type) {
-	case *time.Time:
-		i.CreatedAt = *val
-	default:
-		err = validationError{fmt.Errorf("wrong type for CreatedAt; got %T, exp *time.Time", val)}
-		return
-	}
-	switch val := attrs[8].(type) {
-	case *time.Time:
-		i.UpdatedAt = *val
-	default:
-		err = validationError{fmt.Errorf("wrong type for UpdatedAt; got %T, exp *time.Time", val)}
-		return
-	}
-	return
-}
-
 type Frequency uint8
 
 const (
@@ -292,11 +177,40 @@ type ContentMetadata struct {
 	URL       string
 }
 
-// TODO: implement, should return the metadata only.
+// _UnencryptedContentPrefix marks Item content that the client did not
+// encrypt. The rest of the content is base64-encoded JSON. Extensions are
+// saved this way so the server can read their settings.
+const _UnencryptedContentPrefix = "000"
+
+// DecodedContentMetadata reads the settings out of unencrypted Item content.
+// It returns nil if the content is empty, encrypted or malformed.
 func (i *Item) DecodedContentMetadata() (out *ContentMetadata) {
-	if i.Content == "" {
+	if !strings.HasPrefix(i.Content, _UnencryptedContentPrefix) {
+		return
+	}
+	decoded, err := base64.StdEncoding.DecodeString(i.Content[len(_UnencryptedContentPrefix):])
+	if err != nil {
+		logger.LogIfDebug(err)
 		return
 	}
+	var content struct {
+		Frequency string `json:"frequency"`
+		SubType   string `json:"subtype"`
+		URL       string `json:"url"`
+	}
+	if err = json.Unmarshal(decoded, &content); err != nil {
+		logger.LogIfDebug(err)
+		return
+	}
+	out = &ContentMetadata{SubType: content.SubType, URL: content.URL}
+	switch content.Frequency {
+	case "realtime":
+		out.Frequency = FrequencyRealtime
+	case "hourly":
+		out.Frequency = FrequencyHourly
+	case "daily":
+		out.Frequency = FrequencyDaily
+	}
 	return
 }
 
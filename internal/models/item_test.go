@@ -1,17 +1,19 @@
 package models_test
 
 import (
+	"context"
+	"encoding/base64"
 	"encoding/json"
 	"testing"
 	"time"
 
-	"github.com/rafaelespinoza/standardnotes/internal/db"
+	"github.com/rafaelespinoza/standardnotes/internal/db/dbtest"
 	"github.com/rafaelespinoza/standardnotes/internal/errs"
 	"github.com/rafaelespinoza/standardnotes/internal/models"
 )
 
 func init() {
-	db.Init(":memory:")
+	dbtest.Init()
 }
 
 const stubbedUUID = "2d931510-d99f-494a-8c67-87feb05e1594"
@@ -26,11 +28,11 @@ func TestLoadItemByUUID(t *testing.T) {
 			AuthHash:    "alpha",
 			Deleted:     false,
 		}
-		if err := saved.Save(); err != nil {
+		if err := saved.Save(context.Background()); err != nil {
 			t.Fatalf("got expected error; %v", err)
 		}
 
-		loaded, err := models.LoadItemByUUID(saved.UUID)
+		loaded, err := models.LoadItemByUUID(context.Background(), saved.UUID)
 		if err != nil {
 			t.Errorf("did not expect error; got %v", err)
 		}
@@ -40,13 +42,13 @@ func TestLoadItemByUUID(t *testing.T) {
 	})
 
 	t.Run("errors", func(t *testing.T) {
-		if item, err := models.LoadItemByUUID(""); err == nil {
+		if item, err := models.LoadItemByUUID(context.Background(), ""); err == nil {
 			t.Error("expected an error")
 		} else if item != nil {
 			t.Errorf("item should be nil")
 		}
 
-		if item, err := models.LoadItemByUUID(stubbedUUID); !errs.NotFoundError(err) {
+		if item, err := models.LoadItemByUUID(context.Background(), stubbedUUID); !errs.NotFoundError(err) {
 			t.Errorf("unexpected error type; %#v", err)
 		} else if item != nil {
 			t.Errorf("item should be nil")
@@ -75,7 +77,7 @@ func TestItemCreate(t *testing.T) {
 		}
 
 		for i, item := range tests {
-			if err := item.Create(); err != nil {
+			if err := item.Create(context.Background()); err != nil {
 				t.Error(err)
 			}
 			if item.UUID == "" {
@@ -87,7 +89,7 @@ func TestItemCreate(t *testing.T) {
 			if item.UpdatedAt.IsZero() {
 				t.Errorf("test [%d]; updated at should not be zero", i)
 			}
-			if exists, err := item.Exists(); err != nil {
+			if exists, err := item.Exists(context.Background()); err != nil {
 				t.Fatal(err)
 			} else if !exists {
 				t.Errorf("test [%d]; item should exist in db", i)
@@ -109,7 +111,7 @@ func TestItemCreate(t *testing.T) {
 
 		for i, test := range tests {
 			item := &test.item
-			if err := item.Create(); !errs.ValidationError(err) {
+			if err := item.Create(context.Background()); !errs.ValidationError(err) {
 				t.Errorf("test [%d]; expected validation error; got %#v", i, err)
 			}
 			if !item.CreatedAt.IsZero() {
@@ -118,7 +120,7 @@ func TestItemCreate(t *testing.T) {
 			if !item.UpdatedAt.IsZero() {
 				t.Errorf("test [%d]; updated at should be zero", i)
 			}
-			if exists, err := item.Exists(); err != nil {
+			if exists, err := item.Exists(context.Background()); err != nil {
 				t.Fatal(err)
 			} else if exists {
 				t.Errorf("test [%d]; item should not exist in db", i)
@@ -136,7 +138,7 @@ func TestItemUpdate(t *testing.T) {
 		AuthHash:    "alpha",
 		Deleted:     false,
 	}
-	if err := item.Save(); err != nil {
+	if err := item.Save(context.Background()); err != nil {
 		t.Fatalf("unexpected setup error while saving item; %v", err)
 	}
 
@@ -145,7 +147,7 @@ func TestItemUpdate(t *testing.T) {
 	item.EncItemKey = "bravo"
 	item.AuthHash = "bravo"
 
-	if err := item.Update(); err != nil {
+	if err := item.Update(context.Background()); err != nil {
 		t.Errorf("unexpected error; %v", err)
 	}
 	expectedItem := &models.Item{
@@ -162,7 +164,7 @@ func TestItemUpdate(t *testing.T) {
 		t.Error("items not equal")
 	}
 	// the changed fields are reflected in db.
-	loadedItem, err := models.LoadItemByUUID(item.UUID)
+	loadedItem, err := models.LoadItemByUUID(context.Background(), item.UUID)
 	if err != nil {
 		t.Errorf("did not expect error; got %v", err)
 	}
@@ -181,11 +183,11 @@ func TestItemDelete(t *testing.T) {
 			AuthHash:    "alpha",
 			Deleted:     false,
 		}
-		if err := item.Save(); err != nil {
+		if err := item.Save(context.Background()); err != nil {
 			t.Fatalf("unexpected setup error while saving item; %v", err)
 		}
 		item.Deleted = true // client marks an item for deletion during a sync.
-		if err := item.Delete(); err != nil {
+		if err := item.Delete(context.Background()); err != nil {
 			t.Errorf("unexpected error; %v", err)
 		}
 
@@ -204,7 +206,7 @@ func TestItemDelete(t *testing.T) {
 		}
 
 		// the changed fields are reflected in db.
-		loadedItem, err := models.LoadItemByUUID(item.UUID)
+		loadedItem, err := models.LoadItemByUUID(context.Background(), item.UUID)
 		if err != nil {
 			t.Errorf("did not expect error; got %v", err)
 		}
@@ -240,7 +242,7 @@ func TestItemDelete(t *testing.T) {
 			AuthHash:    "alpha",
 			Deleted:     false,
 		}
-		if err := item.Delete(); err == nil {
+		if err := item.Delete(context.Background()); err == nil {
 			t.Errorf("expected error; got %v", err)
 		}
 	})
@@ -255,11 +257,11 @@ func TestItemCopy(t *testing.T) {
 		AuthHash:    "alpha",
 		Deleted:     false,
 	}
-	if err := item.Save(); err != nil {
+	if err := item.Save(context.Background()); err != nil {
 		t.Fatalf("unexpected setup error while saving item; %v", err)
 	}
 	time.Sleep(100)
-	dupe, err := item.Copy()
+	dupe, err := item.Copy(context.Background())
 	if err != nil {
 		t.Errorf("unexpected error; got %v", err)
 	}
@@ -584,6 +586,49 @@ func TestItemsDelete(t *testing.T) {
 	}
 }
 
+func TestItemDecodedContentMetadata(t *testing.T) {
+	encode := func(content string) string {
+		return "000" + base64.StdEncoding.EncodeToString([]byte(content))
+	}
+	tests := []struct {
+		content  string
+		expected *models.ContentMetadata
+	}{
+		{
+			content: encode(`{"url":"https://ext.example.com/backup","frequency":"daily","subtype":"backup.email_archive"}`),
+			expected: &models.ContentMetadata{
+				Frequency: models.FrequencyDaily,
+				SubType:   "backup.email_archive",
+				URL:       "https://ext.example.com/backup",
+			},
+		},
+		{
+			content:  encode(`{"url":"https://ext.example.com/sync","frequency":"realtime"}`),
+			expected: &models.ContentMetadata{Frequency: models.FrequencyRealtime, URL: "https://ext.example.com/sync"},
+		},
+		{content: "", expected: nil},
+		{content: "003:encrypted:content", expected: nil},
+		{content: "000not-base64!", expected: nil},
+		{content: encode(`not json`), expected: nil},
+	}
+
+	for i, test := range tests {
+		item := models.Item{ContentType: "SF|Extension", Content: test.content}
+		actual := item.DecodedContentMetadata()
+		if test.expected == nil {
+			if actual != nil {
+				t.Errorf("test [%d]; expected nil; got %+v", i, *actual)
+			}
+			continue
+		}
+		if actual == nil {
+			t.Errorf("test [%d]; expected non-nil", i)
+		} else if *actual != *test.expected {
+			t.Errorf("test [%d]\ngot %+v\nexp %+v", i, *actual, *test.expected)
+		}
+	}
+}
+
 func compareItems(t *testing.T, a, b *models.Item, checkTimestamps bool) (ok bool) {
 	t.Helper()
 	ok = true
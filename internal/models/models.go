@@ -3,6 +3,7 @@ package models
 import (
 	"fmt"
 	"regexp"
+	"time"
 )
 
 const (
@@ -18,6 +19,11 @@ const (
 	MinIDLength = 36
 )
 
+// now is the current time, as precise as every supported database can store
+// it. Postgres keeps microseconds, so a value read back is equal to the one
+// that was written.
+func now() time.Time { return time.Now().UTC().Truncate(time.Microsecond) }
+
 type validationError struct{ error }
 
 func (e validationError) Validation() bool { return true }
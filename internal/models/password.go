@@ -1,11 +1,19 @@
 package models
 
 import (
+	"crypto/hmac"
+	"crypto/rand"
 	"crypto/sha1"
 	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"strings"
+	"sync"
+
+	"golang.org/x/crypto/argon2"
 )
 
 const (
@@ -80,6 +88,30 @@ func MakePwGenParams(u User) PwGenParams {
 	return params
 }
 
+// _ParamsSecret keys the nonces of FakePwGenParams. It's from SECRET_KEY_BASE,
+// or the built-in signing key, unless UseParamsSecret is called.
+var _ParamsSecret []byte
+
+// UseParamsSecret sets the secret of FakePwGenParams.
+func UseParamsSecret(secret []byte) { _ParamsSecret = secret }
+
+// BuiltInParamsSecret says whether the secret of FakePwGenParams is the
+// built-in signing key, which anybody could use to tell that they're fake.
+func BuiltInParamsSecret() bool { return string(_ParamsSecret) == _BuiltInSigningKey }
+
+// FakePwGenParams makes up authentication parameters for an email address that
+// isn't registered, so that asking for them doesn't reveal which addresses are.
+// They're like those of a new user, and the same every time for the address;
+// the nonce is an HMAC of the address.
+func FakePwGenParams(email string) PwGenParams {
+	mac := hmac.New(sha256.New, _ParamsSecret)
+	mac.Write([]byte("pw_nonce:" + email))
+	u := NewUser()
+	u.Email = email
+	u.PwNonce = hex.EncodeToString(mac.Sum(nil))
+	return MakePwGenParams(*u)
+}
+
 // PwChangeParams helps facilitate user password changes.
 type PwChangeParams struct {
 	CurrentPassword PwHash `json:"current_password"`
@@ -138,18 +170,97 @@ type PwHash struct {
 	Hashed bool
 }
 
-// Hash calls the hash function on the password. If it's already been hashed,
-// then it returns the hashed value, but does not rehash.
-func (p *PwHash) Hash() string {
-	if p.Hashed {
-		return p.Value
+// Parameters of new password hashes. They're encoded in each hash, so changing
+// them doesn't break existing hashes; those are rehashed with the new
+// parameters the next time the user signs in.
+const (
+	_Argon2Time    = 1
+	_Argon2Memory  = 64 * 1024 // KiB
+	_Argon2Threads = 4
+	_Argon2KeyLen  = 32
+	_Argon2SaltLen = 16
+)
+
+// _LegacyCheckSalt goes into the key that checkPassword derives, and discards,
+// when it checks a legacy hash.
+var _LegacyCheckSalt = make([]byte, _Argon2SaltLen)
+
+// HashPassword derives a salted argon2id hash of the password, encoded with its
+// parameters as "$argon2id$v=19$m=65536,t=1,p=4$<salt>$<key>".
+func HashPassword(password string) (encoded string, err error) {
+	salt := make([]byte, _Argon2SaltLen)
+	if _, err = rand.Read(salt); err != nil {
+		return
+	}
+	key := argon2.IDKey([]byte(password), salt, _Argon2Time, _Argon2Memory, _Argon2Threads, _Argon2KeyLen)
+	encoded = fmt.Sprintf(
+		"$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, _Argon2Memory, _Argon2Time, _Argon2Threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key),
+	)
+	return
+}
+
+// _NobodysPassword is a hash for SimulatePasswordCheck to check against. It's
+// made the first time it's needed, because hashing takes a while.
+var _NobodysPassword struct {
+	once sync.Once
+	hash string
+}
+
+// SimulatePasswordCheck takes about as long as checking the password against a
+// hash made by HashPassword. It's for when there's no user to check against,
+// so that a failed sign in takes the same time whether or not the email address
+// is registered.
+func SimulatePasswordCheck(password string) {
+	_NobodysPassword.once.Do(func() {
+		// the outcome is ignored, so the password doesn't matter.
+		_NobodysPassword.hash, _ = HashPassword("nobody")
+	})
+	checkPassword(_NobodysPassword.hash, password)
+}
+
+// checkPassword compares a password to a hash made by HashPassword, or to a
+// legacy hash made by Hash. The rehash output says whether or not the hash
+// should be replaced with a new one from HashPassword, because it's a legacy
+// hash or its parameters are out of date. It's only meaningful if ok is true.
+func checkPassword(encoded, password string) (ok, rehash bool) {
+	if !strings.HasPrefix(encoded, "$argon2id$") {
+		// a legacy hash is quick to check. Derive a key anyway, so that a
+		// wrong password takes as long as it would with any other hash.
+		argon2.IDKey([]byte(password), _LegacyCheckSalt, _Argon2Time, _Argon2Memory, _Argon2Threads, _Argon2KeyLen)
+		ok = subtle.ConstantTimeCompare([]byte(Hash(password)), []byte(encoded)) == 1
+		rehash = true
+		return
+	}
+	var version int
+	var memory, iterations uint32
+	var threads uint8
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 {
+		return
+	} else if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return
+	} else if _, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &iterations, &threads); err != nil {
+		return
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return
 	}
-	p.Value = Hash(p.Value)
-	p.Hashed = true
-	return p.Value
+	actual := argon2.IDKey([]byte(password), salt, iterations, memory, threads, uint32(len(key)))
+	ok = subtle.ConstantTimeCompare(actual, key) == 1
+	rehash = memory != _Argon2Memory || iterations != _Argon2Time || threads != _Argon2Threads ||
+		len(key) != _Argon2KeyLen || len(salt) != _Argon2SaltLen
+	return
 }
 
-// Hash computes a sha256 checksum of the input.
+// Hash computes a sha256 checksum of the input. It's how passwords used to be
+// stored; new passwords are hashed with HashPassword.
 func Hash(input string) string {
 	return strings.Replace(
 		fmt.Sprintf("% x", sha256.Sum256([]byte(input))),
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"strings"
 	"testing"
 
 	"github.com/rafaelespinoza/standardnotes/internal/models"
@@ -119,3 +120,47 @@ func TestNewPassword(t *testing.T) {
 		})
 	})
 }
+
+func TestHashPassword(t *testing.T) {
+	a, err := models.HashPassword("testpassword123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := models.HashPassword("testpassword123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(a, "$argon2id$v=19$m=65536,t=1,p=4$") {
+		t.Errorf("unexpected encoding; got %q", a)
+	}
+	if a == b {
+		t.Error("hashes of the same password should differ by salt")
+	}
+}
+
+func TestFakePwGenParams(t *testing.T) {
+	const email = "nobody@example.com"
+	models.UseParamsSecret([]byte("alpha"))
+	alpha := models.FakePwGenParams(email)
+	if again := models.FakePwGenParams(email); again != alpha {
+		t.Errorf("expected the same params every time;\nfirst:  %+v\nsecond: %+v", alpha, again)
+	}
+	models.UseParamsSecret([]byte("bravo"))
+	if bravo := models.FakePwGenParams(email); bravo.PwNonce == alpha.PwNonce || bravo.PwSalt == alpha.PwSalt {
+		t.Errorf("expected the params to depend on the secret; got %+v", bravo)
+	}
+
+	// they should look like those of a actual user.
+	user := models.NewUser()
+	user.Email = email
+	user.PwNonce = strings.Repeat("0", 64)
+	actual := models.MakePwGenParams(*user)
+	fake := models.FakePwGenParams(email)
+	if fake.Version != actual.Version || fake.Identifier != actual.Identifier || fake.PwFunc != actual.PwFunc ||
+		fake.PwAlg != actual.PwAlg || fake.PwCost != actual.PwCost || fake.PwKeySize != actual.PwKeySize {
+		t.Errorf("wrong params;\ngot      %+v\nexpected %+v", fake, actual)
+	}
+	if len(fake.PwNonce) != len(actual.PwNonce) || len(fake.PwSalt) != len(actual.PwSalt) {
+		t.Errorf("wrong lengths of nonce or salt;\ngot      %+v\nexpected %+v", fake, actual)
+	}
+}
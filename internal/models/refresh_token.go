@@ -0,0 +1,112 @@
+package models
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/rafaelespinoza/standardnotes/internal/db"
+	"github.com/rafaelespinoza/standardnotes/internal/errs"
+)
+
+// A RefreshToken gets a new access token for a Session, along with the next
+// RefreshToken. Each one can only be used once. Only a hash of the token is
+// stored.
+type RefreshToken struct {
+	Token       string
+	SessionUUID string
+	ExpiresAt   time.Time
+}
+
+var (
+	errRefreshTokenInvalid = errors.New("invalid refresh token")
+	errRefreshTokenExpired = errors.New("refresh token expired")
+	errRefreshTokenReused  = errors.New("refresh token already used, the session is revoked")
+)
+
+// IssueRefreshToken makes a new refresh token for the session, which expires
+// after ttl. Expired tokens of the session are cleaned up.
+func IssueRefreshToken(ctx context.Context, sessionUUID string, ttl time.Duration) (out RefreshToken, err error) {
+	raw := make([]byte, 32)
+	if _, err = rand.Read(raw); err != nil {
+		return
+	}
+	t := now()
+	out = RefreshToken{
+		Token:       base64.RawURLEncoding.EncodeToString(raw),
+		SessionUUID: sessionUUID,
+		ExpiresAt:   t.Add(ttl),
+	}
+	err = db.WithTx(ctx, func(ctx context.Context) (err error) {
+		if err = db.Exec(ctx,
+			"DELETE FROM refresh_tokens WHERE session_uuid=? AND expires_at < ?",
+			sessionUUID, t,
+		); err != nil {
+			return
+		}
+		err = db.Exec(ctx,
+			"INSERT INTO refresh_tokens (token_hash, session_uuid, used, expires_at, created_at) VALUES (?,?,?,?,?)",
+			hashRefreshToken(out.Token), out.SessionUUID, false, out.ExpiresAt, t,
+		)
+		return
+	})
+	if err != nil {
+		out = RefreshToken{}
+	}
+	return
+}
+
+// UseRefreshToken marks the refresh token as used and outputs the UUID of its
+// session. Using a token more than once means that it was stolen, or that a
+// copy of it was, so the session and all of its tokens are revoked.
+func UseRefreshToken(ctx context.Context, token string, t time.Time) (sessionUUID string, err error) {
+	hash := hashRefreshToken(token)
+	var reused bool
+	err = db.WithTx(ctx, func(ctx context.Context) (err error) {
+		var used bool
+		var expiresAt time.Time
+		if err = db.SelectOne(ctx, func(row db.Iterator) error {
+			return row.Scan(&sessionUUID, &used, &expiresAt)
+		}, "SELECT session_uuid, used, expires_at FROM refresh_tokens WHERE token_hash=?", hash); errs.NotFoundError(err) {
+			err = validationError{errRefreshTokenInvalid}
+			return
+		} else if err != nil {
+			return
+		}
+		if !used && !t.Before(expiresAt) {
+			err = validationError{errRefreshTokenExpired}
+			return
+		}
+		var n int64
+		if !used {
+			// The condition on used catches a concurrent request with the
+			// same token.
+			if n, err = db.ExecAffected(ctx,
+				"UPDATE refresh_tokens SET used=? WHERE token_hash=? AND used=?",
+				true, hash, false,
+			); err != nil {
+				return
+			}
+		}
+		if reused = n == 0; reused {
+			err = revokeSession(ctx, sessionUUID)
+		}
+		return
+	})
+	if err == nil && reused {
+		err = validationError{errRefreshTokenReused}
+	}
+	if err != nil {
+		sessionUUID = ""
+	}
+	return
+}
+
+func hashRefreshToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,80 @@
+package models_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/rafaelespinoza/standardnotes/internal/errs"
+	"github.com/rafaelespinoza/standardnotes/internal/models"
+)
+
+func TestRefreshTokens(t *testing.T) {
+	ctx := context.Background()
+	user := models.NewUser()
+	user.Email = t.Name() + "@example.com"
+	user.Password = "testpassword123"
+	if err := user.Create(ctx); err != nil {
+		t.Fatal(err)
+	}
+	sess, err := models.CreateSession(ctx, user.UUID, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("ok", func(t *testing.T) {
+		token, err := models.IssueRefreshToken(ctx, sess.UUID, time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token.Token == "" || token.SessionUUID != sess.UUID {
+			t.Fatalf("unexpected token %+v", token)
+		}
+		sessionUUID, err := models.UseRefreshToken(ctx, token.Token, time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sessionUUID != sess.UUID {
+			t.Errorf("wrong session; got %q, expected %q", sessionUUID, sess.UUID)
+		}
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		if _, err := models.UseRefreshToken(ctx, "not-a-token", time.Now()); !errs.ValidationError(err) {
+			t.Errorf("expected validation error for unknown token; got %v", err)
+		}
+		token, err := models.IssueRefreshToken(ctx, sess.UUID, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = models.UseRefreshToken(ctx, token.Token, time.Now().Add(time.Hour)); !errs.ValidationError(err) {
+			t.Errorf("expected validation error for expired token; got %v", err)
+		}
+		if _, err = models.LoadSession(ctx, sess.UUID); err != nil {
+			t.Errorf("did not expect an expired token to revoke the session; got %v", err)
+		}
+	})
+
+	t.Run("reuse", func(t *testing.T) {
+		token, err := models.IssueRefreshToken(ctx, sess.UUID, time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		next, err := models.IssueRefreshToken(ctx, sess.UUID, time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = models.UseRefreshToken(ctx, token.Token, time.Now()); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = models.UseRefreshToken(ctx, token.Token, time.Now()); !errs.ValidationError(err) {
+			t.Errorf("expected validation error for reused token; got %v", err)
+		}
+		if _, err = models.LoadSession(ctx, sess.UUID); !errs.NotFoundError(err) {
+			t.Errorf("expected session to be revoked; got %v", err)
+		}
+		if _, err = models.UseRefreshToken(ctx, next.Token, time.Now()); !errs.ValidationError(err) {
+			t.Errorf("expected other tokens of the session to be revoked; got %v", err)
+		}
+	})
+}
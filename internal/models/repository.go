@@ -0,0 +1,80 @@
+package models
+
+import (
+	"context"
+	"time"
+)
+
+// A UserRepository stores and retrieves Users. Lookups of a missing User
+// return an error satisfying errs.NotFound.
+type UserRepository interface {
+	FindByUUID(ctx context.Context, uuid string) (*User, error)
+	FindByEmail(ctx context.Context, email string) (*User, error)
+	// EmailExists tells you if a User has the email address, ignoring case.
+	EmailExists(ctx context.Context, email string) (bool, error)
+	// ListUUIDs returns the UUID of every User, oldest first.
+	ListUUIDs(ctx context.Context) ([]string, error)
+	Create(ctx context.Context, u *User) error
+	// Update saves the password and password generation fields of a User.
+	Update(ctx context.Context, u *User) error
+	// UpdateEmail saves the email address of a User, along with the password
+	// and password generation fields, which depend on it.
+	UpdateEmail(ctx context.Context, u *User) error
+	// Delete removes a User for good.
+	Delete(ctx context.Context, uuid string) error
+}
+
+// An ItemRepository stores and retrieves Items. Lookups of a missing Item
+// return an error satisfying errs.NotFound.
+type ItemRepository interface {
+	FindByUUID(ctx context.Context, uuid string) (*Item, error)
+	Exists(ctx context.Context, uuid string) (bool, error)
+	Create(ctx context.Context, i *Item) error
+	Update(ctx context.Context, i *Item) error
+	// Delete saves a soft-deleted Item. The caller should have already
+	// cleared its fields.
+	Delete(ctx context.Context, i *Item) error
+	// Purge removes all of the user's items for good, including deleted ones.
+	Purge(ctx context.Context, userUUID string) error
+	// FindActive returns the user's items that aren't deleted and have a
+	// content type, newest first.
+	FindActive(ctx context.Context, userUUID string) (Items, error)
+	// FindActiveByContentType returns the user's items of a content type
+	// that aren't deleted, newest first.
+	FindActiveByContentType(ctx context.Context, userUUID, contentType string) (Items, error)
+	// FindUpdatedAfter returns up to limit of the user's items, including
+	// deleted ones, updated after t, oldest first. If inclusive is true, then
+	// items updated at exactly t are included.
+	FindUpdatedAfter(ctx context.Context, userUUID string, t time.Time, inclusive bool, limit int) (Items, error)
+	// FindAll returns up to limit of the user's items that aren't deleted,
+	// oldest first.
+	FindAll(ctx context.Context, userUUID string, limit int) (Items, error)
+	// Usage totals the user's items that aren't deleted.
+	Usage(ctx context.Context, userUUID string) (Usage, error)
+}
+
+// Repositories are the storage backends for models.
+type Repositories struct {
+	Users UserRepository
+	Items ItemRepository
+}
+
+var _Repos = SQLRepositories()
+
+// UseRepositories sets the storage backends for all subsequent model
+// operations. It's meant to be called at startup or in tests, not while
+// requests are being served. A nil field goes back to the SQL backend.
+func UseRepositories(r Repositories) {
+	sql := SQLRepositories()
+	if r.Users == nil {
+		r.Users = sql.Users
+	}
+	if r.Items == nil {
+		r.Items = sql.Items
+	}
+	_Repos = r
+}
+
+type notFoundError struct{ error }
+
+func (e notFoundError) NotFound() bool { return true }
@@ -0,0 +1,261 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryRepositories store models in memory. Nothing is persisted; each call
+// makes a new, empty set of repositories. They're mostly useful for tests.
+func MemoryRepositories() Repositories {
+	return Repositories{
+		Users: &memoryUsers{users: make(map[string]User)},
+		Items: &memoryItems{items: make(map[string]Item)},
+	}
+}
+
+type memoryUsers struct {
+	mtx   sync.RWMutex
+	users map[string]User
+}
+
+var _ UserRepository = (*memoryUsers)(nil)
+
+func (r *memoryUsers) FindByUUID(ctx context.Context, uuid string) (*User, error) {
+	return r.find(func(u *User) bool { return u.UUID == uuid })
+}
+
+func (r *memoryUsers) FindByEmail(ctx context.Context, email string) (*User, error) {
+	return r.find(func(u *User) bool { return strings.EqualFold(u.Email, email) })
+}
+
+func (r *memoryUsers) find(match func(u *User) bool) (*User, error) {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	for _, user := range r.users {
+		if match(&user) {
+			user.passwordHashed = true
+			return &user, nil
+		}
+	}
+	return nil, notFoundError{fmt.Errorf("user not found")}
+}
+
+func (r *memoryUsers) EmailExists(ctx context.Context, email string) (bool, error) {
+	_, err := r.find(func(u *User) bool { return strings.EqualFold(u.Email, email) })
+	if err != nil {
+		return false, nil
+	}
+	return true, nil
+}
+
+func (r *memoryUsers) ListUUIDs(ctx context.Context) (out []string, err error) {
+	r.mtx.RLock()
+	users := make([]User, 0, len(r.users))
+	for _, user := range r.users {
+		users = append(users, user)
+	}
+	r.mtx.RUnlock()
+
+	sort.Slice(users, func(i, j int) bool { return users[i].CreatedAt.Before(users[j].CreatedAt) })
+	out = make([]string, len(users))
+	for i, user := range users {
+		out[i] = user.UUID
+	}
+	return
+}
+
+func (r *memoryUsers) Create(ctx context.Context, u *User) error {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if _, ok := r.users[u.UUID]; ok {
+		return fmt.Errorf("user %q already exists", u.UUID)
+	}
+	r.users[u.UUID] = *u
+	return nil
+}
+
+func (r *memoryUsers) Update(ctx context.Context, u *User) error {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	stored, ok := r.users[u.UUID]
+	if !ok {
+		return nil // same as an UPDATE that matches no rows.
+	}
+	stored.Password = u.Password
+	stored.PwAlg = u.PwAlg
+	stored.PwCost = u.PwCost
+	stored.PwFunc = u.PwFunc
+	stored.PwKeySize = u.PwKeySize
+	stored.PwNonce = u.PwNonce
+	stored.PwSalt = u.PwSalt
+	stored.UpdatedAt = u.UpdatedAt
+	r.users[u.UUID] = stored
+	return nil
+}
+
+func (r *memoryUsers) UpdateEmail(ctx context.Context, u *User) error {
+	r.mtx.Lock()
+	stored, ok := r.users[u.UUID]
+	if ok {
+		stored.Email = u.Email
+		r.users[u.UUID] = stored
+	}
+	r.mtx.Unlock()
+	return r.Update(ctx, u)
+}
+
+func (r *memoryUsers) Delete(ctx context.Context, uuid string) error {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	delete(r.users, uuid)
+	return nil
+}
+
+type memoryItems struct {
+	mtx   sync.RWMutex
+	items map[string]Item
+}
+
+var _ ItemRepository = (*memoryItems)(nil)
+
+func (r *memoryItems) FindByUUID(ctx context.Context, uuid string) (*Item, error) {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	item, ok := r.items[uuid]
+	if !ok {
+		return nil, notFoundError{fmt.Errorf("item not found")}
+	}
+	return &item, nil
+}
+
+func (r *memoryItems) Exists(ctx context.Context, uuid string) (bool, error) {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	_, ok := r.items[uuid]
+	return ok, nil
+}
+
+func (r *memoryItems) Create(ctx context.Context, i *Item) error {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if _, ok := r.items[i.UUID]; ok {
+		return fmt.Errorf("item %q already exists", i.UUID)
+	}
+	r.items[i.UUID] = *i
+	return nil
+}
+
+func (r *memoryItems) Update(ctx context.Context, i *Item) error {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	stored, ok := r.items[i.UUID]
+	if !ok || stored.UserUUID != i.UserUUID {
+		return nil // same as an UPDATE that matches no rows.
+	}
+	stored.Content = i.Content
+	stored.ContentType = i.ContentType
+	stored.EncItemKey = i.EncItemKey
+	stored.AuthHash = i.AuthHash
+	stored.Deleted = i.Deleted
+	stored.UpdatedAt = i.UpdatedAt
+	r.items[i.UUID] = stored
+	return nil
+}
+
+func (r *memoryItems) Delete(ctx context.Context, i *Item) error {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	stored, ok := r.items[i.UUID]
+	if !ok || stored.UserUUID != i.UserUUID {
+		return nil
+	}
+	stored.Content = ""
+	stored.EncItemKey = ""
+	stored.AuthHash = ""
+	stored.Deleted = true
+	stored.UpdatedAt = i.UpdatedAt
+	r.items[i.UUID] = stored
+	return nil
+}
+
+func (r *memoryItems) Purge(ctx context.Context, userUUID string) error {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	for uuid, item := range r.items {
+		if item.UserUUID == userUUID {
+			delete(r.items, uuid)
+		}
+	}
+	return nil
+}
+
+func (r *memoryItems) FindActive(ctx context.Context, userUUID string) (Items, error) {
+	items := r.filter(func(i *Item) bool {
+		return i.UserUUID == userUUID && i.ContentType != "" && !i.Deleted
+	})
+	sortItems(items, true)
+	return items, nil
+}
+
+func (r *memoryItems) FindActiveByContentType(ctx context.Context, userUUID, contentType string) (Items, error) {
+	items := r.filter(func(i *Item) bool {
+		return i.UserUUID == userUUID && i.ContentType == contentType && !i.Deleted
+	})
+	sortItems(items, true)
+	return items, nil
+}
+
+func (r *memoryItems) FindUpdatedAfter(ctx context.Context, userUUID string, t time.Time, inclusive bool, limit int) (Items, error) {
+	items := r.filter(func(i *Item) bool {
+		return i.UserUUID == userUUID && (i.UpdatedAt.After(t) || (inclusive && i.UpdatedAt.Equal(t)))
+	})
+	sortItems(items, false)
+	return limitItems(items, limit), nil
+}
+
+func (r *memoryItems) FindAll(ctx context.Context, userUUID string, limit int) (Items, error) {
+	items := r.filter(func(i *Item) bool { return i.UserUUID == userUUID && !i.Deleted })
+	sortItems(items, false)
+	return limitItems(items, limit), nil
+}
+
+func (r *memoryItems) Usage(ctx context.Context, userUUID string) (out Usage, err error) {
+	for _, item := range r.filter(func(i *Item) bool { return i.UserUUID == userUUID }) {
+		out = out.Add(item.Usage())
+	}
+	return
+}
+
+func (r *memoryItems) filter(match func(i *Item) bool) Items {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	out := make(Items, 0)
+	for _, item := range r.items {
+		if match(&item) {
+			out = append(out, item)
+		}
+	}
+	return out
+}
+
+// sortItems orders items by when they were updated.
+func sortItems(items Items, newestFirst bool) {
+	sort.SliceStable(items, func(i, j int) bool {
+		if newestFirst {
+			return items[j].UpdatedAt.Before(items[i].UpdatedAt)
+		}
+		return items[i].UpdatedAt.Before(items[j].UpdatedAt)
+	})
+}
+
+func limitItems(items Items, limit int) Items {
+	if limit >= 0 && len(items) > limit {
+		return items[:limit]
+	}
+	return items
+}
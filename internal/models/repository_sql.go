@@ -0,0 +1,228 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/rafaelespinoza/standardnotes/internal/db"
+	"github.com/rafaelespinoza/standardnotes/internal/logger"
+)
+
+// SQLRepositories store models in the database opened by the db package.
+func SQLRepositories() Repositories {
+	return Repositories{Users: sqlUsers{}, Items: sqlItems{}}
+}
+
+type sqlUsers struct{}
+
+var _ UserRepository = sqlUsers{}
+
+func (r sqlUsers) FindByUUID(ctx context.Context, uuid string) (*User, error) {
+	return r.find(ctx, `SELECT `+_UserColumns+` FROM users WHERE uuid = ?`, uuid)
+}
+
+func (r sqlUsers) FindByEmail(ctx context.Context, email string) (*User, error) {
+	return r.find(ctx, "SELECT "+_UserColumns+" FROM users WHERE LOWER(email)=LOWER(?)", email)
+}
+
+func (r sqlUsers) find(ctx context.Context, query string, args ...interface{}) (user *User, err error) {
+	err = db.SelectOne(ctx, func(row db.Iterator) (e error) {
+		user, e = scanUser(row)
+		return
+	}, query, args...)
+	if err != nil {
+		logger.LogIfDebug(err)
+		user = nil
+	}
+	return
+}
+
+func (r sqlUsers) EmailExists(ctx context.Context, email string) (bool, error) {
+	var id string
+	return db.SelectExists(ctx, &id, "SELECT uuid FROM users WHERE LOWER(email)=LOWER(?)", email)
+}
+
+func (r sqlUsers) ListUUIDs(ctx context.Context) (out []string, err error) {
+	out = make([]string, 0)
+	err = db.SelectMany(ctx, func(iterator db.Iterator) (e error) {
+		var id string
+		if e = iterator.Scan(&id); e != nil {
+			return
+		}
+		out = append(out, id)
+		return
+	}, "SELECT uuid FROM users ORDER BY created_at ASC")
+	return
+}
+
+func (r sqlUsers) Create(ctx context.Context, u *User) error {
+	return emailTaken(db.Exec(ctx,
+		strings.TrimSpace(`
+		INSERT INTO users (
+			uuid, email, password, pw_func, pw_alg, pw_cost, pw_key_size,
+			pw_nonce, pw_salt, created_at, updated_at
+		) VALUES (?,?,?,?,?,?,?,?,?,?,?)`),
+		u.UUID, u.Email, u.Password, u.PwFunc, u.PwAlg, u.PwCost, u.PwKeySize,
+		u.PwNonce, u.PwSalt, u.CreatedAt, u.UpdatedAt,
+	))
+}
+
+func (r sqlUsers) Update(ctx context.Context, u *User) error {
+	return db.Exec(ctx,
+		strings.TrimSpace(`
+		UPDATE users
+		SET password=?, pw_alg=?, pw_cost=?, pw_func=?, pw_key_size=?, pw_nonce=?, pw_salt=?, updated_at=?
+		WHERE uuid=?`),
+
+		u.Password, u.PwAlg, u.PwCost, u.PwFunc, u.PwKeySize, u.PwNonce, u.PwSalt, u.UpdatedAt,
+		u.UUID,
+	)
+}
+
+func (r sqlUsers) UpdateEmail(ctx context.Context, u *User) error {
+	return emailTaken(db.Exec(ctx,
+		strings.TrimSpace(`
+		UPDATE users
+		SET email=?, password=?, pw_cost=?, pw_nonce=?, pw_salt=?, updated_at=?
+		WHERE uuid=?`),
+		u.Email, u.Password, u.PwCost, u.PwNonce, u.PwSalt, u.UpdatedAt,
+		u.UUID,
+	))
+}
+
+// emailTaken turns err into the usual validation error if it's because the
+// email address is already registered, in any case. Checking beforehand isn't
+// enough when two requests race for the same address; the unique index on
+// users decides.
+func emailTaken(err error) error {
+	if db.UniqueViolation(err) {
+		return validationError{fmt.Errorf("email is already registered")}
+	}
+	return err
+}
+
+func (r sqlUsers) Delete(ctx context.Context, uuid string) error {
+	return db.Exec(ctx, "DELETE FROM users WHERE uuid=?", uuid)
+}
+
+type sqlItems struct{}
+
+var _ ItemRepository = sqlItems{}
+
+func (r sqlItems) FindByUUID(ctx context.Context, uuid string) (item *Item, err error) {
+	err = db.SelectOne(ctx, func(row db.Iterator) (e error) {
+		item, e = scanItem(row)
+		return
+	}, `SELECT `+_ItemColumns+` FROM items WHERE uuid = ?`, uuid)
+	if err != nil {
+		item = nil
+	}
+	return
+}
+
+func (r sqlItems) Exists(ctx context.Context, uuid string) (bool, error) {
+	var id string
+	return db.SelectExists(ctx, &id, "SELECT uuid FROM items WHERE uuid=?", uuid)
+}
+
+func (r sqlItems) Create(ctx context.Context, i *Item) error {
+	return db.Exec(ctx,
+		strings.TrimSpace(`
+		INSERT INTO items (
+			uuid, user_uuid, content, content_type, enc_item_key, auth_hash, deleted, created_at, updated_at
+		) VALUES(?,?,?,?,?,?,?,?,?)`),
+		i.UUID, i.UserUUID, i.Content, i.ContentType, i.EncItemKey, i.AuthHash, i.Deleted, i.CreatedAt, i.UpdatedAt,
+	)
+}
+
+func (r sqlItems) Update(ctx context.Context, i *Item) error {
+	return db.Exec(ctx,
+		strings.TrimSpace(`
+		UPDATE items
+		SET content=?, content_type=?, enc_item_key=?, auth_hash=?, deleted=?, updated_at=?
+		WHERE uuid=? AND user_uuid=?`,
+		),
+		i.Content, i.ContentType, i.EncItemKey, i.AuthHash, i.Deleted, i.UpdatedAt,
+		i.UUID, i.UserUUID,
+	)
+}
+
+func (r sqlItems) Delete(ctx context.Context, i *Item) error {
+	return db.Exec(ctx,
+		strings.TrimSpace(`
+			UPDATE items
+			SET content='', enc_item_key='', auth_hash='', deleted=?, updated_at=?
+			WHERE uuid=? AND user_uuid=?`,
+		),
+		true, i.UpdatedAt, i.UUID, i.UserUUID,
+	)
+}
+
+func (r sqlItems) Purge(ctx context.Context, userUUID string) error {
+	return db.Exec(ctx, "DELETE FROM items WHERE user_uuid=?", userUUID)
+}
+
+func (r sqlItems) FindActive(ctx context.Context, userUUID string) (Items, error) {
+	return queryItems(
+		ctx,
+		`SELECT `+_ItemColumns+` FROM items
+			WHERE user_uuid=? AND content_type <> '' AND deleted = ?
+			ORDER BY updated_at DESC`,
+		userUUID, false,
+	)
+}
+
+func (r sqlItems) FindActiveByContentType(ctx context.Context, userUUID, contentType string) (Items, error) {
+	return queryItems(
+		ctx,
+		`SELECT `+_ItemColumns+` FROM items WHERE user_uuid=? AND content_type = ? AND deleted = ?  ORDER BY updated_at DESC`,
+		userUUID, contentType, false,
+	)
+}
+
+func (r sqlItems) FindUpdatedAfter(ctx context.Context, userUUID string, t time.Time, inclusive bool, limit int) (Items, error) {
+	if inclusive {
+		return queryItems(
+			ctx,
+			`SELECT `+_ItemColumns+` FROM items WHERE user_uuid=? AND updated_at >= ? ORDER BY updated_at ASC LIMIT ?`,
+			userUUID, t, limit,
+		)
+	}
+	return queryItems(
+		ctx,
+		`SELECT `+_ItemColumns+` FROM items WHERE user_uuid=? AND updated_at > ?  ORDER BY updated_at ASC LIMIT ?`,
+		userUUID, t, limit,
+	)
+}
+
+func (r sqlItems) FindAll(ctx context.Context, userUUID string, limit int) (Items, error) {
+	return queryItems(
+		ctx,
+		"SELECT "+_ItemColumns+" FROM items WHERE user_uuid=? AND deleted = ? ORDER BY updated_at ASC LIMIT ?",
+		userUUID, false, limit,
+	)
+}
+
+func (r sqlItems) Usage(ctx context.Context, userUUID string) (out Usage, err error) {
+	// Item contents are ASCII text, so counting characters counts bytes.
+	err = db.SelectOne(ctx, func(row db.Iterator) error {
+		return row.Scan(&out.Items, &out.Bytes)
+	}, "SELECT COUNT(*), COALESCE(SUM(LENGTH(content)), 0) FROM items WHERE user_uuid=? AND deleted = ?", userUUID, false)
+	return
+}
+
+func queryItems(ctx context.Context, query string, args ...interface{}) (items Items, err error) {
+	found := make([]Item, 0)
+	err = db.SelectMany(ctx, func(iterator db.Iterator) (e error) {
+		var item *Item
+		if item, e = scanItem(iterator); e != nil {
+			return
+		}
+		found = append(found, *item)
+		return
+	}, query, args...)
+	items = found
+	return
+}
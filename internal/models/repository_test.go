@@ -0,0 +1,235 @@
+package models_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rafaelespinoza/standardnotes/internal/errs"
+	"github.com/rafaelespinoza/standardnotes/internal/models"
+)
+
+// TestRepositories runs the same operations against each backend, through the
+// model functions that use them, to check that they behave the same way.
+func TestRepositories(t *testing.T) {
+	backends := map[string]func() models.Repositories{
+		"sql":    models.SQLRepositories,
+		"memory": models.MemoryRepositories,
+	}
+	defer models.UseRepositories(models.Repositories{})
+
+	for name, newRepos := range backends {
+		t.Run(name, func(t *testing.T) {
+			models.UseRepositories(newRepos())
+
+			user := models.NewUser()
+			user.Email = t.Name() + "@example.com"
+			user.Password = "testpassword123"
+			user.PwNonce = "stub_password_nonce"
+			if err := user.Create(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			testRepositoryUsers(t, user)
+			testRepositoryItems(t, user)
+			testRepositoryDelete(t, user)
+		})
+	}
+}
+
+func testRepositoryUsers(t *testing.T, user *models.User) {
+	t.Helper()
+
+	loaders := map[string]func() (*models.User, error){
+		"uuid":  func() (*models.User, error) { return models.LoadUserByUUID(context.Background(), user.UUID) },
+		"email": func() (*models.User, error) { return models.LoadUserByEmail(context.Background(), user.Email) },
+		"email in another case": func() (*models.User, error) {
+			return models.LoadUserByEmail(context.Background(), strings.ToUpper(user.Email))
+		},
+	}
+	for name, load := range loaders {
+		loaded, err := load()
+		if err != nil {
+			t.Fatalf("load by %s; %v", name, err)
+		}
+		if loaded.UUID != user.UUID || loaded.Email != user.Email || !loaded.PwHashState().Hashed {
+			t.Errorf("load by %s; wrong user %+v", name, loaded)
+		}
+	}
+	if _, err := models.LoadUserByUUID(context.Background(), "00000000-0000-0000-0000-000000000000"); !errs.NotFoundError(err) {
+		t.Errorf("expected not found error; got %v", err)
+	}
+
+	dupe := models.NewUser()
+	dupe.Email = user.Email
+	dupe.Password = "testpassword123"
+	if err := dupe.Create(context.Background()); !errs.ValidationError(err) {
+		t.Errorf("expected validation error for duplicate email; got %v", err)
+	}
+	dupe.Email = strings.ToUpper(user.Email)
+	if err := dupe.Create(context.Background()); !errs.ValidationError(err) {
+		t.Errorf("expected validation error for duplicate email in another case; got %v", err)
+	}
+
+	updates := user.MakeSaferCopy()
+	hashed, err := models.HashPassword("newpassword123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	updates.Password = hashed
+	updates.PwNonce = "new_nonce"
+	if err = user.Update(context.Background(), updates); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := models.LoadUserByEmail(context.Background(), user.Email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.PwNonce != "new_nonce" {
+		t.Errorf("update not saved; got nonce %q", loaded.PwNonce)
+	}
+	if ok, err := loaded.VerifyPassword(context.Background(), "newpassword123"); err != nil || !ok {
+		t.Errorf("password not updated; got ok=%t, err=%v", ok, err)
+	}
+
+	updates = user.MakeSaferCopy()
+	updates.Email = "changed-" + user.Email
+	updates.Password = hashed
+	updates.PwNonce = "changed_nonce"
+	if err = user.ChangeEmail(context.Background(), updates); err != nil {
+		t.Fatal(err)
+	}
+	if loaded, err = models.LoadUserByUUID(context.Background(), user.UUID); err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Email != updates.Email || loaded.PwNonce != "changed_nonce" {
+		t.Errorf("email change not saved; got email %q, nonce %q", loaded.Email, loaded.PwNonce)
+	}
+
+	uuids, err := models.LoadUserUUIDs(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var found bool
+	for _, id := range uuids {
+		found = found || id == user.UUID
+	}
+	if !found {
+		t.Errorf("expected user %q in %v", user.UUID, uuids)
+	}
+}
+
+func testRepositoryItems(t *testing.T, user *models.User) {
+	t.Helper()
+
+	note := models.Item{UserUUID: user.UUID, ContentType: "Note", Content: "003:note"}
+	extension := models.Item{UserUUID: user.UUID, ContentType: "SF|Extension", Content: "003:ext"}
+	trash := models.Item{UserUUID: user.UUID, ContentType: "Note", Content: "003:trash"}
+	for _, item := range []*models.Item{&note, &extension, &trash} {
+		if err := item.Create(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(2 * time.Millisecond) // make updated_at values distinct.
+	}
+	if err := trash.Delete(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := models.LoadItemByUUID(context.Background(), trash.UUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !loaded.Deleted || loaded.Content != "" {
+		t.Errorf("expected deleted item to be saved; got %+v", loaded)
+	}
+	if exists, err := note.Exists(context.Background()); err != nil || !exists {
+		t.Errorf("expected item to exist; got %t, %v", exists, err)
+	}
+	if _, err = models.LoadItemByUUID(context.Background(), "00000000-0000-0000-0000-000000000000"); !errs.NotFoundError(err) {
+		t.Errorf("expected not found error; got %v", err)
+	}
+
+	note.Content = "003:updated"
+	if err = note.Update(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	active, err := user.LoadActiveItems(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkItemUUIDs(t, "active", active, note.UUID, extension.UUID)
+	if active[0].Content != "003:updated" {
+		t.Errorf("update not saved; got content %q", active[0].Content)
+	}
+
+	extensions, err := user.LoadActiveExtensionItems(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkItemUUIDs(t, "extensions", extensions, extension.UUID)
+
+	all, more, err := user.LoadAllItems(context.Background(), "", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !more {
+		t.Error("expected more items")
+	}
+	checkItemUUIDs(t, "all", all, extension.UUID)
+
+	after, _, err := user.LoadItemsAfter(context.Background(), extension.UpdatedAt, true, "", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkItemUUIDs(t, "after inclusive", after, extension.UUID, trash.UUID, note.UUID)
+	after, _, err = user.LoadItemsAfter(context.Background(), extension.UpdatedAt, false, "", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkItemUUIDs(t, "after exclusive", after, trash.UUID, note.UUID)
+
+	usage, err := models.LoadUsage(context.Background(), user.UUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedUsage := models.Usage{Items: 2, Bytes: int64(len(note.Content) + len(extension.Content))}
+	if usage != expectedUsage {
+		t.Errorf("wrong usage; got %+v, expected %+v", usage, expectedUsage)
+	}
+}
+
+func checkItemUUIDs(t *testing.T, name string, items models.Items, expected ...string) {
+	t.Helper()
+	if len(items) != len(expected) {
+		t.Errorf("%s; wrong number of items; got %d, expected %d", name, len(items), len(expected))
+		return
+	}
+	for i, item := range items {
+		if item.UUID != expected[i] {
+			t.Errorf("%s; item[%d]; got %q, expected %q", name, i, item.UUID, expected[i])
+		}
+	}
+}
+
+func testRepositoryDelete(t *testing.T, user *models.User) {
+	t.Helper()
+
+	items, _, err := user.LoadItemsAfter(context.Background(), time.Time{}, true, "", 100)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(items) < 1 {
+		t.Fatal("expected items to delete")
+	}
+	if err = user.Delete(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = models.LoadUserByUUID(context.Background(), user.UUID); !errs.NotFoundError(err) {
+		t.Errorf("expected not found error for deleted user; got %v", err)
+	}
+	for _, item := range items {
+		if _, err = models.LoadItemByUUID(context.Background(), item.UUID); !errs.NotFoundError(err) {
+			t.Errorf("expected not found error for item of deleted user; got %v", err)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package models
+
+import (
+	"strings"
+
+	"github.com/rafaelespinoza/standardnotes/internal/db"
+)
+
+// A column pairs the name of a DB column with the field it's scanned into.
+// Keeping them together means a SELECT clause and the Scan call that reads its
+// result can't get out of order.
+type column struct {
+	name string
+	dest interface{}
+}
+
+func itemColumns(i *Item) []column {
+	return []column{
+		{"uuid", &i.UUID},
+		{"user_uuid", &i.UserUUID},
+		{"content", &i.Content},
+		{"content_type", &i.ContentType},
+		{"enc_item_key", &i.EncItemKey},
+		{"auth_hash", &i.AuthHash},
+		{"deleted", &i.Deleted},
+		{"created_at", &i.CreatedAt},
+		{"updated_at", &i.UpdatedAt},
+	}
+}
+
+func userColumns(u *User) []column {
+	return []column{
+		{"uuid", &u.UUID},
+		{"email", &u.Email},
+		{"password", &u.Password},
+		{"pw_func", &u.PwFunc},
+		{"pw_alg", &u.PwAlg},
+		{"pw_cost", &u.PwCost},
+		{"pw_key_size", &u.PwKeySize},
+		{"pw_nonce", &u.PwNonce},
+		{"pw_salt", &u.PwSalt},
+		{"created_at", &u.CreatedAt},
+		{"updated_at", &u.UpdatedAt},
+	}
+}
+
+// _ItemColumns and _UserColumns are for the SELECT clause of a query whose
+// rows are read with scanItem or scanUser.
+var (
+	_ItemColumns = columnNames(itemColumns(&Item{}))
+	_UserColumns = columnNames(userColumns(&User{}))
+)
+
+func columnNames(cols []column) string {
+	names := make([]string, len(cols))
+	for i, col := range cols {
+		names[i] = col.name
+	}
+	return strings.Join(names, ", ")
+}
+
+func scanColumns(row db.Iterator, cols []column) error {
+	dest := make([]interface{}, len(cols))
+	for i, col := range cols {
+		dest[i] = col.dest
+	}
+	return row.Scan(dest...)
+}
+
+// scanItem reads a row selected with _ItemColumns.
+func scanItem(row db.Iterator) (item *Item, err error) {
+	item = &Item{}
+	if err = scanColumns(row, itemColumns(item)); err != nil {
+		item = nil
+	}
+	return
+}
+
+// scanUser reads a row selected with _UserColumns.
+func scanUser(row db.Iterator) (user *User, err error) {
+	user = NewUser()
+	if err = scanColumns(row, userColumns(user)); err != nil {
+		user = nil
+		return
+	}
+	// Assume the password stored in the DB is hashed.
+	user.passwordHashed = true
+	return
+}
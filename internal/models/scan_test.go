@@ -0,0 +1,124 @@
+package models
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rafaelespinoza/standardnotes/internal/db"
+)
+
+// This file is in package models, rather than models_test, to get at the
+// column lists. The DB is set up by TestMain in the models_test package.
+
+// TestColumnsMatchSchema fails when a column is added to or removed from a
+// table without updating the columns scanned from it.
+func TestColumnsMatchSchema(t *testing.T) {
+	tests := []struct {
+		table   string
+		columns []column
+	}{
+		{"items", itemColumns(&Item{})},
+		{"users", userColumns(&User{})},
+	}
+	for _, test := range tests {
+		t.Run(test.table, func(t *testing.T) {
+			rows, err := db.DB().QueryContext(context.Background(), `SELECT * FROM `+test.table+` WHERE 1 = 0`)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer rows.Close()
+			inSchema, err := rows.Columns()
+			if err != nil {
+				t.Fatal(err)
+			}
+			inScanner := make([]string, len(test.columns))
+			for i, col := range test.columns {
+				inScanner[i] = col.name
+			}
+			sort.Strings(inSchema)
+			sort.Strings(inScanner)
+			if !reflect.DeepEqual(inSchema, inScanner) {
+				t.Errorf(
+					"columns of %s differ from the scanner;\nschema  %v\nscanner %v",
+					test.table, inSchema, inScanner,
+				)
+			}
+		})
+	}
+}
+
+// TestScanRoundTrip saves a value with a distinct value in each field and loads
+// it back, to catch a column that's scanned into the wrong field.
+func TestScanRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	repos := SQLRepositories()
+	createdAt := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	updatedAt := createdAt.Add(time.Hour)
+
+	t.Run("users", func(t *testing.T) {
+		in := &User{
+			UUID:      uuid.New().String(),
+			Email:     "scan-round-trip@example.com",
+			Password:  "password",
+			PwFunc:    "pw_func",
+			PwAlg:     "pw_alg",
+			PwCost:    123,
+			PwKeySize: 456,
+			PwNonce:   "pw_nonce",
+			PwSalt:    "pw_salt",
+			CreatedAt: createdAt,
+			UpdatedAt: updatedAt,
+		}
+		if err := repos.Users.Create(ctx, in); err != nil {
+			t.Fatal(err)
+		}
+		out, err := repos.Users.FindByUUID(ctx, in.UUID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkColumns(t, userColumns(out), userColumns(in))
+	})
+
+	t.Run("items", func(t *testing.T) {
+		in := &Item{
+			UUID:        uuid.New().String(),
+			UserUUID:    uuid.New().String(),
+			Content:     "content",
+			ContentType: "content_type",
+			EncItemKey:  "enc_item_key",
+			AuthHash:    "auth_hash",
+			Deleted:     true,
+			CreatedAt:   createdAt,
+			UpdatedAt:   updatedAt,
+		}
+		if err := repos.Items.Create(ctx, in); err != nil {
+			t.Fatal(err)
+		}
+		out, err := repos.Items.FindByUUID(ctx, in.UUID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkColumns(t, itemColumns(out), itemColumns(in))
+	})
+}
+
+func checkColumns(t *testing.T, actual, expected []column) {
+	t.Helper()
+	for i, col := range actual {
+		got := reflect.ValueOf(col.dest).Elem().Interface()
+		exp := reflect.ValueOf(expected[i].dest).Elem().Interface()
+		if gotTime, ok := got.(time.Time); ok {
+			if !gotTime.Equal(exp.(time.Time)) {
+				t.Errorf("wrong %s; got %v, expected %v", col.name, got, exp)
+			}
+			continue
+		}
+		if got != exp {
+			t.Errorf("wrong %s; got %v, expected %v", col.name, got, exp)
+		}
+	}
+}
@@ -0,0 +1,246 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rafaelespinoza/standardnotes/internal/db"
+)
+
+// _SessionTouchInterval limits how often a session's LastUsedAt is saved, so
+// that every authenticated request isn't also a write.
+const _SessionTouchInterval = time.Minute
+
+// _MaxUserAgentLength is where user agents are cut off before they're saved.
+const _MaxUserAgentLength = 512
+
+// A Session is a signed in device. Each token belongs to a session, and
+// revoking the session revokes its tokens. Revoked sessions are remembered, so
+// that a legacy token, which doesn't expire, can't bring its session back.
+type Session struct {
+	UUID       string    `json:"uuid"`
+	UserUUID   string    `json:"-"`
+	UserAgent  string    `json:"user_agent"`
+	IPAddress  string    `json:"ip_address"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+}
+
+// CreateSession saves a new session for the user.
+func CreateSession(ctx context.Context, userUUID, userAgent, ipAddress string) (sess *Session, err error) {
+	if len(userUUID) < MinIDLength {
+		err = validationError{fmt.Errorf("user_uuid too short")}
+		return
+	}
+	if len(userAgent) > _MaxUserAgentLength {
+		userAgent = userAgent[:_MaxUserAgentLength]
+	}
+	t := now()
+	sess = &Session{
+		UUID:       uuid.New().String(),
+		UserUUID:   userUUID,
+		UserAgent:  userAgent,
+		IPAddress:  ipAddress,
+		CreatedAt:  t,
+		LastUsedAt: t,
+	}
+	if err = db.Exec(ctx,
+		strings.TrimSpace(`
+		INSERT INTO sessions (uuid, user_uuid, user_agent, ip_address, created_at, last_used_at)
+		VALUES (?,?,?,?,?,?)`),
+		sess.UUID, sess.UserUUID, sess.UserAgent, sess.IPAddress, sess.CreatedAt, sess.LastUsedAt,
+	); err != nil {
+		sess = nil
+	}
+	return
+}
+
+const _SessionColumns = "uuid, user_uuid, user_agent, ip_address, created_at, last_used_at"
+
+func scanSession(row db.Iterator) (sess Session, err error) {
+	err = row.Scan(&sess.UUID, &sess.UserUUID, &sess.UserAgent, &sess.IPAddress, &sess.CreatedAt, &sess.LastUsedAt)
+	return
+}
+
+// LoadSession fetches a session. If it doesn't exist, maybe because it was
+// revoked, then the error is a NotFound error.
+func LoadSession(ctx context.Context, sessionUUID string) (sess *Session, err error) {
+	err = db.SelectOne(ctx, func(row db.Iterator) (e error) {
+		var found Session
+		if found, e = scanSession(row); e == nil {
+			sess = &found
+		}
+		return
+	}, "SELECT "+_SessionColumns+" FROM sessions WHERE uuid=?", sessionUUID)
+	return
+}
+
+// RestoreSession saves a session that was cleaned up while idle, under its old
+// UUID, for a legacy token that's used again. If the session was revoked, then
+// the error is a NotFound error.
+func RestoreSession(ctx context.Context, sessionUUID, userUUID string) (sess *Session, err error) {
+	err = db.WithTx(ctx, func(ctx context.Context) (err error) {
+		var revoked bool
+		var found string
+		if revoked, err = db.SelectExists(ctx, &found, "SELECT uuid FROM revoked_sessions WHERE uuid=?", sessionUUID); err != nil {
+			return
+		} else if revoked {
+			err = notFoundError{fmt.Errorf("session revoked")}
+			return
+		}
+		t := now()
+		sess = &Session{UUID: sessionUUID, UserUUID: userUUID, CreatedAt: t, LastUsedAt: t}
+		err = db.Exec(ctx,
+			strings.TrimSpace(`
+			INSERT INTO sessions (uuid, user_uuid, user_agent, ip_address, created_at, last_used_at)
+			VALUES (?,?,?,?,?,?)`),
+			sess.UUID, sess.UserUUID, sess.UserAgent, sess.IPAddress, sess.CreatedAt, sess.LastUsedAt,
+		)
+		return
+	})
+	if err != nil {
+		sess = nil
+	}
+	return
+}
+
+// LoadSessions fetches the user's sessions, most recently used first.
+func LoadSessions(ctx context.Context, userUUID string) (out []Session, err error) {
+	out = make([]Session, 0)
+	err = db.SelectMany(ctx, func(row db.Iterator) error {
+		sess, err := scanSession(row)
+		if err != nil {
+			return err
+		}
+		out = append(out, sess)
+		return nil
+	}, "SELECT "+_SessionColumns+" FROM sessions WHERE user_uuid=? ORDER BY last_used_at DESC", userUUID)
+	return
+}
+
+// Touch records that the session was used at time t. It's only saved if the
+// last save was a while ago.
+func (s *Session) Touch(ctx context.Context, t time.Time) (err error) {
+	if t.Sub(s.LastUsedAt) < _SessionTouchInterval {
+		return
+	}
+	if err = db.Exec(ctx,
+		"UPDATE sessions SET last_used_at=? WHERE uuid=?",
+		t.UTC(), s.UUID,
+	); err == nil {
+		s.LastUsedAt = t.UTC()
+	}
+	return
+}
+
+// RevokeSession deletes one of the user's sessions, along with its refresh
+// tokens. If the user has no such session, then the error is a NotFound error.
+func RevokeSession(ctx context.Context, userUUID, sessionUUID string) error {
+	return db.WithTx(ctx, func(ctx context.Context) (err error) {
+		if err = rememberRevoked(ctx, "uuid=? AND user_uuid=?", sessionUUID, userUUID); err != nil {
+			return
+		}
+		var n int64
+		if n, err = db.ExecAffected(ctx,
+			"DELETE FROM sessions WHERE uuid=? AND user_uuid=?",
+			sessionUUID, userUUID,
+		); err != nil {
+			return
+		} else if n == 0 {
+			err = notFoundError{fmt.Errorf("session not found")}
+			return
+		}
+		err = db.Exec(ctx, "DELETE FROM refresh_tokens WHERE session_uuid=?", sessionUUID)
+		return
+	})
+}
+
+// RevokeOtherSessions deletes all of the user's sessions except for keepUUID.
+func RevokeOtherSessions(ctx context.Context, userUUID, keepUUID string) error {
+	return db.WithTx(ctx, func(ctx context.Context) (err error) {
+		if err = rememberRevoked(ctx, "user_uuid=? AND uuid <> ?", userUUID, keepUUID); err != nil {
+			return
+		}
+		if err = db.Exec(ctx,
+			strings.TrimSpace(`
+			DELETE FROM refresh_tokens WHERE session_uuid IN (
+				SELECT uuid FROM sessions WHERE user_uuid=? AND uuid <> ?
+			)`),
+			userUUID, keepUUID,
+		); err != nil {
+			return
+		}
+		err = db.Exec(ctx,
+			"DELETE FROM sessions WHERE user_uuid=? AND uuid <> ?",
+			userUUID, keepUUID,
+		)
+		return
+	})
+}
+
+// revokeSession deletes a session and its refresh tokens, no matter whose it
+// is.
+func revokeSession(ctx context.Context, sessionUUID string) error {
+	return db.WithTx(ctx, func(ctx context.Context) (err error) {
+		if err = rememberRevoked(ctx, "uuid=?", sessionUUID); err != nil {
+			return
+		}
+		if err = db.Exec(ctx, "DELETE FROM refresh_tokens WHERE session_uuid=?", sessionUUID); err != nil {
+			return
+		}
+		err = db.Exec(ctx, "DELETE FROM sessions WHERE uuid=?", sessionUUID)
+		return
+	})
+}
+
+// rememberRevoked records that the sessions matching where are being revoked.
+func rememberRevoked(ctx context.Context, where string, args ...interface{}) error {
+	return db.Exec(ctx,
+		"INSERT INTO revoked_sessions (uuid, user_uuid, revoked_at) SELECT uuid, user_uuid, ? FROM sessions WHERE "+where,
+		append([]interface{}{now()}, args...)...,
+	)
+}
+
+// ForgetRevokedSessions deletes the record of the user's revoked sessions. It's
+// for when the user's password changes, because legacy tokens from before
+// then don't work anymore anyway.
+func ForgetRevokedSessions(ctx context.Context, userUUID string) error {
+	return db.Exec(ctx, "DELETE FROM revoked_sessions WHERE user_uuid=?", userUUID)
+}
+
+// RevokeRefreshTokens deletes the refresh tokens of a session, without
+// revoking the session itself.
+func RevokeRefreshTokens(ctx context.Context, sessionUUID string) error {
+	return db.Exec(ctx, "DELETE FROM refresh_tokens WHERE session_uuid=?", sessionUUID)
+}
+
+// DeleteExpiredSessions cleans up refresh tokens that expired before t, and
+// sessions that weren't used since idleBefore and have no refresh tokens left.
+// Legacy tokens can restore their sessions, but revoked ones stay revoked,
+// unless keepRevoked is false, which is for when legacy tokens aren't
+// accepted. The outputs are the numbers of deleted refresh tokens and sessions.
+func DeleteExpiredSessions(ctx context.Context, t, idleBefore time.Time, keepRevoked bool) (tokens, sessions int64, err error) {
+	err = db.WithTx(ctx, func(ctx context.Context) (err error) {
+		if tokens, err = db.ExecAffected(ctx,
+			"DELETE FROM refresh_tokens WHERE expires_at < ?",
+			t.UTC(),
+		); err != nil {
+			return
+		}
+		if sessions, err = db.ExecAffected(ctx,
+			strings.TrimSpace(`
+			DELETE FROM sessions WHERE last_used_at < ? AND NOT EXISTS (
+				SELECT 1 FROM refresh_tokens WHERE refresh_tokens.session_uuid = sessions.uuid AND used = ?
+			)`),
+			idleBefore.UTC(), false,
+		); err != nil || keepRevoked {
+			return
+		}
+		err = db.Exec(ctx, "DELETE FROM revoked_sessions")
+		return
+	})
+	return
+}
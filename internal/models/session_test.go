@@ -0,0 +1,142 @@
+package models_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rafaelespinoza/standardnotes/internal/errs"
+	"github.com/rafaelespinoza/standardnotes/internal/models"
+)
+
+func TestSessions(t *testing.T) {
+	ctx := context.Background()
+	user := models.NewUser()
+	user.Email = t.Name() + "@example.com"
+	user.Password = "testpassword123"
+	if err := user.Create(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := models.CreateSession(ctx, user.UUID, strings.Repeat("a", 1000), "192.0.2.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(first.UserAgent) != 512 {
+		t.Errorf("expected long user agent to be cut off; got length %d", len(first.UserAgent))
+	}
+	second, err := models.CreateSession(ctx, user.UUID, "second", "192.0.2.2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	third, err := models.CreateSession(ctx, user.UUID, "third", "192.0.2.3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = models.CreateSession(ctx, "", "", ""); !errs.ValidationError(err) {
+		t.Errorf("expected validation error; got %v", err)
+	}
+
+	t.Run("touch", func(t *testing.T) {
+		later := time.Now().Add(time.Hour)
+		if err := second.Touch(ctx, later); err != nil {
+			t.Fatal(err)
+		}
+		loaded, err := models.LoadSession(ctx, second.UUID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !loaded.LastUsedAt.Equal(later.UTC()) {
+			t.Errorf("wrong LastUsedAt; got %v, expected %v", loaded.LastUsedAt, later.UTC())
+		}
+		sessions, err := models.LoadSessions(ctx, user.UUID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(sessions) != 3 || sessions[0].UUID != second.UUID {
+			t.Errorf("expected most recently used session first; got %+v", sessions)
+		}
+	})
+
+	t.Run("revoke", func(t *testing.T) {
+		if err := models.RevokeSession(ctx, "not-the-owner", first.UUID); !errs.NotFoundError(err) {
+			t.Errorf("expected not found error for another user's session; got %v", err)
+		}
+		if err := models.RevokeSession(ctx, user.UUID, first.UUID); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := models.LoadSession(ctx, first.UUID); !errs.NotFoundError(err) {
+			t.Errorf("expected not found error; got %v", err)
+		}
+		if err := models.RevokeOtherSessions(ctx, user.UUID, third.UUID); err != nil {
+			t.Fatal(err)
+		}
+		sessions, err := models.LoadSessions(ctx, user.UUID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(sessions) != 1 || sessions[0].UUID != third.UUID {
+			t.Errorf("expected only the kept session; got %+v", sessions)
+		}
+	})
+}
+
+func TestDeleteExpiredSessions(t *testing.T) {
+	ctx := context.Background()
+	user := models.NewUser()
+	user.Email = t.Name() + "@example.com"
+	user.Password = "testpassword123"
+	if err := user.Create(ctx); err != nil {
+		t.Fatal(err)
+	}
+	refreshed, err := models.CreateSession(ctx, user.UUID, "refreshed", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = models.IssueRefreshToken(ctx, refreshed.UUID, 48*time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	expired, err := models.CreateSession(ctx, user.UUID, "expired", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = models.IssueRefreshToken(ctx, expired.UUID, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	revoked, err := models.CreateSession(ctx, user.UUID, "revoked", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = models.RevokeSession(ctx, user.UUID, revoked.UUID); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(24 * time.Hour)
+
+	for _, keepRevoked := range []bool{true, false} {
+		if _, _, err = models.DeleteExpiredSessions(ctx, later, later, keepRevoked); err != nil {
+			t.Fatal(err)
+		}
+		sessions, err := models.LoadSessions(ctx, user.UUID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(sessions) != 1 || sessions[0].UUID != refreshed.UUID {
+			t.Errorf("keepRevoked %t; expected only the session with a refresh token left; got %+v", keepRevoked, sessions)
+		}
+		// the idle session can be restored, but the revoked one only once
+		// it's been forgotten.
+		if _, err = models.RestoreSession(ctx, expired.UUID, user.UUID); err != nil {
+			t.Errorf("keepRevoked %t; expected idle session to be restored; got %v", keepRevoked, err)
+		}
+		_, err = models.RestoreSession(ctx, revoked.UUID, user.UUID)
+		if keepRevoked && !errs.NotFoundError(err) {
+			t.Errorf("expected revoked session to stay revoked; got %v", err)
+		} else if !keepRevoked && err != nil {
+			t.Errorf("expected revoked session to be forgotten; got %v", err)
+		}
+		if err = models.RevokeSession(ctx, user.UUID, expired.UUID); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
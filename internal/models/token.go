@@ -6,16 +6,100 @@ import (
 	"time"
 
 	"github.com/golang-jwt/jwt/v4"
+	"github.com/rafaelespinoza/standardnotes/internal/keys"
 )
 
-var _SigningKey = []byte{}
+// _BuiltInSigningKey is used when no other key is configured. It's in the
+// source code, so anybody can sign tokens with it. It's only fit for debugging.
+const _BuiltInSigningKey = "qA6irmDikU6RkCM4V0cJiUJEROuCsqTa1esexI4aWedSv405v8lw4g1KB1nQVsSdCrcyRlKFdws4XPlsArWwv9y5Xr5Jtkb11w1NxKZabOUa7mxjeENuCs31Y1Ce49XH9kGMPe0ms7iV7e9F6WgnsPFGOlIA3CwfGyr12okas2EsDd71SbSnA0zJYjyxeCVCZJWISmLB"
+
+var (
+	// _SigningKeys, if set, signs new tokens with its current key and
+	// verifies tokens by their kid header.
+	_SigningKeys *keys.Set
+	// _LegacyKey signs tokens while _SigningKeys is unset, and verifies tokens
+	// without a kid header. It's from SECRET_KEY_BASE, or the built-in key.
+	_LegacyKey []byte
+	// _BuiltInKey says whether _LegacyKey is the built-in key.
+	_BuiltInKey bool
+)
 
 func init() {
 	key := os.Getenv("SECRET_KEY_BASE")
 	if key == "" {
-		key = "qA6irmDikU6RkCM4V0cJiUJEROuCsqTa1esexI4aWedSv405v8lw4g1KB1nQVsSdCrcyRlKFdws4XPlsArWwv9y5Xr5Jtkb11w1NxKZabOUa7mxjeENuCs31Y1Ce49XH9kGMPe0ms7iV7e9F6WgnsPFGOlIA3CwfGyr12okas2EsDd71SbSnA0zJYjyxeCVCZJWISmLB"
+		key, _BuiltInKey = _BuiltInSigningKey, true
+	}
+	_LegacyKey = []byte(key)
+	_ParamsSecret = []byte(key)
+}
+
+// UseSigningKeys makes the current key of set sign new tokens, and has tokens
+// verified by the key matching their kid header. Tokens without a kid were
+// signed before keys were configured; they're still accepted if
+// SECRET_KEY_BASE is set, but never with the built-in key.
+func UseSigningKeys(set *keys.Set) error {
+	if err := set.Validate(); err != nil {
+		return err
+	}
+	_SigningKeys = set
+	if _BuiltInKey {
+		_LegacyKey = nil
+	}
+	return nil
+}
+
+// BuiltInSigningKey says whether tokens are signed with the built-in key,
+// because neither a keys file nor SECRET_KEY_BASE is configured.
+func BuiltInSigningKey() bool { return _SigningKeys == nil && _BuiltInKey }
+
+// signToken signs claims with the current key, and names the key in the kid
+// header.
+func signToken(claims jwt.Claims) (string, error) {
+	if _SigningKeys == nil {
+		return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(_LegacyKey)
 	}
-	_SigningKey = []byte(key)
+	key, _ := _SigningKeys.Current()
+	method := jwt.GetSigningMethod(key.Alg)
+	if method == nil {
+		return "", fmt.Errorf("unsupported signing method %q", key.Alg)
+	}
+	token := jwt.NewWithClaims(method, claims)
+	token.Header["kid"] = key.ID
+	return token.SignedString(key.SigningKey())
+}
+
+// verificationKey looks up the key that should have signed the token. The
+// token's algorithm has to be the key's, so that a public key can't be passed
+// off as an HMAC secret.
+func verificationKey(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	if kid == "" {
+		if _LegacyKey == nil {
+			return nil, fmt.Errorf("token has no kid")
+		} else if token.Method != jwt.SigningMethodHS256 {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		return _LegacyKey, nil
+	}
+	if _SigningKeys == nil {
+		return nil, fmt.Errorf("unknown kid %q", kid)
+	}
+	key, ok := _SigningKeys.Find(kid)
+	if !ok {
+		return nil, fmt.Errorf("unknown kid %q", kid)
+	} else if token.Method.Alg() != key.Alg {
+		return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+	}
+	return key.VerificationKey(), nil
+}
+
+// PublicSigningKeys outputs the public keys that verify tokens, in JSON Web
+// Key Set form. It's empty unless tokens are signed by asymmetric keys.
+func PublicSigningKeys() map[string][]keys.JWK {
+	if _SigningKeys == nil {
+		return (&keys.Set{}).JWKS()
+	}
+	return _SigningKeys.JWKS()
 }
 
 // A Token provides user authentication using a JWT.
@@ -38,8 +122,13 @@ func (t *webToken) Valid() bool    { return t.token.Valid }
 type Claims interface {
 	// UUID should return the UUID of the User represented in the token.
 	UUID() string
-	// Hash should return the hashed password of the User.
+	// Hash should return the password fingerprint of the User.
 	Hash() string
+	// Session should return the UUID of the Session that the token belongs to.
+	Session() string
+	// Expiry should return when the token expires, or the zero time if it
+	// doesn't.
+	Expiry() time.Time
 	// Valid should return an error to signal an invalid token, or otherwise
 	// return nil.
 	Valid() error
@@ -47,28 +136,41 @@ type Claims interface {
 
 // userClaims is a set of JWT claims that implements the Claims interface.
 type userClaims struct {
-	PwHash string
-	UserID string
+	PwHash    string
+	UserID    string
+	SessionID string
 	jwt.StandardClaims
 }
 
 var _ Claims = (*userClaims)(nil)
 
-func (c *userClaims) Hash() string { return c.PwHash }
-func (c *userClaims) UUID() string { return c.UserID }
+func (c *userClaims) Hash() string    { return c.PwHash }
+func (c *userClaims) UUID() string    { return c.UserID }
+func (c *userClaims) Session() string { return c.SessionID }
+
+func (c *userClaims) Expiry() (t time.Time) {
+	if c.ExpiresAt != 0 {
+		t = time.Unix(c.ExpiresAt, 0)
+	}
+	return
+}
 
-// EncodeToken makes a JWT token for a User.
-func EncodeToken(u User) (string, error) {
+// EncodeToken makes a JWT token for a User, which belongs to a Session. It
+// expires at expiresAt, or never if expiresAt is the zero time.
+func EncodeToken(u User, sessionUUID string, expiresAt time.Time) (string, error) {
 	claims := userClaims{
-		UserID: u.UUID,
-		PwHash: u.Password,
+		UserID:    u.UUID,
+		PwHash:    u.PasswordFingerprint(),
+		SessionID: sessionUUID,
 		StandardClaims: jwt.StandardClaims{
 			IssuedAt: time.Now().Unix(),
 		},
 	}
+	if !expiresAt.IsZero() {
+		claims.ExpiresAt = expiresAt.Unix()
+	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	signedToken, err := token.SignedString(_SigningKey)
+	signedToken, err := signToken(claims)
 	if err != nil {
 		return "", err
 	}
@@ -82,15 +184,7 @@ func DecodeToken(encodedToken string) (tok Token, err error) {
 	out, err := new(jwt.Parser).ParseWithClaims(
 		encodedToken,
 		claims,
-		func(token *jwt.Token) (interface{}, error) {
-			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-				return nil, fmt.Errorf(
-					"unexpected signing method: %v",
-					token.Header["alg"],
-				)
-			}
-			return _SigningKey, nil
-		},
+		verificationKey,
 	)
 	if err != nil {
 		return
@@ -98,3 +192,51 @@ func DecodeToken(encodedToken string) (tok Token, err error) {
 	tok = &webToken{token: out, claims: claims}
 	return
 }
+
+// _VerificationSubject distinguishes email verification tokens from the tokens
+// used for authenticating requests.
+const _VerificationSubject = "email_verification"
+
+// verificationClaims is the JWT payload of an email verification link.
+type verificationClaims struct {
+	UserID string
+	Email  string
+	jwt.StandardClaims
+}
+
+// EncodeVerificationToken makes a signed token, to be used in a link, which
+// proves that the holder received an email sent to the User's email address.
+// The token expires after ttl.
+func EncodeVerificationToken(u User, ttl time.Duration) (string, error) {
+	now := time.Now()
+	claims := verificationClaims{
+		UserID: u.UUID,
+		Email:  u.Email,
+		StandardClaims: jwt.StandardClaims{
+			Subject:   _VerificationSubject,
+			IssuedAt:  now.Unix(),
+			ExpiresAt: now.Add(ttl).Unix(),
+		},
+	}
+	return signToken(claims)
+}
+
+// DecodeVerificationToken checks the signature and expiry of a token made by
+// EncodeVerificationToken and returns the user UUID and email address in it.
+func DecodeVerificationToken(encodedToken string) (userUUID, email string, err error) {
+	claims := new(verificationClaims)
+	if _, err = new(jwt.Parser).ParseWithClaims(
+		encodedToken,
+		claims,
+		verificationKey,
+	); err != nil {
+		err = validationError{err}
+		return
+	}
+	if claims.Subject != _VerificationSubject {
+		err = validationError{fmt.Errorf("not a verification token")}
+		return
+	}
+	userUUID, email = claims.UserID, claims.Email
+	return
+}
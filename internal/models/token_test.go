@@ -1,9 +1,15 @@
 package models_test
 
 import (
+	"crypto/ed25519"
+	"encoding/base64"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/rafaelespinoza/standardnotes/internal/errs"
+	"github.com/rafaelespinoza/standardnotes/internal/keys"
 	"github.com/rafaelespinoza/standardnotes/internal/models"
 )
 
@@ -12,7 +18,7 @@ func TestEncodeToken(t *testing.T) {
 	user.UUID = "just-a-stub-uuid"
 	user.Password = models.Hash("testpassword123")
 
-	token, err := models.EncodeToken(*user)
+	token, err := models.EncodeToken(*user, "just-a-stub-session-uuid", time.Now().Add(time.Hour))
 	if err != nil {
 		t.Errorf("did not expect error; got %v", err)
 	}
@@ -42,7 +48,7 @@ func TestDecodeToken(t *testing.T) {
 	user := models.NewUser()
 	user.UUID = userUUID
 	user.Password = models.Hash(plaintextPassword)
-	encodedToken, err := models.EncodeToken(*user)
+	encodedToken, err := models.EncodeToken(*user, "just-a-stub-session-uuid", time.Now().Add(time.Hour))
 	if err != nil {
 		t.Fatal(err)
 	} else if encodedToken == "" {
@@ -59,10 +65,10 @@ func TestDecodeToken(t *testing.T) {
 
 		if claims := decodedToken.Claims(); claims == nil {
 			t.Error("expected non-nil claims")
-		} else if claims.Hash() != models.Hash(plaintextPassword) {
+		} else if claims.Hash() != user.PasswordFingerprint() {
 			t.Errorf(
-				"expected Hash to be the hashed password\ngot %q\nexp %q",
-				claims.Hash(), models.Hash(plaintextPassword),
+				"expected Hash to be the password fingerprint\ngot %q\nexp %q",
+				claims.Hash(), user.PasswordFingerprint(),
 			)
 		} else if claims.UUID() != userUUID {
 			t.Errorf(
@@ -88,3 +94,154 @@ func TestDecodeToken(t *testing.T) {
 		}
 	})
 }
+
+func TestVerificationToken(t *testing.T) {
+	user := models.NewUser()
+	user.UUID = "just-a-stub-uuid"
+	user.Email = "verify@example.com"
+	user.Password = models.Hash("testpassword123")
+
+	t.Run("ok", func(t *testing.T) {
+		encoded, err := models.EncodeVerificationToken(*user, time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		userUUID, email, err := models.DecodeVerificationToken(encoded)
+		if err != nil {
+			t.Errorf("did not expect error; got %v", err)
+		}
+		if userUUID != user.UUID {
+			t.Errorf("wrong user uuid; got %q, expected %q", userUUID, user.UUID)
+		}
+		if email != user.Email {
+			t.Errorf("wrong email; got %q, expected %q", email, user.Email)
+		}
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		t.Run("expired", func(t *testing.T) {
+			encoded, err := models.EncodeVerificationToken(*user, -time.Minute)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, _, err = models.DecodeVerificationToken(encoded); !errs.ValidationError(err) {
+				t.Errorf("expected validation error; got %v", err)
+			}
+		})
+
+		t.Run("auth token", func(t *testing.T) {
+			encoded, err := models.EncodeToken(*user, "just-a-stub-session-uuid", time.Now().Add(time.Hour))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, _, err = models.DecodeVerificationToken(encoded); !errs.ValidationError(err) {
+				t.Errorf("expected validation error; got %v", err)
+			}
+		})
+	})
+}
+
+func TestSigningKeys(t *testing.T) {
+	user := models.NewUser()
+	user.UUID = "just-a-stub-uuid"
+	user.Password = models.Hash("testpassword123")
+	encode := func(t *testing.T) string {
+		t.Helper()
+		token, err := models.EncodeToken(*user, "just-a-stub-session-uuid", time.Now().Add(time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	newKey := func(t *testing.T) keys.Key {
+		t.Helper()
+		key, err := keys.Generate(keys.HS256, time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return key
+	}
+
+	builtIn := models.BuiltInSigningKey()
+	withoutKid := encode(t)
+	first, second := newKey(t), newKey(t)
+	if err := models.UseSigningKeys(&keys.Set{}); err == nil {
+		t.Error("expected error for a set without keys")
+	}
+	if err := models.UseSigningKeys(&keys.Set{Keys: []keys.Key{first}}); err != nil {
+		t.Fatal(err)
+	}
+	if models.BuiltInSigningKey() {
+		t.Error("expected built-in key to be replaced")
+	}
+	if _, err := models.DecodeToken(withoutKid); builtIn && err == nil {
+		t.Error("expected token signed by the built-in key to be rejected")
+	}
+	signedByFirst := encode(t)
+
+	if err := models.UseSigningKeys(&keys.Set{Keys: []keys.Key{first, second}}); err != nil {
+		t.Fatal(err)
+	}
+	signedBySecond := encode(t)
+	for _, token := range []string{signedByFirst, signedBySecond} {
+		if _, err := models.DecodeToken(token); err != nil {
+			t.Errorf("expected token to verify; got %v", err)
+		}
+	}
+
+	if err := models.UseSigningKeys(&keys.Set{Keys: []keys.Key{second}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := models.DecodeToken(signedByFirst); err == nil {
+		t.Error("expected token signed by a removed key to be rejected")
+	}
+	if _, err := models.DecodeToken(signedBySecond); err != nil {
+		t.Errorf("expected token to verify; got %v", err)
+	}
+}
+
+func TestAsymmetricSigningKeys(t *testing.T) {
+	user := models.NewUser()
+	user.UUID = "just-a-stub-uuid"
+	user.Password = models.Hash("testpassword123")
+	key, err := keys.Generate(keys.EdDSA, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = models.UseSigningKeys(&keys.Set{Keys: []keys.Key{key}}); err != nil {
+		t.Fatal(err)
+	}
+	encoded, err := models.EncodeToken(*user, "just-a-stub-session-uuid", time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = models.DecodeToken(encoded); err != nil {
+		t.Errorf("did not expect error; got %v", err)
+	}
+
+	// another service only has the public key.
+	jwks := models.PublicSigningKeys()["keys"]
+	if len(jwks) != 1 || jwks[0].Kid != key.ID {
+		t.Fatalf("expected the public key; got %+v", jwks)
+	}
+	x, err := base64.RawURLEncoding.DecodeString(jwks[0].X)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = jwt.Parse(encoded, func(token *jwt.Token) (interface{}, error) {
+		return ed25519.PublicKey(x), nil
+	}); err != nil {
+		t.Errorf("expected token to verify with the public key; got %v", err)
+	}
+
+	// the public key is no HMAC secret.
+	forged := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.StandardClaims{Subject: user.UUID})
+	forged.Header["kid"] = key.ID
+	signed, err := forged.SignedString(x)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = models.DecodeToken(signed); err == nil {
+		t.Error("expected token signed with the public key as an HMAC secret to be rejected")
+	}
+}
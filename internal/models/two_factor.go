@@ -0,0 +1,243 @@
+package models
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/rafaelespinoza/standardnotes/internal/db"
+)
+
+// Parameters of TOTP codes. These are the defaults of authenticator apps, which
+// is why they're not configurable.
+const (
+	_TOTPPeriod    = 30 * time.Second
+	_TOTPDigits    = 6
+	_TOTPSkew      = 1 // time steps accepted before and after the current one
+	_TOTPSecretLen = 20
+
+	_RecoveryCodeCount = 10
+)
+
+var _TOTPEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// TwoFactor is a user's TOTP (RFC 6238) second factor. It's pending from
+// enrollment until the user shows that they can make codes with it, at which
+// point it's Enabled and required to sign in.
+type TwoFactor struct {
+	UserUUID string
+	// Secret is the base32-encoded key shared with the authenticator app.
+	Secret  string
+	Enabled bool
+	// LastCounter is the time step of the last accepted code. A code can only
+	// be used once, so codes from this step or earlier are rejected.
+	LastCounter int64
+}
+
+// NewTwoFactor makes a pending second factor with a random secret.
+func NewTwoFactor(userUUID string) (tf TwoFactor, err error) {
+	if len(userUUID) < MinIDLength {
+		err = validationError{fmt.Errorf("user_uuid too short")}
+		return
+	}
+	key := make([]byte, _TOTPSecretLen)
+	if _, err = rand.Read(key); err != nil {
+		return
+	}
+	tf = TwoFactor{UserUUID: userUUID, Secret: _TOTPEncoding.EncodeToString(key)}
+	return
+}
+
+// LoadTwoFactor fetches the user's second factor. If the user has never
+// enrolled, then it returns a NotFound error.
+func LoadTwoFactor(ctx context.Context, userUUID string) (tf TwoFactor, err error) {
+	err = db.SelectOne(ctx, func(row db.Iterator) error {
+		return row.Scan(&tf.UserUUID, &tf.Secret, &tf.Enabled, &tf.LastCounter)
+	}, "SELECT user_uuid, secret, enabled, last_counter FROM two_factor WHERE user_uuid=?", userUUID)
+	return
+}
+
+// SavePending stores the second factor, replacing a pending one from an earlier
+// enrollment. It fails if the user's second factor is already enabled.
+func (tf TwoFactor) SavePending(ctx context.Context) error {
+	return db.WithTx(ctx, func(ctx context.Context) (err error) {
+		if err = db.Exec(ctx,
+			"DELETE FROM two_factor WHERE user_uuid=? AND enabled=?",
+			tf.UserUUID, false,
+		); err != nil {
+			return
+		}
+		now := time.Now().UTC()
+		err = db.Exec(ctx,
+			strings.TrimSpace(`
+			INSERT INTO two_factor (user_uuid, secret, enabled, last_counter, created_at, updated_at)
+			VALUES (?,?,?,?,?,?)`),
+			tf.UserUUID, tf.Secret, false, tf.LastCounter, now, now,
+		)
+		return
+	})
+}
+
+// Enable turns on the second factor and replaces the user's recovery codes.
+// The new codes are only available here, they are stored hashed.
+func (tf *TwoFactor) Enable(ctx context.Context) (recoveryCodes []string, err error) {
+	err = db.WithTx(ctx, func(ctx context.Context) (err error) {
+		if err = db.Exec(ctx,
+			"UPDATE two_factor SET enabled=?, updated_at=? WHERE user_uuid=?",
+			true, time.Now().UTC(), tf.UserUUID,
+		); err != nil {
+			return
+		}
+		recoveryCodes, err = makeRecoveryCodes(ctx, tf.UserUUID)
+		return
+	})
+	if err == nil {
+		tf.Enabled = true
+	}
+	return
+}
+
+// DeleteTwoFactor removes the user's second factor and recovery codes.
+func DeleteTwoFactor(ctx context.Context, userUUID string) error {
+	return db.WithTx(ctx, func(ctx context.Context) (err error) {
+		if err = db.Exec(ctx, "DELETE FROM recovery_codes WHERE user_uuid=?", userUUID); err != nil {
+			return
+		}
+		err = db.Exec(ctx, "DELETE FROM two_factor WHERE user_uuid=?", userUUID)
+		return
+	})
+}
+
+// URI is for a QR code that adds the secret to an authenticator app. See
+// https://github.com/google/google-authenticator/wiki/Key-Uri-Format.
+func (tf TwoFactor) URI(issuer, account string) string {
+	params := url.Values{}
+	params.Set("secret", tf.Secret)
+	params.Set("issuer", issuer)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", fmt.Sprint(_TOTPDigits))
+	params.Set("period", fmt.Sprint(int(_TOTPPeriod.Seconds())))
+	label := url.PathEscape(issuer) + ":" + url.PathEscape(account)
+	// Some apps show a "+" in the issuer as is, rather than as a space.
+	return "otpauth://totp/" + label + "?" + strings.ReplaceAll(params.Encode(), "+", "%20")
+}
+
+// Check tells you whether or not the code is valid at time t. Codes from the
+// time steps next to the current one are also accepted, to allow for clock
+// drift. An accepted code is used up, along with codes from earlier steps.
+func (tf *TwoFactor) Check(ctx context.Context, code string, t time.Time) (ok bool, err error) {
+	code = strings.TrimSpace(code)
+	current := t.Unix() / int64(_TOTPPeriod.Seconds())
+	for counter := current - _TOTPSkew; counter <= current+_TOTPSkew; counter++ {
+		if counter <= tf.LastCounter {
+			continue
+		}
+		var expected string
+		if expected, err = totpCode(tf.Secret, counter); err != nil {
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(code), []byte(expected)) != 1 {
+			continue
+		}
+		// The condition on last_counter keeps a concurrent request from using
+		// the same code.
+		var n int64
+		if n, err = db.ExecAffected(ctx,
+			"UPDATE two_factor SET last_counter=?, updated_at=? WHERE user_uuid=? AND last_counter < ?",
+			counter, time.Now().UTC(), tf.UserUUID, counter,
+		); err != nil {
+			return
+		}
+		if ok = n == 1; ok {
+			tf.LastCounter = counter
+		}
+		return
+	}
+	return
+}
+
+// TOTPCode computes the code for a base32-encoded secret at time t.
+func TOTPCode(secret string, t time.Time) (string, error) {
+	return totpCode(secret, t.Unix()/int64(_TOTPPeriod.Seconds()))
+}
+
+// totpCode is HOTP (RFC 4226) with a time step as the counter.
+func totpCode(secret string, counter int64) (code string, err error) {
+	var key []byte
+	if key, err = _TOTPEncoding.DecodeString(strings.ToUpper(secret)); err != nil {
+		err = validationError{fmt.Errorf("invalid secret; %v", err)}
+		return
+	}
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(counter))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	code = fmt.Sprintf("%0*d", _TOTPDigits, value%uint32(math.Pow10(_TOTPDigits)))
+	return
+}
+
+// makeRecoveryCodes replaces the user's recovery codes with new ones.
+func makeRecoveryCodes(ctx context.Context, userUUID string) (codes []string, err error) {
+	if err = db.Exec(ctx, "DELETE FROM recovery_codes WHERE user_uuid=?", userUUID); err != nil {
+		return
+	}
+	now := time.Now().UTC()
+	codes = make([]string, _RecoveryCodeCount)
+	for i := range codes {
+		raw := make([]byte, 10)
+		if _, err = rand.Read(raw); err != nil {
+			return
+		}
+		code := strings.ToLower(_TOTPEncoding.EncodeToString(raw))
+		codes[i] = code[:4] + "-" + code[4:8] + "-" + code[8:12] + "-" + code[12:]
+		if err = db.Exec(ctx,
+			"INSERT INTO recovery_codes (user_uuid, code_hash, created_at) VALUES (?,?,?)",
+			userUUID, hashRecoveryCode(codes[i]), now,
+		); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// UseRecoveryCode tells you whether or not the code is one of the user's
+// recovery codes. Each code is only accepted once.
+func UseRecoveryCode(ctx context.Context, userUUID, code string) (ok bool, err error) {
+	var n int64
+	n, err = db.ExecAffected(ctx,
+		"DELETE FROM recovery_codes WHERE user_uuid=? AND code_hash=?",
+		userUUID, hashRecoveryCode(code),
+	)
+	ok = n == 1
+	return
+}
+
+// CountRecoveryCodes is how many unused recovery codes the user has.
+func CountRecoveryCodes(ctx context.Context, userUUID string) (n int, err error) {
+	err = db.SelectOne(ctx, func(row db.Iterator) error {
+		return row.Scan(&n)
+	}, "SELECT COUNT(*) FROM recovery_codes WHERE user_uuid=?", userUUID)
+	return
+}
+
+// hashRecoveryCode normalizes the code so that it can be typed without the
+// dash or in either case. The codes are random, so a salt isn't needed.
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,174 @@
+package models_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rafaelespinoza/standardnotes/internal/errs"
+	"github.com/rafaelespinoza/standardnotes/internal/models"
+)
+
+func TestTOTPCode(t *testing.T) {
+	// Test vectors from RFC 6238, appendix B, truncated to 6 digits. The secret
+	// is "12345678901234567890" in base32.
+	const secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+	tests := []struct {
+		unix     int64
+		expected string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	}
+	for _, test := range tests {
+		code, err := models.TOTPCode(secret, time.Unix(test.unix, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != test.expected {
+			t.Errorf("wrong code at %d; got %q, expected %q", test.unix, code, test.expected)
+		}
+	}
+	if _, err := models.TOTPCode("not base32!", time.Now()); !errs.ValidationError(err) {
+		t.Errorf("expected validation error; got %v", err)
+	}
+}
+
+func TestTwoFactorURI(t *testing.T) {
+	tf := models.TwoFactor{Secret: "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"}
+	tests := []struct {
+		issuer, account string
+	}{
+		{issuer: "Standard Notes", account: "user@example.com"},
+		{issuer: "Notes", account: "first last@example.com"},
+	}
+	for _, test := range tests {
+		uri := tf.URI(test.issuer, test.account)
+		if !strings.Contains(uri, "%20") {
+			t.Errorf("expected spaces to be encoded as %%20; got %q", uri)
+		}
+		if strings.Contains(uri, "+") {
+			t.Errorf("did not expect a \"+\" in %q", uri)
+		}
+	}
+	if uri := tf.URI("Standard Notes", "user@example.com"); !strings.Contains(uri, "issuer=Standard%20Notes") {
+		t.Errorf("expected issuer param with %%20; got %q", uri)
+	}
+}
+
+func TestTwoFactor(t *testing.T) {
+	ctx := context.Background()
+	user := models.NewUser()
+	user.Email = t.Name() + "@example.com"
+	user.Password = "testpassword123"
+	if err := user.Create(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := models.LoadTwoFactor(ctx, user.UUID); !errs.NotFoundError(err) {
+		t.Fatalf("expected not found error before enrolling; got %v", err)
+	}
+	first, err := models.NewTwoFactor(user.UUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = first.SavePending(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// enrolling again replaces the pending secret.
+	tf, err := models.NewTwoFactor(user.UUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = tf.SavePending(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if loaded, err := models.LoadTwoFactor(ctx, user.UUID); err != nil {
+		t.Fatal(err)
+	} else if loaded.Secret != tf.Secret || loaded.Enabled {
+		t.Errorf("wrong second factor; got %+v, expected %+v", loaded, tf)
+	}
+	if uri := tf.URI("Standard Notes", user.Email); !strings.HasPrefix(uri, "otpauth://totp/Standard%20Notes:") ||
+		!strings.Contains(uri, "secret="+tf.Secret) {
+		t.Errorf("unexpected uri %q", uri)
+	}
+
+	t.Run("check", func(t *testing.T) {
+		now := time.Now()
+		code, err := models.TOTPCode(tf.Secret, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok, err := tf.Check(ctx, code, now); err != nil || !ok {
+			t.Fatalf("expected code to be accepted; got ok=%t, err=%v", ok, err)
+		}
+		loaded, err := models.LoadTwoFactor(ctx, user.UUID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok, err := loaded.Check(ctx, code, now); err != nil || ok {
+			t.Errorf("expected used code to be rejected; got ok=%t, err=%v", ok, err)
+		}
+		next, err := models.TOTPCode(tf.Secret, now.Add(30*time.Second))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok, err := loaded.Check(ctx, next, now); err != nil || !ok {
+			t.Errorf("expected code from the next step to be accepted; got ok=%t, err=%v", ok, err)
+		}
+		late, err := models.TOTPCode(tf.Secret, now.Add(-5*time.Minute))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok, err := loaded.Check(ctx, late, now); err != nil || ok {
+			t.Errorf("expected old code to be rejected; got ok=%t, err=%v", ok, err)
+		}
+	})
+
+	t.Run("recovery codes", func(t *testing.T) {
+		codes, err := tf.Enable(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(codes) != 10 {
+			t.Fatalf("wrong number of recovery codes; got %d, expected %d", len(codes), 10)
+		}
+		if n, err := models.CountRecoveryCodes(ctx, user.UUID); err != nil || n != len(codes) {
+			t.Errorf("wrong count; got %d, err %v", n, err)
+		}
+		if ok, err := models.UseRecoveryCode(ctx, user.UUID, strings.ToUpper(codes[0])); err != nil || !ok {
+			t.Errorf("expected recovery code to be accepted; got ok=%t, err=%v", ok, err)
+		}
+		if ok, err := models.UseRecoveryCode(ctx, user.UUID, codes[0]); err != nil || ok {
+			t.Errorf("expected used recovery code to be rejected; got ok=%t, err=%v", ok, err)
+		}
+		if n, err := models.CountRecoveryCodes(ctx, user.UUID); err != nil || n != len(codes)-1 {
+			t.Errorf("wrong count; got %d, err %v", n, err)
+		}
+
+		// an enabled second factor can't be replaced by enrolling again.
+		again, err := models.NewTwoFactor(user.UUID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = again.SavePending(ctx); err == nil {
+			t.Error("expected error saving over an enabled second factor")
+		}
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		if err := models.DeleteTwoFactor(ctx, user.UUID); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := models.LoadTwoFactor(ctx, user.UUID); !errs.NotFoundError(err) {
+			t.Errorf("expected not found error; got %v", err)
+		}
+		if n, err := models.CountRecoveryCodes(ctx, user.UUID); err != nil || n != 0 {
+			t.Errorf("expected recovery codes to be deleted; got %d, err %v", n, err)
+		}
+	})
+}
@@ -0,0 +1,40 @@
+package models
+
+import (
+	"context"
+	"fmt"
+)
+
+// Usage is how much a user stores. Deleted items don't count.
+type Usage struct {
+	Items int   `json:"items"`
+	Bytes int64 `json:"bytes"`
+}
+
+// Add sums two Usages. Pass a negated Usage to subtract.
+func (u Usage) Add(other Usage) Usage {
+	return Usage{Items: u.Items + other.Items, Bytes: u.Bytes + other.Bytes}
+}
+
+// Negate flips the sign of each field.
+func (u Usage) Negate() Usage {
+	return Usage{Items: -u.Items, Bytes: -u.Bytes}
+}
+
+// LoadUsage totals the items of a user.
+func LoadUsage(ctx context.Context, userUUID string) (usage Usage, err error) {
+	if userUUID == "" {
+		err = validationError{fmt.Errorf("user uuid is empty")}
+		return
+	}
+	usage, err = _Repos.Items.Usage(ctx, userUUID)
+	return
+}
+
+// Usage is what the Item adds to its user's Usage.
+func (i *Item) Usage() Usage {
+	if i.Deleted {
+		return Usage{}
+	}
+	return Usage{Items: 1, Bytes: int64(len(i.Content))}
+}
@@ -1,6 +1,10 @@
 package models
 
 import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
 	"fmt"
 	"strings"
 	"time"
@@ -35,70 +39,34 @@ func NewUser() *User {
 		PwAlg:     "sha512",
 		PwKeySize: 512,
 		PwFunc:    "pbkdf2",
-		CreatedAt: time.Now().UTC(),
-		UpdatedAt: time.Now().UTC(),
+		CreatedAt: now(),
+		UpdatedAt: now(),
 	}
 }
 
 // LoadUserByUUID fetches a User from the DB.
-func LoadUserByUUID(uuid string) (user *User, err error) {
+func LoadUserByUUID(ctx context.Context, uuid string) (user *User, err error) {
 	if uuid == "" {
 		err = validationError{fmt.Errorf("uuid is empty")}
 		return
 	}
-	user = NewUser() // can't be nil to start out
-	if err = user.fetchHydrate(`SELECT * FROM users WHERE uuid = ?`, uuid); err != nil {
-		user = nil
-	}
+	user, err = _Repos.Users.FindByUUID(ctx, uuid)
 	return
 }
 
-// LoadByEmail populates the user fields with a DB lookup.
-func LoadUserByEmail(email string) (user *User, err error) {
+// LoadByEmail populates the user fields with a DB lookup. The email address
+// matches in any case.
+func LoadUserByEmail(ctx context.Context, email string) (user *User, err error) {
 	if verr := ValidateEmail(email); verr != nil {
 		err = verr
 		return
 	}
-	user = NewUser()
-	if err = user.fetchHydrate("SELECT * FROM users WHERE email=?", email); err != nil {
-		user = nil
-	}
-	return
-}
-
-// LoadUserByEmailAndPassword populates user fields by looking up the user email
-// and hashed password.
-func LoadUserByEmailAndPassword(email, password string) (user *User, err error) {
-	if err = ValidateEmail(email); err != nil {
-		return
-	} else if err = ValidatePassword(password); err != nil {
-		return
-	}
-	user = NewUser()
-	if err = user.fetchHydrate(
-		"SELECT * FROM users WHERE email=? AND password=?",
-		email, password,
-	); err != nil {
-		user = nil
-	}
-	return
-}
-
-func (u *User) fetchHydrate(query string, args ...interface{}) (err error) {
-	if u == nil {
-		u = NewUser()
-	}
-	if err = db.SelectStruct(u, query, args...); err != nil {
-		logger.LogIfDebug(err)
-		return
-	}
-	// Assume the password stored in the DB is hashed.
-	u.passwordHashed = true
+	user, err = _Repos.Users.FindByEmail(ctx, email)
 	return
 }
 
 // Create saves the user to the DB.
-func (u *User) Create() (err error) {
+func (u *User) Create(ctx context.Context) (err error) {
 	if u.UUID != "" {
 		err = validationError{fmt.Errorf("cannot recreate existing user")}
 		return
@@ -109,7 +77,7 @@ func (u *User) Create() (err error) {
 		return
 	}
 
-	if exists, xerr := u.Exists(); xerr != nil {
+	if exists, xerr := u.Exists(ctx); xerr != nil {
 		err = xerr
 		return
 	} else if exists {
@@ -119,31 +87,29 @@ func (u *User) Create() (err error) {
 
 	id := uuid.New()
 	u.UUID = uuid.Must(id, nil).String()
-	u.Password = Hash(u.Password)
-	u.CreatedAt = time.Now().UTC()
-
-	err = db.Query(
-		strings.TrimSpace(`
-		INSERT INTO users (
-			uuid, email, password, pw_func, pw_alg, pw_cost, pw_key_size,
-			pw_nonce, pw_salt, created_at, updated_at
-		) VALUES (?,?,?,?,?,?,?,?,?,?,?)`),
-		u.UUID, u.Email, u.Password, u.PwFunc, u.PwAlg, u.PwCost, u.PwKeySize,
-		u.PwNonce, u.PwSalt, u.CreatedAt, u.UpdatedAt,
-	)
+	password := u.Password
+	if u.Password, err = HashPassword(u.Password); err != nil {
+		return
+	}
+	u.CreatedAt = now()
 
-	if err != nil {
+	if err = _Repos.Users.Create(ctx, u); err != nil {
 		logger.LogIfDebug(err)
+		// such as when another request registered the address in between.
+		u.UUID, u.Password, u.CreatedAt = "", password, time.Time{}
 		return
 	}
 	u.passwordHashed = true
 	return err
 }
 
-// Update performs a db update on the User.
-func (u *User) Update(updates User) (err error) {
+// Update performs a db update on the User. The password in the updates should
+// already be hashed.
+func (u *User) Update(ctx context.Context, updates User) (err error) {
 	if u.UUID == "" {
 		return fmt.Errorf("Unknown user")
+	} else if updates.Password == "" {
+		return validationError{fmt.Errorf("password cannot be empty")}
 	}
 	dupe := u.makeUnsafeCopy() // in case of db error, rollback in-memory.
 
@@ -154,44 +120,147 @@ func (u *User) Update(updates User) (err error) {
 	u.PwKeySize = updates.PwKeySize
 	u.PwNonce = updates.PwNonce
 	u.PwSalt = updates.PwSalt
-	u.UpdatedAt = time.Now().UTC()
+	u.UpdatedAt = now()
+
+	if err = _Repos.Users.Update(ctx, u); err != nil {
+		logger.LogIfDebug(err)
+		*u = dupe
+		return err
+	}
+	u.passwordHashed = true
+	return nil
+}
 
-	err = db.Query(
-		strings.TrimSpace(`
-		UPDATE users
-		SET password=?, pw_alg=?, pw_cost=?, pw_func=?, pw_key_size=?, pw_nonce=?, pw_salt=?, updated_at=?
-		WHERE uuid=?`),
+// ChangeEmail moves the user to a new email address. Clients derive their keys
+// from the email address, so the updates should also have the hash of the
+// password, and the nonce, that the client derived for the new address. The
+// salt is cleared, so that it's derived from the new address too. It's a
+// validation error if the new address is already registered, in any case. If
+// this is part of a bigger transaction, then the caller should also roll back
+// the User if the transaction fails.
+func (u *User) ChangeEmail(ctx context.Context, updates User) (err error) {
+	if u.UUID == "" {
+		return fmt.Errorf("Unknown user")
+	} else if err = ValidateEmail(updates.Email); err != nil {
+		return
+	} else if updates.Password == "" {
+		return validationError{fmt.Errorf("password cannot be empty")}
+	}
+	dupe := u.makeUnsafeCopy() // in case of db error, rollback in-memory.
 
-		u.Password, u.PwAlg, u.PwCost, u.PwFunc, u.PwKeySize, u.PwNonce, u.PwSalt, u.UpdatedAt,
-		u.UUID,
-	)
+	u.Email = updates.Email
+	u.Password = updates.Password
+	u.PwNonce = updates.PwNonce
+	u.PwSalt = ""
+	if updates.PwCost > 0 {
+		u.PwCost = updates.PwCost
+	}
+	u.UpdatedAt = now()
 
+	err = db.WithTx(ctx, func(ctx context.Context) (err error) {
+		var exists bool
+		if exists, err = _Repos.Users.EmailExists(ctx, u.Email); err != nil {
+			return
+		} else if exists {
+			return validationError{fmt.Errorf("email is already registered")}
+		}
+		return _Repos.Users.UpdateEmail(ctx, u)
+	})
 	if err != nil {
 		logger.LogIfDebug(err)
-		u = &dupe
-		return err
+		*u = dupe
+		return
 	}
 	u.passwordHashed = true
-	return nil
+	return
+}
+
+// _UserDataQueries delete everything else that belongs to a user, other than
+// items. Each one takes the user's UUID, except for auth_failures, which is
+// keyed by email address.
+var _UserDataQueries = []string{
+	"DELETE FROM refresh_tokens WHERE session_uuid IN (SELECT uuid FROM sessions WHERE user_uuid=?)",
+	"DELETE FROM sessions WHERE user_uuid=?",
+	"DELETE FROM revoked_sessions WHERE user_uuid=?",
+	"DELETE FROM recovery_codes WHERE user_uuid=?",
+	"DELETE FROM two_factor WHERE user_uuid=?",
+	"DELETE FROM email_verifications WHERE user_uuid=?",
+	"DELETE FROM extension_health WHERE user_uuid=?",
+	"DELETE FROM outbound_rejections WHERE user_uuid=?",
+	"DELETE FROM quarantined_items WHERE user_uuid=?",
+	"DELETE FROM webhook_deliveries WHERE user_uuid=?",
+}
+
+// Delete removes the user for good, along with all of the user's items,
+// sessions, webhook deliveries and other data, in one transaction.
+func (u *User) Delete(ctx context.Context) (err error) {
+	if u.UUID == "" {
+		return fmt.Errorf("Unknown user")
+	}
+	err = db.WithTx(ctx, func(ctx context.Context) (err error) {
+		if err = _Repos.Items.Purge(ctx, u.UUID); err != nil {
+			return
+		}
+		for _, query := range _UserDataQueries {
+			if err = db.Exec(ctx, query, u.UUID); err != nil {
+				return
+			}
+		}
+		if err = db.Exec(ctx, "DELETE FROM auth_failures WHERE email=?", u.Email); err != nil {
+			return
+		}
+		err = _Repos.Users.Delete(ctx, u.UUID)
+		return
+	})
+	if err != nil {
+		logger.LogIfDebug(err)
+	}
+	return
 }
 
 // Exists checks if the user exists in the DB.
-func (u *User) Exists() (bool, error) {
+func (u *User) Exists(ctx context.Context) (bool, error) {
 	if err := ValidateEmail(u.Email); err != nil {
 		// swallow this error, it doesn't answer the question asked by this method.
 		return false, nil
 	}
-	var id string
-	return db.SelectExists(
-		&id,
-		"SELECT uuid FROM users WHERE email=?",
-		u.Email,
-	)
+	return _Repos.Users.EmailExists(ctx, u.Email)
+}
+
+// VerifyPassword checks a password against the stored hash. A legacy hash,
+// or one with outdated parameters, is replaced with a new hash of the password
+// once it's verified.
+func (u *User) VerifyPassword(ctx context.Context, password string) (ok bool, err error) {
+	var rehash bool
+	if ok, rehash = checkPassword(u.Password, password); !ok || !rehash {
+		return
+	}
+	var hashed string
+	if hashed, err = HashPassword(password); err != nil {
+		return
+	}
+	updates := u.makeUnsafeCopy()
+	updates.Password = hashed
+	err = u.Update(ctx, updates)
+	return
+}
+
+// PasswordFingerprint identifies the stored password hash without revealing
+// it. It goes in tokens, so that changing the password invalidates them.
+func (u *User) PasswordFingerprint() string {
+	sum := sha256.Sum256([]byte("standardnotes token:" + u.Password))
+	return hex.EncodeToString(sum[:])
 }
 
-// Validate checks the jwt for a valid password.
-func (u *User) Validate(password string) bool {
-	return password == u.Password
+// Validate checks the password fingerprint from a jwt. Tokens made before
+// passwords were hashed with HashPassword have the legacy hash instead, which
+// is accepted until the password is rehashed.
+func (u *User) Validate(fingerprint string) bool {
+	if subtle.ConstantTimeCompare([]byte(fingerprint), []byte(u.PasswordFingerprint())) == 1 {
+		return true
+	}
+	return !strings.HasPrefix(u.Password, "$argon2id$") &&
+		subtle.ConstantTimeCompare([]byte(fingerprint), []byte(u.Password)) == 1
 }
 
 // MakeSaferCopy duplicates the User value, but excludes some sensitive fields.
@@ -224,21 +293,37 @@ func (u *User) PwHashState() PwHash {
 	return PwHash{Value: u.Password, Hashed: u.passwordHashed}
 }
 
-func (u *User) LoadActiveItems() (items Items, err error) {
-	items, err = queryItems(
-		`SELECT * FROM items
-			WHERE user_uuid=? AND content_type IS NOT '' AND deleted = ?
-			ORDER BY updated_at DESC`,
-		u.UUID, false,
-	)
+func (u *User) LoadActiveItems(ctx context.Context) (items Items, err error) {
+	items, err = _Repos.Items.FindActive(ctx, u.UUID)
+	return
+}
+
+func (u *User) LoadActiveExtensionItems(ctx context.Context) (items Items, err error) {
+	items, err = _Repos.Items.FindActiveByContentType(ctx, u.UUID, "SF|Extension")
+	return
+}
+
+// A Backup is an export of a User's account, in the same format that clients
+// use for their own backups. Item contents stay encrypted by the client, so the
+// user's password is needed to make use of it.
+type Backup struct {
+	Items      Items       `json:"items"`
+	AuthParams PwGenParams `json:"auth_params"`
+}
+
+// MakeBackup exports the User's active items along with the parameters that
+// the client needs to decrypt them.
+func (u *User) MakeBackup(ctx context.Context) (out Backup, err error) {
+	if out.Items, err = u.LoadActiveItems(ctx); err != nil {
+		return
+	}
+	out.AuthParams = MakePwGenParams(*u)
 	return
 }
 
-func (u *User) LoadActiveExtensionItems() (items Items, err error) {
-	items, err = queryItems(
-		`SELECT * FROM items WHERE user_uuid=? AND content_type = ? AND deleted = ?  ORDER BY updated_at DESC`,
-		u.UUID, "SF|Extension", false,
-	)
+// LoadUserUUIDs fetches the UUID of every User.
+func LoadUserUUIDs(ctx context.Context) (out []string, err error) {
+	out, err = _Repos.Users.ListUUIDs(ctx)
 	return
 }
 
@@ -248,21 +333,10 @@ const UserItemMaxPageSize = 1000
 // LoadItemsAfter fetches user items from the DB. If gte is true,  then it
 // performs a >= comparison on the updated at field. Otherwise, it does a >
 // comparison.
-func (u *User) LoadItemsAfter(date time.Time, gte bool, contentType string, limit int) (items Items, more bool, err error) {
+func (u *User) LoadItemsAfter(ctx context.Context, date time.Time, gte bool, contentType string, limit int) (items Items, more bool, err error) {
 	// TODO: add condition: `WHERE content_type = req.ContentType`
-	var found []Item
-	if gte {
-		found, err = queryItems(
-			`SELECT * FROM items WHERE user_uuid=? AND updated_at >= ? ORDER BY updated_at ASC LIMIT ?`,
-			u.UUID, date, limit+1,
-		)
-	} else {
-		found, err = queryItems(
-			`SELECT * FROM items WHERE user_uuid=? AND updated_at > ?  ORDER BY updated_at ASC LIMIT ?`,
-			u.UUID, date, limit+1,
-		)
-
-	}
+	var found Items
+	found, err = _Repos.Items.FindUpdatedAfter(ctx, u.UUID, date, gte, limit+1)
 
 	more = len(found) > limit
 	if more {
@@ -276,13 +350,10 @@ func (u *User) LoadItemsAfter(date time.Time, gte bool, contentType string, limi
 
 // LoadAllItems fetches all the user's items up to limit. Typically, this is
 // used for initial item syncs.
-func (u *User) LoadAllItems(contentType string, limit int) (items Items, more bool, err error) {
+func (u *User) LoadAllItems(ctx context.Context, contentType string, limit int) (items Items, more bool, err error) {
 	var found Items
 	// TODO: add condition: `WHERE content_type = req.ContentType`
-	found, err = queryItems(
-		"SELECT * FROM items WHERE user_uuid=? AND deleted = ? ORDER BY updated_at ASC LIMIT ?",
-		u.UUID, false, limit+1,
-	)
+	found, err = _Repos.Items.FindAll(ctx, u.UUID, limit+1)
 
 	more = len(found) > limit
 	if more {
@@ -292,17 +363,3 @@ func (u *User) LoadAllItems(contentType string, limit int) (items Items, more bo
 	}
 	return
 }
-
-func queryItems(query string, args ...interface{}) (items Items, err error) {
-	found := make([]Item, 0)
-	err = db.SelectMany(func(iterator db.Iterator) (e error) {
-		item := &Item{}
-		if e = item.detuplize(iterator); e != nil {
-			return
-		}
-		found = append(found, *item)
-		return
-	}, query, args...)
-	items = found
-	return
-}
@@ -1,17 +1,21 @@
 package models_test
 
 import (
+	"context"
 	"database/sql"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/rafaelespinoza/standardnotes/internal/db"
+	"github.com/rafaelespinoza/standardnotes/internal/db/dbtest"
 	"github.com/rafaelespinoza/standardnotes/internal/errs"
 	"github.com/rafaelespinoza/standardnotes/internal/models"
 )
 
 func init() {
-	db.Init(":memory:")
+	dbtest.Init()
 }
 
 func TestLoadUser(t *testing.T) {
@@ -22,19 +26,16 @@ func TestLoadUser(t *testing.T) {
 		saved.Email = t.Name() + "@example.com"
 		saved.Password = "testpassword123"
 		saved.PwNonce = "stub_password_nonce"
-		if err := saved.Create(); err != nil {
+		if err := saved.Create(context.Background()); err != nil {
 			t.Fatalf("unexpected error; %v", err)
 		}
 
 		tests := []userLoader{
 			func() (*models.User, error) {
-				return models.LoadUserByUUID(saved.UUID)
+				return models.LoadUserByUUID(context.Background(), saved.UUID)
 			},
 			func() (*models.User, error) {
-				return models.LoadUserByEmail(saved.Email)
-			},
-			func() (*models.User, error) {
-				return models.LoadUserByEmailAndPassword(saved.Email, saved.Password)
+				return models.LoadUserByEmail(context.Background(), saved.Email)
 			},
 		}
 
@@ -56,19 +57,10 @@ func TestLoadUser(t *testing.T) {
 		t.Run("empty inputs", func(t *testing.T) {
 			tests := []userLoader{
 				func() (*models.User, error) {
-					return models.LoadUserByUUID("")
+					return models.LoadUserByUUID(context.Background(), "")
 				},
 				func() (*models.User, error) {
-					return models.LoadUserByEmail("")
-				},
-				func() (*models.User, error) {
-					return models.LoadUserByEmailAndPassword("foo@example.com", "")
-				},
-				func() (*models.User, error) {
-					return models.LoadUserByEmailAndPassword("", "testpassword123")
-				},
-				func() (*models.User, error) {
-					return models.LoadUserByEmailAndPassword("", "")
+					return models.LoadUserByEmail(context.Background(), "")
 				},
 			}
 
@@ -90,7 +82,7 @@ func TestLoadUser(t *testing.T) {
 		t.Run("not found", func(t *testing.T) {
 			tests := []userLoader{
 				func() (*models.User, error) {
-					return models.LoadUserByUUID("not-in-the-db")
+					return models.LoadUserByUUID(context.Background(), "not-in-the-db")
 				},
 			}
 
@@ -111,10 +103,10 @@ func TestUserExists(t *testing.T) {
 		user.Email = t.Name() + "@example.com"
 		user.Password = "testpassword123"
 		user.PwNonce = "stub_password_nonce"
-		if err := user.Create(); err != nil {
+		if err := user.Create(context.Background()); err != nil {
 			t.Fatalf("unexpected error; %v", err)
 		}
-		exists, err := user.Exists()
+		exists, err := user.Exists(context.Background())
 		if err != nil {
 			t.Errorf("unexpected error; got %v", err)
 		}
@@ -126,7 +118,7 @@ func TestUserExists(t *testing.T) {
 	t.Run("false", func(t *testing.T) {
 		t.Run("invalid email", func(t *testing.T) {
 			user := models.NewUser()
-			exists, err := user.Exists()
+			exists, err := user.Exists(context.Background())
 			if err != nil {
 				t.Errorf("unexpected error; got %v", err)
 			}
@@ -138,7 +130,7 @@ func TestUserExists(t *testing.T) {
 		t.Run("no uuid", func(t *testing.T) {
 			user := models.NewUser()
 			user.Email = t.Name() + "@example.com"
-			exists, err := user.Exists()
+			exists, err := user.Exists(context.Background())
 			if err != nil {
 				t.Errorf("unexpected error; got %v", err)
 			}
@@ -150,7 +142,7 @@ func TestUserExists(t *testing.T) {
 		t.Run("does not exist", func(t *testing.T) {
 			user := models.NewUser()
 			user.UUID = "1234"
-			exists, err := user.Exists()
+			exists, err := user.Exists(context.Background())
 			if err != nil {
 				t.Errorf("unexpected error; got %v", err)
 			}
@@ -205,18 +197,18 @@ func TestUserCreate(t *testing.T) {
 		user := models.NewUser()
 		user.Email = t.Name() + "@example.com"
 		user.Password = plaintextPassword
-		if err := user.Create(); err != nil {
+		if err := user.Create(context.Background()); err != nil {
 			t.Error(err)
 			return
 		}
 		if user.UUID == "" {
 			t.Error("UUID should not be empty")
 		}
-		if user.Password != models.Hash(plaintextPassword) {
-			t.Errorf(
-				"should Hash password;\ngot: %q\nexp: %q",
-				user.Password, models.Hash(plaintextPassword),
-			)
+		if !strings.HasPrefix(user.Password, "$argon2id$") {
+			t.Errorf("should hash password with argon2id; got %q", user.Password)
+		}
+		if ok, err := user.VerifyPassword(context.Background(), plaintextPassword); err != nil || !ok {
+			t.Errorf("should verify password; got ok=%t, err=%v", ok, err)
 		}
 		if user.CreatedAt.IsZero() {
 			t.Error("should set CreatedAt")
@@ -250,7 +242,7 @@ func TestUserCreate(t *testing.T) {
 			},
 		}
 		for i, test := range tests {
-			err := test.user.Create()
+			err := test.user.Create(context.Background())
 			if err == nil {
 				t.Errorf("test [%d]; expected error", i)
 			}
@@ -261,7 +253,7 @@ func TestUserCreate(t *testing.T) {
 			existingUser := models.NewUser()
 			existingUser.Email = email
 			existingUser.Password = plaintextPassword
-			if err := existingUser.Create(); err != nil {
+			if err := existingUser.Create(context.Background()); err != nil {
 				t.Fatal(err)
 				return
 			}
@@ -269,7 +261,7 @@ func TestUserCreate(t *testing.T) {
 			user := models.NewUser()
 			user.Email = email
 			user.Password = plaintextPassword
-			if err := user.Create(); err == nil {
+			if err := user.Create(context.Background()); err == nil {
 				t.Error("expected error")
 			}
 			if user.UUID == "" {
@@ -278,12 +270,119 @@ func TestUserCreate(t *testing.T) {
 
 			// further troubleshooting...
 			t.Error("user UUID should be empty")
-			if wtf, err := models.LoadUserByUUID(user.UUID); err != sql.ErrNoRows {
+			if wtf, err := models.LoadUserByUUID(context.Background(), user.UUID); err != sql.ErrNoRows {
 				t.Errorf("unexpected error; %v", err)
 			} else {
 				t.Errorf("did not expect to find user in db; got %v", wtf)
 			}
 		})
+
+		t.Run("already registered, by a request in between", func(t *testing.T) {
+			ctx := context.Background()
+			existingUser := models.NewUser()
+			existingUser.Email = t.Name() + "@example.com"
+			existingUser.Password = plaintextPassword
+			if err := existingUser.Create(ctx); err != nil {
+				t.Fatal(err)
+			}
+			// skip the check beforehand, as if the other user was saved
+			// right after it.
+			users := models.SQLRepositories().Users
+			racer := models.NewUser()
+			racer.UUID = uuid.New().String()
+			racer.Email = strings.ToUpper(existingUser.Email)
+			racer.Password = plaintextPassword
+			if err := users.Create(ctx, racer); !errs.ValidationError(err) || !strings.Contains(err.Error(), "already registered") {
+				t.Errorf("expected validation error from the unique index; got %v", err)
+			}
+
+			other := models.NewUser()
+			other.Email = "other-" + existingUser.Email
+			other.Password = plaintextPassword
+			if err := other.Create(ctx); err != nil {
+				t.Fatal(err)
+			}
+			other.Email = strings.ToUpper(existingUser.Email)
+			if err := users.UpdateEmail(ctx, other); !errs.ValidationError(err) || !strings.Contains(err.Error(), "already registered") {
+				t.Errorf("expected validation error from the unique index; got %v", err)
+			}
+		})
+	})
+}
+
+func TestUserVerifyPassword(t *testing.T) {
+	const plaintextPassword = "testpassword123"
+
+	t.Run("ok", func(t *testing.T) {
+		user := models.NewUser()
+		user.Email = t.Name() + "@example.com"
+		user.Password = plaintextPassword
+		if err := user.Create(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		hashed := user.Password
+		if ok, err := user.VerifyPassword(context.Background(), plaintextPassword); err != nil {
+			t.Fatal(err)
+		} else if !ok {
+			t.Error("expected password to match")
+		}
+		if user.Password != hashed {
+			t.Error("current hash should not be replaced")
+		}
+		if ok, err := user.VerifyPassword(context.Background(), plaintextPassword[1:]); err != nil {
+			t.Fatal(err)
+		} else if ok {
+			t.Error("expected wrong password to not match")
+		}
+	})
+
+	t.Run("legacy hash", func(t *testing.T) {
+		user := models.NewUser()
+		user.Email = t.Name() + "@example.com"
+		user.Password = plaintextPassword
+		if err := user.Create(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		updates := user.MakeSaferCopy()
+		updates.Password = models.Hash(plaintextPassword)
+		if err := user.Update(context.Background(), updates); err != nil {
+			t.Fatal(err)
+		}
+		legacyClaim := user.Password
+		if !user.Validate(legacyClaim) {
+			t.Error("tokens with the legacy hash should be valid until it's rehashed")
+		}
+
+		if ok, err := user.VerifyPassword(context.Background(), plaintextPassword[1:]); err != nil {
+			t.Fatal(err)
+		} else if ok {
+			t.Error("expected wrong password to not match")
+		}
+		if user.Password != legacyClaim {
+			t.Error("hash should not be replaced after a wrong password")
+		}
+
+		if ok, err := user.VerifyPassword(context.Background(), plaintextPassword); err != nil {
+			t.Fatal(err)
+		} else if !ok {
+			t.Error("expected password to match")
+		}
+		loaded, err := models.LoadUserByUUID(context.Background(), user.UUID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(loaded.Password, "$argon2id$") {
+			t.Errorf("expected legacy hash to be replaced; got %q", loaded.Password)
+		}
+		if ok, err := loaded.VerifyPassword(context.Background(), plaintextPassword); err != nil || !ok {
+			t.Errorf("expected rehashed password to match; got ok=%t, err=%v", ok, err)
+		}
+		if loaded.Validate(legacyClaim) {
+			t.Error("tokens with the legacy hash should be invalid after it's rehashed")
+		}
+		if !loaded.Validate(loaded.PasswordFingerprint()) {
+			t.Error("expected fingerprint of the new hash to be valid")
+		}
 	})
 }
 
@@ -293,7 +392,7 @@ func TestUserLoadActiveItems(t *testing.T) {
 	user.Password = "testpassword123"
 	user.PwNonce = "stub_password_nonce"
 	var err error
-	if err = user.Create(); err != nil {
+	if err = user.Create(context.Background()); err != nil {
 		t.Fatal(err)
 	}
 	initialItems := []models.Item{
@@ -301,12 +400,12 @@ func TestUserLoadActiveItems(t *testing.T) {
 		{UserUUID: user.UUID, Content: "b", ContentType: "b", EncItemKey: "b", AuthHash: "b"},
 	}
 	for i, item := range initialItems {
-		if err := item.Save(); err != nil {
+		if err := item.Save(context.Background()); err != nil {
 			t.Fatalf("could not save existingItems[%d] during setup; %v", i, err)
 		}
 	}
 
-	fetchedItems, err := user.LoadActiveItems()
+	fetchedItems, err := user.LoadActiveItems(context.Background())
 	if err != nil {
 		t.Error(err)
 	}
@@ -381,3 +480,237 @@ func compareUsers(t *testing.T, a, b *models.User, checkTimestamps bool) (ok boo
 	}
 	return
 }
+
+func TestUserDelete(t *testing.T) {
+	ctx := context.Background()
+	newUser := func(t *testing.T, email string) *models.User {
+		t.Helper()
+		user := models.NewUser()
+		user.Email = email
+		user.Password = "testpassword123"
+		if err := user.Create(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if err := (&models.Item{UserUUID: user.UUID, ContentType: "Note", Content: "003:note"}).Create(ctx); err != nil {
+			t.Fatal(err)
+		}
+		return user
+	}
+	user := newUser(t, t.Name()+"@example.com")
+	other := newUser(t, "other-"+t.Name()+"@example.com")
+
+	sess, err := models.CreateSession(ctx, user.UUID, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	refresh, err := models.IssueRefreshToken(ctx, sess.UUID, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tf, err := models.NewTwoFactor(user.UUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = tf.SavePending(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = tf.Enable(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = models.RequireEmailVerification(ctx, user.UUID); err != nil {
+		t.Fatal(err)
+	}
+	health := models.ExtensionHealth{ExtensionUUID: uuid.New().String(), UserUUID: user.UUID}
+	if err = health.Save(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = models.RecordAuthFailure(ctx, user.Email, 5, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	for _, seed := range []struct {
+		query string
+		args  []interface{}
+	}{
+		{
+			query: "INSERT INTO outbound_rejections (user_uuid, url, reason, created_at) VALUES (?,?,?,?)",
+			args:  []interface{}{user.UUID, "http://127.0.0.1", "loopback", time.Now().UTC()},
+		},
+		{
+			query: strings.TrimSpace(`
+			INSERT INTO quarantined_items (
+				uuid, user_uuid, content, content_type, enc_item_key, auth_hash, deleted,
+				created_at, updated_at, reason
+			) VALUES (?,?,?,?,?,?,?,?,?,?)`),
+			args: []interface{}{uuid.New().String(), user.UUID, []byte("003:note"), "Note", "", "", false, time.Now().UTC(), time.Now().UTC(), "test"},
+		},
+	} {
+		if err = db.Exec(ctx, seed.query, seed.args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	deliveries := map[string]string{"user": user.UUID, "other": other.UUID}
+	deliveryIDs := make(map[string]string, len(deliveries))
+	for name, userUUID := range deliveries {
+		deliveryIDs[name] = uuid.New().String()
+		if err = db.Exec(
+			ctx,
+			strings.TrimSpace(`
+			INSERT INTO webhook_deliveries (uuid, event, url, payload, status, next_attempt_at, user_uuid)
+			VALUES (?,?,?,?,?,?,?)`),
+			deliveryIDs[name], "test", "http://127.0.0.1", []byte(`{"data":{"user_uuid":"`+userUUID+`"}}`), "pending", time.Now().UTC(), userUUID,
+		); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err = user.Delete(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// nothing that's keyed by the user is left.
+	for _, test := range []struct {
+		query string
+		arg   string
+	}{
+		{query: "SELECT COUNT(*) FROM users WHERE uuid=?", arg: user.UUID},
+		{query: "SELECT COUNT(*) FROM items WHERE user_uuid=?", arg: user.UUID},
+		{query: "SELECT COUNT(*) FROM sessions WHERE user_uuid=?", arg: user.UUID},
+		{query: "SELECT COUNT(*) FROM refresh_tokens WHERE session_uuid=?", arg: sess.UUID},
+		{query: "SELECT COUNT(*) FROM two_factor WHERE user_uuid=?", arg: user.UUID},
+		{query: "SELECT COUNT(*) FROM recovery_codes WHERE user_uuid=?", arg: user.UUID},
+		{query: "SELECT COUNT(*) FROM email_verifications WHERE user_uuid=?", arg: user.UUID},
+		{query: "SELECT COUNT(*) FROM extension_health WHERE user_uuid=?", arg: user.UUID},
+		{query: "SELECT COUNT(*) FROM outbound_rejections WHERE user_uuid=?", arg: user.UUID},
+		{query: "SELECT COUNT(*) FROM quarantined_items WHERE user_uuid=?", arg: user.UUID},
+		{query: "SELECT COUNT(*) FROM auth_failures WHERE email=?", arg: user.Email},
+		{query: "SELECT COUNT(*) FROM webhook_deliveries WHERE user_uuid=?", arg: user.UUID},
+	} {
+		var n int
+		if err = db.SelectOne(ctx, func(row db.Iterator) error { return row.Scan(&n) }, test.query, test.arg); err != nil {
+			t.Fatal(err)
+		}
+		if n != 0 {
+			t.Errorf("expected no rows for %q; got %d", test.query, n)
+		}
+	}
+	if _, err = models.LoadUserByUUID(ctx, user.UUID); !errs.NotFoundError(err) {
+		t.Errorf("expected user to be deleted; got %v", err)
+	}
+	if _, err = models.LoadSession(ctx, sess.UUID); !errs.NotFoundError(err) {
+		t.Errorf("expected session to be deleted; got %v", err)
+	}
+	if _, err = models.UseRefreshToken(ctx, refresh.Token, time.Now()); !errs.ValidationError(err) {
+		t.Errorf("expected refresh token to be deleted; got %v", err)
+	}
+	if _, err = models.LoadTwoFactor(ctx, user.UUID); !errs.NotFoundError(err) {
+		t.Errorf("expected second factor to be deleted; got %v", err)
+	}
+	if n, err := models.CountRecoveryCodes(ctx, user.UUID); err != nil || n != 0 {
+		t.Errorf("expected recovery codes to be deleted; got %d, err %v", n, err)
+	}
+	if items, err := user.LoadActiveItems(ctx); err != nil || len(items) != 0 {
+		t.Errorf("expected items to be deleted; got %d, err %v", len(items), err)
+	}
+
+	// other users are left alone.
+	if _, err = models.LoadUserByUUID(ctx, other.UUID); err != nil {
+		t.Errorf("did not expect error; got %v", err)
+	}
+	if items, err := other.LoadActiveItems(ctx); err != nil || len(items) != 1 {
+		t.Errorf("expected other user's items to be kept; got %d, err %v", len(items), err)
+	}
+	var n int
+	if err = db.SelectOne(ctx, func(row db.Iterator) error { return row.Scan(&n) },
+		"SELECT COUNT(*) FROM webhook_deliveries WHERE uuid=?", deliveryIDs["other"],
+	); err != nil || n != 1 {
+		t.Errorf("expected other user's webhook delivery to be kept; got %d, err %v", n, err)
+	}
+}
+
+func TestUserChangeEmail(t *testing.T) {
+	ctx := context.Background()
+	newUser := func(t *testing.T, email string) *models.User {
+		t.Helper()
+		user := models.NewUser()
+		user.Email = email
+		user.Password = "testpassword123"
+		user.PwNonce = "stub_password_nonce"
+		user.PwSalt = "stub_password_salt"
+		if err := user.Create(ctx); err != nil {
+			t.Fatal(err)
+		}
+		return user
+	}
+	hashed, err := models.HashPassword("newpassword123")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("ok", func(t *testing.T) {
+		user := newUser(t, t.Name()+"@example.com")
+		before := models.MakePwGenParams(*user)
+		updates := user.MakeSaferCopy()
+		updates.Email = "changed-" + t.Name() + "@example.com"
+		updates.Password = hashed
+		updates.PwNonce = "new_nonce"
+		updates.PwCost = 420000
+		if err := user.ChangeEmail(ctx, updates); err != nil {
+			t.Fatal(err)
+		}
+		if user.Email != updates.Email {
+			t.Errorf("wrong email; got %q, expected %q", user.Email, updates.Email)
+		}
+
+		loaded, err := models.LoadUserByEmail(ctx, updates.Email)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if loaded.UUID != user.UUID || loaded.PwCost != 420000 || loaded.PwSalt != "" {
+			t.Errorf("email change not saved; got %+v", loaded)
+		}
+		if ok, err := loaded.VerifyPassword(ctx, "newpassword123"); err != nil || !ok {
+			t.Errorf("password not updated; got ok=%t, err=%v", ok, err)
+		}
+		after := models.MakePwGenParams(*loaded)
+		if after.Identifier != updates.Email || after.PwNonce != "new_nonce" {
+			t.Errorf("wrong params; got %+v", after)
+		}
+		if after.PwSalt == before.PwSalt || after.PwSalt == "" {
+			t.Errorf("expected salt to be derived from the new address; got %q", after.PwSalt)
+		}
+		if _, err = models.LoadUserByEmail(ctx, t.Name()+"@example.com"); !errs.NotFoundError(err) {
+			t.Errorf("expected old address to be free; got %v", err)
+		}
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		user := newUser(t, t.Name()+"@example.com")
+		other := newUser(t, "other-"+t.Name()+"@example.com")
+		tests := []struct {
+			name  string
+			email string
+		}{
+			{name: "taken", email: other.Email},
+			{name: "taken, in another case", email: strings.ToUpper(other.Email)},
+			{name: "invalid", email: "not an email address"},
+		}
+		for _, test := range tests {
+			updates := user.MakeSaferCopy()
+			updates.Email = test.email
+			updates.Password = hashed
+			updates.PwNonce = "new_nonce"
+			if err := user.ChangeEmail(ctx, updates); !errs.ValidationError(err) {
+				t.Errorf("test %q; expected validation error; got %v", test.name, err)
+			}
+			if user.Email != t.Name()+"@example.com" || user.PwNonce != "stub_password_nonce" {
+				t.Errorf("test %q; expected user to be left alone; got %+v", test.name, user)
+			}
+		}
+		if loaded, err := models.LoadUserByUUID(ctx, user.UUID); err != nil {
+			t.Fatal(err)
+		} else if loaded.Email != user.Email || loaded.PwNonce != "stub_password_nonce" {
+			t.Errorf("expected stored user to be left alone; got %+v", loaded)
+		}
+	})
+}
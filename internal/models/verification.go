@@ -0,0 +1,65 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/rafaelespinoza/standardnotes/internal/db"
+)
+
+// RequireEmailVerification marks the user's email address as unverified. The
+// user should not be able to sign in until the address is verified. It may be
+// called again, such as when the address changes.
+func RequireEmailVerification(ctx context.Context, userUUID string) error {
+	if len(userUUID) < MinIDLength {
+		return validationError{fmt.Errorf("user_uuid too short")}
+	}
+	return setEmailVerified(ctx, userUUID, false)
+}
+
+// EmailVerified tells you whether or not the user's email address has been
+// verified. Accounts that were never required to verify, such as those created
+// before verification was turned on, are considered verified. Registration adds
+// the record of an account that has to verify in the same transaction as the
+// account, so every new account that should have one does.
+func EmailVerified(ctx context.Context, userUUID string) (verified bool, err error) {
+	var exists bool
+	if exists, err = db.SelectExists(ctx,
+		&verified,
+		"SELECT verified FROM email_verifications WHERE user_uuid=?",
+		userUUID,
+	); err != nil {
+		return
+	} else if !exists {
+		verified = true
+	}
+	return
+}
+
+// MarkEmailVerified records that the user has verified their email address.
+func MarkEmailVerified(ctx context.Context, userUUID string) error {
+	return setEmailVerified(ctx, userUUID, true)
+}
+
+// setEmailVerified updates the user's verification record, or adds one if
+// there isn't one yet.
+func setEmailVerified(ctx context.Context, userUUID string, verified bool) error {
+	now := time.Now().UTC()
+	return db.WithTx(ctx, func(ctx context.Context) (err error) {
+		var n int64
+		if n, err = db.ExecAffected(ctx,
+			"UPDATE email_verifications SET verified=?, updated_at=? WHERE user_uuid=?",
+			verified, now, userUUID,
+		); err != nil || n > 0 {
+			return
+		}
+		return db.Exec(ctx,
+			strings.TrimSpace(`
+			INSERT INTO email_verifications (user_uuid, verified, created_at, updated_at)
+			VALUES (?,?,?,?)`),
+			userUUID, verified, now, now,
+		)
+	})
+}
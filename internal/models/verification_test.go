@@ -0,0 +1,61 @@
+package models_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/rafaelespinoza/standardnotes/internal/models"
+)
+
+func TestEmailVerified(t *testing.T) {
+	t.Run("without a record", func(t *testing.T) {
+		// such as an account from before verification was required.
+		user := models.NewUser()
+		user.Email = t.Name() + "@example.com"
+		user.Password = "testpassword123"
+		if err := user.Create(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if verified, err := models.EmailVerified(context.Background(), user.UUID); err != nil {
+			t.Errorf("unexpected error; %v", err)
+		} else if !verified {
+			t.Error("expected user to be considered verified")
+		}
+	})
+
+	t.Run("required", func(t *testing.T) {
+		user := models.NewUser()
+		user.Email = t.Name() + "@example.com"
+		user.Password = "testpassword123"
+		if err := user.Create(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if err := models.RequireEmailVerification(context.Background(), user.UUID); err != nil {
+			t.Fatal(err)
+		}
+		if verified, err := models.EmailVerified(context.Background(), user.UUID); err != nil {
+			t.Errorf("unexpected error; %v", err)
+		} else if verified {
+			t.Error("expected user to be unverified")
+		}
+
+		if err := models.MarkEmailVerified(context.Background(), user.UUID); err != nil {
+			t.Fatal(err)
+		}
+		if verified, err := models.EmailVerified(context.Background(), user.UUID); err != nil {
+			t.Errorf("unexpected error; %v", err)
+		} else if !verified {
+			t.Error("expected user to be verified")
+		}
+
+		// such as after changing the email address.
+		if err := models.RequireEmailVerification(context.Background(), user.UUID); err != nil {
+			t.Fatal(err)
+		}
+		if verified, err := models.EmailVerified(context.Background(), user.UUID); err != nil {
+			t.Errorf("unexpected error; %v", err)
+		} else if verified {
+			t.Error("expected user to be unverified again")
+		}
+	})
+}
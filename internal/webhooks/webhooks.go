@@ -0,0 +1,320 @@
+// Package webhooks notifies external HTTP endpoints about server events. Events
+// are saved to the DB as pending deliveries, which are sent by a background
+// loop that retries failed deliveries with backoff.
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rafaelespinoza/standardnotes/internal/config"
+	"github.com/rafaelespinoza/standardnotes/internal/db"
+	"github.com/rafaelespinoza/standardnotes/internal/logger"
+)
+
+// Names of events that can be delivered.
+const (
+	EventUserRegistered  = "user.registered"
+	EventPasswordChanged = "user.password_changed"
+	EventEmailChanged    = "user.email_changed"
+	EventUserDeleted     = "user.deleted"
+	EventSignInLockout   = "user.sign_in_lockout"
+	EventItemsSynced     = "items.synced"
+)
+
+// Delivery states.
+const (
+	StatusPending   = "pending"
+	StatusDelivered = "delivered"
+	StatusFailed    = "failed"
+)
+
+const (
+	// _MaxAttempts is how many times a delivery is tried before giving up.
+	_MaxAttempts = 6
+	// _BaseBackoff is the wait before the first retry. It doubles after each
+	// subsequent failed attempt.
+	_BaseBackoff = 30 * time.Second
+	// _PollInterval is how often the delivery loop checks for pending work
+	// when it hasn't been notified of any new events.
+	_PollInterval = 10 * time.Second
+	_BatchSize    = 50
+)
+
+// Request headers sent with each delivery.
+const (
+	HeaderEvent     = "X-Standardnotes-Event"
+	HeaderDelivery  = "X-Standardnotes-Delivery"
+	HeaderTimestamp = "X-Standardnotes-Timestamp"
+	HeaderSignature = "X-Standardnotes-Signature"
+)
+
+// A Delivery is one event sent, or to be sent, to one webhook URL.
+type Delivery struct {
+	UUID          string
+	Event         string
+	URL           string
+	Payload       []byte
+	Status        string
+	Attempts      int
+	ResponseCode  int
+	LastError     string
+	NextAttemptAt time.Time
+	CreatedAt     time.Time
+	UpdatedAt     time.Time
+}
+
+// envelope is the request body of a delivery.
+type envelope struct {
+	ID        string      `json:"id"`
+	Event     string      `json:"event"`
+	CreatedAt time.Time   `json:"created_at"`
+	Data      interface{} `json:"data"`
+}
+
+// wake nudges a running delivery loop so new events don't wait for the next
+// poll. It's buffered so Publish never blocks.
+var wake = make(chan struct{}, 1)
+
+// Publish saves a pending delivery of the event for each configured webhook
+// interested in it. It does not send anything itself, that's done by Run.
+// Errors are logged rather than returned so that callers, which are doing
+// something more important, can keep going. The deliveries are saved with
+// userUUID, the user that the event is about, if any, so that they're deleted
+// along with the user.
+func Publish(ctx context.Context, event, userUUID string, data interface{}) {
+	hooks := subscribers(event)
+	if len(hooks) < 1 {
+		return
+	}
+	now := time.Now().UTC()
+	for _, hook := range hooks {
+		id := uuid.New().String()
+		payload, err := json.Marshal(envelope{ID: id, Event: event, CreatedAt: now, Data: data})
+		if err != nil {
+			log.Printf("webhooks: could not encode %s event; %v\n", event, err)
+			return
+		}
+		if err = db.Exec(
+			ctx,
+			strings.TrimSpace(`
+			INSERT INTO webhook_deliveries (
+				uuid, event, url, payload, status, attempts, response_code, last_error,
+				next_attempt_at, created_at, updated_at, user_uuid
+			) VALUES (?,?,?,?,?,?,?,?,?,?,?,?)`),
+			id, event, hook.URL, payload, StatusPending, 0, 0, "",
+			now, now, now, userUUID,
+		); err != nil {
+			log.Printf("webhooks: could not save %s delivery; %v\n", event, err)
+		}
+	}
+	select {
+	case wake <- struct{}{}:
+	default:
+	}
+}
+
+func subscribers(event string) (out []config.Webhook) {
+	for _, hook := range config.Conf.Webhooks {
+		if hook.URL == "" {
+			continue
+		}
+		if len(hook.Events) < 1 {
+			out = append(out, hook)
+			continue
+		}
+		for _, name := range hook.Events {
+			if name == event || name == "*" {
+				out = append(out, hook)
+				break
+			}
+		}
+	}
+	return
+}
+
+var (
+	runMtx  sync.Mutex
+	running bool
+)
+
+// Run sends pending deliveries until the done channel is closed. Only one
+// delivery loop runs at a time; calling it again while it's running is a no-op.
+func Run(done <-chan struct{}) {
+	runMtx.Lock()
+	if running {
+		runMtx.Unlock()
+		return
+	}
+	running = true
+	runMtx.Unlock()
+	defer func() {
+		runMtx.Lock()
+		running = false
+		runMtx.Unlock()
+	}()
+
+	client := &http.Client{Timeout: 15 * time.Second}
+	ticker := time.NewTicker(_PollInterval)
+	defer ticker.Stop()
+	for {
+		if err := deliverPending(context.Background(), client, time.Now().UTC()); err != nil {
+			log.Printf("webhooks: %v\n", err)
+		}
+		select {
+		case <-done:
+			return
+		case <-wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+func deliverPending(ctx context.Context, client *http.Client, now time.Time) (err error) {
+	var pending []Delivery
+	if pending, err = loadDeliveries(
+		ctx,
+		`SELECT `+_DeliveryColumns+` FROM webhook_deliveries
+			WHERE status = ? AND next_attempt_at <= ?
+			ORDER BY next_attempt_at ASC LIMIT ?`,
+		StatusPending, now, _BatchSize,
+	); err != nil {
+		return
+	}
+	for _, delivery := range pending {
+		delivery.attempt(client, now)
+		if err = delivery.save(ctx); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// attempt sends the delivery once and updates its state with the outcome.
+func (d *Delivery) attempt(client *http.Client, now time.Time) {
+	d.Attempts++
+	d.UpdatedAt = now
+
+	code, err := send(client, *d, now)
+	d.ResponseCode = code
+	if err == nil {
+		d.Status = StatusDelivered
+		d.LastError = ""
+		logger.LogIfDebug("webhooks: delivered", d.UUID, d.Event, d.URL)
+		return
+	}
+
+	d.LastError = err.Error()
+	if d.Attempts >= _MaxAttempts {
+		d.Status = StatusFailed
+		log.Printf("webhooks: giving up on delivery %s to %s; %v\n", d.UUID, d.URL, err)
+		return
+	}
+	d.NextAttemptAt = now.Add(_BaseBackoff << uint(d.Attempts-1))
+}
+
+func send(client *http.Client, d Delivery, now time.Time) (code int, err error) {
+	hook, ok := findHook(d.URL)
+	if !ok {
+		err = fmt.Errorf("webhook %q is no longer configured", d.URL)
+		return
+	}
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+
+	var req *http.Request
+	if req, err = http.NewRequest(http.MethodPost, d.URL, bytes.NewReader(d.Payload)); err != nil {
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HeaderEvent, d.Event)
+	req.Header.Set(HeaderDelivery, d.UUID)
+	req.Header.Set(HeaderTimestamp, timestamp)
+	req.Header.Set(HeaderSignature, "sha256="+Sign(hook.Secret, timestamp, d.Payload))
+
+	var res *http.Response
+	if res, err = client.Do(req); err != nil {
+		return
+	}
+	defer res.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(res.Body, 1<<16))
+	code = res.StatusCode
+	if code < 200 || code >= 300 {
+		err = fmt.Errorf("unexpected response status %d", code)
+	}
+	return
+}
+
+func findHook(url string) (hook config.Webhook, ok bool) {
+	for _, hook = range config.Conf.Webhooks {
+		if hook.URL == url {
+			ok = true
+			return
+		}
+	}
+	return
+}
+
+// Sign computes the hex-encoded HMAC-SHA256 of the timestamp and body. The
+// receiver should compute the same value over the timestamp header, a ".",
+// and the raw request body, then compare it to the signature header.
+func Sign(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// LoadRecentDeliveries fetches the most recently created deliveries, up to
+// limit, newest first.
+func LoadRecentDeliveries(ctx context.Context, limit int) ([]Delivery, error) {
+	return loadDeliveries(
+		ctx,
+		`SELECT `+_DeliveryColumns+` FROM webhook_deliveries ORDER BY created_at DESC LIMIT ?`,
+		limit,
+	)
+}
+
+const _DeliveryColumns = `uuid, event, url, payload, status, attempts, response_code,
+	last_error, next_attempt_at, created_at, updated_at`
+
+func loadDeliveries(ctx context.Context, query string, args ...interface{}) (out []Delivery, err error) {
+	out = make([]Delivery, 0)
+	err = db.SelectMany(ctx, func(iterator db.Iterator) (e error) {
+		var d Delivery
+		if e = iterator.Scan(
+			&d.UUID, &d.Event, &d.URL, &d.Payload, &d.Status, &d.Attempts, &d.ResponseCode,
+			&d.LastError, &d.NextAttemptAt, &d.CreatedAt, &d.UpdatedAt,
+		); e != nil {
+			return
+		}
+		out = append(out, d)
+		return
+	}, query, args...)
+	return
+}
+
+func (d *Delivery) save(ctx context.Context) error {
+	return db.Exec(
+		ctx,
+		strings.TrimSpace(`
+		UPDATE webhook_deliveries
+		SET status=?, attempts=?, response_code=?, last_error=?, next_attempt_at=?, updated_at=?
+		WHERE uuid=?`),
+		d.Status, d.Attempts, d.ResponseCode, d.LastError, d.NextAttemptAt, d.UpdatedAt,
+		d.UUID,
+	)
+}
@@ -0,0 +1,130 @@
+package webhooks
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rafaelespinoza/standardnotes/internal/config"
+	"github.com/rafaelespinoza/standardnotes/internal/db/dbtest"
+)
+
+func init() {
+	dbtest.Init()
+}
+
+func TestSubscribers(t *testing.T) {
+	defer func(hooks []config.Webhook) { config.Conf.Webhooks = hooks }(config.Conf.Webhooks)
+	config.Conf.Webhooks = []config.Webhook{
+		{URL: "http://alpha.example.com"},
+		{URL: "http://bravo.example.com", Events: []string{EventUserRegistered}},
+		{URL: "http://charlie.example.com", Events: []string{"*"}},
+		{URL: ""},
+	}
+
+	tests := map[string][]string{
+		EventUserRegistered: {"http://alpha.example.com", "http://bravo.example.com", "http://charlie.example.com"},
+		EventItemsSynced:    {"http://alpha.example.com", "http://charlie.example.com"},
+	}
+	for event, expected := range tests {
+		actual := subscribers(event)
+		if len(actual) != len(expected) {
+			t.Errorf("event %q; wrong number of subscribers; got %d, expected %d", event, len(actual), len(expected))
+			continue
+		}
+		for i, hook := range actual {
+			if hook.URL != expected[i] {
+				t.Errorf("event %q; subscriber [%d]; got %q, expected %q", event, i, hook.URL, expected[i])
+			}
+		}
+	}
+}
+
+func TestDeliverPending(t *testing.T) {
+	const secret = "stub_webhook_secret"
+	var mtx sync.Mutex
+	var received []*http.Request
+	var bodies [][]byte
+	status := http.StatusOK
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mtx.Lock()
+		defer mtx.Unlock()
+		received = append(received, r)
+		bodies = append(bodies, body)
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+
+	defer func(hooks []config.Webhook) { config.Conf.Webhooks = hooks }(config.Conf.Webhooks)
+	config.Conf.Webhooks = []config.Webhook{{URL: srv.URL, Secret: secret}}
+
+	t.Run("ok", func(t *testing.T) {
+		received, bodies, status = nil, nil, http.StatusOK
+		Publish(context.Background(), EventUserRegistered, t.Name(), map[string]string{"user_uuid": t.Name()})
+		if err := deliverPending(context.Background(), srv.Client(), time.Now().UTC()); err != nil {
+			t.Fatal(err)
+		}
+		if len(received) != 1 {
+			t.Fatalf("wrong number of requests; got %d, expected %d", len(received), 1)
+		}
+		req := received[0]
+		if req.Header.Get(HeaderEvent) != EventUserRegistered {
+			t.Errorf("wrong event header; got %q", req.Header.Get(HeaderEvent))
+		}
+		expSignature := "sha256=" + Sign(secret, req.Header.Get(HeaderTimestamp), bodies[0])
+		if sig := req.Header.Get(HeaderSignature); sig != expSignature {
+			t.Errorf("wrong signature\ngot %q\nexp %q", sig, expSignature)
+		}
+
+		deliveries, err := LoadRecentDeliveries(context.Background(), 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if deliveries[0].Status != StatusDelivered {
+			t.Errorf("wrong status; got %q, expected %q", deliveries[0].Status, StatusDelivered)
+		}
+	})
+
+	t.Run("retry", func(t *testing.T) {
+		received, bodies, status = nil, nil, http.StatusInternalServerError
+		Publish(context.Background(), EventItemsSynced, t.Name(), map[string]string{"user_uuid": t.Name()})
+
+		now := time.Now().UTC()
+		for attempt := 1; attempt <= _MaxAttempts; attempt++ {
+			if err := deliverPending(context.Background(), srv.Client(), now); err != nil {
+				t.Fatal(err)
+			}
+			deliveries, err := LoadRecentDeliveries(context.Background(), 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			delivery := deliveries[0]
+			if delivery.Attempts != attempt {
+				t.Fatalf("wrong number of attempts; got %d, expected %d", delivery.Attempts, attempt)
+			}
+			if delivery.ResponseCode != http.StatusInternalServerError {
+				t.Errorf("wrong response code; got %d", delivery.ResponseCode)
+			}
+			expStatus := StatusPending
+			if attempt == _MaxAttempts {
+				expStatus = StatusFailed
+			}
+			if delivery.Status != expStatus {
+				t.Errorf("attempt %d; wrong status; got %q, expected %q", attempt, delivery.Status, expStatus)
+			}
+			if delivery.Status == StatusPending && !delivery.NextAttemptAt.After(now) {
+				t.Errorf("attempt %d; next attempt should be delayed", attempt)
+			}
+			now = delivery.NextAttemptAt
+		}
+		if len(received) != _MaxAttempts {
+			t.Errorf("wrong number of requests; got %d, expected %d", len(received), _MaxAttempts)
+		}
+	})
+}
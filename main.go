@@ -13,6 +13,7 @@ import (
 
 	"github.com/rafaelespinoza/standardnotes/internal/api"
 	"github.com/rafaelespinoza/standardnotes/internal/config"
+	"github.com/rafaelespinoza/standardnotes/internal/db"
 	"github.com/sevlyar/go-daemon"
 )
 
@@ -21,16 +22,29 @@ import (
 type Args struct {
 	config string
 	stop   bool
-
-	daemon  bool
-	db      string
-	debug   bool
-	host    string
-	migrate bool
-	noReg   bool
-	port    int
-	socket  string
-	useCors bool
+	// positional holds the arguments after the command's flags.
+	positional []string
+
+	alg         string
+	daemon      bool
+	db          string
+	dbDriver    string
+	debug       bool
+	emailBackup bool
+	ephemeral   bool
+	fix         bool
+	gzip        bool
+	host        string
+	keep        int
+	keysFile    string
+	limit       int
+	migrate     bool
+	noReg       bool
+	output      string
+	port        int
+	seed        string
+	socket      string
+	useCors     bool
 }
 
 func init() {
@@ -63,9 +77,11 @@ Commands:
 	flag.StringVar(&_Args.config, "config", "./internal/config/standardnotes.json", "config file location")
 	// The following flags can also be set with a config file, but are
 	// overridden with a CLI flag.
-	flag.StringVar(&_Args.db, "db", "sf.db", "path to database (sqlite3) file")
+	flag.StringVar(&_Args.db, "db", "", "path to database (sqlite3) file or connection string (postgres) (default \"sf.db\")")
+	flag.StringVar(&_Args.dbDriver, "dbdriver", "", "database driver, sqlite3 or postgres (default \"sqlite3\")")
 	flag.BoolVar(&_Args.debug, "debug", false, "run server in debug mode")
 	flag.StringVar(&_Args.host, "host", "localhost", "server hostname")
+	flag.BoolVar(&_Args.migrate, "migrate", false, "apply pending schema migrations when the server starts")
 	flag.BoolVar(&_Args.noReg, "noreg", false, "disable user registration")
 	flag.IntVar(&_Args.port, "port", 8888, "server port")
 	flag.StringVar(&_Args.socket, "socket", "", "server socket")
@@ -113,6 +129,14 @@ func initCommand(positionalArgs []string, a *Args) (cmd *Command, err error) {
 	} else if config.Conf.DB == "" {
 		config.Conf.DB = "sf.db"
 	}
+	if a.dbDriver != "" {
+		config.Conf.DBDriver = a.dbDriver
+	} else if config.Conf.DBDriver == "" {
+		config.Conf.DBDriver = db.DriverSQLite
+	}
+	if a.migrate {
+		config.Conf.AutoMigrate = true
+	}
 	if a.noReg {
 		config.Conf.NoReg = true
 	}
@@ -127,6 +151,13 @@ func initCommand(positionalArgs []string, a *Args) (cmd *Command, err error) {
 	if err = subflags.Parse(positionalArgs[1:]); err != nil {
 		return
 	}
+	a.positional = subflags.Args()
+	if a.seed != "" && !a.ephemeral {
+		err = fmt.Errorf("-seed requires -ephemeral")
+		return
+	}
+	config.Conf.Ephemeral = a.ephemeral
+	config.Conf.Seed = a.seed
 	return
 }
 
@@ -163,7 +194,9 @@ func main() {
 
 	if !_Args.stop && !_Args.daemon {
 		// run server in foreground
-		api.Serve(config.Conf)
+		if err := api.Serve(config.Conf); err != nil {
+			os.Exit(1)
+		}
 		return
 	}
 
@@ -196,7 +229,11 @@ func main() {
 	}
 
 	defer ctx.Release()
-	go api.Serve(config.Conf)
+	go func() {
+		if err := api.Serve(config.Conf); err != nil {
+			os.Exit(1)
+		}
+	}()
 
 	if err := daemon.ServeSignals(); err != nil {
 		log.Println("Error:", err)